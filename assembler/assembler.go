@@ -0,0 +1,324 @@
+package assembler
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/halseth/tapsim/file"
+	"github.com/halseth/tapsim/script"
+)
+
+const (
+	// schemaPrefix is the prefix of the optional header line holding the
+	// state schema, as in trace files.
+	schemaPrefix = "#:"
+
+	// memPrefix is the prefix of the optional header line declaring the
+	// program memory, as in program files.
+	memPrefix = "#mem:"
+
+	// envPrefix is the prefix of the optional header line holding the
+	// environment the steps are executed in, as in program files.
+	envPrefix = "#env:"
+
+	// labelRefPrefix is the prefix of a reference to the pc of a labelled
+	// step.
+	labelRefPrefix = "@"
+
+	// haltStep is the step the program must end with.
+	haltStep = "OP_NOP"
+)
+
+var (
+	labelRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*):`)
+	refRe   = regexp.MustCompile(`^@[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Assembly is an assembled step program.
+type Assembly struct {
+	// Schema is the state schema given in the source header, nil if the
+	// source has none.
+	Schema *schema.Schema
+
+	// Memory is the program memory given in the source header, nil if the
+	// source has none.
+	Memory *scripts.Memory
+
+	// Env is the execution environment given in the source header, nil if
+	// the source has none.
+	Env *execute.Env
+
+	// Hints are the prover hints declared by the steps, indexed by pc.
+	Hints []*scripts.HintOp
+
+	// Steps are the script steps, indexed by pc.
+	Steps []string
+
+	// Labels maps the step labels to their pc.
+	Labels map[string]int
+}
+
+// Program returns the assembled program. It fails if the source has no
+// schema header.
+func (a *Assembly) Program() (*scripts.Program, error) {
+	if a.Schema == nil {
+		return nil, fmt.Errorf("program has no schema header")
+	}
+
+	prog := &scripts.Program{
+		Schema: a.Schema,
+		Steps:  a.Steps,
+		Memory: a.Memory,
+		Hints:  a.Hints,
+		Env:    a.Env,
+	}
+	if err := prog.Validate(); err != nil {
+		return nil, err
+	}
+
+	return prog, nil
+}
+
+// step is a labelled step being assembled.
+type step struct {
+	label string
+	line  int
+	src   []string
+}
+
+// Assemble assembles a step program. Each step starts with a label on its own
+// line, or followed by the first opcodes of the step:
+//
+//	#:	x i pc
+//	loop:
+//		OP_DROP OP_DUP OP_8 OP_LESSTHAN
+//		OP_IF @body OP_ELSE @halt OP_ENDIF
+//	body:	OP_DROP OP_1ADD OP_SWAP OP_DUP OP_ADD OP_SWAP @loop
+//	halt:	OP_NOP
+//
+// Steps are in the tapsim script syntax, with # comments. A reference @label
+// is replaced by the push of the pc of the labelled step, the pc being the
+// index of the step in the source. An #env: header gives the environment the
+// steps are executed in. As in program files, steps can start with a HINT
+// declaration of the prover hints they take, and with a #mem: header following
+// the schema, with a MEM_LOAD or MEM_STORE memory access. The first step is the
+// entry point, and the last step must be the halting OP_NOP step.
+func Assemble(src string) (*Assembly, error) {
+	var (
+		a = &Assembly{
+			Labels: make(map[string]int),
+		}
+		steps   []*step
+		scanner = bufio.NewScanner(strings.NewReader(src))
+	)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+
+		if hdr, ok := strings.CutPrefix(line, schemaPrefix); ok {
+			if len(steps) > 0 || a.Schema != nil {
+				return nil, fmt.Errorf("line %d: schema header "+
+					"must be first", lineNum)
+			}
+
+			var err error
+			a.Schema, err = schema.Parse(hdr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			continue
+		}
+
+		if hdr, ok := strings.CutPrefix(line, envPrefix); ok {
+			if len(steps) > 0 || a.Env != nil {
+				return nil, fmt.Errorf("line %d: environment "+
+					"header must come before the steps",
+					lineNum)
+			}
+
+			var err error
+			a.Env, err = execute.ParseEnv(hdr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			continue
+		}
+
+		if hdr, ok := strings.CutPrefix(line, memPrefix); ok {
+			if a.Schema == nil || a.Memory != nil || len(steps) > 0 {
+				return nil, fmt.Errorf("line %d: memory header "+
+					"must follow the schema header", lineNum)
+			}
+
+			var err error
+			a.Memory, err = scripts.ParseMemHeader(a.Schema, hdr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			continue
+		}
+
+		trimmed := strings.TrimSpace(line)
+		if m := labelRe.FindStringSubmatch(trimmed); m != nil {
+			label := m[1]
+			if strings.HasPrefix(label, "OP_") {
+				return nil, fmt.Errorf("line %d: label %s looks "+
+					"like an opcode", lineNum, label)
+			}
+			if _, ok := a.Labels[label]; ok {
+				return nil, fmt.Errorf("line %d: duplicate "+
+					"label %s", lineNum, label)
+			}
+
+			a.Labels[label] = len(steps)
+			steps = append(steps, &step{
+				label: label,
+				line:  lineNum,
+			})
+			trimmed = trimmed[len(m[0]):]
+		}
+
+		code, err := file.ParseScript([]byte(trimmed))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if code == "" {
+			continue
+		}
+
+		if len(steps) == 0 {
+			return nil, fmt.Errorf("line %d: code before first "+
+				"label", lineNum)
+		}
+
+		s := steps[len(steps)-1]
+		s.src = append(s.src, code)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("program has no steps")
+	}
+
+	for pc, s := range steps {
+		code, err := a.resolve(s)
+		if err != nil {
+			return nil, err
+		}
+
+		code, err = a.hintOp(pc, s, code)
+		if err != nil {
+			return nil, err
+		}
+
+		code, err = a.memOp(pc, s, code)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := script.Parse(code); err != nil {
+			return nil, fmt.Errorf("step %s: %v", s.label, err)
+		}
+
+		a.Steps = append(a.Steps, code)
+	}
+
+	last := steps[len(steps)-1]
+	if a.Steps[len(a.Steps)-1] != haltStep {
+		return nil, fmt.Errorf("last step %s must be the halting %s "+
+			"step", last.label, haltStep)
+	}
+
+	return a, nil
+}
+
+// hintOp records the prover hints the code of the step at the given pc
+// declares, if any, and returns the rest of the code.
+func (a *Assembly) hintOp(pc int, s *step, code string) (string, error) {
+	if a.Schema == nil {
+		return code, nil
+	}
+
+	op, rest, err := scripts.ParseHintOp(a.Schema, code)
+	if err != nil {
+		return "", fmt.Errorf("step %s: %v", s.label, err)
+	}
+	if op == nil {
+		return code, nil
+	}
+
+	for len(a.Hints) < pc {
+		a.Hints = append(a.Hints, nil)
+	}
+	a.Hints = append(a.Hints, op)
+
+	return rest, nil
+}
+
+// memOp records the memory access the code of the step at the given pc starts
+// with, if any, and returns the rest of the code.
+func (a *Assembly) memOp(pc int, s *step, code string) (string, error) {
+	if a.Schema == nil {
+		return code, nil
+	}
+
+	op, rest, err := scripts.ParseMemOp(a.Schema, code)
+	if err != nil {
+		return "", fmt.Errorf("step %s: %v", s.label, err)
+	}
+	if op == nil {
+		return code, nil
+	}
+
+	if a.Memory == nil {
+		return "", fmt.Errorf("step %s: memory access without memory "+
+			"header", s.label)
+	}
+
+	for len(a.Memory.Ops) < pc {
+		a.Memory.Ops = append(a.Memory.Ops, nil)
+	}
+	a.Memory.Ops = append(a.Memory.Ops, op)
+
+	return rest, nil
+}
+
+// resolve returns the code of the step, with label references replaced by
+// pc pushes.
+func (a *Assembly) resolve(s *step) (string, error) {
+	var words []string
+	for _, code := range s.src {
+		words = append(words, strings.Fields(code)...)
+	}
+	if len(words) == 0 {
+		return "", fmt.Errorf("line %d: step %s is empty", s.line,
+			s.label)
+	}
+
+	for i, w := range words {
+		if !strings.HasPrefix(w, labelRefPrefix) {
+			continue
+		}
+
+		if !refRe.MatchString(w) {
+			return "", fmt.Errorf("step %s: invalid label "+
+				"reference %s", s.label, w)
+		}
+
+		pc, ok := a.Labels[strings.TrimPrefix(w, labelRefPrefix)]
+		if !ok {
+			return "", fmt.Errorf("step %s: undefined label %s",
+				s.label, w)
+		}
+
+		words[i] = scripts.NumToOp(pc)
+	}
+
+	return strings.Join(words, " "), nil
+}
@@ -0,0 +1,112 @@
+package assembler
+
+import (
+	"testing"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/stretchr/testify/require"
+)
+
+const multiplySrc = `#:	x i pc
+loop:
+	OP_DROP OP_DUP OP_8 OP_LESSTHAN # i < 8
+	OP_IF @body OP_ELSE @halt OP_ENDIF
+body:	OP_DROP OP_1ADD OP_SWAP OP_DUP OP_ADD OP_SWAP @loop
+halt:	OP_NOP
+`
+
+// TestAssembleMultiply checks that the assembler source of the multiply
+// program assembles to the hand numbered steps.
+func TestAssembleMultiply(t *testing.T) {
+	a, err := Assemble(multiplySrc)
+	require.NoError(t, err)
+
+	require.Equal(t, scripts.ScriptSteps, a.Steps)
+	require.Equal(t, map[string]int{"loop": 0, "body": 1, "halt": 2},
+		a.Labels)
+	require.True(t, a.Schema.Equal(scripts.StateSchema))
+
+	prog, err := a.Program()
+	require.NoError(t, err)
+
+	want, err := scripts.MultiplyProgram.Hash()
+	require.NoError(t, err)
+	got, err := prog.Hash()
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+// TestAssembleNoSchema checks that sources without a schema header assemble,
+// but don't make a program.
+func TestAssembleNoSchema(t *testing.T) {
+	a, err := Assemble("start: OP_1 @end\nend: OP_NOP\n")
+	require.NoError(t, err)
+	require.Nil(t, a.Schema)
+	require.Equal(t, []string{"OP_1 OP_1", "OP_NOP"}, a.Steps)
+
+	_, err = a.Program()
+	require.Error(t, err)
+}
+
+// TestAssembleHeaders checks that the headers and step declarations are
+// recorded in the program.
+func TestAssembleHeaders(t *testing.T) {
+	const src = `#:	mem:32 addr v pc
+#env:	flags=standard opcodes=OP_CAT
+#mem:	mem 4
+load:	HINT addr MEM_LOAD addr v OP_DROP @check
+check:	OP_DROP @halt
+halt:	OP_NOP
+`
+
+	a, err := Assemble(src)
+	require.NoError(t, err)
+
+	prog, err := a.Program()
+	require.NoError(t, err)
+
+	require.NotNil(t, prog.Env)
+	require.NotNil(t, prog.Memory)
+	require.Equal(t, 4, prog.Memory.Depth)
+
+	load := prog.Memory.Op(0)
+	require.NotNil(t, load)
+	require.Equal(t, scripts.MemLoad, load.Kind)
+	require.Nil(t, prog.Memory.Op(1))
+
+	require.Equal(t, 1, prog.NumProverHints(0))
+	require.Equal(t, 0, prog.NumProverHints(1))
+
+	// The declarations are removed from the step code.
+	require.Equal(t, "OP_DROP OP_1", prog.Steps[0])
+	require.Equal(t, "OP_DROP OP_2", prog.Steps[1])
+}
+
+// TestAssembleErrors checks that invalid sources are rejected.
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"empty", ""},
+		{"code before label", "OP_1\nhalt: OP_NOP\n"},
+		{"duplicate label", "a: OP_1 @a\na: OP_NOP\n"},
+		{"opcode label", "OP_DUP: OP_1\nhalt: OP_NOP\n"},
+		{"unknown label", "a: OP_DROP @b\nhalt: OP_NOP\n"},
+		{"unknown opcode", "a: OP_FOO\nhalt: OP_NOP\n"},
+		{"no halt step", "a: OP_DROP @a\n"},
+		{"schema not first", "a: OP_NOP\n#: x pc\n"},
+		{"memory before schema", "#mem: mem 4\n#: mem:32 pc\n" +
+			"halt: OP_NOP\n"},
+		{"unknown register", "#: x pc\na: HINT y OP_DROP @halt\n" +
+			"halt: OP_NOP\n"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Assemble(test.src)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/halseth/mattlab/assembler"
+	"github.com/halseth/mattlab/scripts"
+)
+
+// Assemble a step program read from the given file, or stdin, and print it in
+// the program file format read by the tracer. The schema header is only
+// printed if the source has one.
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var (
+		src []byte
+		err error
+	)
+	switch len(os.Args) {
+	case 1:
+		src, err = io.ReadAll(os.Stdin)
+	case 2:
+		src, err = os.ReadFile(os.Args[1])
+	default:
+		return fmt.Errorf("usage: %s [source file]", os.Args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	a, err := assembler.Assemble(string(src))
+	if err != nil {
+		return err
+	}
+
+	return scripts.WriteProgram(os.Stdout, &scripts.Program{
+		Schema: a.Schema,
+		Steps:  a.Steps,
+		Memory: a.Memory,
+		Hints:  a.Hints,
+		Env:    a.Env,
+	})
+}
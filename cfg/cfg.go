@@ -0,0 +1,176 @@
+package cfg
+
+import (
+	"sort"
+
+	"github.com/halseth/mattlab/scripts"
+)
+
+// Node is a step of the program in the control-flow graph.
+type Node struct {
+	// PC is the program counter of the step.
+	PC int
+
+	// Code is the step code, as in the program.
+	Code string
+
+	// Succs are the pcs of the steps the step can transition to, in
+	// increasing order.
+	Succs []int
+
+	// OutOfRange are the pcs outside the program the step can transition
+	// to, in increasing order. Such transitions get stuck, as there is no
+	// step, nor leaf, to execute at them.
+	OutOfRange []int
+
+	// Dynamic is true if the step can transition to a pc not known
+	// statically, e.g. one computed from a register, or leave a state
+	// that doesn't fit the schema.
+	Dynamic bool
+
+	// Fails is true if every execution of the step fails.
+	Fails bool
+
+	// Reachable is true if the step can be executed from a start state.
+	Reachable bool
+}
+
+// Graph is the control-flow graph of a program: the transitions between its
+// steps.
+type Graph struct {
+	// Nodes are the steps by pc.
+	Nodes []*Node
+
+	// Halt is the pc of the halting step, which has no transitions.
+	Halt int
+}
+
+// Build builds the control-flow graph of the program by symbolically executing
+// every step. A step transitions to the pc its paths leave in the pc register.
+// Start states have pc 0, so the steps reachable from step 0 are reachable.
+// Once a reachable step has a dynamic transition, any step is considered
+// reachable.
+func Build(prog *scripts.Program) (*Graph, error) {
+	if err := prog.Validate(); err != nil {
+		return nil, err
+	}
+
+	g := &Graph{
+		Halt: prog.HaltPC(),
+	}
+
+	n := prog.Schema.NumRegisters()
+	for pc := range prog.Steps {
+		node := &Node{
+			PC:   pc,
+			Code: prog.Steps[pc],
+		}
+		g.Nodes = append(g.Nodes, node)
+
+		if pc == g.Halt {
+			continue
+		}
+
+		paths, err := prog.AnalyzeStep(pc)
+		if err != nil {
+			return nil, err
+		}
+
+		var (
+			succs = make(map[int]bool)
+			out   = make(map[int]bool)
+			fails = true
+		)
+		for _, p := range paths {
+			if p.Err != nil {
+				continue
+			}
+			fails = false
+
+			if len(p.Stack) != n || p.Alt != 0 {
+				node.Dynamic = true
+				continue
+			}
+
+			next, ok := p.Stack[prog.Schema.PC].Int()
+			switch {
+			case !ok:
+				node.Dynamic = true
+			case next < 0 || next >= int64(len(prog.Steps)):
+				out[int(next)] = true
+			default:
+				succs[int(next)] = true
+			}
+		}
+
+		node.Succs = sortedKeys(succs)
+		node.OutOfRange = sortedKeys(out)
+		node.Fails = fails
+	}
+
+	g.markReachable()
+
+	return g, nil
+}
+
+// markReachable marks the steps reachable from step 0.
+func (g *Graph) markReachable() {
+	stack := []int{0}
+	g.Nodes[0].Reachable = true
+	for len(stack) > 0 {
+		node := g.Nodes[stack[len(stack)-1]]
+		stack = stack[:len(stack)-1]
+
+		// A dynamic transition can go to any step.
+		if node.Dynamic {
+			for _, n := range g.Nodes {
+				n.Reachable = true
+			}
+			return
+		}
+
+		for _, pc := range node.Succs {
+			if !g.Nodes[pc].Reachable {
+				g.Nodes[pc].Reachable = true
+				stack = append(stack, pc)
+			}
+		}
+	}
+}
+
+// Unreachable returns the pcs of the steps not reachable from a start state.
+func (g *Graph) Unreachable() []int {
+	var pcs []int
+	for _, n := range g.Nodes {
+		if !n.Reachable {
+			pcs = append(pcs, n.PC)
+		}
+	}
+
+	return pcs
+}
+
+// NeededLeaves returns the pcs of the steps that can be disputed: the reachable
+// steps. The halting step is always included, as the trace can end in it. Leaf
+// generation doesn't use it, every pc gets a leaf.
+func (g *Graph) NeededLeaves() []int {
+	var pcs []int
+	for _, n := range g.Nodes {
+		if n.Reachable || n.PC == g.Halt {
+			pcs = append(pcs, n.PC)
+		}
+	}
+
+	return pcs
+}
+
+// sortedKeys returns the keys of the set in increasing order.
+func sortedKeys(set map[int]bool) []int {
+	var keys []int
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	return keys
+}
@@ -0,0 +1,155 @@
+package cfg
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+// newProgram returns a program of the given steps over the state x pc.
+func newProgram(t *testing.T, steps ...string) *scripts.Program {
+	s, err := schema.Parse("x pc")
+	require.NoError(t, err)
+
+	return &scripts.Program{
+		Schema: s,
+		Steps:  steps,
+	}
+}
+
+// TestBuildMultiply checks the graph of the multiply program: the loop and its
+// exit to the halting step.
+func TestBuildMultiply(t *testing.T) {
+	g, err := Build(scripts.MultiplyProgram)
+	require.NoError(t, err)
+
+	require.Len(t, g.Nodes, 3)
+	require.Equal(t, 2, g.Halt)
+	require.Equal(t, []int{1, 2}, g.Nodes[0].Succs)
+	require.Equal(t, []int{0}, g.Nodes[1].Succs)
+	require.Empty(t, g.Nodes[2].Succs)
+
+	for _, n := range g.Nodes {
+		require.True(t, n.Reachable, "step %d", n.PC)
+		require.False(t, n.Dynamic, "step %d", n.PC)
+		require.False(t, n.Fails, "step %d", n.PC)
+		require.Empty(t, n.OutOfRange, "step %d", n.PC)
+	}
+
+	require.Empty(t, g.Unreachable())
+	require.Equal(t, []int{0, 1, 2}, g.NeededLeaves())
+}
+
+// TestBuild checks that unreachable steps, steps that always fail and
+// transitions out of range are found.
+func TestBuild(t *testing.T) {
+	prog := newProgram(t,
+		"OP_DROP OP_2",
+		"OP_DROP OP_4",
+		"OP_DROP OP_DUP OP_IF OP_4 OP_ELSE OP_9 OP_ENDIF",
+		"OP_RETURN",
+		"OP_NOP",
+	)
+
+	g, err := Build(prog)
+	require.NoError(t, err)
+
+	require.Equal(t, []int{2}, g.Nodes[0].Succs)
+	require.Equal(t, []int{4}, g.Nodes[1].Succs)
+	require.Equal(t, []int{4}, g.Nodes[2].Succs)
+	require.Equal(t, []int{9}, g.Nodes[2].OutOfRange)
+	require.True(t, g.Nodes[3].Fails)
+	require.Empty(t, g.Nodes[3].Succs)
+
+	require.Equal(t, []int{1, 3}, g.Unreachable())
+	require.Equal(t, []int{0, 2, 4}, g.NeededLeaves())
+}
+
+// TestBuildDynamic checks that a transition to a pc computed from a register
+// makes every step reachable.
+func TestBuildDynamic(t *testing.T) {
+	prog := newProgram(t,
+		"OP_DROP OP_DUP",
+		"OP_DROP OP_2",
+		"OP_NOP",
+	)
+
+	g, err := Build(prog)
+	require.NoError(t, err)
+
+	require.True(t, g.Nodes[0].Dynamic)
+	require.False(t, g.Nodes[1].Dynamic)
+	require.Empty(t, g.Unreachable())
+	require.Equal(t, []int{0, 1, 2}, g.NeededLeaves())
+}
+
+// TestBuildInvalid checks that invalid programs are rejected.
+func TestBuildInvalid(t *testing.T) {
+	_, err := Build(newProgram(t, "OP_DROP OP_1"))
+	require.ErrorContains(t, err, "OP_NOP")
+}
+
+// TestWrite checks that both formats show every step, transition and marking.
+func TestWrite(t *testing.T) {
+	prog := newProgram(t,
+		"OP_DROP OP_DUP OP_IF OP_3 OP_ELSE OP_1 OP_ENDIF",
+		"OP_DROP OP_DUP OP_IF OP_DUP OP_ELSE OP_0 OP_1SUB OP_ENDIF",
+		"OP_RETURN",
+		"OP_NOP",
+	)
+
+	g, err := Build(prog)
+	require.NoError(t, err)
+
+	tests := []struct {
+		format Format
+		want   []string
+	}{
+		{FormatDOT, []string{
+			"digraph program {",
+			`s0 [label="0: OP_DROP OP_DUP OP_IF OP_3 OP_ELSE OP_..."];`,
+			`s3 [label="3: OP_NOP" peripheries=2];`,
+			"s0 -> s1;",
+			"s0 -> s3;",
+			"s1 -> out_1_m1 [color=red];",
+			"s1 -> dynamic [style=dashed];",
+			`dynamic [label="?" shape=circle];`,
+			`s2 [label="2: OP_RETURN" color=red];`,
+		}},
+		{FormatMermaid, []string{
+			"flowchart TD",
+			`s3(["3: OP_NOP"])`,
+			"s0 --> s1",
+			"s0 --> s3",
+			`s1 --> out_1_m1["-1: out of range"]`,
+			"s1 -.-> dynamic",
+			"class s2,out_1_m1 fails",
+		}},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		require.NoError(t, Write(&buf, test.format, g))
+
+		for _, want := range test.want {
+			require.Contains(t, buf.String(), want, test.format)
+		}
+	}
+
+	require.Error(t, Write(&bytes.Buffer{}, Format("svg"), g))
+}
+
+// TestParseFormat checks parsing format names.
+func TestParseFormat(t *testing.T) {
+	for _, f := range []Format{FormatDOT, FormatMermaid} {
+		parsed, err := ParseFormat(string(f))
+		require.NoError(t, err)
+		require.Equal(t, f, parsed)
+	}
+
+	_, err := ParseFormat("svg")
+	require.ErrorContains(t, err, "unknown graph format")
+}
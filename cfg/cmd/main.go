@@ -0,0 +1,100 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/halseth/mattlab/cfg"
+	"github.com/halseth/mattlab/loader"
+	"github.com/halseth/mattlab/scripts"
+)
+
+var (
+	programPath = flag.String("program", "", "file to load the program "+
+		"from, "+loader.AsmExt+" files are assembled and "+
+		loader.SourceExt+" files compiled; the multiply program if "+
+		"not set")
+	format = flag.String("format", string(cfg.FormatDOT), "graph "+
+		"output format: dot or mermaid")
+	effects = flag.Bool("effects", false, "also report the stack "+
+		"effect of every step")
+)
+
+// Print the control-flow graph of a program, and report unreachable steps,
+// transitions out of range and dynamic transitions to stderr, optionally with
+// the stack effects of the steps.
+func main() {
+	flag.Parse()
+	err := run()
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	f, err := cfg.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	prog := scripts.MultiplyProgram
+	if *programPath != "" {
+		prog, err = loader.LoadProgram(*programPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	g, err := cfg.Build(prog)
+	if err != nil {
+		return err
+	}
+
+	// Find the stack effects before writing the graph, so that errors
+	// aren't printed after it.
+	var stackEffects []*scripts.StackEffect
+	if *effects {
+		for pc := range prog.Steps {
+			e, err := prog.StackEffect(pc)
+			if err != nil {
+				return err
+			}
+			stackEffects = append(stackEffects, e)
+		}
+	}
+
+	if err := cfg.Write(os.Stdout, f, g); err != nil {
+		return err
+	}
+
+	for _, n := range g.Nodes {
+		switch {
+		case !n.Reachable:
+			fmt.Fprintf(os.Stderr, "step %d: unreachable\n", n.PC)
+		case n.Fails:
+			fmt.Fprintf(os.Stderr, "step %d: always fails\n", n.PC)
+		}
+
+		for _, pc := range n.OutOfRange {
+			fmt.Fprintf(os.Stderr, "step %d: transition to pc %d "+
+				"out of range\n", n.PC, pc)
+		}
+
+		if n.Dynamic {
+			fmt.Fprintf(os.Stderr, "step %d: transition not known "+
+				"statically\n", n.PC)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "disputable pcs %v of %d\n",
+		g.NeededLeaves(), len(g.Nodes))
+
+	for pc, e := range stackEffects {
+		fmt.Fprintf(os.Stderr, "step %d: consumes %d, produces %d, "+
+			"max depth %d, max alt depth %d\n", pc, e.Consumed,
+			e.Produced, e.MaxDepth, e.MaxAlt)
+	}
+
+	return nil
+}
@@ -0,0 +1,192 @@
+package cfg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxLabelLen is the number of characters of step code shown in node labels.
+const maxLabelLen = 40
+
+// Format is an output format of the control-flow graph.
+type Format string
+
+const (
+	// FormatDOT is the graphviz DOT language.
+	FormatDOT Format = "dot"
+
+	// FormatMermaid is a mermaid flowchart.
+	FormatMermaid Format = "mermaid"
+)
+
+// ParseFormat parses the name of a graph format.
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(s); f {
+	case FormatDOT, FormatMermaid:
+		return f, nil
+	}
+
+	return "", fmt.Errorf("unknown graph format %q, must be %s or %s", s,
+		FormatDOT, FormatMermaid)
+}
+
+// Write writes the graph in the given format. Steps are labeled by their pc
+// and the start of their code. The halting step is marked, unreachable steps
+// are dashed, and steps that always fail and transitions out of range are
+// red. Dynamic transitions go to a node labeled ?.
+func Write(w io.Writer, f Format, g *Graph) error {
+	switch f {
+	case FormatDOT:
+		return writeDOT(w, g)
+	case FormatMermaid:
+		return writeMermaid(w, g)
+	}
+
+	return fmt.Errorf("unknown graph format %q", f)
+}
+
+// label returns the label of the node.
+func label(n *Node) string {
+	code := n.Code
+	if len(code) > maxLabelLen {
+		code = code[:maxLabelLen-3] + "..."
+	}
+
+	return fmt.Sprintf("%d: %s", n.PC, code)
+}
+
+// hasDynamic returns true if any step has a dynamic transition.
+func (g *Graph) hasDynamic() bool {
+	for _, n := range g.Nodes {
+		if n.Dynamic {
+			return true
+		}
+	}
+
+	return false
+}
+
+// writeDOT writes the graph in the DOT language.
+func writeDOT(w io.Writer, g *Graph) error {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+	lines := []string{
+		"digraph program {",
+		"\tnode [shape=box fontname=monospace];",
+	}
+	for _, n := range g.Nodes {
+		attrs := fmt.Sprintf(`label="%s"`, quote.Replace(label(n)))
+		if n.PC == g.Halt {
+			attrs += " peripheries=2"
+		}
+		if !n.Reachable {
+			attrs += " style=dashed"
+		}
+		if n.Fails {
+			attrs += " color=red"
+		}
+		lines = append(lines, fmt.Sprintf("\ts%d [%s];", n.PC, attrs))
+	}
+
+	if g.hasDynamic() {
+		lines = append(lines, `	dynamic [label="?" shape=circle];`)
+	}
+
+	for _, n := range g.Nodes {
+		for _, pc := range n.Succs {
+			lines = append(lines, fmt.Sprintf("\ts%d -> s%d;", n.PC,
+				pc))
+		}
+
+		for _, pc := range n.OutOfRange {
+			lines = append(lines, fmt.Sprintf("\tout_%d_%s "+
+				`[label="%d: out of range" shape=plaintext `+
+				"fontcolor=red];", n.PC, outID(pc), pc))
+			lines = append(lines, fmt.Sprintf("\ts%d -> out_%d_%s "+
+				"[color=red];", n.PC, n.PC, outID(pc)))
+		}
+
+		if n.Dynamic {
+			lines = append(lines, fmt.Sprintf("\ts%d -> dynamic "+
+				"[style=dashed];", n.PC))
+		}
+	}
+	lines = append(lines, "}")
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// writeMermaid writes the graph as a mermaid flowchart.
+func writeMermaid(w io.Writer, g *Graph) error {
+	quote := strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;")
+
+	lines := []string{"flowchart TD"}
+	var unreachable, fails []string
+	for _, n := range g.Nodes {
+		shape := `s%d["%s"]`
+		if n.PC == g.Halt {
+			shape = `s%d(["%s"])`
+		}
+		lines = append(lines, "\t"+fmt.Sprintf(shape, n.PC,
+			quote.Replace(label(n))))
+
+		if !n.Reachable {
+			unreachable = append(unreachable, fmt.Sprintf("s%d",
+				n.PC))
+		}
+		if n.Fails {
+			fails = append(fails, fmt.Sprintf("s%d", n.PC))
+		}
+	}
+
+	if g.hasDynamic() {
+		lines = append(lines, `	dynamic(("?"))`)
+	}
+
+	for _, n := range g.Nodes {
+		for _, pc := range n.Succs {
+			lines = append(lines, fmt.Sprintf("\ts%d --> s%d", n.PC,
+				pc))
+		}
+
+		for _, pc := range n.OutOfRange {
+			id := fmt.Sprintf("out_%d_%s", n.PC, outID(pc))
+			lines = append(lines, fmt.Sprintf(`	s%d --> %s["%d: `+
+				`out of range"]`, n.PC, id, pc))
+			fails = append(fails, id)
+		}
+
+		if n.Dynamic {
+			lines = append(lines, fmt.Sprintf("\ts%d -.-> dynamic",
+				n.PC))
+		}
+	}
+
+	lines = append(lines,
+		"\tclassDef unreachable stroke-dasharray: 5 5",
+		"\tclassDef fails stroke:#f00,color:#f00",
+	)
+	if len(unreachable) > 0 {
+		lines = append(lines, "\tclass "+strings.Join(unreachable, ",")+
+			" unreachable")
+	}
+	if len(fails) > 0 {
+		lines = append(lines, "\tclass "+strings.Join(fails, ",")+
+			" fails")
+	}
+
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// outID returns the part of a node identifier naming the out of range pc,
+// which may be negative.
+func outID(pc int) string {
+	if pc < 0 {
+		return fmt.Sprintf("m%d", -pc)
+	}
+
+	return fmt.Sprintf("%d", pc)
+}
@@ -242,7 +242,7 @@ func (h *HarnessMiner) AssertTxInBlock(block *wire.MsgBlock,
 		}
 	}
 
-	return fmt.Errorf("tx was not included in block", "tx:%v, block has:%v",
+	return fmt.Errorf("tx was not included in block, tx:%v, block has:%v",
 		txid, blockTxes)
 }
 
@@ -5,10 +5,12 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -25,8 +27,11 @@ import (
 	"github.com/halseth/mattlab/cmd/scenario/btcd"
 	"github.com/halseth/mattlab/commitment"
 	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/checkpoint"
 	"github.com/halseth/mattlab/tracer/cmd/tracer/print"
+	"github.com/halseth/mattlab/tracer/store"
 	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/halseth/mattlab/tracer/verify"
 )
 
 // 1 BTC contract value
@@ -87,7 +92,16 @@ func signTxFee(tx *wire.MsgTx, op *wire.OutPoint) error {
 	return nil
 }
 
+var traceFormat = flag.String("format", string(print.FormatText), "format "+
+	"of Alice's trace read from stdin: text, hex or json")
+
+var checkpointInterval = flag.Int("checkpoint", 0, "keep only every n-th "+
+	"state of Bob's trace, re-executing the segments between them to "+
+	"choose; 0 keeps the full trace on disk")
+
 func main() {
+	flag.Parse()
+
 	// Create a contract UTXO to the question script.
 	// Bob spends this UTXO, posting his question x in the process.
 	// Alice spends this posting her answer.
@@ -97,7 +111,10 @@ func main() {
 	// <potential back and forth>
 	// Alice runs a leaf, takes the money
 	err := run()
-	fmt.Println(err)
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
 }
 
 func run() error {
@@ -105,7 +122,12 @@ func run() error {
 	// In a real scenario Alice would look at the question Bob posts and
 	// then create her trace, but to allow us to introduce mistakes in the
 	// trace, we take it as input.
-	aliceTrace, err := print.ReadTrace()
+	f, err := print.ParseFormat(*traceFormat)
+	if err != nil {
+		return err
+	}
+
+	traceHeader, aliceTrace, err := print.Read(os.Stdin, f)
 	if err != nil {
 		return err
 	}
@@ -114,8 +136,26 @@ func run() error {
 		return fmt.Errorf("no trace given")
 	}
 
+	traceSchema := traceHeader.Schema
+	if !traceSchema.Equal(scripts.StateSchema) {
+		return fmt.Errorf("trace schema %q does not match program "+
+			"schema %q", traceSchema, scripts.StateSchema)
+	}
+
+	progHash, err := scripts.MultiplyProgram.Hash()
+	if err != nil {
+		return err
+	}
+
+	if traceHeader.Program != nil &&
+		!bytes.Equal(traceHeader.Program, progHash[:]) {
+
+		return fmt.Errorf("trace is of program %x, expected %x",
+			traceHeader.Program, progHash)
+	}
+
 	fmt.Println("read trace:")
-	print.PrintTrace(aliceTrace)
+	print.PrintTrace(traceSchema, aliceTrace)
 
 	bitcoindHost := os.Getenv("BITCOIND_HOST")
 	bitcoindPort := os.Getenv("BITCOIND_RPC_PORT")
@@ -357,21 +397,62 @@ func run() error {
 	}
 	fmt.Println("question:", txid)
 
-	// Bob generates his own, correct trace.
-	bobTrace, err := generateTrace(questionTx)
+	// Bob generates his own, correct trace, which he keeps on disk, or
+	// only checkpoints of.
+	var bobTrace store.Source
+	if *checkpointInterval > 0 {
+		bobTrace, err = checkpointTrace(questionTx, *checkpointInterval)
+		if err != nil {
+			return err
+		}
+	} else {
+		traceDir, err := os.MkdirTemp("", "mattlab-scenario")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(traceDir)
+
+		st, err := generateTrace(
+			questionTx, filepath.Join(traceDir, "bob.trace"),
+		)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+
+		bobTrace = st
+	}
+
+	fmt.Printf("Bob got trace of %d states\n", bobTrace.Len())
+
+	aliceSrc := store.Memory(aliceTrace)
+
+	// Bob checks Alice's trace up front, to decide whether a challenge is
+	// worthwhile.
+	verifyRes, err := verify.Trace(
+		scripts.MultiplyProgram, aliceSrc, &verify.Options{
+			Hints: traceHeader.Hints,
+		},
+	)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Bob got trace:")
-	print.PrintTrace(bobTrace)
+	if verifyRes.Valid() {
+		fmt.Println("Alice's trace is valid, a challenge will fail")
+	} else {
+		fmt.Println("Alice's trace is invalid, challenge is worthwhile:")
+		for _, t := range verifyRes.Transitions {
+			fmt.Println(t)
+		}
+	}
 
 	traceStartIndex := 0
-	traceEndIndex := len(aliceTrace) - 1
+	traceEndIndex := aliceSrc.Len() - 1
 
 	fmt.Println("posting answer")
 	answerTx, outputSpender, err := postAnswer(
-		traceStartIndex, traceEndIndex, aliceTrace,
+		traceStartIndex, traceEndIndex, aliceSrc,
 		wire.OutPoint{
 			Hash:  *txid,
 			Index: 0,
@@ -411,7 +492,7 @@ func run() error {
 		revealTx, outputSpender, err = postReveal(
 			level,
 			traceStartIndex, traceEndIndex,
-			aliceTrace,
+			aliceSrc,
 			wire.OutPoint{
 				Hash:  *txid,
 				Index: 0,
@@ -451,9 +532,26 @@ func run() error {
 		fmt.Println("choose at level", level, txid)
 	}
 
+	if src, ok := bobTrace.(*checkpoint.Source); ok {
+		fmt.Printf("Bob re-executed %d steps from his checkpoints\n",
+			src.Reexecuted())
+	}
+
 	// Alice cleaim leaf
+	leafState, err := aliceSrc.State(traceStartIndex)
+	if err != nil {
+		return err
+	}
+
+	// The hints given to the step are not part of the committed trace,
+	// Alice provides them in the witness along with the state.
+	var leafHints [][]byte
+	if traceStartIndex < len(traceHeader.Hints) {
+		leafHints = traceHeader.Hints[traceStartIndex]
+	}
+
 	leafTx, _, aliceAddr, err := postLeaf(
-		aliceTrace[traceStartIndex],
+		leafState, leafHints,
 		wire.OutPoint{
 			Hash:  *txid,
 			Index: 0,
@@ -500,16 +598,65 @@ func run() error {
 	return nil
 }
 
-func generateTrace(questionTx *wire.MsgTx) ([][][]byte, error) {
+// questionX returns Bob's question x from the question transaction.
+func questionX(questionTx *wire.MsgTx) byte {
 	x := questionTx.TxIn[0].Witness[1][0]
 	fmt.Println("found x", x)
 	if x != startX {
 		panic("wrong x found in tx witness")
 	}
 
-	startStack := fmt.Sprintf("%02x <> <>", x)
+	return x
+}
+
+// generateTrace traces the program from the question in the transaction,
+// streaming the trace to a new trace store at the given path.
+func generateTrace(questionTx *wire.MsgTx, path string) (*store.Store,
+	error) {
+
+	startStack := fmt.Sprintf("%02x <> <>", questionX(questionTx))
 	fmt.Println("start stack:", startStack)
-	return trace.GetTrace(scripts.ScriptSteps, startStack)
+
+	// The trace must fill the commitment tree the contract was set up
+	// with.
+	st, err := store.Create(path, scripts.StateSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &trace.Options{
+		MaxSteps: 1 << totalLevels,
+		Depth:    totalLevels,
+		Sink:     st,
+	}
+	_, err = trace.GetTrace(
+		context.Background(), scripts.MultiplyProgram, startStack, opts,
+	)
+	if err != nil {
+		st.Close()
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// checkpointTrace traces the program from the question in the transaction,
+// keeping only every interval-th state. The other states are re-executed when
+// read.
+func checkpointTrace(questionTx *wire.MsgTx, interval int) (
+	*checkpoint.Source, error) {
+
+	// The start state is x i pc, with i and pc at zero.
+	startState := [][]byte{{questionX(questionTx)}, nil, nil}
+
+	opts := &trace.Options{
+		MaxSteps: 1 << totalLevels,
+		Depth:    totalLevels,
+	}
+	return checkpoint.Trace(
+		context.Background(), scripts.MultiplyProgram, startState,
+		interval, opts,
+	)
 }
 
 func postTimeout(out wire.OutPoint, spender *OutputSpender) (
@@ -550,7 +697,7 @@ func postTimeout(out wire.OutPoint, spender *OutputSpender) (
 		return nil, nil, nil, err
 	}
 
-	spender.scriptIndex = len(scripts.ScriptSteps)
+	spender.scriptIndex = len(scripts.MultiplyProgram.Steps)
 	sig, err := spender.Sign(tx, bobKey)
 	if err != nil {
 		return nil, nil, nil, err
@@ -572,7 +719,8 @@ func postTimeout(out wire.OutPoint, spender *OutputSpender) (
 	}, addr, nil
 }
 
-func postLeaf(startState [][]byte, out wire.OutPoint, spender *OutputSpender) (
+func postLeaf(startState, hints [][]byte, out wire.OutPoint,
+	spender *OutputSpender) (
 	*wire.MsgTx, *OutputSpender, btcutil.Address, error) {
 
 	//	pc := trace.GetProgramCounter(startState)
@@ -622,11 +770,11 @@ func postLeaf(startState [][]byte, out wire.OutPoint, spender *OutputSpender) (
 
 	// Use PC from start state to determine which leaf to use
 	fmt.Println("startState:", spew.Sdump(startState))
-	pc := startState[2]
-	spender.scriptIndex = 0
-	if len(pc) != 0 {
-		spender.scriptIndex = int(pc[0])
+	pc, err := trace.GetProgramCounter(scripts.StateSchema, startState)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	spender.scriptIndex = pc
 
 	sig, err := spender.Sign(tx, aliceKey)
 	if err != nil {
@@ -635,6 +783,7 @@ func postLeaf(startState [][]byte, out wire.OutPoint, spender *OutputSpender) (
 	witness := wire.TxWitness{}
 	witness = append(witness, sig)
 	witness = append(witness, startState...)
+	witness = append(witness, hints...)
 
 	ctrlBlock, err := spender.CtrlBlock()
 	if err != nil {
@@ -658,41 +807,53 @@ func postLeaf(startState [][]byte, out wire.OutPoint, spender *OutputSpender) (
 	}, addr, nil
 }
 
-func postChoose(revealTx *wire.MsgTx, level, startIndex, endIndex int, tr [][][]byte, out wire.OutPoint, spender *OutputSpender) (
+func postChoose(revealTx *wire.MsgTx, level, startIndex, endIndex int, tr store.Source, out wire.OutPoint, spender *OutputSpender) (
 	*wire.MsgTx, *OutputSpender, int, int, error) {
 
-	// Get Alice's revealed state from the tx witness.
+	// Get Alice's revealed state from the tx witness. The witness is
+	// sig, sub2_commit, end state, sub1_commit, mid state, start state, with
+	// each state being n elements.
 	revealWitness := revealTx.TxIn[0].Witness
 	//fmt.Println("reveal witness", spew.Sdump(revealWitness))
+	n := scripts.StateSchema.NumRegisters()
+	endState := revealWitness[2 : 2+n]
+	sub1Commit := revealWitness[2+n]
+	midState := revealWitness[3+n : 3+2*n]
+	startState := revealWitness[3+2*n : 3+3*n]
+	sub2Commit := revealWitness[1]
 
 	aliceSub1 := sha256.New()
-	aliceSub1.Write(revealWitness[11]) // start_pc
-	aliceSub1.Write(revealWitness[10]) // start_i
-	aliceSub1.Write(revealWitness[9])  // start_x
-	aliceSub1.Write(revealWitness[8])  // mid_pc
-	aliceSub1.Write(revealWitness[7])  // mid_i
-	aliceSub1.Write(revealWitness[6])  // mid_x
-	aliceSub1.Write(revealWitness[5])  // sub1_commit
+	if err := catState(aliceSub1, startState); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if err := catState(aliceSub1, midState); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	aliceSub1.Write(sub1Commit)
 	hAliceSub1 := aliceSub1.Sum(nil)
 
 	aliceSub2 := sha256.New()
-	aliceSub2.Write(revealWitness[8]) // mid_pc
-	aliceSub2.Write(revealWitness[7]) // mid_i
-	aliceSub2.Write(revealWitness[6]) // mid_x
-	aliceSub2.Write(revealWitness[4]) // end_pc
-	aliceSub2.Write(revealWitness[3]) // end_i
-	aliceSub2.Write(revealWitness[2]) // end_x
-	aliceSub2.Write(revealWitness[1]) // sub2_commit
+	if err := catState(aliceSub2, midState); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	if err := catState(aliceSub2, endState); err != nil {
+		return nil, nil, 0, 0, err
+	}
+	aliceSub2.Write(sub2Commit)
 	hAliceSub2 := aliceSub2.Sum(nil)
 
 	midIndex := startIndex + (endIndex-startIndex)/2
 	fmt.Println("start", startIndex, "mid", midIndex, "end", endIndex)
-	sub1, _, _, err := commitment.SubCommitment(startIndex, midIndex, tr, 0)
+	sub1, _, _, err := commitment.SubCommitment(
+		scripts.StateSchema, startIndex, midIndex, tr, 0,
+	)
 	if err != nil {
 		return nil, nil, 0, 0, err
 	}
 
-	sub2, _, _, err := commitment.SubCommitment(midIndex, endIndex, tr, 0)
+	sub2, _, _, err := commitment.SubCommitment(
+		scripts.StateSchema, midIndex, endIndex, tr, 0,
+	)
 	if err != nil {
 		return nil, nil, 0, 0, err
 	}
@@ -726,7 +887,7 @@ func postChoose(revealTx *wire.MsgTx, level, startIndex, endIndex int, tr [][][]
 	})
 
 	_, outputScriptTree, err := scripts.GenerateChoose(
-		aliceKey.PubKey(), bobKey.PubKey(), level, scripts.ScriptSteps,
+		aliceKey.PubKey(), bobKey.PubKey(), level, scripts.MultiplyProgram,
 	)
 	if err != nil {
 		return nil, nil, 0, 0, err
@@ -808,24 +969,37 @@ func catState(w io.Writer, state [][]byte) error {
 //	start_pc|start_i|start_x|mid_pc|mid_i|mid_x|sub1_commit
 //		and
 //	mid_pc|mid_i|mid_x|end_pc|end_i|end_x|sub2_commit
-func postReveal(level, startIndex, endIndex int, tr [][][]byte, out wire.OutPoint, spender *OutputSpender) (
+func postReveal(level, startIndex, endIndex int, tr store.Source, out wire.OutPoint, spender *OutputSpender) (
 	*wire.MsgTx, *OutputSpender, error) {
 
 	midIndex := startIndex + (endIndex-startIndex)/2
 	fmt.Println("start", startIndex, "mid", midIndex, "end", endIndex)
-	sub1, sub1Commit, _, err := commitment.SubCommitment(startIndex, midIndex, tr, 0)
+	sub1, sub1Commit, _, err := commitment.SubCommitment(
+		scripts.StateSchema, startIndex, midIndex, tr, 0,
+	)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	sub2, sub2Commit, _, err := commitment.SubCommitment(midIndex, endIndex, tr, 0)
+	sub2, sub2Commit, _, err := commitment.SubCommitment(
+		scripts.StateSchema, midIndex, endIndex, tr, 0,
+	)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	startState := tr[startIndex]
-	midState := tr[midIndex]
-	endState := tr[endIndex]
+	startState, err := tr.State(startIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	midState, err := tr.State(midIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	endState, err := tr.State(endIndex)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	tx := wire.NewMsgTx(2)
 	tx.AddTxIn(&wire.TxIn{
@@ -833,7 +1007,7 @@ func postReveal(level, startIndex, endIndex int, tr [][][]byte, out wire.OutPoin
 	})
 
 	_, outputScriptTree, err := scripts.GenerateReveal(
-		aliceKey.PubKey(), bobKey.PubKey(), level, scripts.ScriptSteps,
+		aliceKey.PubKey(), bobKey.PubKey(), level, scripts.MultiplyProgram,
 	)
 	if err != nil {
 		return nil, nil, err
@@ -909,8 +1083,10 @@ func postChallenge(answerTx *wire.MsgTx, out wire.OutPoint, spender *OutputSpend
 	inputCommit := sha256.New()
 	var stack [][]byte
 
-	// Note: index 0 is signature
-	for i := 1; i < 8; i++ {
+	// Note: index 0 is signature, followed by trace commitment, end state
+	// and start state.
+	n := scripts.StateSchema.NumRegisters()
+	for i := 1; i < 2+2*n; i++ {
 		stack = append(stack, wit[i])
 	}
 
@@ -931,7 +1107,7 @@ func postChallenge(answerTx *wire.MsgTx, out wire.OutPoint, spender *OutputSpend
 	})
 
 	_, outputScriptTree, err := scripts.GenerateChallenge(
-		aliceKey.PubKey(), bobKey.PubKey(), totalLevels, scripts.ScriptSteps,
+		aliceKey.PubKey(), bobKey.PubKey(), totalLevels, scripts.MultiplyProgram,
 	)
 	if err != nil {
 		return nil, nil, err
@@ -998,10 +1174,12 @@ func printWitness(witness wire.TxWitness) string {
 	return s
 }
 
-func postAnswer(startIndex, endIndex int, tr [][][]byte, out wire.OutPoint,
+func postAnswer(startIndex, endIndex int, tr store.Source, out wire.OutPoint,
 	spender *OutputSpender) (*wire.MsgTx, *OutputSpender, error) {
 
-	rootNode, _, roots, err := commitment.SubCommitment(startIndex, endIndex, tr, 0)
+	rootNode, _, roots, err := commitment.SubCommitment(
+		scripts.StateSchema, startIndex, endIndex, tr, 0,
+	)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1010,11 +1188,15 @@ func postAnswer(startIndex, endIndex int, tr [][][]byte, out wire.OutPoint,
 	fmt.Printf("anwer root=%x (%s)\n", sha256.Sum256(rootNode), roots)
 
 	midIndex := startIndex + (endIndex-startIndex)/2
-	sub1, _, sub1s, err := commitment.SubCommitment(startIndex, midIndex, tr, 0)
+	sub1, _, sub1s, err := commitment.SubCommitment(
+		scripts.StateSchema, startIndex, midIndex, tr, 0,
+	)
 	if err != nil {
 		return nil, nil, err
 	}
-	sub2, _, sub2s, err := commitment.SubCommitment(midIndex, endIndex, tr, 0)
+	sub2, _, sub2s, err := commitment.SubCommitment(
+		scripts.StateSchema, midIndex, endIndex, tr, 0,
+	)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1022,8 +1204,14 @@ func postAnswer(startIndex, endIndex int, tr [][][]byte, out wire.OutPoint,
 	fmt.Println("answer sub1=", sub1s)
 	fmt.Println("answer sub2=", sub2s)
 
-	startState := tr[startIndex]
-	endState := tr[endIndex]
+	startState, err := tr.State(startIndex)
+	if err != nil {
+		return nil, nil, err
+	}
+	endState, err := tr.State(endIndex)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	hSub1 := sha256.Sum256(sub1)
 
@@ -1044,7 +1232,7 @@ func postAnswer(startIndex, endIndex int, tr [][][]byte, out wire.OutPoint,
 	})
 
 	_, outputScriptTree, err := scripts.GenerateAnswer(
-		aliceKey.PubKey(), bobKey.PubKey(), totalLevels, scripts.ScriptSteps,
+		aliceKey.PubKey(), bobKey.PubKey(), totalLevels, scripts.MultiplyProgram,
 	)
 	if err != nil {
 		return nil, nil, err
@@ -1123,7 +1311,7 @@ func postQuestion(x []byte, out wire.OutPoint, spender *OutputSpender) (
 
 	// Send to answer output
 	_, outputScriptTree, err := scripts.GenerateQuestion(
-		aliceKey.PubKey(), bobKey.PubKey(), totalLevels, scripts.ScriptSteps,
+		aliceKey.PubKey(), bobKey.PubKey(), totalLevels, scripts.MultiplyProgram,
 	)
 	if err != nil {
 		return nil, nil, err
@@ -1279,7 +1467,7 @@ func contractOutput(numLevels int) (*wire.TxOut, *OutputSpender, btcutil.Address
 
 	// The contract output must be spent by Bob posting the question...
 	q, _, err := scripts.GenerateQuestion(
-		aliceKey.PubKey(), bobKey.PubKey(), numLevels, scripts.ScriptSteps,
+		aliceKey.PubKey(), bobKey.PubKey(), numLevels, scripts.MultiplyProgram,
 	)
 	if err != nil {
 		return nil, nil, nil, err
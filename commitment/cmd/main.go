@@ -2,22 +2,56 @@ package main
 
 import (
 	"crypto/sha256"
+	"flag"
 	"fmt"
+	"os"
 
 	"github.com/halseth/mattlab/commitment"
 	"github.com/halseth/mattlab/tracer/cmd/tracer/print"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/halseth/mattlab/tracer/store"
+)
+
+var (
+	format = flag.String("format", string(print.FormatText), "trace "+
+		"input format: text, hex or json")
+	storePath = flag.String("store", "", "read the trace from this trace "+
+		"store instead of stdin")
 )
 
 func main() {
+	flag.Parse()
 
 	// Take a trace and create a commitment tree including human readable version for debugging.
 
-	tr, err := print.ReadTrace()
-	if err != nil {
-		panic(err.Error())
+	var (
+		sc *schema.Schema
+		tr store.Source
+	)
+	if *storePath != "" {
+		st, err := store.Open(*storePath)
+		if err != nil {
+			panic(err.Error())
+		}
+		defer st.Close()
+
+		sc, tr = st.Schema(), st
+	} else {
+		f, err := print.ParseFormat(*format)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		h, states, err := print.Read(os.Stdin, f)
+		if err != nil {
+			panic(err.Error())
+		}
+
+		sc, tr = h.Schema, store.Memory(states)
 	}
 
-	rootNode, _, roots, err := commitment.SubCommitment(0, len(tr)-1, tr, 0)
+	commitment.RecordTree()
+	rootNode, _, roots, err := commitment.SubCommitment(sc, 0, tr.Len()-1, tr, 0)
 	if err != nil {
 		panic(err.Error())
 	}
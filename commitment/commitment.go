@@ -6,19 +6,32 @@ import (
 	"fmt"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/halseth/mattlab/tracer/store"
 )
 
 var (
+	// record is true if the nodes of the commitment tree should be
+	// recorded for debugging.
+	record bool
+
 	commitmentTree [][][32]byte
 	printTree      [][]string
 )
 
+// RecordTree enables recording of the nodes visited by SubCommitment, to be
+// printed by Print. It is disabled by default, as the recorded tree is as
+// large as the trace.
+func RecordTree() {
+	record = true
+}
+
 func Print() {
 	fmt.Println(spew.Sdump(printTree))
 }
 
 // SubCommitment(from, to) returns
-// node = start_pc|start_i|start_x|end_pc|end_i|end_x|h( h(sub1)|h(sub2) )
+// node = start_state|end_state|h( h(sub1)|h(sub2) )
 // subcommit = h( h(sub1)|h(sub2) )
 //
 // where
@@ -26,10 +39,34 @@ func Print() {
 //	sub_node1 = SubCommitment(from, mid, trace)
 //	sub_node2 = SubCommitment(mid, to, trace)
 //
+// and a state is the concatenation of its registers from the top of the stack
+// and down, e.g. pc|i|x for the schema x i pc.
+//
+// States are read from the source as needed, so the trace does not have to
+// be held in memory.
+//
 // NOTE: start == from, end == to
-func SubCommitment(from, to int, trace [][][]byte, depth int) ([]byte, []byte, string, error) {
+func SubCommitment(sc *schema.Schema, from, to int, trace store.Source,
+	depth int) ([]byte, []byte, string, error) {
+
+	startState, err := trace.State(from)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err := sc.Validate(startState); err != nil {
+		return nil, nil, "", fmt.Errorf("state %d: %v", from, err)
+	}
+
+	endState, err := trace.State(to)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if err := sc.Validate(endState); err != nil {
+		return nil, nil, "", fmt.Errorf("state %d: %v", to, err)
+	}
+
 	if to-from == 1 {
-		dat, hsh, s, err := leafCommitment(trace[from], trace[to], depth)
+		dat, hsh, s, err := leafCommitment(startState, endState, depth)
 		if err != nil {
 			return nil, nil, "", err
 		}
@@ -42,21 +79,16 @@ func SubCommitment(from, to int, trace [][][]byte, depth int) ([]byte, []byte, s
 		return nil, nil, "", fmt.Errorf("incompatible %d - %d", from, to)
 	}
 
-	if len(commitmentTree) <= depth {
-		commitmentTree = append(commitmentTree, [][32]byte{})
-		printTree = append(printTree, []string{})
-	}
-
 	mid := from + (to-from)/2
 	//	fmt.Printf("SubCommitment [%d - %d - %d]\n", from, mid, to)
 
 	//	fmt.Println("taking sub commit from", from, "mid", mid, "depth", depth+1)
-	sub1, _, _, err := SubCommitment(from, mid, trace, depth+1)
+	sub1, _, _, err := SubCommitment(sc, from, mid, trace, depth+1)
 	if err != nil {
 		return nil, nil, "", err
 	}
 	//	fmt.Println("taking sub commit mid", mid, "to", to, "depth", depth+1)
-	sub2, _, _, err := SubCommitment(mid, to, trace, depth+1)
+	sub2, _, _, err := SubCommitment(sc, mid, to, trace, depth+1)
 	if err != nil {
 		return nil, nil, "", err
 	}
@@ -69,9 +101,6 @@ func SubCommitment(from, to int, trace [][][]byte, depth int) ([]byte, []byte, s
 	subTr.Write(hSub2[:])
 	hSub := subTr.Sum(nil)
 
-	startState := trace[from]
-	endState := trace[to]
-
 	var nodeData bytes.Buffer
 	var s string
 	for i := range startState {
@@ -88,18 +117,16 @@ func SubCommitment(from, to int, trace [][][]byte, depth int) ([]byte, []byte, s
 	nodeData.Write(hSub)
 	s += fmt.Sprintf("%x", hSub)
 	h := sha256.Sum256(nodeData.Bytes())
-
-	commitmentTree[depth] = append(commitmentTree[depth], h)
-	printTree[depth] = append(printTree[depth], s)
+	recordNode(depth, h, s)
 
 	return nodeData.Bytes(), hSub[:], s, nil
 }
 
 // leafCommitment returns the commitment
-// leaf = start_pc|start_i|start_x|end_pc|end_i|end_x|h( h(<>)|h(<>) )
+// leaf = start_state|end_state|h( h(<>)|h(<>) )
 // sub_commit = h( h(<>)|h(<>) )
 //
-// it takes states on the form
+// it takes states on the form given by the trace schema.
 func leafCommitment(startState, endState [][]byte, depth int) ([]byte, []byte, string, error) {
 
 	emptyHash := sha256.Sum256(nil)
@@ -124,16 +151,23 @@ func leafCommitment(startState, endState [][]byte, depth int) ([]byte, []byte, s
 	leafData.Write(hEmpty)
 	s += fmt.Sprintf("%x", hEmpty)
 	h := sha256.Sum256(leafData.Bytes())
+	recordNode(depth, h, s)
 
-	if len(commitmentTree) <= depth {
-		//fmt.Println("increment tree")
+	return leafData.Bytes(), hEmpty[:], s, nil
+}
+
+// recordNode adds a node at the given depth to the recorded tree, if
+// recording is enabled.
+func recordNode(depth int, h [32]byte, s string) {
+	if !record {
+		return
+	}
+
+	for len(commitmentTree) <= depth {
 		commitmentTree = append(commitmentTree, [][32]byte{})
 		printTree = append(printTree, []string{})
 	}
 
-	//fmt.Println("adding leaf to tree")
 	commitmentTree[depth] = append(commitmentTree[depth], h)
 	printTree[depth] = append(printTree[depth], s)
-
-	return leafData.Bytes(), hEmpty[:], s, nil
 }
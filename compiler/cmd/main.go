@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/halseth/mattlab/compiler"
+	"github.com/halseth/mattlab/scripts"
+)
+
+// Compile a function in the Go-like language read from the given file, or
+// stdin, and print the program in the program file format read by the tracer.
+func main() {
+	err := run()
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	var (
+		src []byte
+		err error
+	)
+	switch len(os.Args) {
+	case 1:
+		src, err = io.ReadAll(os.Stdin)
+	case 2:
+		src, err = os.ReadFile(os.Args[1])
+	default:
+		return fmt.Errorf("usage: %s [source file]", os.Args[0])
+	}
+	if err != nil {
+		return err
+	}
+
+	c, err := compiler.Compile(string(src))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("# params: %v, result: %s\n", c.Params, c.Result)
+	return scripts.WriteProgram(os.Stdout, c.Program)
+}
@@ -0,0 +1,816 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/schema"
+)
+
+// pcName is the name of the program counter register.
+const pcName = "pc"
+
+// resultName is the name of the register allocated for the result, if the
+// function does not always return the same variable.
+const resultName = "ret"
+
+// Compiled is a program compiled from a function.
+type Compiled struct {
+	// Program is the compiled program. Its registers are the function
+	// parameters in order, followed by its local variables in order of
+	// declaration, with the program counter on top.
+	Program *scripts.Program
+
+	// Params are the names of the registers holding the function
+	// parameters, the bottom registers of the state.
+	Params []string
+
+	// Result is the name of the register holding the returned value when
+	// the program halts, empty if the function has no result.
+	Result string
+}
+
+// StartState returns the start state of the program for the given arguments.
+// Registers other than the parameters start out zero.
+func (c *Compiled) StartState(args ...int64) ([][]byte, error) {
+	if len(args) != len(c.Params) {
+		return nil, fmt.Errorf("expected %d arguments, got %d",
+			len(c.Params), len(args))
+	}
+
+	state := make([][]byte, c.Program.Schema.NumRegisters())
+	for i, a := range args {
+		state[i] = commitment.ScriptNum(a).Bytes()
+	}
+
+	if err := c.Program.Schema.Validate(state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// Compile compiles the source of a single function in a small Go-like
+// language to a program of script steps. The language has integer variables
+// and parameters, assignments (:=, =, +=, -=, ++, --), if/else, while loops
+// with break and continue, and return. Expressions support +, -, the
+// comparison operators, &&, ||, ! and the builtins min, max, abs and
+// within(x, lo, hi), all of which map directly to script opcodes.
+//
+// Each basic block of the function becomes one step, such that the program
+// counter of the state selects the block to execute next. Locals start out
+// zero, so declarations of zero at the start of the function cost nothing.
+func Compile(src string) (*Compiled, error) {
+	fn, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	b := newBuilder(fn)
+	if err := b.build(); err != nil {
+		return nil, err
+	}
+
+	blocks := b.layout()
+
+	var registers []schema.Register
+	for _, name := range b.names {
+		registers = append(registers, schema.Register{
+			Name:  name,
+			Width: schema.DefaultWidth,
+		})
+	}
+	registers = append(registers, schema.Register{
+		Name:  pcName,
+		Width: schema.DefaultWidth,
+	})
+
+	sc, err := schema.New(registers, len(registers)-1)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make([]string, len(blocks))
+	for i, blk := range blocks {
+		steps[i] = b.step(blk)
+	}
+
+	return &Compiled{
+		Program: &scripts.Program{
+			Schema: sc,
+			Steps:  steps,
+		},
+		Params: fn.params,
+		Result: b.result,
+	}, nil
+}
+
+// termKind is how a block ends.
+type termKind uint8
+
+const (
+	// termJump continues at the next block.
+	termJump termKind = iota
+
+	// termBranch continues at the next block if cond is true, otherwise
+	// at the alt block.
+	termBranch
+
+	// termHalt is the halting step.
+	termHalt
+)
+
+// assignment sets a register to the value of an expression.
+type assignment struct {
+	reg int
+	val expr
+}
+
+// block is a basic block of the function, compiled to a single step.
+type block struct {
+	assigns []assignment
+
+	term termKind
+	cond expr
+	next *block
+	alt  *block
+
+	// end is set on the block reached by falling off the end of the
+	// function.
+	end bool
+
+	// pc is the program counter of the block's step.
+	pc int
+}
+
+// returnSite is a return statement with a value, ending the given block.
+type returnSite struct {
+	blk *block
+	val expr
+}
+
+// loop is the blocks break and continue statements in a loop jump to.
+type loop struct {
+	brk, cont *block
+}
+
+// builder builds the control flow graph of a function.
+type builder struct {
+	fn *function
+
+	// vars maps variable names to register index, names holds the names
+	// by index.
+	vars  map[string]int
+	names []string
+
+	// result is the name of the register holding the result.
+	result string
+
+	entry   *block
+	current *block
+	halt    *block
+	loops   []loop
+	returns []returnSite
+}
+
+func newBuilder(fn *function) *builder {
+	b := &builder{
+		fn:   fn,
+		vars: make(map[string]int),
+		halt: &block{term: termHalt},
+	}
+	b.entry = &block{}
+	b.current = b.entry
+
+	return b
+}
+
+// declare allocates a register for a new variable.
+func (b *builder) declare(name string) error {
+	if name == pcName {
+		return fmt.Errorf("%s is reserved for the program counter",
+			pcName)
+	}
+
+	if _, ok := b.vars[name]; ok {
+		return fmt.Errorf("%s redeclared", name)
+	}
+
+	b.vars[name] = len(b.names)
+	b.names = append(b.names, name)
+
+	return nil
+}
+
+func (b *builder) build() error {
+	for _, p := range b.fn.params {
+		if err := b.declare(p); err != nil {
+			return fmt.Errorf("parameter %v", err)
+		}
+	}
+
+	// Locals start out zero, so we skip leading zero declarations in the
+	// entry block.
+	body := b.fn.body
+	for len(body) > 0 {
+		s, ok := body[0].(*assignStmt)
+		if !ok || !s.define {
+			break
+		}
+
+		n, ok := s.val.(*numExpr)
+		if !ok || n.val != 0 {
+			break
+		}
+
+		if err := b.declare(s.name); err != nil {
+			return fmt.Errorf("line %d: %v", s.line, err)
+		}
+		body = body[1:]
+	}
+
+	if err := b.stmts(body); err != nil {
+		return err
+	}
+
+	// Falling off the end of the function halts.
+	b.current.end = true
+	b.current.next = b.halt
+
+	if b.fn.result {
+		for _, blk := range b.reachable() {
+			if blk.end {
+				return fmt.Errorf("missing return at end of " +
+					"function")
+			}
+		}
+	}
+
+	return b.finishReturns()
+}
+
+// finishReturns picks the result register. If all return statements return
+// the same variable, it holds the result. Otherwise a register is allocated
+// for it, assigned before each return.
+func (b *builder) finishReturns() error {
+	if !b.fn.result {
+		return nil
+	}
+
+	same := len(b.returns) > 0
+	for _, r := range b.returns {
+		v, ok := r.val.(*varExpr)
+		if !ok || v.name != b.returns[0].val.(*varExpr).name {
+			same = false
+			break
+		}
+	}
+
+	if same {
+		b.result = b.returns[0].val.(*varExpr).name
+		return nil
+	}
+
+	b.result = resultName
+	for {
+		if _, ok := b.vars[b.result]; !ok {
+			break
+		}
+		b.result += "_"
+	}
+	if err := b.declare(b.result); err != nil {
+		return err
+	}
+
+	for _, r := range b.returns {
+		r.blk.assigns = append(r.blk.assigns, assignment{
+			reg: b.vars[b.result],
+			val: r.val,
+		})
+	}
+
+	return nil
+}
+
+func (b *builder) stmts(stmts []stmt) error {
+	for _, s := range stmts {
+		if err := b.stmt(s); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *builder) stmt(s stmt) error {
+	switch s := s.(type) {
+	case *assignStmt:
+		if s.define {
+			// Check the value before declaring, such that it
+			// cannot refer to the variable itself.
+			if err := b.checkExpr(s.val, typeInt); err != nil {
+				return err
+			}
+			if err := b.declare(s.name); err != nil {
+				return fmt.Errorf("line %d: %v", s.line, err)
+			}
+		} else {
+			if _, ok := b.vars[s.name]; !ok {
+				return fmt.Errorf("line %d: undefined: %s",
+					s.line, s.name)
+			}
+			if err := b.checkExpr(s.val, typeInt); err != nil {
+				return err
+			}
+		}
+
+		b.current.assigns = append(b.current.assigns, assignment{
+			reg: b.vars[s.name],
+			val: s.val,
+		})
+
+	case *ifStmt:
+		if err := b.checkExpr(s.cond, typeBool); err != nil {
+			return err
+		}
+
+		then, els, join := &block{}, &block{}, &block{}
+		b.branch(s.cond, then, els)
+
+		b.current = then
+		if err := b.stmts(s.then); err != nil {
+			return err
+		}
+		b.current.next = join
+
+		b.current = els
+		if err := b.stmts(s.els); err != nil {
+			return err
+		}
+		b.current.next = join
+
+		b.current = join
+
+	case *whileStmt:
+		header, body, exit := &block{}, &block{}, &block{}
+		b.current.next = header
+
+		b.current = header
+		if s.cond != nil {
+			if err := b.checkExpr(s.cond, typeBool); err != nil {
+				return err
+			}
+			b.branch(s.cond, body, exit)
+		} else {
+			b.current.next = body
+		}
+
+		b.loops = append(b.loops, loop{brk: exit, cont: header})
+		b.current = body
+		if err := b.stmts(s.body); err != nil {
+			return err
+		}
+		b.current.next = header
+		b.loops = b.loops[:len(b.loops)-1]
+
+		b.current = exit
+
+	case *branchStmt:
+		if len(b.loops) == 0 {
+			return fmt.Errorf("line %d: %s is not in a loop",
+				s.line, s.tok)
+		}
+
+		l := b.loops[len(b.loops)-1]
+		if s.tok == "break" {
+			b.current.next = l.brk
+		} else {
+			b.current.next = l.cont
+		}
+
+		// Anything following is unreachable.
+		b.current = &block{}
+
+	case *returnStmt:
+		switch {
+		case s.val == nil && b.fn.result:
+			return fmt.Errorf("line %d: missing return value",
+				s.line)
+
+		case s.val != nil && !b.fn.result:
+			return fmt.Errorf("line %d: too many return values",
+				s.line)
+
+		case s.val != nil:
+			if err := b.checkExpr(s.val, typeInt); err != nil {
+				return err
+			}
+			b.returns = append(b.returns, returnSite{
+				blk: b.current,
+				val: s.val,
+			})
+		}
+
+		b.current.next = b.halt
+		b.current = &block{}
+
+	default:
+		return fmt.Errorf("line %d: unsupported statement",
+			s.stmtLine())
+	}
+
+	return nil
+}
+
+// branch ends the current block in a branch on the condition.
+func (b *builder) branch(cond expr, then, els *block) {
+	// Branch on the inner expression of a negation, with the targets
+	// swapped.
+	for {
+		u, ok := cond.(*unaryExpr)
+		if !ok || u.op != "!" {
+			break
+		}
+
+		cond = u.x
+		then, els = els, then
+	}
+
+	b.current.term = termBranch
+	b.current.cond = cond
+	b.current.next = then
+	b.current.alt = els
+}
+
+// exprType is the type of an expression.
+type exprType uint8
+
+const (
+	typeInt exprType = iota
+	typeBool
+)
+
+func (t exprType) String() string {
+	if t == typeBool {
+		return "bool"
+	}
+
+	return "int"
+}
+
+// binaryOps maps binary operators to their opcode and operand and result
+// types.
+var binaryOps = map[string]struct {
+	op       string
+	operands exprType
+	result   exprType
+}{
+	"+":  {"OP_ADD", typeInt, typeInt},
+	"-":  {"OP_SUB", typeInt, typeInt},
+	"<":  {"OP_LESSTHAN", typeInt, typeBool},
+	"<=": {"OP_LESSTHANOREQUAL", typeInt, typeBool},
+	">":  {"OP_GREATERTHAN", typeInt, typeBool},
+	">=": {"OP_GREATERTHANOREQUAL", typeInt, typeBool},
+	"==": {"OP_NUMEQUAL", typeInt, typeBool},
+	"!=": {"OP_NUMNOTEQUAL", typeInt, typeBool},
+	"&&": {"OP_BOOLAND", typeBool, typeBool},
+	"||": {"OP_BOOLOR", typeBool, typeBool},
+}
+
+// builtins maps the builtin functions to their opcode and argument and
+// result types.
+var builtins = map[string]struct {
+	op     string
+	args   []exprType
+	result exprType
+}{
+	"min":    {"OP_MIN", []exprType{typeInt, typeInt}, typeInt},
+	"max":    {"OP_MAX", []exprType{typeInt, typeInt}, typeInt},
+	"abs":    {"OP_ABS", []exprType{typeInt}, typeInt},
+	"within": {"OP_WITHIN", []exprType{typeInt, typeInt, typeInt}, typeBool},
+}
+
+// checkExpr checks that the expression is well typed, of the given type, and
+// only refers to declared variables.
+func (b *builder) checkExpr(e expr, want exprType) error {
+	got, err := b.typeOf(e)
+	if err != nil {
+		return err
+	}
+
+	if got != want {
+		return fmt.Errorf("line %d: expected %v expression, found %v",
+			e.exprLine(), want, got)
+	}
+
+	return nil
+}
+
+func (b *builder) typeOf(e expr) (exprType, error) {
+	switch e := e.(type) {
+	case *numExpr:
+		return typeInt, nil
+
+	case *varExpr:
+		if _, ok := b.vars[e.name]; !ok {
+			return 0, fmt.Errorf("line %d: undefined: %s", e.line,
+				e.name)
+		}
+		return typeInt, nil
+
+	case *unaryExpr:
+		t := typeInt
+		if e.op == "!" {
+			t = typeBool
+		}
+		return t, b.checkExpr(e.x, t)
+
+	case *binaryExpr:
+		op, ok := binaryOps[e.op]
+		if !ok {
+			return 0, fmt.Errorf("line %d: operator %s not "+
+				"available in script", e.line, e.op)
+		}
+
+		if err := b.checkExpr(e.x, op.operands); err != nil {
+			return 0, err
+		}
+		if err := b.checkExpr(e.y, op.operands); err != nil {
+			return 0, err
+		}
+		return op.result, nil
+
+	case *callExpr:
+		fn, ok := builtins[e.fn]
+		if !ok {
+			return 0, fmt.Errorf("line %d: unknown function %s",
+				e.line, e.fn)
+		}
+
+		if len(e.args) != len(fn.args) {
+			return 0, fmt.Errorf("line %d: %s takes %d arguments",
+				e.line, e.fn, len(fn.args))
+		}
+		for i, a := range e.args {
+			if err := b.checkExpr(a, fn.args[i]); err != nil {
+				return 0, err
+			}
+		}
+		return fn.result, nil
+
+	default:
+		return 0, fmt.Errorf("line %d: unsupported expression",
+			e.exprLine())
+	}
+}
+
+// layout simplifies the control flow graph, and returns its blocks in
+// program counter order with the halting block last. Empty blocks only
+// jumping to another block are skipped, and blocks with a single predecessor
+// jumping to them are merged into it.
+func (b *builder) layout() []*block {
+	for {
+		b.thread()
+
+		blocks := b.reachable()
+		preds := make(map[*block]int)
+		for _, blk := range blocks {
+			preds[blk.next]++
+			if blk.term == termBranch {
+				preds[blk.alt]++
+			}
+		}
+
+		merged := false
+		for _, blk := range blocks {
+			next := blk.next
+			if blk.term != termJump || next == b.halt ||
+				next == blk || next == b.entry ||
+				preds[next] != 1 {
+
+				continue
+			}
+
+			blk.assigns = append(blk.assigns, next.assigns...)
+			blk.term = next.term
+			blk.cond = next.cond
+			blk.next = next.next
+			blk.alt = next.alt
+			blk.end = blk.end || next.end
+			merged = true
+			break
+		}
+
+		if !merged {
+			break
+		}
+	}
+
+	blocks := append(b.reachable(), b.halt)
+	for i, blk := range blocks {
+		blk.pc = i
+	}
+
+	return blocks
+}
+
+// thread replaces every jump to an empty block that only jumps on with a
+// jump to its final target.
+func (b *builder) thread() {
+	resolve := func(blk *block) *block {
+		seen := make(map[*block]bool)
+		for blk.term == termJump && len(blk.assigns) == 0 &&
+			!seen[blk] {
+
+			seen[blk] = true
+			blk = blk.next
+		}
+
+		return blk
+	}
+
+	b.entry = resolve(b.entry)
+	for _, blk := range b.reachable() {
+		if blk.next != nil {
+			blk.next = resolve(blk.next)
+		}
+		if blk.alt != nil {
+			blk.alt = resolve(blk.alt)
+		}
+	}
+}
+
+// reachable returns the blocks reachable from the entry in depth first
+// order, excluding the halting block.
+func (b *builder) reachable() []*block {
+	var (
+		blocks []*block
+		seen   = map[*block]bool{b.halt: true}
+		visit  func(blk *block)
+	)
+	visit = func(blk *block) {
+		if blk == nil || seen[blk] {
+			return
+		}
+
+		seen[blk] = true
+		blocks = append(blocks, blk)
+		visit(blk.next)
+		if blk.term == termBranch {
+			visit(blk.alt)
+		}
+	}
+	visit(b.entry)
+
+	return blocks
+}
+
+// step returns the script step of the block. It expects the state on the
+// stack, drops the pc, performs the assignments in order and pushes the pc of
+// the block to execute next.
+func (b *builder) step(blk *block) string {
+	if blk.term == termHalt {
+		return "OP_NOP"
+	}
+
+	g := &gen{vars: b.vars, numRegs: len(b.names)}
+	g.emit("OP_DROP")
+
+	for _, a := range blk.assigns {
+		g.expr(a.val)
+		g.store(a.reg)
+	}
+
+	if blk.term == termBranch && blk.next != blk.alt {
+		g.expr(blk.cond)
+		g.emit("OP_IF", pushNum(int64(blk.next.pc)), "OP_ELSE",
+			pushNum(int64(blk.alt.pc)), "OP_ENDIF")
+	} else {
+		g.emit(pushNum(int64(blk.next.pc)))
+	}
+
+	return strings.Join(g.ops, " ")
+}
+
+// gen generates the script of a step, tracking the number of elements
+// pushed on top of the registers.
+type gen struct {
+	vars    map[string]int
+	numRegs int
+	extra   int
+	ops     []string
+}
+
+func (g *gen) emit(ops ...string) {
+	g.ops = append(g.ops, ops...)
+}
+
+// depth returns the depth from the top of the stack of the given register.
+func (g *gen) depth(reg int) int {
+	return g.numRegs - 1 - reg + g.extra
+}
+
+// expr pushes the value of the expression.
+func (g *gen) expr(e expr) {
+	switch e := e.(type) {
+	case *numExpr:
+		g.emit(pushNum(e.val))
+		g.extra++
+
+	case *varExpr:
+		g.emit(pick(g.depth(g.vars[e.name])))
+		g.extra++
+
+	case *unaryExpr:
+		g.expr(e.x)
+		if e.op == "!" {
+			g.emit("OP_NOT")
+		} else {
+			g.emit("OP_NEGATE")
+		}
+
+	case *binaryExpr:
+		g.expr(e.x)
+
+		// Adding or subtracting one has its own opcodes.
+		if n, ok := e.y.(*numExpr); ok && n.val == 1 &&
+			(e.op == "+" || e.op == "-") {
+
+			g.emit(map[string]string{
+				"+": "OP_1ADD", "-": "OP_1SUB",
+			}[e.op])
+			return
+		}
+
+		g.expr(e.y)
+		g.emit(binaryOps[e.op].op)
+		g.extra--
+
+	case *callExpr:
+		for _, a := range e.args {
+			g.expr(a)
+		}
+		g.emit(builtins[e.fn].op)
+		g.extra -= len(e.args) - 1
+	}
+}
+
+// store pops the top element into the given register.
+func (g *gen) store(reg int) {
+	// Number of registers above the one to set.
+	m := g.numRegs - 1 - reg
+	if m == 0 {
+		g.emit("OP_NIP")
+		g.extra--
+		return
+	}
+
+	// Remove the old value, then move the registers above it over the
+	// new one.
+	g.emit(roll(m+1), "OP_DROP")
+	for i := 0; i < m; i++ {
+		g.emit(roll(m))
+	}
+	g.extra--
+}
+
+// pick returns the script copying the element at the given depth to the top.
+func pick(depth int) string {
+	switch depth {
+	case 0:
+		return "OP_DUP"
+	case 1:
+		return "OP_OVER"
+	}
+
+	return pushNum(int64(depth)) + " OP_PICK"
+}
+
+// roll returns the script moving the element at the given depth to the top.
+func roll(depth int) string {
+	switch depth {
+	case 1:
+		return "OP_SWAP"
+	case 2:
+		return "OP_ROT"
+	}
+
+	return pushNum(int64(depth)) + " OP_ROLL"
+}
+
+// pushNum returns the script push of the given number, using the small
+// integer opcodes where possible.
+func pushNum(n int64) string {
+	switch {
+	case n == 0:
+		return "OP_0"
+	case n == -1:
+		return "OP_1NEGATE"
+	case n > 0 && n <= 16:
+		return fmt.Sprintf("OP_%d", n)
+	default:
+		return fmt.Sprintf("%x", commitment.ScriptNum(n).Bytes())
+	}
+}
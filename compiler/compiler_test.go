@@ -0,0 +1,259 @@
+package compiler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/halseth/mattlab/tracer/store"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/halseth/mattlab/tracer/verify"
+	"github.com/stretchr/testify/require"
+)
+
+const multiplySrc = `func multiply(x int) int {
+	i := 0
+	while i < 8 {
+		x = x + x
+		i++
+	}
+	return x
+}`
+
+const fibonacciSrc = `func fib(n int) int {
+	a := 0
+	b := 1
+	while n > 0 {
+		t := a + b
+		a = b
+		b = t
+		n--
+	}
+	return a
+}`
+
+const mixedSrc = `func g(x int, y int) int {
+	s := 0
+	k := 3
+	while k > 0 {
+		k -= 1
+		if x > y && !(k == 1) {
+			s += x - y
+			continue
+		} else if within(x, 0, 10) {
+			s = s + max(x, y) - min(x, 2)
+		} else {
+			s = -s + abs(y)
+		}
+		x = x - 1
+	}
+	if s > 100 {
+		return s
+	}
+	return k + 1000
+}`
+
+const breakSrc = `func f(n int) int {
+	i := 0
+	while {
+		if i >= n || i > 5 {
+			break
+		}
+		i++
+	}
+	return i
+}`
+
+// mixed is the function compiled from mixedSrc.
+func mixed(x, y int64) int64 {
+	var s int64
+	k := int64(3)
+	for k > 0 {
+		k--
+		if x > y && k != 1 {
+			s += x - y
+			continue
+		} else if x >= 0 && x < 10 {
+			s = s + max(x, y) - min(x, 2)
+		} else {
+			abs := y
+			if abs < 0 {
+				abs = -abs
+			}
+			s = -s + abs
+		}
+		x--
+	}
+	if s > 100 {
+		return s
+	}
+
+	return k + 1000
+}
+
+// TestCompile checks that tracing compiled functions gives the result of the
+// same functions in Go, and that the traces verify.
+func TestCompile(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		params []string
+		result string
+		args   [][]int64
+		want   func(args ...int64) int64
+	}{
+		{
+			name:   "multiply",
+			src:    multiplySrc,
+			params: []string{"x"},
+			result: "x",
+			args:   [][]int64{{0}, {1}, {2}, {-3}, {1000}},
+			want: func(args ...int64) int64 {
+				return args[0] * 256
+			},
+		},
+		{
+			name:   "fibonacci",
+			src:    fibonacciSrc,
+			params: []string{"n"},
+			result: "a",
+			args:   [][]int64{{0}, {1}, {2}, {10}, {30}},
+			want: func(args ...int64) int64 {
+				a, b := int64(0), int64(1)
+				for n := args[0]; n > 0; n-- {
+					a, b = b, a+b
+				}
+				return a
+			},
+		},
+		{
+			name:   "mixed",
+			src:    mixedSrc,
+			params: []string{"x", "y"},
+			result: resultName,
+			args: [][]int64{
+				{0, 0}, {5, 3}, {3, 5}, {-4, 7}, {200, 1},
+				{12, -40}, {9, 9},
+			},
+			want: func(args ...int64) int64 {
+				return mixed(args[0], args[1])
+			},
+		},
+		{
+			name:   "break",
+			src:    breakSrc,
+			params: []string{"n"},
+			result: "i",
+			args:   [][]int64{{0}, {3}, {10}},
+			want: func(args ...int64) int64 {
+				return min(args[0], 6)
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			c, err := Compile(test.src)
+			require.NoError(t, err)
+			require.Equal(t, test.params, c.Params)
+			require.Equal(t, test.result, c.Result)
+			require.NoError(t, c.Program.Validate())
+			require.NoError(t, c.Program.CheckStackEffects())
+
+			res, ok := c.Program.Schema.Index(c.Result)
+			require.True(t, ok)
+
+			for _, args := range test.args {
+				start, err := c.StartState(args...)
+				require.NoError(t, err)
+
+				opts := trace.DefaultOptions()
+				opts.Strict = trace.StrictAbort
+				tr, err := trace.GetTraceFromState(
+					context.Background(), c.Program, start,
+					opts,
+				)
+				require.NoError(t, err, args)
+
+				end := tr.Trace[len(tr.Trace)-1]
+				got, err := commitment.MakeScriptNum(
+					end[res], true, schema.DefaultWidth,
+				)
+				require.NoError(t, err)
+				require.EqualValues(t, test.want(args...), got,
+					args)
+
+				v, err := verify.Trace(
+					c.Program, store.Memory(tr.Trace), nil,
+				)
+				require.NoError(t, err)
+				require.True(t, v.Valid(), args)
+			}
+		})
+	}
+}
+
+// TestCompileMultiply checks that the multiply function compiles to a program
+// with the same trace as the hand written multiply program.
+func TestCompileMultiply(t *testing.T) {
+	c, err := Compile(multiplySrc)
+	require.NoError(t, err)
+	require.Equal(t, scripts.MultiplyProgram.Schema.String(),
+		c.Program.Schema.String())
+
+	ctx := context.Background()
+	want, err := trace.GetTrace(ctx, scripts.MultiplyProgram, "02 <> <>",
+		nil)
+	require.NoError(t, err)
+
+	got, err := trace.GetTrace(ctx, c.Program, "02 <> <>", nil)
+	require.NoError(t, err)
+	require.Equal(t, want.Trace, got.Trace)
+}
+
+// TestCompileErrors checks that invalid functions are rejected.
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"empty", ""},
+		{"not a function", "x := 1"},
+		{"undeclared variable", "func f(x int) int { return y }"},
+		{"redeclared variable", "func f(x int) int { x := 1 return x }"},
+		{"break outside loop", "func f(x int) int { break return x }"},
+		{"unknown builtin", "func f(x int) int { return mul(x, x) }"},
+		{"wrong builtin arity", "func f(x int) int { return min(x) }"},
+		{"unterminated block", "func f(x int) int { if x > 0 { x++ "},
+		{"trailing tokens", "func f(x int) int { return x } x"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Compile(test.src)
+			require.Error(t, err)
+		})
+	}
+}
+
+// TestStartState checks the start states built for arguments.
+func TestStartState(t *testing.T) {
+	c, err := Compile(mixedSrc)
+	require.NoError(t, err)
+
+	_, err = c.StartState(1)
+	require.Error(t, err)
+
+	start, err := c.StartState(5, -2)
+	require.NoError(t, err)
+	require.Len(t, start, c.Program.Schema.NumRegisters())
+	require.Equal(t, commitment.ScriptNum(5).Bytes(), start[0])
+	require.Equal(t, commitment.ScriptNum(-2).Bytes(), start[1])
+	for _, r := range start[2:] {
+		require.Empty(t, r)
+	}
+}
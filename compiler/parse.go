@@ -0,0 +1,646 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// tokenKind is the kind of a lexical token.
+type tokenKind uint8
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenNumber
+	tokenKeyword
+	tokenOp
+
+	// tokenSemi ends a statement. Like in Go, it is inserted at the end of
+	// lines ending in an identifier, number, closing bracket or one of
+	// the keywords break, continue and return.
+	tokenSemi
+)
+
+var keywords = map[string]bool{
+	"func":     true,
+	"int":      true,
+	"if":       true,
+	"else":     true,
+	"while":    true,
+	"for":      true,
+	"break":    true,
+	"continue": true,
+	"return":   true,
+}
+
+// operators are the operator tokens, longest first such that the lexer
+// matches them greedily.
+var operators = []string{
+	":=", "+=", "-=", "++", "--", "==", "!=", "<=", ">=", "&&", "||",
+	"<<", ">>", "+", "-", "*", "/", "%", "!", "<", ">", "=", "(", ")",
+	"{", "}", ",", ";",
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of file"
+	case tokenSemi:
+		if t.text == "\n" {
+			return "newline"
+		}
+	}
+
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lex splits the source into tokens.
+func lex(src string) ([]token, error) {
+	var (
+		tokens []token
+		line   = 1
+	)
+
+	// needSemi returns true if a newline after the last token ends the
+	// statement.
+	needSemi := func() bool {
+		if len(tokens) == 0 {
+			return false
+		}
+
+		last := tokens[len(tokens)-1]
+		switch last.kind {
+		case tokenIdent, tokenNumber:
+			return true
+		case tokenKeyword:
+			return last.text == "break" || last.text == "continue" ||
+				last.text == "return"
+		case tokenOp:
+			return last.text == ")" || last.text == "}" ||
+				last.text == "++" || last.text == "--"
+		}
+
+		return false
+	}
+
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case c == '\n':
+			if needSemi() {
+				tokens = append(tokens, token{tokenSemi, "\n", line})
+			}
+			line++
+			i++
+
+		case unicode.IsSpace(c):
+			i++
+
+		case strings.HasPrefix(src[i:], "//"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(src) && (unicode.IsLetter(rune(src[i])) ||
+				unicode.IsDigit(rune(src[i])) || src[i] == '_') {
+
+				i++
+			}
+
+			kind := tokenIdent
+			if keywords[src[start:i]] {
+				kind = tokenKeyword
+			}
+			tokens = append(tokens, token{kind, src[start:i], line})
+
+		case unicode.IsDigit(c):
+			start := i
+			for i < len(src) && unicode.IsDigit(rune(src[i])) {
+				i++
+			}
+			tokens = append(tokens, token{
+				tokenNumber, src[start:i], line,
+			})
+
+		default:
+			var op string
+			for _, o := range operators {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("line %d: unexpected "+
+					"character %q", line, c)
+			}
+
+			kind := tokenOp
+			if op == ";" {
+				kind = tokenSemi
+			}
+			tokens = append(tokens, token{kind, op, line})
+			i += len(op)
+		}
+	}
+
+	if needSemi() {
+		tokens = append(tokens, token{tokenSemi, "\n", line})
+	}
+	tokens = append(tokens, token{tokenEOF, "", line})
+
+	return tokens, nil
+}
+
+// expr is an integer or boolean expression.
+type expr interface {
+	exprLine() int
+}
+
+// numExpr is an integer literal.
+type numExpr struct {
+	line int
+	val  int64
+}
+
+// varExpr is a variable reference.
+type varExpr struct {
+	line int
+	name string
+}
+
+// unaryExpr is a unary operation, - or !.
+type unaryExpr struct {
+	line int
+	op   string
+	x    expr
+}
+
+// binaryExpr is a binary operation.
+type binaryExpr struct {
+	line int
+	op   string
+	x, y expr
+}
+
+// callExpr is a call to one of the builtin functions.
+type callExpr struct {
+	line int
+	fn   string
+	args []expr
+}
+
+func (e *numExpr) exprLine() int    { return e.line }
+func (e *varExpr) exprLine() int    { return e.line }
+func (e *unaryExpr) exprLine() int  { return e.line }
+func (e *binaryExpr) exprLine() int { return e.line }
+func (e *callExpr) exprLine() int   { return e.line }
+
+// stmt is a statement.
+type stmt interface {
+	stmtLine() int
+}
+
+// assignStmt assigns a value to a variable, declaring it if define is set.
+type assignStmt struct {
+	line   int
+	name   string
+	define bool
+	val    expr
+}
+
+// ifStmt is an if statement. An else if is an else branch holding a single
+// ifStmt.
+type ifStmt struct {
+	line int
+	cond expr
+	then []stmt
+	els  []stmt
+}
+
+// whileStmt is a loop, running its body while cond is true. A nil cond
+// loops until a break or return.
+type whileStmt struct {
+	line int
+	cond expr
+	body []stmt
+}
+
+// branchStmt is a break or continue.
+type branchStmt struct {
+	line int
+	tok  string
+}
+
+// returnStmt ends the program, with val as the result if set.
+type returnStmt struct {
+	line int
+	val  expr
+}
+
+func (s *assignStmt) stmtLine() int { return s.line }
+func (s *ifStmt) stmtLine() int     { return s.line }
+func (s *whileStmt) stmtLine() int  { return s.line }
+func (s *branchStmt) stmtLine() int { return s.line }
+func (s *returnStmt) stmtLine() int { return s.line }
+
+// function is a parsed function.
+type function struct {
+	name   string
+	params []string
+	result bool
+	body   []stmt
+}
+
+// parser is a recursive descent parser over the tokens of a function.
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse parses the source of a single function.
+func parse(src string) (*function, error) {
+	tokens, err := lex(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	fn, err := p.function()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSemis()
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, p.errorf(t, "unexpected %v after function", t)
+	}
+
+	return fn, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+// is returns true if the next token is the given operator or keyword.
+func (p *parser) is(text string) bool {
+	t := p.peek()
+	return (t.kind == tokenOp || t.kind == tokenKeyword) && t.text == text
+}
+
+// accept consumes the next token if it is the given operator or keyword.
+func (p *parser) accept(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+
+	return false
+}
+
+// expect consumes the given operator or keyword, failing if it is not next.
+func (p *parser) expect(text string) error {
+	if t := p.peek(); !p.accept(text) {
+		return p.errorf(t, "expected %q, found %v", text, t)
+	}
+
+	return nil
+}
+
+func (p *parser) ident() (string, error) {
+	t := p.next()
+	if t.kind != tokenIdent {
+		return "", p.errorf(t, "expected identifier, found %v", t)
+	}
+
+	return t.text, nil
+}
+
+func (p *parser) skipSemis() {
+	for p.peek().kind == tokenSemi {
+		p.next()
+	}
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", t.line, fmt.Sprintf(format, args...))
+}
+
+// function parses
+//
+//	func name(a int, b int) int { ... }
+func (p *parser) function() (*function, error) {
+	p.skipSemis()
+	if err := p.expect("func"); err != nil {
+		return nil, err
+	}
+
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+
+	fn := &function{name: name}
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.accept(")") {
+		if len(fn.params) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+
+		param, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("int"); err != nil {
+			return nil, err
+		}
+		fn.params = append(fn.params, param)
+	}
+
+	fn.result = p.accept("int")
+
+	fn.body, err = p.block()
+	if err != nil {
+		return nil, err
+	}
+
+	return fn, nil
+}
+
+// block parses a list of statements in braces.
+func (p *parser) block() ([]stmt, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+
+	var stmts []stmt
+	for {
+		p.skipSemis()
+		if p.accept("}") {
+			return stmts, nil
+		}
+
+		s, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, s)
+
+		// Statements must be separated, unless the block ends.
+		if t := p.peek(); t.kind != tokenSemi && !p.is("}") {
+			return nil, p.errorf(t, "unexpected %v after "+
+				"statement", t)
+		}
+	}
+}
+
+func (p *parser) stmt() (stmt, error) {
+	t := p.peek()
+	switch {
+	case p.accept("if"):
+		return p.ifStmt(t)
+
+	case p.accept("while"), p.accept("for"):
+		s := &whileStmt{line: t.line}
+		if !p.is("{") {
+			var err error
+			s.cond, err = p.expr()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		var err error
+		s.body, err = p.block()
+		if err != nil {
+			return nil, err
+		}
+
+		return s, nil
+
+	case p.accept("break"), p.accept("continue"):
+		return &branchStmt{line: t.line, tok: t.text}, nil
+
+	case p.accept("return"):
+		s := &returnStmt{line: t.line}
+		if p.peek().kind != tokenSemi && !p.is("}") {
+			var err error
+			s.val, err = p.expr()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return s, nil
+
+	case t.kind == tokenIdent:
+		return p.assignStmt()
+
+	default:
+		return nil, p.errorf(t, "unexpected %v", t)
+	}
+}
+
+func (p *parser) ifStmt(t token) (stmt, error) {
+	cond, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ifStmt{line: t.line, cond: cond}
+	s.then, err = p.block()
+	if err != nil {
+		return nil, err
+	}
+
+	if !p.accept("else") {
+		return s, nil
+	}
+
+	if elseIf := p.peek(); p.accept("if") {
+		nested, err := p.ifStmt(elseIf)
+		if err != nil {
+			return nil, err
+		}
+		s.els = []stmt{nested}
+
+		return s, nil
+	}
+
+	s.els, err = p.block()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// assignStmt parses an assignment, declaration, increment or decrement,
+// desugaring the latter two and the compound assignments to plain
+// assignments.
+func (p *parser) assignStmt() (stmt, error) {
+	t := p.next()
+	s := &assignStmt{line: t.line, name: t.text}
+	v := &varExpr{line: t.line, name: t.text}
+
+	op := p.next()
+	switch op.text {
+	case ":=", "=", "+=", "-=":
+		val, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+
+		s.define = op.text == ":="
+		s.val = val
+		if op.text == "+=" || op.text == "-=" {
+			s.val = &binaryExpr{
+				line: op.line, op: op.text[:1], x: v, y: val,
+			}
+		}
+
+	case "++", "--":
+		s.val = &binaryExpr{
+			line: op.line, op: op.text[:1], x: v,
+			y: &numExpr{line: op.line, val: 1},
+		}
+
+	default:
+		return nil, p.errorf(op, "expected assignment, found %v", op)
+	}
+
+	return s, nil
+}
+
+// binaryPrec is the precedence of the binary operators, higher binds
+// tighter. Multiplication, division and shifts are parsed, but rejected by
+// the compiler as their opcodes are disabled in script.
+var binaryPrec = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3, "<": 3, "<=": 3, ">": 3, ">=": 3,
+	"+": 4, "-": 4,
+	"*": 5, "/": 5, "%": 5, "<<": 5, ">>": 5,
+}
+
+func (p *parser) expr() (expr, error) {
+	return p.binaryExpr(1)
+}
+
+// binaryExpr parses a binary expression with operators of at least the given
+// precedence.
+func (p *parser) binaryExpr(prec int) (expr, error) {
+	x, err := p.unaryExpr()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		opPrec, ok := binaryPrec[t.text]
+		if t.kind != tokenOp || !ok || opPrec < prec {
+			return x, nil
+		}
+		p.next()
+
+		y, err := p.binaryExpr(opPrec + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		x = &binaryExpr{line: t.line, op: t.text, x: x, y: y}
+	}
+}
+
+func (p *parser) unaryExpr() (expr, error) {
+	t := p.peek()
+	if p.accept("-") || p.accept("!") {
+		x, err := p.unaryExpr()
+		if err != nil {
+			return nil, err
+		}
+
+		// Fold negative literals, so they can be pushed directly.
+		if n, ok := x.(*numExpr); ok && t.text == "-" {
+			return &numExpr{line: t.line, val: -n.val}, nil
+		}
+
+		return &unaryExpr{line: t.line, op: t.text, x: x}, nil
+	}
+
+	return p.primaryExpr()
+}
+
+func (p *parser) primaryExpr() (expr, error) {
+	t := p.next()
+	switch {
+	case t.kind == tokenNumber:
+		n, err := strconv.ParseInt(t.text, 10, 32)
+		if err != nil {
+			return nil, p.errorf(t, "invalid number %s: %v", t.text,
+				err)
+		}
+
+		return &numExpr{line: t.line, val: n}, nil
+
+	case t.kind == tokenIdent && p.is("("):
+		p.next()
+		call := &callExpr{line: t.line, fn: t.text}
+		for !p.accept(")") {
+			if len(call.args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+
+			arg, err := p.expr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+		}
+
+		return call, nil
+
+	case t.kind == tokenIdent:
+		return &varExpr{line: t.line, name: t.text}, nil
+
+	case t.kind == tokenOp && t.text == "(":
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+
+		return x, nil
+
+	default:
+		return nil, p.errorf(t, "expected expression, found %v", t)
+	}
+}
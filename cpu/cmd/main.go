@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/halseth/mattlab/cpu"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/trace"
+)
+
+// sumSrc is the CPU program run if none is given: it sums the numbers from 1
+// to the input, and stores the sum in memory.
+const sumSrc = `	LI r1 0
+loop:	JZ r0 done
+	ADD r1 r0
+	SUBI r0 1
+	JMP loop
+done:	LI r2 sum
+	STORE r1 r2
+	HALT
+sum:	DATA 0
+`
+
+var (
+	romPath = flag.String("rom", "", "file to read the CPU program "+
+		"from; a program summing the numbers up to the input if not "+
+		"set")
+	input    = flag.Int64("input", 10, "input of the CPU program, in r0")
+	maxSteps = flag.Int("maxsteps", trace.DefaultMaxSteps,
+		"maximum number of steps to execute")
+	program = flag.Bool("program", false, "print the CPU step program, "+
+		"committing to the CPU program as its initial memory, instead "+
+		"of running it")
+	cells = flag.Bool("cells", false, "print the initial memory cells, "+
+		"listed like a start stack as read by -memory, instead of "+
+		"running the program")
+)
+
+// Run a program on the CPU implemented as a step program, and check that the
+// trace ends in the state of a Go implementation of the CPU.
+func main() {
+	flag.Parse()
+	err := run()
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	src := sumSrc
+	if *romPath != "" {
+		b, err := os.ReadFile(*romPath)
+		if err != nil {
+			return err
+		}
+		src = string(b)
+	}
+
+	img, err := cpu.Assemble(src)
+	if err != nil {
+		return err
+	}
+
+	prog, err := img.Program()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *program:
+		return scripts.WriteProgram(os.Stdout, prog)
+
+	case *cells:
+		var els []string
+		for _, c := range img.Cells {
+			el := fmt.Sprintf("%x", c)
+			if len(c) == 0 {
+				el = "<>"
+			}
+			els = append(els, el)
+		}
+		fmt.Println(strings.Join(els, " "))
+		return nil
+	}
+
+	start, err := img.StartState(*input)
+	if err != nil {
+		return err
+	}
+
+	mem, err := img.Memory()
+	if err != nil {
+		return err
+	}
+
+	opts := trace.DefaultOptions()
+	opts.MaxSteps = *maxSteps
+	opts.Strict = trace.StrictAbort
+	opts.Memory = mem
+	opts.Hints = cpu.Hints(mem)
+
+	res, err := trace.GetTraceFromState(
+		context.Background(), prog, start, opts,
+	)
+	if err != nil {
+		return err
+	}
+
+	m := cpu.NewMachine(img, *input)
+	if err := m.Run(*maxSteps); err != nil {
+		return err
+	}
+
+	end := res.Trace[len(res.Trace)-1]
+	if err := m.Check(end); err != nil {
+		return fmt.Errorf("trace doesn't match the reference: %v", err)
+	}
+
+	fmt.Printf("executed %d instructions in %d steps\n", m.Steps,
+		res.Steps)
+	for k, v := range m.Regs {
+		fmt.Printf("r%d = %d\n", k, v)
+	}
+
+	return nil
+}
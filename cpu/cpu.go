@@ -0,0 +1,284 @@
+package cpu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/halseth/mattlab/assembler"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/mattlab/tracer/trace"
+)
+
+// Depths below the top of the stack of the registers of the execute steps,
+// once the pc is dropped and the ip moved to the alt stack: v and x are on top
+// of b.
+const (
+	depthB  = 2
+	depthA  = 3
+	depthOp = 4
+	depthIR = 5
+
+	// depthLastReg is the depth of the last general purpose register,
+	// the others being below it.
+	depthLastReg = 7
+)
+
+// srcTemplate is the CPU step program. The general purpose registers are at the
+// bottom of the state, r0 being the input set by the question script. mem is
+// the root of the memory holding code and data, and ip the address of the next
+// instruction.
+//
+// The fetch step loads the instruction at ip into ir, and takes its decoded
+// fields as hints into op, a and b. It checks the hints by encoding them back
+// to ir, before dispatching on op to the step executing the instruction. Memory
+// accesses go through x and v, as addresses and values can't be taken from the
+// general purpose registers directly.
+const srcTemplate = `#:	r0 r1 r2 r3 mem:32 ir:6 op a b x v ip pc
+#mem:	mem %[1]d
+fetch:
+	HINT op a b MEM_LOAD ip ir
+	OP_DROP OP_TOALTSTACK
+	%[2]s OP_EQUALVERIFY
+	%[3]s
+	OP_FROMALTSTACK OP_SWAP
+li:	OP_DROP OP_TOALTSTACK OP_2 OP_PICK %[4]s OP_FROMALTSTACK OP_1ADD @fetch
+mov:	OP_DROP OP_TOALTSTACK %[5]s %[4]s OP_FROMALTSTACK OP_1ADD @fetch
+add:	OP_DROP OP_TOALTSTACK %[6]s OP_ADD %[4]s OP_FROMALTSTACK OP_1ADD @fetch
+sub:	OP_DROP OP_TOALTSTACK %[6]s OP_SUB %[4]s OP_FROMALTSTACK OP_1ADD @fetch
+addi:
+	OP_DROP OP_TOALTSTACK %[7]s OP_3 OP_PICK OP_ADD %[4]s
+	OP_FROMALTSTACK OP_1ADD @fetch
+subi:
+	OP_DROP OP_TOALTSTACK %[7]s OP_3 OP_PICK OP_SUB %[4]s
+	OP_FROMALTSTACK OP_1ADD @fetch
+lt:
+	OP_DROP OP_TOALTSTACK %[6]s OP_LESSTHAN %[4]s
+	OP_FROMALTSTACK OP_1ADD @fetch
+eq:
+	OP_DROP OP_TOALTSTACK %[6]s OP_NUMEQUAL %[4]s
+	OP_FROMALTSTACK OP_1ADD @fetch
+jmp:	OP_DROP OP_DROP OP_3 OP_PICK @fetch
+jz:
+	OP_DROP OP_TOALTSTACK %[7]s OP_0NOTEQUAL
+	OP_IF OP_FROMALTSTACK OP_1ADD
+	OP_ELSE OP_FROMALTSTACK OP_DROP OP_2 OP_PICK OP_ENDIF
+	@fetch
+jnz:
+	OP_DROP OP_TOALTSTACK %[7]s OP_0NOTEQUAL
+	OP_IF OP_FROMALTSTACK OP_DROP OP_2 OP_PICK
+	OP_ELSE OP_FROMALTSTACK OP_1ADD OP_ENDIF
+	@fetch
+load:
+	OP_DROP OP_TOALTSTACK %[5]s OP_ROT OP_DROP OP_SWAP # x = r[b]
+	OP_FROMALTSTACK @loadmem
+loadmem:
+	MEM_LOAD x v
+	OP_DROP OP_TOALTSTACK OP_DUP %[4]s OP_FROMALTSTACK OP_1ADD @fetch
+store:
+	OP_DROP OP_TOALTSTACK %[5]s OP_ROT OP_DROP OP_SWAP # x = r[b]
+	%[7]s OP_NIP                                        # v = r[a]
+	OP_FROMALTSTACK @storemem
+storemem:	MEM_STORE x v OP_DROP OP_1ADD @fetch
+halt:	OP_NOP
+`
+
+// stepLabels are the labels of the steps executing each opcode.
+var stepLabels = [numOps]string{
+	OpHalt:  "halt",
+	OpLI:    "li",
+	OpMov:   "mov",
+	OpAdd:   "add",
+	OpSub:   "sub",
+	OpAddI:  "addi",
+	OpSubI:  "subi",
+	OpLT:    "lt",
+	OpEq:    "eq",
+	OpJmp:   "jmp",
+	OpJZ:    "jz",
+	OpJNZ:   "jnz",
+	OpLoad:  "load",
+	OpStore: "store",
+}
+
+// Source returns the assembler source of the CPU step program.
+func Source() string {
+	// Encode the fields back to an instruction word, the field on top of
+	// the stack coming first when concatenated.
+	word := strings.Join([]string{
+		encodeField(depthB),
+		encodeField(depthA + 1), "OP_CAT",
+		encodeField(depthOp + 1), "OP_CAT",
+		pick(depthIR + 1),
+	}, " ")
+
+	// Dispatch on op, checking that it is a known opcode.
+	dispatch := pick(depthOp)
+	for op := Op(0); op < numOps-1; op++ {
+		dispatch += fmt.Sprintf(" OP_DUP %s OP_NUMEQUAL OP_IF OP_DROP "+
+			"@%s OP_ELSE", scripts.NumToOp(int(op)), stepLabels[op])
+	}
+	dispatch += fmt.Sprintf(" %s OP_NUMEQUALVERIFY @%s",
+		scripts.NumToOp(int(numOps-1)), stepLabels[numOps-1])
+	dispatch += strings.Repeat(" OP_ENDIF", int(numOps-1))
+
+	return fmt.Sprintf(srcTemplate, MemDepth, word, dispatch,
+		setReg(depthA), pushReg(depthB, 0),
+		pushReg(depthA, 0)+" "+pushReg(depthB, 1),
+		pushReg(depthA, 0))
+}
+
+// pick returns the script copying the element at the given depth to the top of
+// the stack.
+func pick(depth int) string {
+	return scripts.NumToOp(depth) + " OP_PICK"
+}
+
+// regDepth returns the depth of general purpose register k.
+func regDepth(k int) int {
+	return depthLastReg + NumRegs - 1 - k
+}
+
+// encodeField returns the script pushing the instruction field at the given
+// depth as encoded in instruction words, checking that it is a byte.
+func encodeField(depth int) string {
+	return pick(depth) + " OP_DUP OP_0 0001 OP_WITHIN OP_VERIFY " +
+		"0001 OP_ADD"
+}
+
+// pushReg returns the script pushing the general purpose register indexed by
+// the operand at the given depth, with n elements pushed on top of the state.
+// The register is selected by a chain of comparisons, as the depth to pick it
+// from must be known statically.
+func pushReg(operand, n int) string {
+	last := NumRegs - 1
+
+	s := pick(operand + n)
+	for k := 0; k < last; k++ {
+		s += fmt.Sprintf(" OP_DUP %s OP_NUMEQUAL OP_IF OP_DROP %s "+
+			"OP_ELSE", scripts.NumToOp(k), pick(regDepth(k)+n))
+	}
+	s += fmt.Sprintf(" %s OP_NUMEQUALVERIFY %s", scripts.NumToOp(last),
+		pick(regDepth(last)+n))
+	s += strings.Repeat(" OP_ENDIF", last)
+
+	return s
+}
+
+// setReg returns the script moving the element on top of the stack to the
+// general purpose register indexed by the operand at the given depth.
+func setReg(operand int) string {
+	last := NumRegs - 1
+
+	s := pick(operand + 1)
+	for k := 0; k < last; k++ {
+		s += fmt.Sprintf(" OP_DUP %s OP_NUMEQUAL OP_IF OP_DROP %s "+
+			"OP_ELSE", scripts.NumToOp(k), replaceReg(k))
+	}
+	s += fmt.Sprintf(" %s OP_NUMEQUALVERIFY %s", scripts.NumToOp(last),
+		replaceReg(last))
+	s += strings.Repeat(" OP_ENDIF", last)
+
+	return s
+}
+
+// replaceReg returns the script replacing general purpose register k with the
+// element on top of the stack: it drops the register, and rolls the elements
+// above it over the new value.
+func replaceReg(k int) string {
+	d := regDepth(k)
+
+	s := scripts.NumToOp(d+1) + " OP_ROLL OP_DROP"
+	for i := 0; i < d; i++ {
+		s += " " + scripts.NumToOp(d) + " OP_ROLL"
+	}
+
+	return s
+}
+
+// Program is the CPU as a step program, starting with an empty memory. Its
+// leaves are the same whatever program the CPU runs, only the question script
+// committing to the initial memory differs.
+var Program = func() *scripts.Program {
+	a, err := assembler.Assemble(Source())
+	if err != nil {
+		panic(err)
+	}
+
+	prog, err := a.Program()
+	if err != nil {
+		panic(err)
+	}
+
+	return prog
+}()
+
+// Memory returns the initial memory holding the image.
+func (img *Image) Memory() (*memory.Memory, error) {
+	return memory.New(MemDepth, img.Cells)
+}
+
+// Program returns the CPU step program starting with the image in memory.
+func (img *Image) Program() (*scripts.Program, error) {
+	mem, err := img.Memory()
+	if err != nil {
+		return nil, err
+	}
+
+	root := mem.Root()
+	m := *Program.Memory
+	m.Init = &root
+
+	prog := *Program
+	prog.Memory = &m
+
+	return &prog, nil
+}
+
+// StartState returns the state the CPU starts executing the image from, with
+// the given input in r0.
+func (img *Image) StartState(input int64) ([][]byte, error) {
+	mem, err := img.Memory()
+	if err != nil {
+		return nil, err
+	}
+
+	s := Program.Schema
+	state := make([][]byte, s.NumRegisters())
+	for i := range state {
+		state[i] = []byte{}
+	}
+	state[0] = num(input)
+
+	root := mem.Root()
+	state[Program.Memory.Root] = root[:]
+
+	return state, nil
+}
+
+// Hints returns the hint provider decoding the instructions fetched from the
+// memory, which must be the memory the program is traced with.
+func Hints(mem *memory.Memory) trace.HintProvider {
+	ip, _ := Program.Schema.Index("ip")
+
+	return func(_, _ int, state [][]byte) ([][]byte, error) {
+		addr, err := toNum(state[ip])
+		if err != nil {
+			return nil, fmt.Errorf("ip: %v", err)
+		}
+
+		cell, err := mem.Read(int(addr))
+		if err != nil {
+			return nil, err
+		}
+
+		i, err := Decode(cell)
+		if err != nil {
+			return nil, fmt.Errorf("address %d: %v", addr, err)
+		}
+
+		return [][]byte{
+			num(int64(i.Op)), num(int64(i.A)), num(int64(i.B)),
+		}, nil
+	}
+}
@@ -0,0 +1,260 @@
+package cpu
+
+import (
+	"context"
+	"testing"
+
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/stretchr/testify/require"
+)
+
+// sumSrc sums the numbers from 1 to r0, and stores the sum in memory.
+const sumSrc = `	LI r1 0
+loop:	JZ r0 done
+	ADD r1 r0
+	SUBI r0 1
+	JMP loop
+done:	LI r2 sum
+	STORE r1 r2
+	HALT
+sum:	DATA 0
+`
+
+// allOpsSrc executes every instruction, looping r0 times over a memory
+// update.
+const allOpsSrc = `	MOV r1 r0
+	ADDI r1 3
+	SUBI r1 1
+	ADD r1 r0
+	SUB r1 r0
+	LI r2 10
+	LT r2 r1	# r2 = 10 < r1
+	MOV r3 r1
+	EQ r3 r1	# r3 = 1
+	JNZ r3 skip
+	LI r1 99
+skip:	LI r2 data
+	LOAD r3 r2
+	ADD r3 r1
+	STORE r3 r2
+	JZ r0 end
+	SUBI r0 1
+	JMP skip
+end:	HALT
+data:	DATA 40
+`
+
+// traceImage traces the CPU running the image from the given input, and
+// returns the trace result.
+func traceImage(t *testing.T, img *Image, input int64,
+	hints func(trace.HintProvider) trace.HintProvider) (*trace.Result,
+	error) {
+
+	t.Helper()
+
+	prog, err := img.Program()
+	require.NoError(t, err)
+	start, err := img.StartState(input)
+	require.NoError(t, err)
+	mem, err := img.Memory()
+	require.NoError(t, err)
+
+	opts := trace.DefaultOptions()
+	opts.Strict = trace.StrictAbort
+	opts.Memory = mem
+	opts.Hints = hints(Hints(mem))
+
+	return trace.GetTraceFromState(context.Background(), prog, start, opts)
+}
+
+// TestMachineCheck checks that the states of the traced CPU program match the
+// Go implementation, after every executed instruction.
+func TestMachineCheck(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		inputs []int64
+	}{
+		{"sum", sumSrc, []int64{0, 1, 5, 20}},
+		{"all ops", allOpsSrc, []int64{0, 1, 3, 12}},
+	}
+
+	honest := func(h trace.HintProvider) trace.HintProvider {
+		return h
+	}
+
+	pcReg, ok := Program.Schema.Index("pc")
+	require.True(t, ok)
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			img, err := Assemble(test.src)
+			require.NoError(t, err)
+
+			for _, input := range test.inputs {
+				res, err := traceImage(t, img, input, honest)
+				require.NoError(t, err, input)
+
+				// Every fetch step, at pc 0, starts executing
+				// the next instruction.
+				m := NewMachine(img, input)
+				for i := 0; i <= res.Steps; i++ {
+					state := res.Trace[i]
+					pc, err := toNum(state[pcReg])
+					require.NoError(t, err)
+					if pc != 0 {
+						continue
+					}
+
+					require.NoError(t, m.Check(state),
+						"input %d state %d", input, i)
+					require.NoError(t, m.Step())
+				}
+				require.True(t, m.Halted)
+
+				end := res.Trace[len(res.Trace)-1]
+				require.NoError(t, m.Check(end), input)
+
+				// The reference must match the machine run
+				// from the start.
+				ref := NewMachine(img, input)
+				require.NoError(t, ref.Run(1000))
+				require.Equal(t, m.Regs, ref.Regs)
+				require.NoError(t, ref.Check(end))
+			}
+		})
+	}
+}
+
+// TestMachineCheckMismatch checks that states differing from the machine are
+// rejected.
+func TestMachineCheckMismatch(t *testing.T) {
+	img, err := Assemble(sumSrc)
+	require.NoError(t, err)
+
+	res, err := traceImage(t, img, 4,
+		func(h trace.HintProvider) trace.HintProvider { return h })
+	require.NoError(t, err)
+
+	m := NewMachine(img, 4)
+	require.NoError(t, m.Run(100))
+	require.EqualValues(t, 10, m.Regs[1])
+
+	end := res.Trace[len(res.Trace)-1]
+	require.NoError(t, m.Check(end))
+
+	tamper := func(reg string, v []byte) [][]byte {
+		i, ok := Program.Schema.Index(reg)
+		require.True(t, ok)
+
+		state := append([][]byte{}, end...)
+		state[i] = v
+		return state
+	}
+
+	require.Error(t, m.Check(tamper("r1", num(11))))
+	require.Error(t, m.Check(tamper("ip", num(0))))
+	require.Error(t, m.Check(tamper("mem", make([]byte, 32))))
+
+	// The sum is stored in memory.
+	m.Cells[img.Labels["sum"]] = num(9)
+	require.Error(t, m.Check(end))
+}
+
+// TestBadHints checks that the fetch step rejects decoded fields not matching
+// the fetched instruction.
+func TestBadHints(t *testing.T) {
+	img, err := Assemble("\tLI r1 7\n\tADDI r1 1\n\tHALT\n")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		tamper func(h [][]byte) [][]byte
+	}{
+		{"op", func(h [][]byte) [][]byte {
+			h[0] = num(int64(OpMov))
+			return h
+		}},
+		{"a", func(h [][]byte) [][]byte {
+			h[1] = num(2)
+			return h
+		}},
+		{"b", func(h [][]byte) [][]byte {
+			h[2] = num(8)
+			return h
+		}},
+		{"unknown op", func(h [][]byte) [][]byte {
+			h[0] = num(int64(numOps))
+			return h
+		}},
+		{"fields not bytes", func(h [][]byte) [][]byte {
+			// Encodes to the same word without the fields
+			// being bytes.
+			h[0] = num(65280)
+			h[1] = num(-255)
+			return h
+		}},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			_, err := traceImage(t, img, 0,
+				func(h trace.HintProvider) trace.HintProvider {
+					return func(step, pc int,
+						state [][]byte) ([][]byte, error) {
+
+						hints, err := h(step, pc, state)
+						if err != nil {
+							return nil, err
+						}
+
+						return test.tamper(hints), nil
+					}
+				},
+			)
+
+			var stepErr *trace.StepError
+			require.ErrorAs(t, err, &stepErr)
+		})
+	}
+}
+
+// TestEncode checks that instructions decode to themselves.
+func TestEncode(t *testing.T) {
+	for op := Op(0); op < numOps; op++ {
+		i := Instruction{Op: op, A: 3, B: 2}
+		d, err := Decode(i.Encode())
+		require.NoError(t, err, op)
+		require.Equal(t, i, d)
+	}
+
+	bad := [][]byte{
+		{},
+		num(5),
+		{byte(OpAdd), 1, 0, 1, 0},
+		{byte(OpAdd), 0, 0, 1, 0, 1},
+		{byte(numOps), 1, 0, 1, 0, 1},
+		{byte(OpAdd), 1, NumRegs, 1, 0, 1},
+	}
+	for _, cell := range bad {
+		_, err := Decode(cell)
+		require.Error(t, err, "%x", cell)
+	}
+}
+
+// TestAssembleErrors checks that invalid CPU programs are rejected.
+func TestAssembleErrors(t *testing.T) {
+	for _, src := range []string{
+		"\tADD r1 r4\n",
+		"\tJMP nowhere\n",
+		"\tLI r1 256\n",
+		"\tFOO r1\n",
+		"\tADD r1\n",
+		"a:\tHALT\na:\tHALT\n",
+	} {
+		_, err := Assemble(src)
+		require.Error(t, err, src)
+	}
+}
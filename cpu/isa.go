@@ -0,0 +1,364 @@
+package cpu
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/halseth/mattlab/commitment"
+)
+
+const (
+	// NumRegs is the number of general purpose registers, r0 to r3.
+	NumRegs = 4
+
+	// MemDepth is the depth of the memory tree, holding both code and
+	// data. Its 2^MemDepth cells are all addressable by an operand.
+	MemDepth = 8
+
+	// wordLen is the length of an encoded instruction.
+	wordLen = 6
+)
+
+// Op is an instruction opcode.
+type Op uint8
+
+const (
+	// OpHalt halts the CPU.
+	OpHalt Op = iota
+
+	// OpLI loads the immediate b into register a.
+	OpLI
+
+	// OpMov copies register b into register a.
+	OpMov
+
+	// OpAdd adds register b to register a.
+	OpAdd
+
+	// OpSub subtracts register b from register a.
+	OpSub
+
+	// OpAddI adds the immediate b to register a.
+	OpAddI
+
+	// OpSubI subtracts the immediate b from register a.
+	OpSubI
+
+	// OpLT sets register a to 1 if it is less than register b, 0
+	// otherwise.
+	OpLT
+
+	// OpEq sets register a to 1 if it is equal to register b, 0
+	// otherwise.
+	OpEq
+
+	// OpJmp jumps to the address a.
+	OpJmp
+
+	// OpJZ jumps to the address b if register a is 0.
+	OpJZ
+
+	// OpJNZ jumps to the address b if register a is not 0.
+	OpJNZ
+
+	// OpLoad loads the memory cell at the address in register b into
+	// register a.
+	OpLoad
+
+	// OpStore stores register a in the memory cell at the address in
+	// register b.
+	OpStore
+
+	// numOps is the number of opcodes.
+	numOps
+)
+
+// operand is the kind of an instruction operand.
+type operand uint8
+
+const (
+	none operand = iota
+	reg
+	imm
+)
+
+// opInfo is the mnemonic and operands of an opcode.
+type opInfo struct {
+	name string
+	a, b operand
+}
+
+var ops = [numOps]opInfo{
+	OpHalt:  {"HALT", none, none},
+	OpLI:    {"LI", reg, imm},
+	OpMov:   {"MOV", reg, reg},
+	OpAdd:   {"ADD", reg, reg},
+	OpSub:   {"SUB", reg, reg},
+	OpAddI:  {"ADDI", reg, imm},
+	OpSubI:  {"SUBI", reg, imm},
+	OpLT:    {"LT", reg, reg},
+	OpEq:    {"EQ", reg, reg},
+	OpJmp:   {"JMP", imm, none},
+	OpJZ:    {"JZ", reg, imm},
+	OpJNZ:   {"JNZ", reg, imm},
+	OpLoad:  {"LOAD", reg, reg},
+	OpStore: {"STORE", reg, reg},
+}
+
+// String returns the mnemonic of the opcode.
+func (op Op) String() string {
+	if op >= numOps {
+		return fmt.Sprintf("unknown(%d)", uint8(op))
+	}
+
+	return ops[op].name
+}
+
+// Instruction is a CPU instruction: an opcode and two operands, each a register
+// index or an immediate as given by the opcode.
+type Instruction struct {
+	Op Op
+	A  uint8
+	B  uint8
+}
+
+// Encode returns the memory cell holding the instruction. Each field is
+// encoded as the script number field+256, i.e. as its byte followed by 01,
+// which the decoder can check with a single addition and no byte operations.
+func (i Instruction) Encode() []byte {
+	return []byte{byte(i.Op), 1, i.A, 1, i.B, 1}
+}
+
+// Decode decodes the instruction in the memory cell, checking that its operands
+// are valid for the opcode.
+func Decode(cell []byte) (Instruction, error) {
+	if len(cell) != wordLen || cell[1] != 1 || cell[3] != 1 ||
+		cell[5] != 1 {
+
+		return Instruction{}, fmt.Errorf("cell %x is not an "+
+			"instruction", cell)
+	}
+
+	i := Instruction{
+		Op: Op(cell[0]),
+		A:  cell[2],
+		B:  cell[4],
+	}
+	if err := i.check(); err != nil {
+		return Instruction{}, err
+	}
+
+	return i, nil
+}
+
+// check checks that the instruction has a known opcode, and register operands
+// in range.
+func (i Instruction) check() error {
+	if i.Op >= numOps {
+		return fmt.Errorf("unknown opcode %d", i.Op)
+	}
+
+	info := ops[i.Op]
+	for _, o := range []struct {
+		kind operand
+		v    uint8
+	}{{info.a, i.A}, {info.b, i.B}} {
+		if o.kind == reg && o.v >= NumRegs {
+			return fmt.Errorf("%s: register r%d out of range",
+				i.Op, o.v)
+		}
+	}
+
+	return nil
+}
+
+// String returns the instruction in the assembler syntax.
+func (i Instruction) String() string {
+	if i.Op >= numOps {
+		return fmt.Sprintf("%s %d %d", i.Op, i.A, i.B)
+	}
+
+	s := i.Op.String()
+	info := ops[i.Op]
+	for _, o := range []struct {
+		kind operand
+		v    uint8
+	}{{info.a, i.A}, {info.b, i.B}} {
+		switch o.kind {
+		case reg:
+			s += fmt.Sprintf(" r%d", o.v)
+		case imm:
+			s += fmt.Sprintf(" %d", o.v)
+		}
+	}
+
+	return s
+}
+
+// Image is the initial memory of the CPU: the program code and its data.
+type Image struct {
+	// Cells are the memory cells from address 0, the remaining cells
+	// being empty.
+	Cells [][]byte
+
+	// Labels maps the labels of the source to their address.
+	Labels map[string]int
+}
+
+var (
+	labelRe = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*):`)
+	regRe   = regexp.MustCompile(`^r([0-9]+)$`)
+)
+
+// Assemble assembles a CPU program to its memory image. Each line holds an
+// instruction, optionally preceded by a label, with # comments:
+//
+//		LI r1 0
+//	loop:	JZ r0 done
+//		ADD r1 r0
+//		SUBI r0 1
+//		JMP loop
+//	done:	HALT
+//
+// Registers are written r0 to r3, and immediates as numbers or labels, which
+// stand for the address of the labelled line. A DATA n line holds the script
+// number n instead of an instruction. The CPU starts executing at address 0.
+func Assemble(src string) (*Image, error) {
+	type line struct {
+		num    int
+		fields []string
+	}
+
+	var (
+		img = &Image{
+			Labels: make(map[string]int),
+		}
+		lines   []line
+		scanner = bufio.NewScanner(strings.NewReader(src))
+	)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		text = strings.TrimSpace(text)
+
+		if m := labelRe.FindStringSubmatch(text); m != nil {
+			if _, ok := img.Labels[m[1]]; ok {
+				return nil, fmt.Errorf("line %d: duplicate "+
+					"label %s", lineNum, m[1])
+			}
+
+			img.Labels[m[1]] = len(lines)
+			text = text[len(m[0]):]
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		lines = append(lines, line{lineNum, fields})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(lines) > 1<<MemDepth {
+		return nil, fmt.Errorf("program of %d cells doesn't fit in "+
+			"memory of %d cells", len(lines), 1<<MemDepth)
+	}
+
+	for _, l := range lines {
+		cell, err := img.assembleLine(l.fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", l.num, err)
+		}
+
+		img.Cells = append(img.Cells, cell)
+	}
+
+	return img, nil
+}
+
+// assembleLine returns the memory cell of the line with the given fields.
+func (img *Image) assembleLine(fields []string) ([]byte, error) {
+	if fields[0] == "DATA" {
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("DATA takes a single number")
+		}
+
+		n, err := strconv.ParseInt(fields[1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", fields[1])
+		}
+
+		return commitment.ScriptNum(n).Bytes(), nil
+	}
+
+	op := numOps
+	for o, info := range ops {
+		if info.name == fields[0] {
+			op = Op(o)
+		}
+	}
+	if op == numOps {
+		return nil, fmt.Errorf("unknown instruction %s", fields[0])
+	}
+
+	info := ops[op]
+	var kinds []operand
+	for _, k := range []operand{info.a, info.b} {
+		if k != none {
+			kinds = append(kinds, k)
+		}
+	}
+	if len(fields)-1 != len(kinds) {
+		return nil, fmt.Errorf("%s takes %d operands", op, len(kinds))
+	}
+
+	var vals [2]uint8
+	for i, k := range kinds {
+		v, err := img.operand(k, fields[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", op, err)
+		}
+		vals[i] = v
+	}
+
+	i := Instruction{Op: op, A: vals[0], B: vals[1]}
+	if err := i.check(); err != nil {
+		return nil, err
+	}
+
+	return i.Encode(), nil
+}
+
+// operand parses an operand of the given kind.
+func (img *Image) operand(kind operand, s string) (uint8, error) {
+	if kind == reg {
+		m := regRe.FindStringSubmatch(s)
+		if m == nil {
+			return 0, fmt.Errorf("expected register, got %s", s)
+		}
+
+		n, err := strconv.Atoi(m[1])
+		if err != nil || n >= NumRegs {
+			return 0, fmt.Errorf("unknown register %s", s)
+		}
+
+		return uint8(n), nil
+	}
+
+	if addr, ok := img.Labels[s]; ok {
+		return uint8(addr), nil
+	}
+
+	n, err := strconv.ParseUint(s, 10, 8)
+	if err != nil {
+		return 0, fmt.Errorf("invalid immediate %q, must be a label "+
+			"or a number in [0, 255]", s)
+	}
+
+	return uint8(n), nil
+}
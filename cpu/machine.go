@@ -0,0 +1,213 @@
+package cpu
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/tracer/schema"
+)
+
+// maxValue is the largest magnitude of a register value, which must fit the
+// four bytes numeric opcodes accept.
+const maxValue = 1<<31 - 1
+
+// Machine executes the CPU in Go, as a reference for the step program.
+//
+// NOTE: not safe for concurrent use.
+type Machine struct {
+	// Regs are the general purpose registers.
+	Regs [NumRegs]int64
+
+	// IP is the address of the next instruction.
+	IP int
+
+	// Cells are the memory cells.
+	Cells [][]byte
+
+	// Halted is true once a HALT instruction is executed.
+	Halted bool
+
+	// Steps is the number of instructions executed.
+	Steps int
+}
+
+// NewMachine returns a machine starting to execute the image with the given
+// input in r0.
+func NewMachine(img *Image, input int64) *Machine {
+	m := &Machine{
+		Cells: make([][]byte, 1<<MemDepth),
+	}
+	m.Regs[0] = input
+	for i := range m.Cells {
+		m.Cells[i] = []byte{}
+		if i < len(img.Cells) {
+			m.Cells[i] = img.Cells[i]
+		}
+	}
+
+	return m
+}
+
+// Step executes the next instruction.
+func (m *Machine) Step() error {
+	if m.Halted {
+		return fmt.Errorf("machine halted")
+	}
+
+	if m.IP < 0 || m.IP >= len(m.Cells) {
+		return fmt.Errorf("ip %d out of range", m.IP)
+	}
+
+	i, err := Decode(m.Cells[m.IP])
+	if err != nil {
+		return fmt.Errorf("address %d: %v", m.IP, err)
+	}
+
+	a, b := int64(i.A), int64(i.B)
+	next := m.IP + 1
+	switch i.Op {
+	case OpHalt:
+		m.Halted = true
+		next = m.IP
+	case OpLI:
+		m.Regs[a] = b
+	case OpMov:
+		m.Regs[a] = m.Regs[b]
+	case OpAdd:
+		m.Regs[a] += m.Regs[b]
+	case OpSub:
+		m.Regs[a] -= m.Regs[b]
+	case OpAddI:
+		m.Regs[a] += b
+	case OpSubI:
+		m.Regs[a] -= b
+	case OpLT:
+		m.Regs[a] = boolNum(m.Regs[a] < m.Regs[b])
+	case OpEq:
+		m.Regs[a] = boolNum(m.Regs[a] == m.Regs[b])
+	case OpJmp:
+		next = int(a)
+	case OpJZ:
+		if m.Regs[a] == 0 {
+			next = int(b)
+		}
+	case OpJNZ:
+		if m.Regs[a] != 0 {
+			next = int(b)
+		}
+	case OpLoad:
+		addr, err := m.addr(m.Regs[b])
+		if err != nil {
+			return err
+		}
+
+		m.Regs[a], err = toNum(m.Cells[addr])
+		if err != nil {
+			return fmt.Errorf("address %d: %v", addr, err)
+		}
+	case OpStore:
+		addr, err := m.addr(m.Regs[b])
+		if err != nil {
+			return err
+		}
+
+		m.Cells[addr] = num(m.Regs[a])
+	}
+
+	for k, v := range m.Regs {
+		if v > maxValue || v < -maxValue {
+			return fmt.Errorf("address %d: %s overflows r%d", m.IP,
+				i, k)
+		}
+	}
+
+	m.IP = next
+	m.Steps++
+
+	return nil
+}
+
+// Run executes instructions until the machine halts, at most maxSteps.
+func (m *Machine) Run(maxSteps int) error {
+	for !m.Halted {
+		if m.Steps >= maxSteps {
+			return fmt.Errorf("not halted after %d instructions",
+				maxSteps)
+		}
+
+		if err := m.Step(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check checks that the state of the step program holds the registers, ip and
+// memory of the machine.
+func (m *Machine) Check(state [][]byte) error {
+	s := Program.Schema
+	if err := s.Validate(state); err != nil {
+		return err
+	}
+
+	for k, v := range m.Regs {
+		if !bytes.Equal(state[k], num(v)) {
+			return fmt.Errorf("r%d is %x, expected %d", k, state[k],
+				v)
+		}
+	}
+
+	ip, _ := s.Index("ip")
+	if !bytes.Equal(state[ip], num(int64(m.IP))) {
+		return fmt.Errorf("ip is %x, expected %d", state[ip], m.IP)
+	}
+
+	img := &Image{Cells: m.Cells}
+	mem, err := img.Memory()
+	if err != nil {
+		return err
+	}
+
+	root := mem.Root()
+	if !bytes.Equal(state[Program.Memory.Root], root[:]) {
+		return fmt.Errorf("memory root is %x, expected %x",
+			state[Program.Memory.Root], root[:])
+	}
+
+	return nil
+}
+
+// addr checks that the value is a memory address.
+func (m *Machine) addr(v int64) (int, error) {
+	if v < 0 || v >= int64(len(m.Cells)) {
+		return 0, fmt.Errorf("address %d out of range", v)
+	}
+
+	return int(v), nil
+}
+
+// boolNum returns 1 for true and 0 for false, like the comparison opcodes.
+func boolNum(b bool) int64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// num returns the script number encoding of n.
+func num(n int64) []byte {
+	return commitment.ScriptNum(n).Bytes()
+}
+
+// toNum decodes the script number.
+func toNum(b []byte) (int64, error) {
+	n, err := commitment.MakeScriptNum(b, true, schema.DefaultWidth)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n), nil
+}
@@ -0,0 +1,127 @@
+package loader
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/halseth/mattlab/assembler"
+	"github.com/halseth/mattlab/compiler"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/tapsim/file"
+	"github.com/halseth/tapsim/script"
+)
+
+const (
+	// AsmExt is the extension of step programs in the assembler format.
+	AsmExt = ".asm"
+
+	// SourceExt is the extension of functions in the Go-like language
+	// of the compiler.
+	SourceExt = ".fn"
+)
+
+// LoadProgram loads the program in the file at the given path. The format is
+// chosen by the file extension: AsmExt files are assembled, SourceExt files
+// are compiled, and any other file is read as a program file with one step
+// per line.
+func LoadProgram(path string) (*scripts.Program, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch filepath.Ext(path) {
+	case AsmExt:
+		a, err := assembler.Assemble(string(src))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		return a.Program()
+
+	case SourceExt:
+		c, err := compiler.Compile(string(src))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		return c.Program, nil
+	}
+
+	prog, err := scripts.ReadProgram(bytes.NewReader(src))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return prog, nil
+}
+
+// LoadStartStack reads a start stack in the witness syntax from the file at
+// the given path, e.g. "02 <> <>". Elements may span several lines, and #
+// comments are ignored.
+func LoadStartStack(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return file.ParseScript(data)
+}
+
+// LoadMemory reads the initial memory of the program from the file at the
+// given path. The file lists the values of the first memory cells in the
+// witness syntax of start stacks, e.g. "01 <> ff00", and the remaining cells
+// are empty.
+func LoadMemory(path string, prog *scripts.Program) (*memory.Memory, error) {
+	if prog.Memory == nil {
+		return nil, fmt.Errorf("program has no memory")
+	}
+
+	cells, err := loadElements(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return memory.New(prog.Memory.Depth, cells)
+}
+
+// LoadHintTape reads a hint tape from the file at the given path, listing the
+// prover hints in the witness syntax of start stacks. The steps taking prover
+// hints are given the next hints from the tape in execution order.
+func LoadHintTape(path string) ([][]byte, error) {
+	return loadElements(path)
+}
+
+// loadElements reads the stack elements listed in the witness syntax of start
+// stacks from the file at the given path.
+func loadElements(path string) ([][]byte, error) {
+	elsStr, err := LoadStartStack(path)
+	if err != nil {
+		return nil, err
+	}
+
+	witness, err := script.ParseWitness(elsStr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	// The elements are plain data, there is nothing to sign.
+	signFunc := func(keyID string) ([]byte, error) {
+		return nil, fmt.Errorf("signatures not supported")
+	}
+
+	var els [][]byte
+	for _, gen := range witness {
+		el, err := gen(signFunc)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		els = append(els, el)
+	}
+
+	return els, nil
+}
@@ -0,0 +1,116 @@
+package loader
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/stretchr/testify/require"
+)
+
+const multiplyAsm = `#:	x i pc
+loop:
+	OP_DROP OP_DUP OP_8 OP_LESSTHAN # i < 8
+	OP_IF @body OP_ELSE @halt OP_ENDIF
+body:	OP_DROP OP_1ADD OP_SWAP OP_DUP OP_ADD OP_SWAP @loop
+halt:	OP_NOP
+`
+
+const multiplyFn = `func multiply(x int) int {
+	i := 0
+	while i < 8 {
+		x = x + x
+		i++
+	}
+	return x
+}
+`
+
+// writeFile writes the file to a temporary directory, and returns its path.
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	return path
+}
+
+// TestLoadProgram checks that the multiply program loads from the formats
+// chosen by the file extension.
+func TestLoadProgram(t *testing.T) {
+	want, err := scripts.MultiplyProgram.Hash()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, scripts.WriteProgram(&buf, scripts.MultiplyProgram))
+
+	for _, file := range []struct {
+		name    string
+		content string
+	}{
+		{"multiply" + AsmExt, multiplyAsm},
+		{"multiply.txt", buf.String()},
+		{"multiply", buf.String()},
+	} {
+		prog, err := LoadProgram(writeFile(t, file.name, file.content))
+		require.NoError(t, err, file.name)
+
+		got, err := prog.Hash()
+		require.NoError(t, err)
+		require.Equal(t, want, got, file.name)
+	}
+
+	// The compiled function has the same schema, but its own steps.
+	prog, err := LoadProgram(writeFile(t, "multiply"+SourceExt,
+		multiplyFn))
+	require.NoError(t, err)
+	require.True(t, prog.Schema.Equal(scripts.StateSchema))
+
+	// Each file is read in the format of its extension only.
+	for _, name := range []string{"multiply" + SourceExt, "multiply.txt"} {
+		_, err := LoadProgram(writeFile(t, name, multiplyAsm))
+		require.Error(t, err, name)
+	}
+
+	_, err = LoadProgram(filepath.Join(t.TempDir(), "missing.asm"))
+	require.Error(t, err)
+}
+
+// TestLoadElements checks reading start stacks, memories and hint tapes.
+func TestLoadElements(t *testing.T) {
+	path := writeFile(t, "stack.txt", "02 # x\n<>\n\n<> # pc\n")
+
+	stack, err := LoadStartStack(path)
+	require.NoError(t, err)
+	require.Equal(t, "02 <> <>", stack)
+
+	tape, err := LoadHintTape(path)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{0x02}, {}, {}}, tape)
+
+	_, err = LoadMemory(path, scripts.MultiplyProgram)
+	require.Error(t, err)
+
+	prog := &scripts.Program{
+		Schema: scripts.StateSchema,
+		Steps:  scripts.ScriptSteps,
+		Memory: &scripts.Memory{Depth: 2},
+	}
+	mem, err := LoadMemory(writeFile(t, "cells.txt", "01 <> ff00"), prog)
+	require.NoError(t, err)
+
+	want, err := memory.New(2, [][]byte{{0x01}, {}, {0xff, 0x00}})
+	require.NoError(t, err)
+	require.Equal(t, want.Root(), mem.Root())
+
+	// More cells than fit the memory.
+	_, err = LoadMemory(writeFile(t, "cells.txt", "01 02 03 04 05"), prog)
+	require.Error(t, err)
+
+	_, err = LoadHintTape(writeFile(t, "tape.txt", "0g"))
+	require.Error(t, err)
+}
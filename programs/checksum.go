@@ -0,0 +1,97 @@
+package programs
+
+import (
+	"fmt"
+)
+
+// maxChecksumLen is the maximum length of the checksummed data.
+const maxChecksumLen = 64
+
+// checksumSrc computes a Fletcher-like checksum of the data, without the
+// modulo: a is the sum of its bytes, and s the sum of the a's after each byte.
+// Data can't be split by script, so for each byte the prover gives the rest of
+// the data, the byte b and its value v as hints. The step checks that b is a
+// single byte, that b and the rest make up the data, and that v is the value of
+// b: v+256 is encoded as b followed by 01. The size check is needed, as the
+// encoding check alone accepts a longer b with a v to match.
+const checksumSrc = `#:	data:64 a s pc
+loop:
+	OP_DROP OP_2 OP_PICK OP_SIZE OP_NIP OP_0NOTEQUAL
+	OP_IF @byte OP_ELSE @halt OP_ENDIF
+byte:
+	HINT 3
+	OP_3 OP_ROLL OP_DROP                   # data a s rest v b
+	OP_SIZE OP_1 OP_EQUALVERIFY
+	OP_OVER 0001 OP_ADD OP_1 OP_2 OP_PICK OP_CAT OP_EQUALVERIFY
+	OP_ROT OP_DUP OP_ROT OP_CAT            # data a s v rest b|rest
+	OP_5 OP_ROLL OP_EQUALVERIFY            # a s v rest
+	OP_SWAP OP_3 OP_ROLL OP_ADD OP_ROT OP_OVER OP_ADD
+	@loop
+halt:	OP_NOP
+`
+
+// ChecksumExample checksums byte strings.
+var ChecksumExample = func() *Example {
+	prog := mustAssemble(checksumSrc)
+
+	all := make([]byte, maxChecksumLen)
+	for i := range all {
+		all[i] = byte(i * 4)
+	}
+	data := [][]byte{
+		{},
+		{0x00},
+		{0x01},
+		{0x7f},
+		{0x80},
+		{0xff},
+		{0x00, 0x00, 0x80, 0x00},
+		[]byte("hello, world"),
+		all,
+		append(all[:maxChecksumLen-1], 0xff),
+	}
+
+	var inputs [][][]byte
+	for _, d := range data {
+		inputs = append(inputs, [][]byte{d, num(0), num(0), num(0)})
+	}
+
+	return &Example{
+		Name:    "checksum",
+		Source:  checksumSrc,
+		Program: prog,
+		Inputs:  inputs,
+		Hints: func(_, _ int, state [][]byte) ([][]byte, error) {
+			if len(state) == 0 || len(state[0]) == 0 {
+				return nil, fmt.Errorf("no data left")
+			}
+
+			data := state[0]
+			return [][]byte{
+				data[1:], num(int64(data[0])), data[:1],
+			}, nil
+		},
+		Reference: func(start [][]byte) ([][]byte, error) {
+			if len(start) == 0 || len(start[0]) > maxChecksumLen {
+				return nil, fmt.Errorf("data out of range")
+			}
+
+			a, s := Checksum(start[0])
+			return [][]byte{
+				{}, num(a), num(s), halted(prog),
+			}, nil
+		},
+	}
+}()
+
+// Checksum returns the sum a of the bytes of the data, and the sum s of the
+// partial sums of a after each byte.
+func Checksum(data []byte) (int64, int64) {
+	var a, s int64
+	for _, b := range data {
+		a += int64(b)
+		s += a
+	}
+
+	return a, s
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/halseth/mattlab/cfg"
+	"github.com/halseth/mattlab/programs"
+)
+
+var (
+	name = flag.String("program", "", "name of the example program to "+
+		"check; all if not set")
+	source = flag.Bool("source", false, "print the assembler source of "+
+		"the program instead of checking it")
+)
+
+// Check the example programs: their steps must pass the stack effect check
+// and all be reachable, and tracing them from their inputs must end in the
+// state computed by their reference implementation.
+func main() {
+	flag.Parse()
+	err := run()
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	examples := programs.All
+	if *name != "" {
+		e, err := programs.ByName(*name)
+		if err != nil {
+			return err
+		}
+		examples = []*programs.Example{e}
+	}
+
+	if *source {
+		for _, e := range examples {
+			fmt.Print(e.Source)
+		}
+		return nil
+	}
+
+	ctx := context.Background()
+	for _, e := range examples {
+		if err := e.Program.CheckStackEffects(); err != nil {
+			return fmt.Errorf("%s: %v", e.Name, err)
+		}
+
+		g, err := cfg.Build(e.Program)
+		if err != nil {
+			return fmt.Errorf("%s: %v", e.Name, err)
+		}
+		if pcs := g.Unreachable(); len(pcs) > 0 {
+			return fmt.Errorf("%s: steps %v unreachable", e.Name,
+				pcs)
+		}
+
+		for _, start := range e.Inputs {
+			if err := e.Check(ctx, start); err != nil {
+				return fmt.Errorf("%s from input %x: %v",
+					e.Name, start, err)
+			}
+		}
+
+		fmt.Printf("%s: %d inputs ok\n", e.Name, len(e.Inputs))
+	}
+
+	return nil
+}
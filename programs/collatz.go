@@ -0,0 +1,74 @@
+package programs
+
+import (
+	"fmt"
+)
+
+// collatzSrc counts the steps of the Collatz sequence from n to 1. There is no
+// opcode for the parity of n, so the prover gives n/2 as a hint, and the step
+// checks that n - 2*(n/2) is 0 or 1 before halving n or taking 3n+1.
+const collatzSrc = `#:	n steps pc
+loop:
+	OP_DROP OP_OVER OP_1 OP_GREATERTHAN
+	OP_IF @step OP_ELSE @halt OP_ENDIF
+step:
+	HINT 1
+	OP_SWAP OP_DROP                        # n steps half
+	OP_DUP OP_DUP OP_ADD OP_3 OP_PICK OP_SWAP OP_SUB
+	OP_DUP OP_0 OP_2 OP_WITHIN OP_VERIFY   # n steps half n%2
+	OP_IF
+		OP_DROP OP_SWAP OP_DUP OP_DUP OP_ADD OP_ADD OP_1ADD
+		OP_SWAP
+	OP_ELSE
+		OP_ROT OP_DROP OP_SWAP
+	OP_ENDIF
+	OP_1ADD @loop
+halt:	OP_NOP
+`
+
+// CollatzExample counts Collatz sequence steps.
+var CollatzExample = func() *Example {
+	prog := mustAssemble(collatzSrc)
+	return &Example{
+		Name:    "collatz",
+		Source:  collatzSrc,
+		Program: prog,
+		Inputs:  numInputs(prog, 1, 100),
+		Hints: func(_, _ int, state [][]byte) ([][]byte, error) {
+			n, err := toNum(state, 0)
+			if err != nil {
+				return nil, err
+			}
+
+			return [][]byte{num(n / 2)}, nil
+		},
+		Reference: func(start [][]byte) ([][]byte, error) {
+			n, err := toNum(start, 0)
+			if err != nil {
+				return nil, err
+			}
+			if n <= 0 {
+				return nil, fmt.Errorf("n = %d out of range", n)
+			}
+
+			return [][]byte{
+				num(1), num(CollatzSteps(n)), halted(prog),
+			}, nil
+		},
+	}
+}()
+
+// CollatzSteps returns the number of steps the Collatz sequence takes from the
+// positive number n to 1.
+func CollatzSteps(n int64) int64 {
+	var steps int64
+	for ; n > 1; steps++ {
+		if n%2 == 0 {
+			n /= 2
+		} else {
+			n = 3*n + 1
+		}
+	}
+
+	return steps
+}
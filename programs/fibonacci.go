@@ -0,0 +1,52 @@
+package programs
+
+import (
+	"fmt"
+)
+
+// fibonacciSrc computes the n-th fibonacci number into a, counting n down to
+// zero while stepping a, b = b, a+b. As F(47) doesn't fit a register, n must
+// be at most 45.
+const fibonacciSrc = `#:	n a b pc
+init:	OP_2DROP OP_DROP OP_0 OP_1 @loop
+loop:
+	OP_DROP OP_2 OP_PICK OP_0NOTEQUAL
+	OP_IF @body OP_ELSE @halt OP_ENDIF
+body:	OP_DROP OP_ROT OP_1SUB OP_ROT OP_ROT OP_TUCK OP_ADD @loop
+halt:	OP_NOP
+`
+
+// FibonacciExample computes fibonacci numbers.
+var FibonacciExample = func() *Example {
+	prog := mustAssemble(fibonacciSrc)
+	return &Example{
+		Name:    "fibonacci",
+		Source:  fibonacciSrc,
+		Program: prog,
+		Inputs:  numInputs(prog, 0, 45),
+		Reference: func(start [][]byte) ([][]byte, error) {
+			n, err := toNum(start, 0)
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 || n > 45 {
+				return nil, fmt.Errorf("n = %d out of range", n)
+			}
+
+			a, b := Fibonacci(int(n))
+			return [][]byte{
+				num(0), num(a), num(b), halted(prog),
+			}, nil
+		},
+	}
+}()
+
+// Fibonacci returns the n-th and n+1-th fibonacci numbers, F(0) being 0.
+func Fibonacci(n int) (int64, int64) {
+	a, b := int64(0), int64(1)
+	for i := 0; i < n; i++ {
+		a, b = b, a+b
+	}
+
+	return a, b
+}
@@ -0,0 +1,67 @@
+package programs
+
+import (
+	"fmt"
+)
+
+// gcdSrc computes the greatest common divisor of a and b by Euclid's
+// algorithm, subtracting the smaller number from the larger until they are
+// equal. Both must be positive for the program to halt.
+const gcdSrc = `#:	a b pc
+loop:
+	OP_DROP OP_2DUP OP_NUMEQUAL
+	OP_IF @halt OP_ELSE @sub OP_ENDIF
+sub:
+	OP_DROP OP_2DUP OP_GREATERTHAN
+	OP_IF OP_TUCK OP_SUB OP_SWAP OP_ELSE OP_OVER OP_SUB OP_ENDIF
+	@loop
+halt:	OP_NOP
+`
+
+// GCDExample computes greatest common divisors.
+var GCDExample = func() *Example {
+	prog := mustAssemble(gcdSrc)
+
+	var inputs [][][]byte
+	for a := int64(1); a <= 24; a++ {
+		for b := int64(1); b <= 24; b++ {
+			inputs = append(inputs, [][]byte{
+				num(a), num(b), num(0),
+			})
+		}
+	}
+	inputs = append(inputs, [][]byte{num(1000), num(1), num(0)})
+
+	return &Example{
+		Name:    "gcd",
+		Source:  gcdSrc,
+		Program: prog,
+		Inputs:  inputs,
+		Reference: func(start [][]byte) ([][]byte, error) {
+			a, err := toNum(start, 0)
+			if err != nil {
+				return nil, err
+			}
+			b, err := toNum(start, 1)
+			if err != nil {
+				return nil, err
+			}
+			if a <= 0 || b <= 0 {
+				return nil, fmt.Errorf("gcd of %d and %d never "+
+					"halts", a, b)
+			}
+
+			g := GCD(a, b)
+			return [][]byte{num(g), num(g), halted(prog)}, nil
+		},
+	}
+}()
+
+// GCD returns the greatest common divisor of a and b.
+func GCD(a, b int64) int64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+
+	return a
+}
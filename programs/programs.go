@@ -0,0 +1,167 @@
+package programs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/halseth/mattlab/assembler"
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/halseth/mattlab/tracer/trace"
+)
+
+// Example is a ready-made program, with a reference implementation of what it
+// computes.
+type Example struct {
+	// Name is the name of the example.
+	Name string
+
+	// Source is the assembler source of the program.
+	Source string
+
+	// Program is the step program.
+	Program *scripts.Program
+
+	// Hints provides the prover hints for the steps taking them, nil if
+	// the program has none.
+	Hints trace.HintProvider
+
+	// Inputs are the start states the example is checked from.
+	Inputs [][][]byte
+
+	// Reference returns the state the program halts in from the given
+	// start state, as computed in Go.
+	Reference func(start [][]byte) ([][]byte, error)
+}
+
+// All are the example programs.
+var All = []*Example{
+	FibonacciExample,
+	GCDExample,
+	CollatzExample,
+	SqrtExample,
+	ChecksumExample,
+}
+
+// ByName returns the example with the given name.
+func ByName(name string) (*Example, error) {
+	var names []string
+	for _, e := range All {
+		if e.Name == name {
+			return e, nil
+		}
+		names = append(names, e.Name)
+	}
+
+	return nil, fmt.Errorf("unknown program %q, must be one of %s", name,
+		strings.Join(names, ", "))
+}
+
+// Check traces the program with trace.GetTrace from the given start state,
+// and checks that it halts in the state computed by the reference
+// implementation. Steps failing in the VM are errors.
+func (e *Example) Check(ctx context.Context, start [][]byte) error {
+	want, err := e.Reference(start)
+	if err != nil {
+		return err
+	}
+
+	opts := trace.DefaultOptions()
+	opts.Strict = trace.StrictAbort
+	opts.Hints = e.Hints
+
+	res, err := trace.GetTrace(ctx, e.Program, witness(start), opts)
+	if err != nil {
+		return err
+	}
+
+	end := res.Trace[len(res.Trace)-1]
+	if len(end) != len(want) {
+		return fmt.Errorf("program halted with %d registers, "+
+			"expected %d", len(end), len(want))
+	}
+
+	names := e.Program.Schema.Names()
+	for i := range want {
+		if !bytes.Equal(end[i], want[i]) {
+			return fmt.Errorf("program halted with %s = %x, "+
+				"expected %x", names[i], end[i], want[i])
+		}
+	}
+
+	return nil
+}
+
+// witness returns the state in the witness syntax of start stacks.
+func witness(state [][]byte) string {
+	elements := make([]string, len(state))
+	for i, el := range state {
+		elements[i] = fmt.Sprintf("%x", el)
+		if len(el) == 0 {
+			elements[i] = "<>"
+		}
+	}
+
+	return strings.Join(elements, " ")
+}
+
+// mustAssemble assembles the program source, panicking on errors.
+func mustAssemble(src string) *scripts.Program {
+	a, err := assembler.Assemble(src)
+	if err != nil {
+		panic(err)
+	}
+
+	prog, err := a.Program()
+	if err != nil {
+		panic(err)
+	}
+
+	return prog
+}
+
+// num returns the script number encoding of n.
+func num(n int64) []byte {
+	return commitment.ScriptNum(n).Bytes()
+}
+
+// toNum decodes the script number held by the given register of the state.
+func toNum(state [][]byte, reg int) (int64, error) {
+	if reg >= len(state) {
+		return 0, fmt.Errorf("state has %d registers", len(state))
+	}
+
+	n, err := commitment.MakeScriptNum(state[reg], true,
+		schema.DefaultWidth)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n), nil
+}
+
+// numInputs returns start states with the given numbers in the first
+// register, and all other registers of the schema zero.
+func numInputs(prog *scripts.Program, from, to int64) [][][]byte {
+	var inputs [][][]byte
+	for n := from; n <= to; n++ {
+		start := make([][]byte, prog.Schema.NumRegisters())
+		for i := range start {
+			start[i] = []byte{}
+		}
+		start[0] = num(n)
+
+		inputs = append(inputs, start)
+	}
+
+	return inputs
+}
+
+// halted returns the pc of the halting step of the program as a register
+// value.
+func halted(prog *scripts.Program) []byte {
+	return num(int64(prog.HaltPC()))
+}
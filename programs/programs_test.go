@@ -0,0 +1,105 @@
+package programs
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/halseth/mattlab/cfg"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/stretchr/testify/require"
+)
+
+// TestExamples checks that the example programs pass the static checks, and
+// that tracing them from each of their inputs ends in the state computed by
+// their reference implementation.
+func TestExamples(t *testing.T) {
+	ctx := context.Background()
+	for _, e := range All {
+		e := e
+		t.Run(e.Name, func(t *testing.T) {
+			require.NoError(t, e.Program.CheckStackEffects())
+
+			g, err := cfg.Build(e.Program)
+			require.NoError(t, err)
+			require.Empty(t, g.Unreachable())
+
+			require.NotEmpty(t, e.Inputs)
+			for _, start := range e.Inputs {
+				start := start
+				t.Run(witness(start), func(t *testing.T) {
+					require.NoError(t, e.Check(ctx, start))
+				})
+			}
+		})
+	}
+}
+
+// TestBadHints checks that steps taking prover hints reject hints not
+// matching the state.
+func TestBadHints(t *testing.T) {
+	tests := []struct {
+		name    string
+		program *Example
+		start   string
+		tape    [][]byte
+	}{
+		{
+			// v+256 is encoded as b followed by 01 also for the
+			// two byte b 0000, consuming all the data at once.
+			name:    "checksum multi-byte b",
+			program: ChecksumExample,
+			start:   "0000 <> <> <>",
+			tape:    [][]byte{{}, {0x00, 0xff, 0x00}, {0x00, 0x00}},
+		},
+		{
+			name:    "checksum wrong v",
+			program: ChecksumExample,
+			start:   "01 <> <> <>",
+			tape:    [][]byte{{}, num(2), {0x01}},
+		},
+		{
+			name:    "checksum wrong rest",
+			program: ChecksumExample,
+			start:   "0102 <> <> <>",
+			tape:    [][]byte{{0x03}, num(1), {0x01}},
+		},
+		{
+			name:    "sqrt root too small",
+			program: SqrtExample,
+			start:   fmt.Sprintf("%x <> <> <> <>", num(9)),
+			tape:    [][]byte{num(2)},
+		},
+		{
+			name:    "sqrt root too large",
+			program: SqrtExample,
+			start:   fmt.Sprintf("%x <> <> <> <>", num(9)),
+			tape:    [][]byte{num(4)},
+		},
+		{
+			name:    "collatz wrong half",
+			program: CollatzExample,
+			start:   fmt.Sprintf("%x <> <>", num(6)),
+			tape:    [][]byte{num(2)},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			prog := test.program.Program
+
+			opts := trace.DefaultOptions()
+			opts.Strict = trace.StrictAbort
+			opts.Hints = trace.HintTape(prog, test.tape)
+
+			_, err := trace.GetTrace(
+				context.Background(), prog, test.start, opts,
+			)
+			require.Error(t, err)
+
+			var stepErr *trace.StepError
+			require.ErrorAs(t, err, &stepErr)
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package programs
+
+import (
+	"fmt"
+)
+
+// sqrtSrc computes the integer square root of n. The prover gives the root r
+// as a hint, and the program squares it by repeated addition, as there is no
+// multiplication opcode, to check that r^2 <= n < (r+1)^2.
+const sqrtSrc = `#:	n r i sq pc
+hint:	HINT r OP_DROP @loop
+loop:
+	OP_DROP OP_OVER OP_3 OP_PICK OP_LESSTHAN
+	OP_IF @add OP_ELSE @check OP_ENDIF
+add:	OP_DROP OP_2 OP_PICK OP_ADD OP_SWAP OP_1ADD OP_SWAP @loop
+check:
+	OP_DROP
+	OP_DUP OP_4 OP_PICK OP_LESSTHANOREQUAL OP_VERIFY
+	OP_DUP OP_3 OP_PICK OP_DUP OP_ADD OP_ADD OP_1ADD
+	OP_4 OP_PICK OP_GREATERTHAN OP_VERIFY
+	@halt
+halt:	OP_NOP
+`
+
+// SqrtExample computes integer square roots.
+var SqrtExample = func() *Example {
+	prog := mustAssemble(sqrtSrc)
+	inputs := numInputs(prog, 0, 150)
+	inputs = append(inputs, numInputs(prog, 9990, 10010)...)
+
+	return &Example{
+		Name:    "sqrt",
+		Source:  sqrtSrc,
+		Program: prog,
+		Inputs:  inputs,
+		Hints: func(_, _ int, state [][]byte) ([][]byte, error) {
+			n, err := toNum(state, 0)
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 {
+				return nil, fmt.Errorf("n = %d out of range", n)
+			}
+
+			return [][]byte{num(Sqrt(n))}, nil
+		},
+		Reference: func(start [][]byte) ([][]byte, error) {
+			n, err := toNum(start, 0)
+			if err != nil {
+				return nil, err
+			}
+			if n < 0 {
+				return nil, fmt.Errorf("n = %d out of range", n)
+			}
+
+			r := Sqrt(n)
+			return [][]byte{
+				num(n), num(r), num(r), num(r * r),
+				halted(prog),
+			}, nil
+		},
+	}
+}()
+
+// Sqrt returns the integer square root of the non-negative number n, the
+// largest r such that r^2 <= n.
+func Sqrt(n int64) int64 {
+	r := int64(0)
+	for (r+1)*(r+1) <= n {
+		r++
+	}
+
+	return r
+}
@@ -0,0 +1,333 @@
+package analysis
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/halseth/mattlab/commitment"
+)
+
+const (
+	// maxStates is the number of execution states followed before states
+	// of the same shape are merged, losing values that differ between
+	// them.
+	maxStates = 64
+
+	// maxPaths is the number of execution states after merging at which
+	// the analysis gives up.
+	maxPaths = 4096
+
+	// maxNumLen is the maximum number of bytes of a stack element
+	// interpreted as a number.
+	maxNumLen = 4
+)
+
+// Value is an abstract stack element: either a value known to be the same in
+// every execution, or an unknown value.
+type Value struct {
+	// Known is true if the value is known.
+	Known bool
+
+	// Bytes is the value if it is known.
+	Bytes []byte
+
+	// ID identifies an unknown value. Unknown values with the same ID
+	// are the same value, e.g. a register and its copy.
+	ID int
+}
+
+// Const returns the known value.
+func Const(b []byte) Value {
+	return Value{
+		Known: true,
+		Bytes: b,
+	}
+}
+
+// Num returns the known value of the number.
+func Num(n int64) Value {
+	return Const(commitment.ScriptNum(n).Bytes())
+}
+
+// Unknowns returns n distinct unknown values, to start the analysis from.
+func Unknowns(n int) []Value {
+	vals := make([]Value, n)
+	for i := range vals {
+		vals[i] = Value{ID: i + 1}
+	}
+
+	return vals
+}
+
+// Int returns the number the value encodes, and false if the value is unknown
+// or not a minimally encoded number.
+func (v Value) Int() (int64, bool) {
+	if !v.Known {
+		return 0, false
+	}
+
+	n, err := commitment.MakeScriptNum(v.Bytes, true, maxNumLen)
+	if err != nil {
+		return 0, false
+	}
+
+	return int64(n), true
+}
+
+// equal returns true if the values are the same known value, or the same
+// unknown value.
+func (v Value) equal(o Value) bool {
+	if v.Known != o.Known {
+		return false
+	}
+
+	if !v.Known {
+		return v.ID == o.ID
+	}
+
+	return string(v.Bytes) == string(o.Bytes)
+}
+
+// UnderflowError is the error of a path taking more elements from the stack or
+// the alt stack than it holds.
+type UnderflowError struct {
+	// Alt is true if the alt stack underflows.
+	Alt bool
+
+	// Needed is the number of elements needed, and Held the number of
+	// elements on the stack.
+	Needed int
+	Held   int
+}
+
+// Error returns the error message.
+func (e *UnderflowError) Error() string {
+	stack := "stack"
+	if e.Alt {
+		stack = "alt stack"
+	}
+
+	return fmt.Sprintf("%s underflow, %d elements needed, %d on %s",
+		stack, e.Needed, e.Held, stack)
+}
+
+// Path is the outcome of the executions of a script taking the same branches,
+// or of several such paths merged into one.
+type Path struct {
+	// Stack is the stack at the end of the path.
+	Stack []Value
+
+	// Alt is the number of elements left on the alt stack at the end of
+	// the path.
+	Alt int
+
+	// Consumed is the number of start stack elements removed from the
+	// stack at some point of the path, moved elements included.
+	Consumed int
+
+	// MaxDepth is the largest number of elements on the stack during the
+	// path.
+	MaxDepth int
+
+	// MaxAlt is the largest number of elements on the alt stack during
+	// the path.
+	MaxAlt int
+
+	// Err is the reason the path always fails, nil if it may succeed.
+	Err error
+
+	// Op is the index of the opcode the path fails at.
+	Op int
+
+	// start is the size of the start stack.
+	start int
+}
+
+// Produced returns the number of elements the path leaves on the stack in
+// place of the consumed ones.
+func (p *Path) Produced() int {
+	return len(p.Stack) - (p.start - p.Consumed)
+}
+
+// Analyze symbolically executes the script from the start stack, following
+// both branches of conditionals on unknown values. It returns the paths
+// through the script, the failing ones included. Branches taken on the same
+// unknown value are assumed to agree, and paths contradicting an earlier
+// branch fail.
+//
+// An error is returned if the script cannot be analyzed: if it doesn't parse,
+// uses opcodes unknown to the analysis, picks or rolls by an unknown depth, or
+// has too many paths to follow.
+func Analyze(pkScript []byte, start []Value) ([]*Path, error) {
+	a := &analyzer{}
+	for _, v := range start {
+		a.next = max(a.next, v.ID)
+	}
+
+	states := []*state{{
+		stk:      append([]Value{}, start...),
+		assume:   make(map[int]bool),
+		start:    len(start),
+		low:      len(start),
+		maxDepth: len(start),
+	}}
+
+	var (
+		paths     []*Path
+		idx       int
+		tokenizer = txscript.MakeScriptTokenizer(0, pkScript)
+	)
+	for ; tokenizer.Next(); idx++ {
+		op := tokenizer.Opcode()
+		data := tokenizer.Data()
+
+		var next []*state
+		for _, s := range states {
+			forks, err := a.step(s, op, data)
+			if err != nil {
+				return nil, fmt.Errorf("opcode %d: %v", idx, err)
+			}
+
+			for _, f := range forks {
+				if f.err != nil {
+					paths = append(paths, f.path(idx))
+					continue
+				}
+
+				next = append(next, f)
+			}
+		}
+
+		states = next
+		if len(states) > maxStates {
+			states = a.merge(states)
+		}
+		if len(states) > maxPaths {
+			return nil, fmt.Errorf("more than %d paths through "+
+				"script", maxPaths)
+		}
+	}
+	if err := tokenizer.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, s := range states {
+		if len(s.cond) != 0 {
+			s.err = fmt.Errorf("unbalanced conditional")
+		}
+
+		paths = append(paths, s.path(idx))
+	}
+
+	return paths, nil
+}
+
+// analyzer holds the state shared by the paths of an analysis.
+type analyzer struct {
+	// next is the last ID given to an unknown value.
+	next int
+}
+
+// fresh returns a new unknown value.
+func (a *analyzer) fresh() Value {
+	a.next++
+	return Value{ID: a.next}
+}
+
+// state is the abstract VM state of a path.
+type state struct {
+	stk []Value
+	alt []Value
+
+	// cond is the condition stack, with values as in txscript.
+	cond []int
+
+	// assume holds the truth of the unknown values branched on or
+	// verified so far, by ID.
+	assume map[int]bool
+
+	// start is the size of the start stack, and low the smallest size
+	// of the stack so far.
+	start    int
+	low      int
+	maxDepth int
+	maxAlt   int
+
+	err error
+}
+
+// copy returns a copy of the state.
+func (s *state) copy() *state {
+	c := *s
+	c.stk = append([]Value{}, s.stk...)
+	c.alt = append([]Value{}, s.alt...)
+	c.cond = append([]int{}, s.cond...)
+	c.assume = make(map[int]bool, len(s.assume))
+	for id, v := range s.assume {
+		c.assume[id] = v
+	}
+
+	return &c
+}
+
+// path returns the path ending in the state, failing at the given opcode if
+// the state failed.
+func (s *state) path(idx int) *Path {
+	return &Path{
+		Stack:    s.stk,
+		Alt:      len(s.alt),
+		Consumed: s.start - s.low,
+		MaxDepth: s.maxDepth,
+		MaxAlt:   s.maxAlt,
+		Err:      s.err,
+		Op:       idx,
+		start:    s.start,
+	}
+}
+
+// shape is the part of a state that must match for states to be merged.
+func (s *state) shape() string {
+	return fmt.Sprintf("%d %d %v", len(s.stk), len(s.alt), s.cond)
+}
+
+// merge merges the states of the same shape, keeping the values equal in all
+// of them and the assumptions they agree on.
+func (a *analyzer) merge(states []*state) []*state {
+	var (
+		merged []*state
+		byKey  = make(map[string]*state)
+	)
+	for _, s := range states {
+		m, ok := byKey[s.shape()]
+		if !ok {
+			m = s.copy()
+			byKey[s.shape()] = m
+			merged = append(merged, m)
+			continue
+		}
+
+		a.mergeValues(m.stk, s.stk)
+		a.mergeValues(m.alt, s.alt)
+		for id, v := range m.assume {
+			if w, ok := s.assume[id]; !ok || w != v {
+				delete(m.assume, id)
+			}
+		}
+
+		m.low = min(m.low, s.low)
+		m.maxDepth = max(m.maxDepth, s.maxDepth)
+		m.maxAlt = max(m.maxAlt, s.maxAlt)
+	}
+
+	return merged
+}
+
+// mergeValues replaces the values differing from the other values by fresh
+// unknown values.
+func (a *analyzer) mergeValues(vals, other []Value) {
+	for i := range vals {
+		if !vals[i].equal(other[i]) {
+			vals[i] = a.fresh()
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package analysis
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/tapsim/script"
+	"github.com/stretchr/testify/require"
+)
+
+// analyze parses the script and analyzes it from the start stack.
+func analyze(t *testing.T, scr string, start []Value) []*Path {
+	t.Helper()
+
+	pkScript, err := script.Parse(scr)
+	require.NoError(t, err)
+
+	paths, err := Analyze(pkScript, start)
+	require.NoError(t, err, scr)
+
+	return paths
+}
+
+// succeeding returns the paths that may succeed.
+func succeeding(paths []*Path) []*Path {
+	var ok []*Path
+	for _, p := range paths {
+		if p.Err == nil {
+			ok = append(ok, p)
+		}
+	}
+
+	return ok
+}
+
+// TestKnownValues checks that scripts executed from known values give the
+// single path the script engine executes, with its end stack.
+func TestKnownValues(t *testing.T) {
+	tests := []struct {
+		script string
+		start  [][]byte
+	}{
+		{"OP_2 OP_3 OP_ADD", nil},
+		{"OP_DUP OP_8 OP_LESSTHAN OP_IF OP_1 OP_ELSE OP_2 OP_ENDIF",
+			[][]byte{{5}}},
+		{"OP_DUP OP_8 OP_LESSTHAN OP_IF OP_1 OP_ELSE OP_2 OP_ENDIF",
+			[][]byte{{9}}},
+		{"OP_SWAP OP_DUP OP_ADD OP_SWAP OP_1SUB", [][]byte{{3}, {4}}},
+		{"OP_ROT OP_ROT OP_2DUP OP_CAT OP_SIZE",
+			[][]byte{{1}, {2}, {3}}},
+		{"OP_TOALTSTACK OP_NEGATE OP_FROMALTSTACK OP_MAX",
+			[][]byte{{7}, {2}}},
+		{"OP_1 OP_PICK OP_2 OP_ROLL OP_WITHIN", [][]byte{{3}, {1}, {5}}},
+		{"OP_DUP OP_0NOTEQUAL OP_NOTIF OP_1ADD OP_ENDIF OP_ABS",
+			[][]byte{{}}},
+	}
+
+	harness := execute.NewHarness()
+	for _, test := range tests {
+		start := make([]Value, len(test.start))
+		for i, el := range test.start {
+			start[i] = Const(el)
+		}
+
+		paths := analyze(t, test.script, start)
+		require.Len(t, paths, 1, test.script)
+		require.NoError(t, paths[0].Err, test.script)
+
+		pkScript, err := script.Parse(test.script)
+		require.NoError(t, err)
+		want, err := harness.ExecuteStep(pkScript, test.start)
+		require.True(t, execute.IsBenign(err), test.script)
+
+		got := paths[0].Stack
+		require.Len(t, got, len(want), test.script)
+		for i := range want {
+			require.True(t, got[i].Known, test.script)
+			require.True(t, bytes.Equal(want[i], got[i].Bytes),
+				"%s: element %d is %x, expected %x",
+				test.script, i, got[i].Bytes, want[i])
+		}
+	}
+}
+
+// TestBranches checks that conditionals on unknown values are followed both
+// ways, and that later branches on the same value agree with the first.
+func TestBranches(t *testing.T) {
+	start := Unknowns(1)
+
+	paths := analyze(t, "OP_IF OP_1 OP_ELSE OP_2 OP_ENDIF", start)
+	require.Len(t, paths, 2)
+	require.Equal(t, []Value{Num(1)}, paths[0].Stack)
+	require.Equal(t, []Value{Num(2)}, paths[1].Stack)
+
+	// The second branch on the value agrees with the first, giving two
+	// paths rather than four.
+	paths = analyze(t, "OP_DUP OP_IF OP_1 OP_ELSE OP_2 OP_ENDIF "+
+		"OP_SWAP OP_NOTIF OP_3 OP_ELSE OP_4 OP_ENDIF", start)
+	require.Len(t, paths, 2)
+	require.Equal(t, []Value{Num(1), Num(4)}, paths[0].Stack)
+	require.Equal(t, []Value{Num(2), Num(3)}, paths[1].Stack)
+
+	// Verifying the value contradicts the false branch.
+	paths = analyze(t, "OP_DUP OP_IF OP_1 OP_ELSE OP_DUP OP_VERIFY "+
+		"OP_ENDIF", start)
+	require.Len(t, paths, 2)
+	require.Len(t, succeeding(paths), 1)
+	require.Equal(t, []Value{start[0], Num(1)},
+		succeeding(paths)[0].Stack)
+
+	// A verified value is only followed one way.
+	paths = analyze(t, "OP_DUP OP_VERIFY OP_IF OP_1 OP_ELSE OP_2 "+
+		"OP_ENDIF", start)
+	require.Len(t, paths, 1)
+	require.Equal(t, []Value{Num(1)}, paths[0].Stack)
+}
+
+// TestUnknownValues checks that copies of unknown values keep their identity,
+// and that results computed from them are new unknown values.
+func TestUnknownValues(t *testing.T) {
+	start := Unknowns(2)
+
+	for _, scr := range []string{"OP_OVER OP_DUP OP_ADD", "OP_2DUP OP_EQUAL",
+		"OP_OVER OP_SHA256"} {
+
+		paths := analyze(t, scr, start)
+		require.Len(t, paths, 1, scr)
+		stk := paths[0].Stack
+		require.Len(t, stk, 3, scr)
+		require.Equal(t, start, stk[:2], scr)
+		require.False(t, stk[2].Known, scr)
+		require.NotEqual(t, start[0].ID, stk[2].ID, scr)
+		require.NotEqual(t, start[1].ID, stk[2].ID, scr)
+	}
+
+	// Values are equal to their copies.
+	paths := analyze(t, "OP_DUP OP_EQUAL", start)
+	require.Len(t, paths, 1)
+	require.Equal(t, []Value{start[0], Num(1)}, paths[0].Stack)
+
+	_, ok := start[0].Int()
+	require.False(t, ok)
+}
+
+// TestStackEffects checks the consumed and produced elements and the stack
+// depths of paths.
+func TestStackEffects(t *testing.T) {
+	tests := []struct {
+		script   string
+		consumed int
+		produced int
+		maxDepth int
+		maxAlt   int
+	}{
+		{"OP_NOP", 0, 0, 3, 0},
+		{"OP_DROP OP_1", 1, 1, 3, 0},
+		{"OP_DUP OP_DUP OP_2DROP", 0, 0, 5, 0},
+		{"OP_ADD OP_ADD OP_1 OP_2", 3, 3, 3, 0},
+		{"OP_TOALTSTACK OP_TOALTSTACK OP_FROMALTSTACK OP_FROMALTSTACK",
+			2, 2, 3, 2},
+		{"OP_2 OP_ROLL", 3, 3, 4, 0},
+		{"OP_SWAP", 2, 2, 3, 0},
+	}
+
+	for _, test := range tests {
+		paths := analyze(t, test.script, Unknowns(3))
+		require.Len(t, paths, 1, test.script)
+
+		p := paths[0]
+		require.NoError(t, p.Err, test.script)
+		require.Equal(t, test.consumed, p.Consumed, test.script)
+		require.Equal(t, test.produced, p.Produced(), test.script)
+		require.Equal(t, test.maxDepth, p.MaxDepth, test.script)
+		require.Equal(t, test.maxAlt, p.MaxAlt, test.script)
+		require.Zero(t, p.Alt, test.script)
+	}
+}
+
+// TestFailingPaths checks that paths that always fail are returned with the
+// reason and the opcode they fail at.
+func TestFailingPaths(t *testing.T) {
+	tests := []struct {
+		script string
+		op     int
+		err    string
+	}{
+		{"OP_DROP OP_DROP OP_ADD", 2, "stack underflow, 2 elements " +
+			"needed, 0 on stack"},
+		{"OP_FROMALTSTACK", 0, "alt stack underflow"},
+		{"OP_0 OP_VERIFY", 1, "OP_VERIFY failed"},
+		{"OP_1 OP_2 OP_NUMEQUALVERIFY", 2, "OP_NUMEQUALVERIFY failed"},
+		{"OP_2 OP_IF OP_ENDIF", 1, "must be empty or 1"},
+		{"OP_ELSE", 0, "without OP_IF"},
+		{"OP_1 OP_IF", 2, "unbalanced conditional"},
+		{"OP_RETURN", 0, "OP_RETURN"},
+		{"OP_1NEGATE OP_PICK", 1, "out of range"},
+		{"0102030405 OP_1ADD", 1, "is not a number"},
+	}
+
+	for _, test := range tests {
+		paths := analyze(t, test.script, Unknowns(2))
+		require.Len(t, paths, 1, test.script)
+		require.ErrorContains(t, paths[0].Err, test.err, test.script)
+		require.Equal(t, test.op, paths[0].Op, test.script)
+	}
+
+	paths := analyze(t, "OP_DROP OP_DROP OP_ADD", Unknowns(2))
+	var underflow *UnderflowError
+	require.ErrorAs(t, paths[0].Err, &underflow)
+	require.Equal(t, &UnderflowError{Needed: 2, Held: 0}, underflow)
+}
+
+// TestMerge checks that paths of the same shape are merged once there are too
+// many, keeping the values they agree on.
+func TestMerge(t *testing.T) {
+	// Each conditional doubles the paths, all leaving 7 below a count of
+	// the branches taken.
+	script := func(n int) string {
+		return strings.TrimSpace(
+			strings.Repeat("OP_ROT OP_IF OP_1ADD OP_ENDIF ", n),
+		)
+	}
+	start := append(Unknowns(7), Num(7), Num(0))
+
+	// 64 paths are followed separately.
+	paths := analyze(t, script(6), start)
+	require.Len(t, paths, maxStates)
+	for _, p := range paths {
+		require.Len(t, p.Stack, 3)
+		require.Equal(t, Num(7), p.Stack[1])
+		_, ok := p.Stack[2].Int()
+		require.True(t, ok)
+	}
+
+	// The 128 paths of the last conditional are merged into one per
+	// branch, losing the count.
+	paths = analyze(t, script(7), start)
+	require.Len(t, paths, 2)
+	for _, p := range paths {
+		require.Len(t, p.Stack, 2)
+		require.Equal(t, Num(7), p.Stack[0])
+		require.False(t, p.Stack[1].Known)
+	}
+}
+
+// TestAnalyzeErrors checks that scripts the analysis can't follow are errors.
+func TestAnalyzeErrors(t *testing.T) {
+	tests := []struct {
+		script string
+		err    string
+	}{
+		{"OP_PICK", "by unknown depth"},
+		{"OP_DUP OP_ROLL", "by unknown depth"},
+		{"OP_MUL", "not supported"},
+	}
+
+	for _, test := range tests {
+		pkScript, err := script.Parse(test.script)
+		require.NoError(t, err)
+
+		_, err = Analyze(pkScript, Unknowns(3))
+		require.ErrorContains(t, err, test.err, test.script)
+	}
+
+	// A truncated push doesn't parse.
+	_, err := Analyze([]byte{0x05, 0x01}, nil)
+	require.Error(t, err)
+}
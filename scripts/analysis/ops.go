@@ -0,0 +1,601 @@
+package analysis
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// executing returns true if the state is in an executing branch.
+func (s *state) executing() bool {
+	return len(s.cond) == 0 || s.cond[len(s.cond)-1] == txscript.OpCondTrue
+}
+
+// fail marks the state as failing.
+func (s *state) fail(format string, args ...interface{}) {
+	if s.err == nil {
+		s.err = fmt.Errorf(format, args...)
+	}
+}
+
+// underflow fails the state for needing more elements than the stack holds.
+func (s *state) underflow(alt bool, needed, held int) {
+	if s.err == nil {
+		s.err = &UnderflowError{
+			Alt:    alt,
+			Needed: needed,
+			Held:   held,
+		}
+	}
+}
+
+// need checks that the stack has at least n elements, failing the state
+// otherwise.
+func (s *state) need(n int) bool {
+	if len(s.stk) < n {
+		s.underflow(false, n, len(s.stk))
+		return false
+	}
+
+	return true
+}
+
+func (s *state) push(vals ...Value) {
+	s.stk = append(s.stk, vals...)
+	s.maxDepth = max(s.maxDepth, len(s.stk))
+}
+
+// remove removes the element idx from the top of the stack and returns it.
+func (s *state) remove(idx int) Value {
+	i := len(s.stk) - idx - 1
+	v := s.stk[i]
+	s.stk = append(s.stk[:i], s.stk[i+1:]...)
+	s.low = min(s.low, i)
+
+	return v
+}
+
+// pop pops n elements, and returns them bottom element first. It fails the
+// state and returns nil if the stack holds fewer.
+func (s *state) pop(n int) []Value {
+	if !s.need(n) {
+		return nil
+	}
+
+	vals := append([]Value{}, s.stk[len(s.stk)-n:]...)
+	s.stk = s.stk[:len(s.stk)-n]
+	s.low = min(s.low, len(s.stk))
+
+	return vals
+}
+
+// peek returns the element idx from the top of the stack.
+func (s *state) peek(idx int) (Value, bool) {
+	if !s.need(idx + 1) {
+		return Value{}, false
+	}
+
+	return s.stk[len(s.stk)-idx-1], true
+}
+
+// truth returns the truth of the value, and false if it is not known in the
+// state.
+func (s *state) truth(v Value) (bool, bool) {
+	if v.Known {
+		return asBool(v.Bytes), true
+	}
+
+	t, ok := s.assume[v.ID]
+	return t, ok
+}
+
+// asBool interprets the stack element as a boolean.
+func asBool(t []byte) bool {
+	for i := range t {
+		if t[i] != 0 {
+			// Negative 0 is also considered false.
+			if i == len(t)-1 && t[i] == 0x80 {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// boolValue returns the known value of the boolean.
+func boolValue(b bool) Value {
+	if b {
+		return Const([]byte{1})
+	}
+
+	return Const(nil)
+}
+
+// opName returns the name of the opcode.
+func opName(op byte) string {
+	name, err := txscript.DisasmString([]byte{op})
+	if err != nil {
+		return fmt.Sprintf("0x%02x", op)
+	}
+
+	return name
+}
+
+// step executes a single opcode in the state. It returns the states following
+// it, two if the opcode branches on an unknown value. Failing states have
+// their error set.
+func (a *analyzer) step(s *state, op byte, data []byte) ([]*state, error) {
+	// Conditionals are executed also in non-executing branches.
+	switch op {
+	case txscript.OP_IF, txscript.OP_NOTIF:
+		if !s.executing() {
+			s.cond = append(s.cond, txscript.OpCondSkip)
+			return []*state{s}, nil
+		}
+
+		vals := s.pop(1)
+		if vals == nil {
+			return []*state{s}, nil
+		}
+		v := vals[0]
+
+		// Minimal if is always enforced for tapscript.
+		if v.Known && (len(v.Bytes) > 1 ||
+			(len(v.Bytes) == 1 && v.Bytes[0] != 1)) {
+
+			s.fail("%s argument must be empty or 1", opName(op))
+			return []*state{s}, nil
+		}
+
+		branch := func(s *state, t bool) *state {
+			cond := txscript.OpCondFalse
+			if t != (op == txscript.OP_NOTIF) {
+				cond = txscript.OpCondTrue
+			}
+			s.cond = append(s.cond, cond)
+
+			return s
+		}
+
+		if t, ok := s.truth(v); ok {
+			return []*state{branch(s, t)}, nil
+		}
+
+		f := s.copy()
+		s.assume[v.ID] = true
+		f.assume[v.ID] = false
+
+		return []*state{branch(s, true), branch(f, false)}, nil
+
+	case txscript.OP_ELSE:
+		if len(s.cond) == 0 {
+			s.fail("OP_ELSE without OP_IF")
+			return []*state{s}, nil
+		}
+
+		i := len(s.cond) - 1
+		switch s.cond[i] {
+		case txscript.OpCondTrue:
+			s.cond[i] = txscript.OpCondFalse
+		case txscript.OpCondFalse:
+			s.cond[i] = txscript.OpCondTrue
+		}
+		return []*state{s}, nil
+
+	case txscript.OP_ENDIF:
+		if len(s.cond) == 0 {
+			s.fail("OP_ENDIF without OP_IF")
+			return []*state{s}, nil
+		}
+
+		s.cond = s.cond[:len(s.cond)-1]
+		return []*state{s}, nil
+	}
+
+	if !s.executing() {
+		return []*state{s}, nil
+	}
+
+	// OP_IFDUP branches on its argument like OP_IF.
+	if op == txscript.OP_IFDUP {
+		v, ok := s.peek(0)
+		if !ok {
+			return []*state{s}, nil
+		}
+
+		t, ok := s.truth(v)
+		if ok {
+			if t {
+				s.push(v)
+			}
+			return []*state{s}, nil
+		}
+
+		f := s.copy()
+		s.assume[v.ID] = true
+		f.assume[v.ID] = false
+		s.push(v)
+
+		return []*state{s, f}, nil
+	}
+
+	if err := a.exec(s, op, data); err != nil {
+		return nil, err
+	}
+	s.maxAlt = max(s.maxAlt, len(s.alt))
+
+	return []*state{s}, nil
+}
+
+// exec executes a non-conditional opcode in an executing branch.
+func (a *analyzer) exec(s *state, op byte, data []byte) error {
+	switch {
+	case op <= txscript.OP_PUSHDATA4:
+		s.push(Const(data))
+		return nil
+
+	case op == txscript.OP_1NEGATE:
+		s.push(Num(-1))
+		return nil
+
+	case op >= txscript.OP_1 && op <= txscript.OP_16:
+		s.push(Num(int64(op - txscript.OP_1 + 1)))
+		return nil
+	}
+
+	switch op {
+	case txscript.OP_NOP, txscript.OP_NOP1, txscript.OP_NOP4,
+		txscript.OP_NOP5, txscript.OP_NOP6, txscript.OP_NOP7,
+		txscript.OP_NOP8, txscript.OP_NOP9, txscript.OP_NOP10,
+		txscript.OP_CODESEPARATOR:
+
+	case txscript.OP_CHECKLOCKTIMEVERIFY, txscript.OP_CHECKSEQUENCEVERIFY:
+		s.need(1)
+
+	case txscript.OP_RETURN:
+		s.fail("OP_RETURN")
+
+	case txscript.OP_VERIFY:
+		vals := s.pop(1)
+		if vals != nil {
+			s.verify(vals[0], op)
+		}
+
+	case txscript.OP_TOALTSTACK:
+		if vals := s.pop(1); vals != nil {
+			s.alt = append(s.alt, vals[0])
+		}
+
+	case txscript.OP_FROMALTSTACK:
+		if len(s.alt) == 0 {
+			s.underflow(true, 1, 0)
+			return nil
+		}
+		s.push(s.alt[len(s.alt)-1])
+		s.alt = s.alt[:len(s.alt)-1]
+
+	case txscript.OP_DROP, txscript.OP_2DROP:
+		n := 1
+		if op == txscript.OP_2DROP {
+			n = 2
+		}
+		s.pop(n)
+
+	case txscript.OP_DUP, txscript.OP_2DUP, txscript.OP_3DUP:
+		n := 1
+		switch op {
+		case txscript.OP_2DUP:
+			n = 2
+		case txscript.OP_3DUP:
+			n = 3
+		}
+		if s.need(n) {
+			s.push(s.stk[len(s.stk)-n:]...)
+		}
+
+	case txscript.OP_OVER, txscript.OP_2OVER:
+		n := 1
+		if op == txscript.OP_2OVER {
+			n = 2
+		}
+		if s.need(2 * n) {
+			l := len(s.stk)
+			s.push(s.stk[l-2*n : l-n]...)
+		}
+
+	case txscript.OP_NIP:
+		if s.need(2) {
+			s.remove(1)
+		}
+
+	case txscript.OP_SWAP, txscript.OP_2SWAP:
+		n := 1
+		if op == txscript.OP_2SWAP {
+			n = 2
+		}
+		if vals := s.pop(2 * n); vals != nil {
+			s.push(vals[n:]...)
+			s.push(vals[:n]...)
+		}
+
+	case txscript.OP_ROT, txscript.OP_2ROT:
+		n := 1
+		if op == txscript.OP_2ROT {
+			n = 2
+		}
+		if vals := s.pop(3 * n); vals != nil {
+			s.push(vals[n:]...)
+			s.push(vals[:n]...)
+		}
+
+	case txscript.OP_TUCK:
+		if vals := s.pop(2); vals != nil {
+			s.push(vals[1], vals[0], vals[1])
+		}
+
+	case txscript.OP_PICK, txscript.OP_ROLL:
+		vals := s.pop(1)
+		if vals == nil {
+			return nil
+		}
+
+		if !vals[0].Known {
+			return fmt.Errorf("%s by unknown depth", opName(op))
+		}
+
+		n, ok := vals[0].Int()
+		if !ok || n < 0 {
+			s.fail("%s depth %x out of range", opName(op),
+				vals[0].Bytes)
+			return nil
+		}
+
+		v, ok := s.peek(int(n))
+		if !ok {
+			return nil
+		}
+		if op == txscript.OP_ROLL {
+			s.remove(int(n))
+		}
+		s.push(v)
+
+	case txscript.OP_DEPTH:
+		// The step is executed on top of other elements in leaf
+		// scripts, so the depth differs between executions.
+		s.push(a.fresh())
+
+	case txscript.OP_SIZE:
+		v, ok := s.peek(0)
+		if !ok {
+			return nil
+		}
+		if v.Known {
+			s.push(Num(int64(len(v.Bytes))))
+		} else {
+			s.push(a.fresh())
+		}
+
+	case txscript.OP_CAT:
+		vals := s.pop(2)
+		if vals == nil {
+			return nil
+		}
+
+		// The top element comes first in the concatenation.
+		if vals[0].Known && vals[1].Known {
+			b := append([]byte{}, vals[1].Bytes...)
+			s.push(Const(append(b, vals[0].Bytes...)))
+		} else {
+			s.push(a.fresh())
+		}
+
+	case txscript.OP_EQUAL, txscript.OP_EQUALVERIFY:
+		vals := s.pop(2)
+		if vals == nil {
+			return nil
+		}
+
+		eq := a.fresh()
+		switch {
+		case vals[0].equal(vals[1]):
+			eq = boolValue(true)
+		case vals[0].Known && vals[1].Known:
+			eq = boolValue(false)
+		}
+
+		if op == txscript.OP_EQUALVERIFY {
+			s.verify(eq, op)
+			return nil
+		}
+		s.push(eq)
+
+	case txscript.OP_1ADD, txscript.OP_1SUB, txscript.OP_NEGATE,
+		txscript.OP_ABS, txscript.OP_NOT, txscript.OP_0NOTEQUAL:
+
+		nums, ok := s.popNums(1, op)
+		if !ok {
+			return nil
+		}
+		if nums == nil {
+			s.push(a.fresh())
+			return nil
+		}
+
+		n := nums[0]
+		switch op {
+		case txscript.OP_1ADD:
+			n++
+		case txscript.OP_1SUB:
+			n--
+		case txscript.OP_NEGATE:
+			n = -n
+		case txscript.OP_ABS:
+			if n < 0 {
+				n = -n
+			}
+		case txscript.OP_NOT:
+			n = boolNum(n == 0)
+		case txscript.OP_0NOTEQUAL:
+			n = boolNum(n != 0)
+		}
+		s.push(Num(n))
+
+	case txscript.OP_ADD, txscript.OP_SUB, txscript.OP_BOOLAND,
+		txscript.OP_BOOLOR, txscript.OP_NUMEQUAL,
+		txscript.OP_NUMEQUALVERIFY, txscript.OP_NUMNOTEQUAL,
+		txscript.OP_LESSTHAN, txscript.OP_GREATERTHAN,
+		txscript.OP_LESSTHANOREQUAL, txscript.OP_GREATERTHANOREQUAL,
+		txscript.OP_MIN, txscript.OP_MAX:
+
+		nums, ok := s.popNums(2, op)
+		if !ok {
+			return nil
+		}
+
+		res := a.fresh()
+		if nums != nil {
+			res = Num(binaryOp(op, nums[0], nums[1]))
+		}
+
+		if op == txscript.OP_NUMEQUALVERIFY {
+			s.verify(res, op)
+			return nil
+		}
+		s.push(res)
+
+	case txscript.OP_WITHIN:
+		nums, ok := s.popNums(3, op)
+		if !ok {
+			return nil
+		}
+
+		if nums == nil {
+			s.push(a.fresh())
+			return nil
+		}
+		s.push(boolValue(nums[0] >= nums[1] && nums[0] < nums[2]))
+
+	case txscript.OP_RIPEMD160, txscript.OP_SHA1, txscript.OP_SHA256,
+		txscript.OP_HASH160, txscript.OP_HASH256:
+
+		if s.pop(1) != nil {
+			s.push(a.fresh())
+		}
+
+	case txscript.OP_CHECKSIG:
+		if s.pop(2) != nil {
+			s.push(a.fresh())
+		}
+
+	case txscript.OP_CHECKSIGVERIFY:
+		s.pop(2)
+
+	case txscript.OP_CHECKSIGADD:
+		if s.pop(3) != nil {
+			s.push(a.fresh())
+		}
+
+	case txscript.OP_CHECKCONTRACTVERIFY:
+		// data index key taptree flags
+		s.pop(5)
+
+	case txscript.OP_CHECKMULTISIG, txscript.OP_CHECKMULTISIGVERIFY:
+		s.fail("%s is disabled in tapscript", opName(op))
+
+	default:
+		return fmt.Errorf("opcode %s not supported by the analysis",
+			opName(op))
+	}
+
+	return nil
+}
+
+// verify fails the state if the value is false, and otherwise assumes it is
+// true.
+func (s *state) verify(v Value, op byte) {
+	t, ok := s.truth(v)
+	switch {
+	case ok && !t:
+		s.fail("%s failed", opName(op))
+	case !ok:
+		s.assume[v.ID] = true
+	}
+}
+
+// popNums pops n numbers, bottom number first. It returns nil if any of them
+// is unknown, and false if the state failed because a known value is not a
+// number.
+func (s *state) popNums(n int, op byte) ([]int64, bool) {
+	vals := s.pop(n)
+	if vals == nil {
+		return nil, false
+	}
+
+	var (
+		nums  []int64
+		known = true
+	)
+	for _, v := range vals {
+		if !v.Known {
+			known = false
+			continue
+		}
+
+		num, ok := v.Int()
+		if !ok {
+			s.fail("%s argument %x is not a number", opName(op),
+				v.Bytes)
+			return nil, false
+		}
+		nums = append(nums, num)
+	}
+
+	if !known {
+		return nil, true
+	}
+
+	return nums, true
+}
+
+// boolNum returns the number of the boolean.
+func boolNum(b bool) int64 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// binaryOp returns the result of the binary numeric opcode, with b the top
+// argument.
+func binaryOp(op byte, a, b int64) int64 {
+	switch op {
+	case txscript.OP_ADD:
+		return a + b
+	case txscript.OP_SUB:
+		return a - b
+	case txscript.OP_BOOLAND:
+		return boolNum(a != 0 && b != 0)
+	case txscript.OP_BOOLOR:
+		return boolNum(a != 0 || b != 0)
+	case txscript.OP_NUMEQUAL, txscript.OP_NUMEQUALVERIFY:
+		return boolNum(a == b)
+	case txscript.OP_NUMNOTEQUAL:
+		return boolNum(a != b)
+	case txscript.OP_LESSTHAN:
+		return boolNum(a < b)
+	case txscript.OP_GREATERTHAN:
+		return boolNum(a > b)
+	case txscript.OP_LESSTHANOREQUAL:
+		return boolNum(a <= b)
+	case txscript.OP_GREATERTHANOREQUAL:
+		return boolNum(a >= b)
+	case txscript.OP_MIN:
+		return min(a, b)
+	case txscript.OP_MAX:
+		return max(a, b)
+	}
+
+	return 0
+}
@@ -0,0 +1,33 @@
+package scripts
+
+import (
+	"fmt"
+
+	"github.com/halseth/mattlab/scripts/analysis"
+	"github.com/halseth/tapsim/script"
+)
+
+// AnalyzeStep symbolically executes the script of the step at the given pc, as
+// by analysis.Analyze. The step is executed from a state of unknown registers,
+// except for the pc register holding the pc, with the step's unknown hints on
+// top.
+func (p *Program) AnalyzeStep(pc int) ([]*analysis.Path, error) {
+	if pc < 0 || pc >= len(p.Steps) {
+		return nil, fmt.Errorf("pc %d out of range", pc)
+	}
+
+	pkScript, err := script.Parse(p.StepScript(pc))
+	if err != nil {
+		return nil, fmt.Errorf("parsing step %d: %v", pc, err)
+	}
+
+	start := analysis.Unknowns(p.Schema.NumRegisters() + p.NumHints(pc))
+	start[p.Schema.PC] = analysis.Num(int64(pc))
+
+	paths, err := analysis.Analyze(pkScript, start)
+	if err != nil {
+		return nil, fmt.Errorf("step %d: %v", pc, err)
+	}
+
+	return paths, nil
+}
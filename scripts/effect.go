@@ -0,0 +1,91 @@
+package scripts
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/halseth/mattlab/scripts/analysis"
+)
+
+// StackEffect is the effect of a step script on the stack, over all paths
+// through it.
+type StackEffect struct {
+	// Consumed is the largest number of elements of the state and hints
+	// the step takes from the stack, and Produced the largest number of
+	// elements it leaves in their place.
+	Consumed int
+	Produced int
+
+	// MaxDepth is the largest number of elements on the stack during the
+	// step, state and hints included.
+	MaxDepth int
+
+	// MaxAlt is the largest number of elements on the alt stack during
+	// the step, alt stack registers included.
+	MaxAlt int
+}
+
+// StackEffect computes the stack effect of the step at the given pc, by
+// symbolically executing its script as by AnalyzeStep. It returns an error if
+// a path through the step underflows the stack, or ends with anything else than
+// a state of the schema's registers and an empty alt stack: the leaf scripts
+// rely on steps mapping a state to a state, taking their hints from the top.
+func (p *Program) StackEffect(pc int) (*StackEffect, error) {
+	paths, err := p.AnalyzeStep(pc)
+	if err != nil {
+		return nil, err
+	}
+
+	n := p.Schema.NumRegisters()
+	effect := &StackEffect{}
+	for _, path := range paths {
+		var underflow *analysis.UnderflowError
+		if errors.As(path.Err, &underflow) {
+			return nil, fmt.Errorf("step %d: opcode %d: %v", pc,
+				path.Op, path.Err)
+		}
+
+		// Paths that always fail have no effect on-chain.
+		if path.Err != nil {
+			continue
+		}
+
+		if len(path.Stack) != n {
+			return nil, fmt.Errorf("step %d leaves %d elements, "+
+				"expected the %d registers", pc,
+				len(path.Stack), n)
+		}
+
+		if path.Alt != 0 {
+			return nil, fmt.Errorf("step %d leaves %d elements on "+
+				"the alt stack", pc, path.Alt)
+		}
+
+		effect.Consumed = max(effect.Consumed, path.Consumed)
+		effect.Produced = max(effect.Produced, path.Produced())
+		effect.MaxDepth = max(effect.MaxDepth, path.MaxDepth)
+		effect.MaxAlt = max(effect.MaxAlt, path.MaxAlt)
+	}
+
+	// The leaf script executes the step on top of a copy of the state.
+	if n+effect.MaxDepth+effect.MaxAlt > txscript.MaxStackSize {
+		return nil, fmt.Errorf("step %d needs %d stack elements in "+
+			"its leaf script, more than the limit of %d", pc,
+			n+effect.MaxDepth+effect.MaxAlt, txscript.MaxStackSize)
+	}
+
+	return effect, nil
+}
+
+// CheckStackEffects checks the stack effect of every step of the program, as
+// by StackEffect.
+func (p *Program) CheckStackEffects() error {
+	for pc := range p.Steps {
+		if _, err := p.StackEffect(pc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,84 @@
+package scripts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestStackEffectMultiply checks the stack effects of the multiply steps.
+func TestStackEffectMultiply(t *testing.T) {
+	want := []*StackEffect{
+		{Consumed: 1, Produced: 1, MaxDepth: 4},
+		{Consumed: 3, Produced: 3, MaxDepth: 3},
+		{MaxDepth: 3},
+	}
+
+	for pc, w := range want {
+		e, err := MultiplyProgram.StackEffect(pc)
+		require.NoError(t, err)
+		require.Equal(t, w, e, "step %d", pc)
+	}
+
+	require.NoError(t, MultiplyProgram.CheckStackEffects())
+}
+
+// TestStackEffect checks the stack effects of steps taking hints and using the
+// alt stack, and that steps not mapping a state to a state are rejected.
+func TestStackEffect(t *testing.T) {
+	tests := []struct {
+		name   string
+		step   string
+		effect *StackEffect
+		err    string
+	}{{
+		name: "hints",
+		step: "HINT 2 OP_ADD OP_ADD OP_NIP OP_1",
+		effect: &StackEffect{
+			Consumed: 4, Produced: 2, MaxDepth: 4,
+		},
+	}, {
+		name: "alt stack",
+		step: "OP_TOALTSTACK OP_TOALTSTACK OP_0 OP_FROMALTSTACK " +
+			"OP_FROMALTSTACK OP_DROP OP_NIP OP_1",
+		effect: &StackEffect{
+			Consumed: 2, Produced: 2, MaxDepth: 3, MaxAlt: 2,
+		},
+	}, {
+		name: "failing path",
+		step: "OP_OVER OP_IF OP_RETURN OP_ENDIF OP_DROP OP_1",
+		effect: &StackEffect{
+			Consumed: 1, Produced: 1, MaxDepth: 3,
+		},
+	}, {
+		name: "underflow",
+		step: "OP_ADD OP_ADD OP_1",
+		err:  "underflow",
+	}, {
+		name: "too many elements",
+		step: "OP_1",
+		err:  "leaves 3 elements",
+	}, {
+		name: "alt stack left",
+		step: "OP_DUP OP_TOALTSTACK",
+		err:  "alt stack",
+	}}
+
+	for _, test := range tests {
+		prog, err := ReadProgram(strings.NewReader(
+			"#: x pc\n" + test.step + "\nOP_NOP\n"))
+		require.NoError(t, err, test.name)
+
+		e, err := prog.StackEffect(0)
+		if test.err != "" {
+			require.ErrorContains(t, err, test.err, test.name)
+			require.Error(t, prog.CheckStackEffects(), test.name)
+			continue
+		}
+
+		require.NoError(t, err, test.name)
+		require.Equal(t, test.effect, e, test.name)
+		require.NoError(t, prog.CheckStackEffects(), test.name)
+	}
+}
@@ -0,0 +1,188 @@
+package scripts
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/halseth/tapsim/file"
+)
+
+// programHeaderPrefix is the prefix of the program file line holding the
+// state schema, as in trace files.
+const programHeaderPrefix = "#:"
+
+// envHeaderPrefix is the prefix of the program file line holding the
+// environment the steps are executed in.
+const envHeaderPrefix = "#env:"
+
+// ReadProgram reads a program file: a header line with the state schema,
+// optionally followed by header lines with the execution environment and the
+// memory, then one script step per line in pc order. Steps are in the tapsim
+// script syntax, and # comments and empty lines are ignored. A step taking
+// prover hints starts with a HINT declaration, and a step accessing memory
+// then continues with a MEM_LOAD or MEM_STORE access:
+//
+//	#:	mem:32 addr v pc
+//	#env:	flags=standard opcodes=OP_CAT
+//	#mem:	mem 4
+//	HINT addr MEM_LOAD addr v OP_DROP OP_1
+//	OP_NOP
+func ReadProgram(r io.Reader) (*Program, error) {
+	var (
+		prog    = &Program{}
+		scanner = bufio.NewScanner(r)
+	)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		if hdr, ok := strings.CutPrefix(line, programHeaderPrefix); ok {
+			if prog.Schema != nil || len(prog.Steps) > 0 {
+				return nil, fmt.Errorf("line %d: schema header "+
+					"must come before the steps", lineNum)
+			}
+
+			var err error
+			prog.Schema, err = schema.Parse(hdr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			continue
+		}
+
+		if hdr, ok := strings.CutPrefix(line, envHeaderPrefix); ok {
+			if prog.Env != nil || len(prog.Steps) > 0 {
+				return nil, fmt.Errorf("line %d: environment "+
+					"header must come before the steps",
+					lineNum)
+			}
+
+			var err error
+			prog.Env, err = execute.ParseEnv(hdr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			continue
+		}
+
+		if hdr, ok := strings.CutPrefix(line, memHeaderPrefix); ok {
+			if prog.Schema == nil || prog.Memory != nil ||
+				len(prog.Steps) > 0 {
+
+				return nil, fmt.Errorf("line %d: memory header "+
+					"must follow the schema header", lineNum)
+			}
+
+			var err error
+			prog.Memory, err = ParseMemHeader(prog.Schema, hdr)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+			continue
+		}
+
+		step, err := file.ParseScript([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if step == "" {
+			continue
+		}
+
+		if prog.Schema != nil {
+			hint, code, err := ParseHintOp(prog.Schema, step)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+
+			if hint != nil {
+				for len(prog.Hints) < len(prog.Steps) {
+					prog.Hints = append(prog.Hints, nil)
+				}
+				prog.Hints = append(prog.Hints, hint)
+				step = code
+			}
+
+			op, code, err := ParseMemOp(prog.Schema, step)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNum, err)
+			}
+
+			if op != nil {
+				if prog.Memory == nil {
+					return nil, fmt.Errorf("line %d: memory "+
+						"access without memory header",
+						lineNum)
+				}
+
+				for len(prog.Memory.Ops) < len(prog.Steps) {
+					prog.Memory.Ops = append(
+						prog.Memory.Ops, nil,
+					)
+				}
+				prog.Memory.Ops = append(prog.Memory.Ops, op)
+				step = code
+			}
+		}
+
+		prog.Steps = append(prog.Steps, step)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if prog.Schema == nil {
+		return nil, fmt.Errorf("program has no schema header")
+	}
+
+	if err := prog.Validate(); err != nil {
+		return nil, err
+	}
+
+	return prog, nil
+}
+
+// WriteProgram writes the program in the format read by ReadProgram. The
+// header is left out if the program has no schema.
+func WriteProgram(w io.Writer, prog *Program) error {
+	if prog.Schema != nil {
+		_, err := fmt.Fprintf(w, "%s\t%s\n", programHeaderPrefix,
+			prog.Schema)
+		if err != nil {
+			return err
+		}
+	}
+
+	if prog.Env != nil {
+		_, err := fmt.Fprintf(w, "%s\t%s\n", envHeaderPrefix,
+			prog.Env)
+		if err != nil {
+			return err
+		}
+	}
+
+	if prog.Memory != nil {
+		_, err := fmt.Fprintf(w, "%s\t%s\n", memHeaderPrefix,
+			prog.Memory.Header(prog.Schema))
+		if err != nil {
+			return err
+		}
+	}
+
+	for pc, step := range prog.Steps {
+		if op := prog.Memory.Op(pc); op != nil {
+			step = op.Format(prog.Schema) + " " + step
+		}
+		if hint := prog.HintOp(pc); hint != nil {
+			step = hint.Format(prog.Schema) + " " + step
+		}
+
+		if _, err := fmt.Fprintln(w, step); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
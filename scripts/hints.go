@@ -0,0 +1,205 @@
+package scripts
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/halseth/mattlab/tracer/schema"
+)
+
+const (
+	// hintOp starts a step taking prover hints, followed by either the
+	// number of hints left on top of the state, or the registers the
+	// hints are stored in.
+	hintOp = "HINT"
+
+	// maxHints is the maximum number of prover hints a step can take.
+	maxHints = 64
+)
+
+// HintOp declares the prover hints taken by a step: advice the prover gives
+// in the witness on top of the state, and that the step verifies instead of
+// computing it. Hints are not part of the state, so they are not committed to
+// in the trace, unless the step stores them in registers.
+type HintOp struct {
+	// Count is the number of hints taken by the step.
+	Count int
+
+	// Regs are the registers the hints are stored in before the step
+	// runs its script, the last one getting the top hint. If nil, the
+	// hints are left on top of the state for the script to consume.
+	Regs []int
+}
+
+// HintOp returns the prover hints taken by the step at the given pc, nil if it
+// takes none.
+func (p *Program) HintOp(pc int) *HintOp {
+	if pc >= len(p.Hints) {
+		return nil
+	}
+
+	return p.Hints[pc]
+}
+
+// NumProverHints returns the number of prover hints taken by the step at the
+// given pc.
+func (p *Program) NumProverHints(pc int) int {
+	op := p.HintOp(pc)
+	if op == nil {
+		return 0
+	}
+
+	return op.Count
+}
+
+// NumHints returns the number of hint elements the step at the given pc
+// expects on top of the state: the proof of its memory access, with its prover
+// hints on top.
+func (p *Program) NumHints(pc int) int {
+	n := p.NumProverHints(pc)
+	if p.Memory.Op(pc) != nil {
+		n += proofLen(p.Memory.Depth)
+	}
+
+	return n
+}
+
+// TakesHints returns true if any step of the program expects hints on top of
+// the state, prover hints or memory proofs.
+func (p *Program) TakesHints() bool {
+	for pc := range p.Steps {
+		if p.NumHints(pc) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateHints checks that the hint declarations fit the program.
+func (p *Program) validateHints() error {
+	if len(p.Hints) > len(p.Steps) {
+		return fmt.Errorf("%d hint declarations for program of %d "+
+			"steps", len(p.Hints), len(p.Steps))
+	}
+
+	for pc, op := range p.Hints {
+		if op == nil {
+			continue
+		}
+
+		if pc == p.HaltPC() {
+			return fmt.Errorf("halting step cannot take hints")
+		}
+
+		if op.Count < 1 || op.Count > maxHints {
+			return fmt.Errorf("step %d: hint count %d not in "+
+				"range [1, %d]", pc, op.Count, maxHints)
+		}
+
+		if op.Regs != nil && len(op.Regs) != op.Count {
+			return fmt.Errorf("step %d: %d hints stored in %d "+
+				"registers", pc, op.Count, len(op.Regs))
+		}
+
+		for _, r := range op.Regs {
+			if err := checkMemReg(p.Schema, r); err != nil {
+				return fmt.Errorf("step %d: %v", pc, err)
+			}
+			if p.Memory != nil && r == p.Memory.Root {
+				return fmt.Errorf("step %d: hints cannot be "+
+					"stored in the memory root register",
+					pc)
+			}
+		}
+	}
+
+	return nil
+}
+
+// ParseHintOp parses the hint declaration at the start of the step code, e.g.
+// "HINT 2 OP_MUL ..." or "HINT q r ...". It returns the declaration, nil if
+// the step doesn't start with one, and the rest of the step code.
+func ParseHintOp(s *schema.Schema, code string) (*HintOp, string, error) {
+	fields := strings.Fields(code)
+	if len(fields) == 0 || fields[0] != hintOp {
+		return nil, code, nil
+	}
+
+	if len(fields) < 2 {
+		return nil, "", fmt.Errorf("%s needs a count or registers",
+			hintOp)
+	}
+
+	if n, err := strconv.Atoi(fields[1]); err == nil {
+		op := &HintOp{Count: n}
+		return op, strings.Join(fields[2:], " "), nil
+	}
+
+	// The registers are all names following the declaration, up to the
+	// first opcode.
+	op := &HintOp{}
+	i := 1
+	for ; i < len(fields); i++ {
+		r, ok := s.Index(fields[i])
+		if !ok {
+			break
+		}
+
+		op.Regs = append(op.Regs, r)
+	}
+	op.Count = len(op.Regs)
+
+	if op.Count == 0 {
+		return nil, "", fmt.Errorf("unknown register %s", fields[1])
+	}
+
+	return op, strings.Join(fields[i:], " "), nil
+}
+
+// Format returns the hint declaration as parsed by ParseHintOp.
+func (op *HintOp) Format(s *schema.Schema) string {
+	if op.Regs == nil {
+		return fmt.Sprintf("%s %d", hintOp, op.Count)
+	}
+
+	names := []string{hintOp}
+	for _, r := range op.Regs {
+		names = append(names, s.Registers[r].Name)
+	}
+
+	return strings.Join(names, " ")
+}
+
+// hintOpScript returns the script handling the prover hints of the step at
+// the given pc before its memory access, with the hints on top of the memory
+// proof. Hints stored in registers are consumed. Hints left for the script
+// are moved to the alt stack around the memory access.
+func (p *Program) hintOpScript(pc int) (pre, post string) {
+	op := p.HintOp(pc)
+	if op == nil {
+		return "", ""
+	}
+
+	numProof := p.NumHints(pc) - op.Count
+	if op.Regs == nil {
+		if numProof == 0 {
+			return "", ""
+		}
+
+		return repeatOp("OP_TOALTSTACK", op.Count, " "),
+			repeatOp("OP_FROMALTSTACK", op.Count, " ")
+	}
+
+	// Store the top hint first, in the register at its depth below the
+	// hints and proof left.
+	numMain := p.Schema.NumRegisters() - p.Schema.NumAlt()
+	var ops []string
+	for i := op.Count - 1; i >= 0; i-- {
+		depth := numMain - 1 - op.Regs[i] + numProof + i
+		ops = append(ops, storeOp(depth))
+	}
+
+	return strings.Join(ops, " "), ""
+}
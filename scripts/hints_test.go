@@ -0,0 +1,80 @@
+package scripts
+
+import (
+	"testing"
+
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+// TestParseHintOp checks parsing hint declarations, and formatting them back.
+func TestParseHintOp(t *testing.T) {
+	s, err := schema.Parse("n q r pc")
+	require.NoError(t, err)
+
+	tests := []struct {
+		code string
+		op   *HintOp
+		rest string
+	}{
+		{"OP_DROP OP_1", nil, "OP_DROP OP_1"},
+		{"HINT 2 OP_ADD", &HintOp{Count: 2}, "OP_ADD"},
+		{"HINT q OP_DROP", &HintOp{Count: 1, Regs: []int{1}}, "OP_DROP"},
+		{"HINT r q", &HintOp{Count: 2, Regs: []int{2, 1}}, ""},
+	}
+
+	for _, test := range tests {
+		op, rest, err := ParseHintOp(s, test.code)
+		require.NoError(t, err, test.code)
+		require.Equal(t, test.op, op, test.code)
+		require.Equal(t, test.rest, rest, test.code)
+
+		if op == nil {
+			continue
+		}
+
+		// The formatted declaration parses to the same one.
+		again, _, err := ParseHintOp(s, op.Format(s)+" "+rest)
+		require.NoError(t, err)
+		require.Equal(t, op, again)
+	}
+
+	for _, code := range []string{"HINT", "HINT x OP_DROP"} {
+		_, _, err := ParseHintOp(s, code)
+		require.Error(t, err, code)
+	}
+}
+
+// TestValidateHints checks that hint declarations not fitting the program are
+// rejected.
+func TestValidateHints(t *testing.T) {
+	s, err := schema.Parse("n q pc")
+	require.NoError(t, err)
+
+	steps := []string{"OP_DROP OP_1", "OP_NOP"}
+	tests := []struct {
+		name  string
+		hints []*HintOp
+		valid bool
+	}{
+		{"none", nil, true},
+		{"count", []*HintOp{{Count: 2}}, true},
+		{"register", []*HintOp{{Count: 1, Regs: []int{1}}}, true},
+		{"zero count", []*HintOp{{Count: 0}}, false},
+		{"too many", []*HintOp{{Count: maxHints + 1}}, false},
+		{"unknown register", []*HintOp{{Count: 1, Regs: []int{3}}}, false},
+		{"register count", []*HintOp{{Count: 2, Regs: []int{1}}}, false},
+		{"halting step", []*HintOp{nil, {Count: 1}}, false},
+		{"past the steps", []*HintOp{nil, nil, {Count: 1}}, false},
+	}
+
+	for _, test := range tests {
+		prog := &Program{Schema: s, Steps: steps, Hints: test.hints}
+		err := prog.Validate()
+		if test.valid {
+			require.NoError(t, err, test.name)
+		} else {
+			require.Error(t, err, test.name)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package scripts
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/halseth/mattlab/scripts/macros"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/mattlab/tracer/schema"
+)
+
+const (
+	// memHeaderPrefix is the prefix of the program file line declaring the
+	// program memory: the register holding the memory root, and the depth
+	// of the memory tree.
+	memHeaderPrefix = "#mem:"
+
+	// memLoadOp and memStoreOp start a step accessing memory, followed by
+	// the address register and the loaded or stored register.
+	memLoadOp  = "MEM_LOAD"
+	memStoreOp = "MEM_STORE"
+
+	// rootWidth is the minimum width of the memory root register.
+	rootWidth = 32
+)
+
+// Memory is the merkleized memory of a program. The state only carries the
+// root of the memory tree, and steps accessing memory are given an inclusion
+// proof of the accessed cell as hints on top of the state. The step verifies
+// the proof against the root before running its script, and for stores
+// replaces the root with the root of the updated memory.
+type Memory struct {
+	// Root is the index of the register holding the memory root.
+	Root int
+
+	// Depth is the depth of the memory tree, the memory having 2^Depth
+	// cells.
+	Depth int
+
+	// Init is the root of the memory the program starts with, nil if it
+	// starts out empty. The question script starts the root register at
+	// it, committing the contract to the initial memory.
+	Init *[32]byte
+
+	// Ops are the memory accesses of the steps, indexed by pc. Steps not
+	// accessing memory have a nil entry, and the slice may be shorter
+	// than the program.
+	Ops []*MemOp
+}
+
+// MemOpKind is the kind of a memory access.
+type MemOpKind uint8
+
+const (
+	// MemLoad loads the value of a memory cell into a register.
+	MemLoad MemOpKind = iota
+
+	// MemStore stores the value of a register in a memory cell.
+	MemStore
+)
+
+// MemOp is a memory access done by a step before running its script.
+type MemOp struct {
+	// Kind is the kind of access.
+	Kind MemOpKind
+
+	// Addr is the index of the register holding the cell address.
+	Addr int
+
+	// Reg is the index of the register loaded into, or stored from.
+	Reg int
+}
+
+// proofLen returns the number of hint elements of a proof for a memory of the
+// given depth.
+func proofLen(depth int) int {
+	// A sibling and direction per level, and the cell value.
+	return 2*depth + 1
+}
+
+// Op returns the memory access of the step at the given pc, nil if it doesn't
+// access memory.
+func (m *Memory) Op(pc int) *MemOp {
+	if m == nil || pc >= len(m.Ops) {
+		return nil
+	}
+
+	return m.Ops[pc]
+}
+
+// Validate checks that the memory is usable by a program with the given
+// schema and number of steps.
+func (m *Memory) Validate(s *schema.Schema, numSteps int) error {
+	if m.Depth < 1 || m.Depth > memory.MaxDepth {
+		return fmt.Errorf("memory depth %d not in range [1, %d]",
+			m.Depth, memory.MaxDepth)
+	}
+
+	if err := checkMemReg(s, m.Root); err != nil {
+		return fmt.Errorf("memory root: %v", err)
+	}
+	if s.Registers[m.Root].Width < rootWidth {
+		return fmt.Errorf("memory root register %s must be at least "+
+			"%d bytes wide", s.Registers[m.Root].Name, rootWidth)
+	}
+
+	if len(m.Ops) > numSteps {
+		return fmt.Errorf("%d memory accesses for program of %d "+
+			"steps", len(m.Ops), numSteps)
+	}
+
+	for pc, op := range m.Ops {
+		if op == nil {
+			continue
+		}
+
+		if pc == numSteps-1 {
+			return fmt.Errorf("halting step cannot access memory")
+		}
+
+		for _, r := range []int{op.Addr, op.Reg} {
+			if err := checkMemReg(s, r); err != nil {
+				return fmt.Errorf("step %d: %v", pc, err)
+			}
+			if r == m.Root {
+				return fmt.Errorf("step %d: memory access "+
+					"cannot use the root register", pc)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkMemReg checks that the register index can be used by a memory access or
+// hint store, which only see the main stack registers.
+func checkMemReg(s *schema.Schema, r int) error {
+	if r < 0 || r >= s.NumRegisters() {
+		return fmt.Errorf("register %d out of range", r)
+	}
+
+	if s.Registers[r].Alt {
+		return fmt.Errorf("register %s is on the alt stack",
+			s.Registers[r].Name)
+	}
+
+	return nil
+}
+
+// ParseMemHeader parses the memory declaration of a program file header,
+// e.g. "mem 8" for a memory of 2^8 cells with its root in register mem. The
+// root of the initial memory can follow in hex, if it doesn't start out empty.
+func ParseMemHeader(s *schema.Schema, hdr string) (*Memory, error) {
+	fields := strings.Fields(hdr)
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, fmt.Errorf("memory header must be <root register> " +
+			"<depth> [initial root]")
+	}
+
+	root, ok := s.Index(fields[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown register %s", fields[0])
+	}
+
+	depth, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory depth %q", fields[1])
+	}
+
+	m := &Memory{
+		Root:  root,
+		Depth: depth,
+	}
+	if len(fields) == 3 {
+		b, err := hex.DecodeString(fields[2])
+		if err != nil || len(b) != 32 {
+			return nil, fmt.Errorf("invalid initial memory root %q",
+				fields[2])
+		}
+
+		m.Init = new([32]byte)
+		copy(m.Init[:], b)
+	}
+
+	return m, nil
+}
+
+// Header returns the memory declaration as parsed by ParseMemHeader.
+func (m *Memory) Header(s *schema.Schema) string {
+	hdr := fmt.Sprintf("%s %d", s.Registers[m.Root].Name, m.Depth)
+	if m.Init != nil {
+		hdr += fmt.Sprintf(" %x", m.Init[:])
+	}
+
+	return hdr
+}
+
+// InitRoot returns the root of the memory the program starts with.
+func (m *Memory) InitRoot() [32]byte {
+	if m.Init != nil {
+		return *m.Init
+	}
+
+	return memory.EmptyRoot(m.Depth)
+}
+
+// ParseMemOp parses the memory access at the start of the step code, e.g.
+// "MEM_LOAD addr x OP_DROP ...". It returns the access, nil if the step
+// doesn't start with one, and the rest of the step code.
+func ParseMemOp(s *schema.Schema, code string) (*MemOp, string, error) {
+	fields := strings.Fields(code)
+	if len(fields) == 0 {
+		return nil, code, nil
+	}
+
+	var kind MemOpKind
+	switch fields[0] {
+	case memLoadOp:
+		kind = MemLoad
+	case memStoreOp:
+		kind = MemStore
+	default:
+		return nil, code, nil
+	}
+
+	if len(fields) < 3 {
+		return nil, "", fmt.Errorf("%s needs an address and a value "+
+			"register", fields[0])
+	}
+
+	op := &MemOp{Kind: kind}
+	for i, r := range []*int{&op.Addr, &op.Reg} {
+		var ok bool
+		*r, ok = s.Index(fields[i+1])
+		if !ok {
+			return nil, "", fmt.Errorf("unknown register %s",
+				fields[i+1])
+		}
+	}
+
+	return op, strings.Join(fields[3:], " "), nil
+}
+
+// Format returns the memory access as parsed by ParseMemOp.
+func (op *MemOp) Format(s *schema.Schema) string {
+	name := memLoadOp
+	if op.Kind == MemStore {
+		name = memStoreOp
+	}
+
+	return fmt.Sprintf("%s %s %s", name, s.Registers[op.Addr].Name,
+		s.Registers[op.Reg].Name)
+}
+
+// memOpScript returns the script doing the memory access of the step at the
+// given pc, with the proof hints on top of the state. It verifies the proof,
+// consuming the hints, and for loads sets the loaded register, for stores
+// sets the root register to the updated root.
+func (p *Program) memOpScript(pc int) string {
+	op := p.Memory.Op(pc)
+	if op == nil {
+		return ""
+	}
+
+	// Depth of a main stack register when on top of the registers.
+	numMain := p.Schema.NumRegisters() - p.Schema.NumAlt()
+	depth := func(r int) int {
+		return numMain - 1 - r
+	}
+
+	var ops []string
+	emit := func(s ...string) {
+		ops = append(ops, s...)
+	}
+
+	// The merkle macros don't check which cell the proof is for, so the
+	// address is accumulated from the directions first, the one of level
+	// l being at depth 2l+1 below the accumulator.
+	d := p.Memory.Depth
+	n := proofLen(d)
+	emit("OP_0")
+	for l := 0; l < d; l++ {
+		emit(pickOp(2*l+2), "OP_IF", NumToOp(1<<l), "OP_ADD",
+			"OP_ENDIF")
+	}
+	emit(pickOp(depth(op.Addr)+n+1), "OP_NUMEQUALVERIFY")
+
+	switch op.Kind {
+	case MemLoad:
+		// The macro expects the root below the proof, so it is copied
+		// there by moving the proof to the alt stack. The cell value
+		// is kept on the alt stack while verifying.
+		emit(repeatOp("OP_TOALTSTACK", n, " "),
+			pickOp(depth(p.Memory.Root)),
+			repeatOp("OP_FROMALTSTACK", n, " "))
+		emit("OP_DUP OP_TOALTSTACK")
+		emit(macroOps(macros.CheckMerkleInclusion(d)))
+		emit("OP_FROMALTSTACK")
+		emit(storeOp(depth(op.Reg)))
+
+	case MemStore:
+		// The macro expects the new cell value and the root on top of
+		// the old value, and leaves the updated root.
+		emit(pickOp(depth(op.Reg)+n), pickOp(depth(p.Memory.Root)+n+1))
+		emit(macroOps(macros.AmendMerkle(d)))
+		emit(storeOp(depth(p.Memory.Root)))
+	}
+
+	return strings.Join(ops, " ")
+}
+
+// macroOps returns the ops of a script macro on a single line, without
+// comments, as expected by script.Parse.
+func macroOps(macro string) string {
+	var ops []string
+	for _, line := range strings.Split(macro, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		ops = append(ops, strings.Fields(line)...)
+	}
+
+	return strings.Join(ops, " ")
+}
+
+// pickOp returns the script copying the element at the given depth to the
+// top.
+func pickOp(depth int) string {
+	switch depth {
+	case 0:
+		return "OP_DUP"
+	case 1:
+		return "OP_OVER"
+	}
+
+	return NumToOp(depth) + " OP_PICK"
+}
+
+// rollOp returns the script moving the element at the given depth to the top.
+func rollOp(depth int) string {
+	switch depth {
+	case 1:
+		return "OP_SWAP"
+	case 2:
+		return "OP_ROT"
+	}
+
+	return NumToOp(depth) + " OP_ROLL"
+}
+
+// storeOp returns the script popping the top element into the register at
+// the given depth below it.
+func storeOp(depth int) string {
+	if depth == 0 {
+		return "OP_NIP"
+	}
+
+	// Remove the old value, then move the registers above it over the new
+	// one.
+	ops := []string{rollOp(depth + 1), "OP_DROP"}
+	for i := 0; i < depth; i++ {
+		ops = append(ops, rollOp(depth))
+	}
+
+	return strings.Join(ops, " ")
+}
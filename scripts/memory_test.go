@@ -0,0 +1,114 @@
+package scripts
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/tapsim/script"
+	"github.com/stretchr/testify/require"
+)
+
+// memProgram loads the cell at addr into v, then stores v back.
+const memProgram = `#:	mem:32 addr v pc
+#mem:	mem 3
+MEM_LOAD addr v OP_DROP OP_1
+MEM_STORE addr v OP_DROP OP_2
+OP_NOP
+`
+
+// execMemStep executes the step at the given pc from the state, with the
+// hints on top, and returns the end state. A nil state is returned if the
+// step fails.
+func execMemStep(t *testing.T, prog *Program, pc int, state,
+	hints [][]byte) [][]byte {
+
+	t.Helper()
+
+	pkScript, err := script.Parse(prog.StepScript(pc))
+	require.NoError(t, err)
+
+	stack := append(append([][]byte{}, state...), hints...)
+	end, err := execute.NewHarness().ExecuteStep(pkScript, stack)
+	if !execute.IsBenign(err) {
+		return nil
+	}
+
+	return end
+}
+
+// TestMemOpScript checks that the memory access of load and store steps
+// accepts the proofs of the memory, and rejects tampered proofs.
+func TestMemOpScript(t *testing.T) {
+	prog, err := ReadProgram(strings.NewReader(memProgram))
+	require.NoError(t, err)
+
+	// Zero is the empty element on the stack.
+	num := func(n int) []byte {
+		return append([]byte{}, commitment.ScriptNum(n).Bytes()...)
+	}
+
+	cells := [][]byte{{1}, {2}, {}, {3, 4}, {5}, {6}, {7}, {8}}
+	mem, err := memory.New(3, cells)
+	require.NoError(t, err)
+	root := mem.Root()
+
+	tamper := func(proof [][]byte, i int, v []byte) [][]byte {
+		p := append([][]byte{}, proof...)
+		p[i] = v
+		return p
+	}
+
+	for addr := range cells {
+		proof, err := mem.Proof(addr)
+		require.NoError(t, err)
+
+		other, err := mem.Proof((addr + 1) % len(cells))
+		require.NoError(t, err)
+
+		top := len(proof) - 1
+		bad := map[string][][]byte{
+			"value":     tamper(proof, top, []byte{9}),
+			"sibling":   tamper(proof, top-2, make([]byte, 32)),
+			"direction": tamper(proof, top-1, []byte{2}),
+			"root dir":  tamper(proof, 1, []byte{2}),
+			"address":   other,
+		}
+
+		// Loading the cell.
+		state := [][]byte{root[:], num(addr), {}, num(0)}
+		end := execMemStep(t, prog, 0, state, proof)
+		require.Equal(t, [][]byte{
+			root[:], num(addr), cells[addr], num(1),
+		}, end, addr)
+
+		for name, p := range bad {
+			end := execMemStep(t, prog, 0, state, p)
+			require.Nil(t, end, "load %d with bad %s", addr, name)
+		}
+
+		// Storing a new value.
+		value := num(100 + addr)
+		updated := mem.Copy()
+		require.NoError(t, updated.Write(addr, value))
+		newRoot := updated.Root()
+
+		state = [][]byte{root[:], num(addr), value, num(1)}
+		end = execMemStep(t, prog, 1, state, proof)
+		require.Equal(t, [][]byte{
+			newRoot[:], num(addr), value, num(2),
+		}, end, addr)
+
+		for name, p := range bad {
+			end := execMemStep(t, prog, 1, state, p)
+			require.Nil(t, end, "store %d with bad %s", addr, name)
+		}
+
+		// A proof against another root is rejected.
+		state[0] = newRoot[:]
+		end = execMemStep(t, prog, 1, state, proof)
+		require.Nil(t, end, "store %d with stale proof", addr)
+	}
+}
@@ -1,29 +1,219 @@
 package scripts
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"strings"
 
 	"github.com/btcsuite/btcd/btcec/v2"
 	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/btcsuite/btcd/txscript"
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/schema"
 	"github.com/halseth/tapsim/file"
 	"github.com/halseth/tapsim/script"
 )
 
+// Program is a program that can be disputed on-chain: the layout of its state
+// and the script steps indexed by the program counter.
+type Program struct {
+	// Schema is the register layout of the program state.
+	Schema *schema.Schema
+
+	// Steps are the script steps, the step at index pc is executed when
+	// the program counter has value pc. The last step must be the
+	// halting OP_NOP step.
+	Steps []string
+
+	// Memory is the merkleized memory of the program, nil if it has
+	// none.
+	Memory *Memory
+
+	// Hints are the prover hints taken by the steps, indexed by pc.
+	// Steps taking no hints have a nil entry, and the slice may be
+	// shorter than the program.
+	Hints []*HintOp
+
+	// Env is the environment the steps are executed in, nil for the
+	// default environment.
+	Env *execute.Env
+}
+
+// Network is the execution environment enforced by the network contracts are
+// deployed on. Leaf generation refuses programs needing flags or opcodes it
+// doesn't enforce.
+var Network = execute.DefaultEnv()
+
 var ScriptSteps = []string{
 	"OP_DROP OP_DUP OP_8 OP_LESSTHAN OP_IF OP_1 OP_ELSE OP_2 OP_ENDIF",
 	"OP_DROP OP_1ADD OP_SWAP OP_DUP OP_ADD OP_SWAP OP_0",
 	"OP_NOP",
 }
 
+// StateSchema is the state layout of ScriptSteps: x i pc, with pc on top.
+var StateSchema = &schema.Schema{
+	Registers: []schema.Register{
+		{Name: "x", Width: schema.DefaultWidth},
+		{Name: "i", Width: schema.DefaultWidth},
+		{Name: "pc", Width: schema.DefaultWidth},
+	},
+	PC: 2,
+}
+
+// MultiplyProgram is the multiply game from docs/challenge.md.
+var MultiplyProgram = &Program{
+	Schema: StateSchema,
+	Steps:  ScriptSteps,
+}
+
+// Hash returns a hash identifying the program, committing to its state schema
+// and step scripts.
+func (p *Program) Hash() ([32]byte, error) {
+	h := sha256.New()
+	h.Write([]byte(p.Schema.String()))
+
+	var l [4]byte
+	for i := range p.Steps {
+		s, err := script.Parse(p.StepScript(i))
+		if err != nil {
+			return [32]byte{}, fmt.Errorf("parsing step %d: %v", i,
+				err)
+		}
+
+		binary.BigEndian.PutUint32(l[:], uint32(len(s)))
+		h.Write(l[:])
+		h.Write(s)
+	}
+
+	// Hints left on top of the state for the script don't change the
+	// step script, only the leaf script, so they are hashed separately.
+	for pc := range p.Steps {
+		if n := p.NumProverHints(pc); n > 0 {
+			binary.BigEndian.PutUint32(l[:], uint32(pc))
+			h.Write(l[:])
+			binary.BigEndian.PutUint32(l[:], uint32(n))
+			h.Write(l[:])
+		}
+	}
+
+	var hash [32]byte
+	copy(hash[:], h.Sum(nil))
+	return hash, nil
+}
+
+// ExecEnv returns the environment the steps are executed in.
+func (p *Program) ExecEnv() *execute.Env {
+	if p.Env == nil {
+		return execute.DefaultEnv()
+	}
+
+	return p.Env
+}
+
+// HaltPC returns the program counter of the halting step.
+func (p *Program) HaltPC() int {
+	return len(p.Steps) - 1
+}
+
+// StepScript returns the script executed for the step at the given pc. Alt
+// stack registers are moved to the alt stack before the step, and back to the
+// main stack after it. Steps accessing memory expect the proof hints on top of
+// the state, and verify them before running the step. Steps taking prover
+// hints expect them on top of the proof, and store them in registers before
+// the memory access if they declare any.
+func (p *Program) StepScript(pc int) string {
+	pre, post := p.hintOpScript(pc)
+	var ops []string
+	for _, s := range []string{pre, p.memOpScript(pc), post, p.Steps[pc]} {
+		if s != "" {
+			ops = append(ops, s)
+		}
+	}
+	step := strings.Join(ops, " ")
+
+	numAlt := p.Schema.NumAlt()
+	if numAlt == 0 {
+		return step
+	}
+
+	// The alt stack registers are below the hints.
+	toAlt := "OP_TOALTSTACK"
+	if k := p.NumHints(pc); k > 0 {
+		toAlt = rollOp(k) + " " + toAlt
+	}
+
+	return strings.Join([]string{
+		repeatOp(toAlt, numAlt, " "),
+		step,
+		repeatOp("OP_FROMALTSTACK", numAlt, " "),
+	}, " ")
+}
+
+// Validate checks that the program is well formed: it must end with the
+// halting OP_NOP step, and its memory and hints must fit the schema.
+func (p *Program) Validate() error {
+	if len(p.Steps) == 0 || p.Steps[p.HaltPC()] != "OP_NOP" {
+		return fmt.Errorf("last script step must be OP_NOP")
+	}
+
+	if p.Memory != nil {
+		if err := p.Memory.Validate(p.Schema, len(p.Steps)); err != nil {
+			return err
+		}
+	}
+
+	return p.validateHints()
+}
+
+// repeatOp returns the opcode repeated n times, separated by sep.
+func repeatOp(op string, n int, sep string) string {
+	ops := make([]string, n)
+	for i := range ops {
+		ops[i] = op
+	}
+
+	return strings.Join(ops, sep)
+}
+
+// catState returns the script concatenating the n top stack elements into
+// one, top element first.
+func catState(n int) string {
+	return repeatOp("OP_CAT", n-1, "\n")
+}
+
+// dupState returns the script duplicating the n top stack elements.
+func dupState(n int) string {
+	switch n {
+	case 1:
+		return "OP_DUP"
+	case 2:
+		return "OP_2DUP"
+	case 3:
+		return "OP_3DUP"
+	}
+
+	return repeatOp(NumToOp(n-1)+" OP_PICK", n, "\n")
+}
+
+// copyToAlt returns the script that, with a concatenation of elements on top
+// of the stack, concatenates the n elements below it one by one while copying
+// them to the alt stack.
+func copyToAlt(n int) string {
+	return repeatOp("OP_SWAP\nOP_DUP\nOP_TOALTSTACK\nOP_SWAP\nOP_CAT", n,
+		"\n")
+}
+
 // bob spends this script in the question transaction
 const questionScript = `
 # ====================== QUESTION SCRIPT =======================
-# on stack is Bob's question x. Commit this as the initial state in the output
-OP_0 # i = 0
-OP_0 # pc = 0
-OP_CAT # pc|i
-OP_CAT # pc|i|x
+# on stack is Bob's question x, the bottom register of the initial state. The
+# remaining registers start at zero, e.g. i = 0 and pc = 0, and a memory root
+# at the root of the empty memory. Commit this as the initial state in the
+# output.
+%s
+%s # pc|i|x
 OP_SHA256 # h(pc|i|x)
 
 OP_0 # index
@@ -38,18 +228,32 @@ OP_CHECKSIG
 # ====================== QUESTION SCRIPT END =======================
 `
 
-func GenerateQuestionStr(bobKey *btcec.PublicKey, taptree []byte) (string, error) {
-	scr := fmt.Sprintf(questionScript, taptree,
-		schnorr.SerializePubKey(bobKey))
+func GenerateQuestionStr(bobKey *btcec.PublicKey, taptree []byte,
+	prog *Program) (string, error) {
+
+	n := prog.Schema.NumRegisters()
+
+	// The memory of the program starts out with its initial root.
+	inits := make([]string, n-1)
+	for i := range inits {
+		inits[i] = "OP_0"
+		if prog.Memory != nil && prog.Memory.Root == i+1 {
+			root := prog.Memory.InitRoot()
+			inits[i] = fmt.Sprintf("%x", root[:])
+		}
+	}
+
+	scr := fmt.Sprintf(questionScript, strings.Join(inits, "\n"),
+		catState(n), taptree, schnorr.SerializePubKey(bobKey))
 	return scr, nil
 }
 
 func GenerateQuestion(aliceKey, bobKey *btcec.PublicKey, totalLevels int,
-	leaves []string) ([]byte, *txscript.IndexedTapScriptTree, error) {
+	prog *Program) ([]byte, *txscript.IndexedTapScriptTree, error) {
 
 	// Always send to answer.
 	answer, _, err := GenerateAnswer(
-		aliceKey, bobKey, totalLevels, leaves,
+		aliceKey, bobKey, totalLevels, prog,
 	)
 	if err != nil {
 		return nil, nil, err
@@ -71,7 +275,7 @@ func GenerateQuestion(aliceKey, bobKey *btcec.PublicKey, totalLevels int,
 	tapScriptTree := txscript.AssembleTaprootScriptTree(tapLeaves...)
 	taptree := tapScriptTree.RootNode.TapHash()
 
-	scr, err := GenerateQuestionStr(bobKey, taptree[:])
+	scr, err := GenerateQuestionStr(bobKey, taptree[:], prog)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -95,13 +299,10 @@ func GenerateQuestion(aliceKey, bobKey *btcec.PublicKey, totalLevels int,
 var answerScript = `
 # ====================== ANSWER SCRIPT =======================
 # on stack is start state, end state, and trace commitment
-OP_3DUP
-OP_TOALTSTACK
-OP_TOALTSTACK
-OP_TOALTSTACK # copy start state to alt stack
+%s
+%s # copy start state to alt stack
 
-OP_CAT # start_pc|start_i
-OP_CAT # start_pc|start_i|start_x
+%s # start_pc|start_i|start_x
 OP_SHA256 # h(pc|i|x)
 
 # verify start state on input
@@ -111,23 +312,14 @@ OP_0 # nums key
 OP_1 # flags, check input
 OP_CHECKCONTRACTVERIFY # check input commitment matches
 
-OP_FROMALTSTACK
-OP_FROMALTSTACK
-OP_FROMALTSTACK
+%s
 
 # commit answer an trace to output
-OP_CAT # start_pc|start_i
-OP_CAT # start_pc|start_i|start_x
+%s # start_pc|start_i|start_x
 
-OP_SWAP
-OP_DUP
-OP_2 
-OP_EQUALVERIFY # enforce pc = 2 for end state
-OP_SWAP
+%s # enforce halting pc for end state
 
-OP_CAT # start_pc|start_i|start_x|end_pc
-OP_CAT # start_pc|start_i|start_x|end_pc|end_i
-OP_CAT # start_pc|start_i|start_x|end_pc|end_i|end_x
+%s # start_pc|start_i|start_x|end_pc|end_i|end_x
 OP_CAT # start_pc|start_i|start_x|end_pc|end_i|end_x|trace
 OP_SHA256
 
@@ -143,18 +335,36 @@ OP_CHECKSIG
 # ====================== ANSWER SCRIPT END =======================
 `
 
-func GenerateAnswerStr(aliceKey *btcec.PublicKey, taptree []byte) (string, error) {
-	scr := fmt.Sprintf(answerScript, taptree,
-		schnorr.SerializePubKey(aliceKey))
+func GenerateAnswerStr(aliceKey *btcec.PublicKey, taptree []byte,
+	prog *Program) (string, error) {
+
+	n := prog.Schema.NumRegisters()
+
+	// The end state is below the concatenated start state, with the pc
+	// at depth pcDepth+1.
+	pcDepth := n - 1 - prog.Schema.PC
+	haltPC := NumToOp(prog.HaltPC())
+	checkHalt := fmt.Sprintf("%s OP_PICK\n%s\nOP_EQUALVERIFY",
+		NumToOp(pcDepth+1), haltPC)
+	if pcDepth == 0 {
+		checkHalt = fmt.Sprintf("OP_SWAP\nOP_DUP\n%s\nOP_EQUALVERIFY\n"+
+			"OP_SWAP", haltPC)
+	}
+
+	scr := fmt.Sprintf(answerScript,
+		dupState(n), repeatOp("OP_TOALTSTACK", n, "\n"), catState(n),
+		repeatOp("OP_FROMALTSTACK", n, "\n"), catState(n), checkHalt,
+		repeatOp("OP_CAT", n, "\n"),
+		taptree, schnorr.SerializePubKey(aliceKey))
 	return scr, nil
 }
 
 func GenerateAnswer(aliceKey, bobKey *btcec.PublicKey, totalLevels int,
-	leaves []string) ([]byte, *txscript.IndexedTapScriptTree, error) {
+	prog *Program) ([]byte, *txscript.IndexedTapScriptTree, error) {
 
 	// Send to challenge
 	challenge, _, err := GenerateChallenge(
-		aliceKey, bobKey, totalLevels, leaves,
+		aliceKey, bobKey, totalLevels, prog,
 	)
 	if err != nil {
 		return nil, nil, err
@@ -176,7 +386,7 @@ func GenerateAnswer(aliceKey, bobKey *btcec.PublicKey, totalLevels int,
 	tapScriptTree := txscript.AssembleTaprootScriptTree(tapLeaves...)
 	taptree := tapScriptTree.RootNode.TapHash()
 
-	scr, err := GenerateAnswerStr(aliceKey, taptree[:])
+	scr, err := GenerateAnswerStr(aliceKey, taptree[:], prog)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -229,10 +439,10 @@ func GenerateChallengeStr(bobKey *btcec.PublicKey, taptree []byte) (string, erro
 }
 
 func GenerateChallenge(aliceKey, bobKey *btcec.PublicKey, totalLevels int,
-	leaves []string) ([]byte, *txscript.IndexedTapScriptTree, error) {
+	prog *Program) ([]byte, *txscript.IndexedTapScriptTree, error) {
 
 	// Send to reveal script at the first level.
-	reveal, _, err := GenerateReveal(aliceKey, bobKey, totalLevels, leaves)
+	reveal, _, err := GenerateReveal(aliceKey, bobKey, totalLevels, prog)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -281,100 +491,43 @@ var revealScript = `
 # start_x, start_i, start_pc
 # we build the two subtrees from the stack variables
 # subtree: start|mid|sub_commitment
-OP_3DUP
-OP_TOALTSTACK
-OP_TOALTSTACK
-OP_TOALTSTACK # copy start state to alt stack
-
-OP_CAT # start_pc|start_i
-OP_CAT # start_pc|start_i|start_x
-
-# copy mid stat to alt stack
-OP_SWAP
-OP_DUP
-OP_TOALTSTACK
-OP_SWAP
-OP_CAT # start_pc|start_i|start_x|mid_pc
+%s
+%s # copy start state to alt stack
 
-OP_SWAP
-OP_DUP
-OP_TOALTSTACK
-OP_SWAP
-OP_CAT # start_pc|start_i|start_x|mid_pc|mid_i
+%s # start_pc|start_i|start_x
 
-OP_SWAP
-OP_DUP
-OP_TOALTSTACK
-OP_SWAP
-OP_CAT # start_pc|start_i|start_x|mid_pc|mid_i|mid_x
+# copy mid state to alt stack
+%s # start_pc|start_i|start_x|mid_pc|mid_i|mid_x
 
-#OP_SWAP
-#OP_DUP
-#OP_TOALTSTACK
-#OP_SWAP
 OP_CAT # sub1 = start_pc|start_i|start_x|mid_pc|mid_i|mid_x|sub1_commit
 
 OP_SHA256 # h(sub1)
 
-OP_FROMALTSTACK
-OP_FROMALTSTACK
-OP_FROMALTSTACK # mid state from alt stack
+%s # mid state from alt stack
 
-OP_CAT # mid_pc|mid_i
-OP_CAT # mid_pc|mid_i|mid_x
+%s # mid_pc|mid_i|mid_x
 OP_SWAP
 OP_TOALTSTACK # h(sub1) to alt stack
 
 # copy end state to alt stack
-OP_SWAP
-OP_DUP
-OP_TOALTSTACK
-OP_SWAP
-OP_CAT # mid_pc|mid_i|mid_x|end_pc
+%s # mid_pc|mid_i|mid_x|end_pc|end_i|end_x
 
-OP_SWAP
-OP_DUP
-OP_TOALTSTACK
-OP_SWAP
-OP_CAT # mid_pc|mid_i|mid_x|end_pc|end_i
-
-OP_SWAP
-OP_DUP
-OP_TOALTSTACK
-OP_SWAP
-OP_CAT # mid_pc|mid_i|mid_x|end_pc|end_i|end_x
-
-#OP_SWAP
-#OP_DUP
-#OP_TOALTSTACK
-#OP_SWAP
 OP_CAT # sub2 = mid_pc|mid_i|mid_x|end_pc|end_i|end_x|sub2_commit
 OP_SHA256 # h(sub2)
 
 # end state from alt stack
-OP_FROMALTSTACK
-OP_FROMALTSTACK
-OP_FROMALTSTACK # end state from alt stack
+%s # end state from alt stack
 
 # h(sub1) from alt stack
 OP_FROMALTSTACK
 
-# start state from alt stack
-OP_FROMALTSTACK
-OP_SWAP # keep h(sub1) on top
-OP_FROMALTSTACK
-OP_SWAP
-OP_FROMALTSTACK 
-OP_SWAP
+# start state from alt stack, keeping h(sub1) on top
+%s
 
 # h(sub1) to alt stack
 OP_TOALTSTACK
 
-OP_CAT # start_pc|start_i
-OP_CAT # start_pc|start_i|start_x
-OP_CAT # start_pc|start_i|start_x|end_pc
-OP_CAT # start_pc|start_i|start_x|end_pc|end_i
-OP_CAT # start_pc|start_i|start_x|end_pc|end_i|end_x
+%s # start_pc|start_i|start_x|end_pc|end_i|end_x
 
 OP_FROMALTSTACK # h(sub1) from alt stack
 OP_ROT
@@ -409,17 +562,25 @@ OP_CHECKSIG
 # ====================== REVEAL SCRIPT END =======================
 `
 
-func GenerateRevealStr(aliceKey *btcec.PublicKey, taptree []byte) (string, error) {
-	scr := fmt.Sprintf(revealScript, taptree,
-		schnorr.SerializePubKey(aliceKey))
+func GenerateRevealStr(aliceKey *btcec.PublicKey, taptree []byte,
+	prog *Program) (string, error) {
+
+	n := prog.Schema.NumRegisters()
+	scr := fmt.Sprintf(revealScript,
+		dupState(n), repeatOp("OP_TOALTSTACK", n, "\n"), catState(n),
+		copyToAlt(n), repeatOp("OP_FROMALTSTACK", n, "\n"), catState(n),
+		copyToAlt(n), repeatOp("OP_FROMALTSTACK", n, "\n"),
+		repeatOp("OP_FROMALTSTACK\nOP_SWAP", n, "\n"),
+		repeatOp("OP_CAT", 2*n-1, "\n"),
+		taptree, schnorr.SerializePubKey(aliceKey))
 	return scr, nil
 }
 
 func GenerateReveal(aliceKey, bobKey *btcec.PublicKey, level int,
-	leaves []string) ([]byte, *txscript.IndexedTapScriptTree, error) {
+	prog *Program) ([]byte, *txscript.IndexedTapScriptTree, error) {
 
 	// Always send to choose
-	choose, _, err := GenerateChoose(aliceKey, bobKey, level, leaves)
+	choose, _, err := GenerateChoose(aliceKey, bobKey, level, prog)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -440,7 +601,7 @@ func GenerateReveal(aliceKey, bobKey *btcec.PublicKey, level int,
 	tapScriptTree := txscript.AssembleTaprootScriptTree(tapLeaves...)
 	taptree := tapScriptTree.RootNode.TapHash()
 
-	scr, err := GenerateRevealStr(aliceKey, taptree[:])
+	scr, err := GenerateRevealStr(aliceKey, taptree[:], prog)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -504,7 +665,7 @@ func GenerateChooseStr(bobKey *btcec.PublicKey,
 // level 1 == last before leaf.
 // returns input script and required output taptree
 func GenerateChoose(aliceKey, bobKey *btcec.PublicKey, level int,
-	leaves []string) ([]byte, *txscript.IndexedTapScriptTree, error) {
+	prog *Program) ([]byte, *txscript.IndexedTapScriptTree, error) {
 
 	if level < 1 {
 		return nil, nil, fmt.Errorf("level 0 only for leaf")
@@ -514,13 +675,13 @@ func GenerateChoose(aliceKey, bobKey *btcec.PublicKey, level int,
 	// Send to leaves.
 	if level == 1 {
 		var err error
-		tapLeaves, err = LeafTapLeaves(aliceKey, bobKey, leaves)
+		tapLeaves, err = LeafTapLeaves(aliceKey, bobKey, prog)
 		if err != nil {
 			return nil, nil, err
 		}
 	} else {
 		// Send to reveal script one level down.
-		reveal, _, err := GenerateReveal(aliceKey, bobKey, level-1, leaves)
+		reveal, _, err := GenerateReveal(aliceKey, bobKey, level-1, prog)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -560,20 +721,38 @@ func GenerateChoose(aliceKey, bobKey *btcec.PublicKey, level int,
 	return parsed, tapScriptTree, nil
 }
 
+// LeafTapLeaves returns the leaf scripts of the program, one for every pc. It
+// fails if the program relies on flags the Network doesn't enforce, the leaf
+// scripts use opcodes it doesn't enable, or a step doesn't map a state to a
+// state as checked by CheckStackEffects.
 func LeafTapLeaves(aliceKey, bobKey *btcec.PublicKey,
-	leaves []string) ([]txscript.TapLeaf, error) {
+	prog *Program) ([]txscript.TapLeaf, error) {
+
+	if err := Network.Covers(prog.ExecEnv()); err != nil {
+		return nil, fmt.Errorf("program cannot be disputed on the "+
+			"network: %v", err)
+	}
+
+	// The leaf scripts hash the stack left by the step as the end state,
+	// so a step leaving anything else can't be disputed.
+	if err := prog.CheckStackEffects(); err != nil {
+		return nil, fmt.Errorf("program cannot be disputed: %v", err)
+	}
 
 	var tapLeaves []txscript.TapLeaf
-	for pcc, leaf := range leaves {
+	for pcc := range prog.Steps {
 		pc := uint16(pcc)
 
-		leafScr, err := GenerateLeaf(
-			aliceKey, pc, string(leaf),
-		)
+		leafScr, err := GenerateLeaf(aliceKey, prog, pc)
 		if err != nil {
 			return nil, err
 		}
 
+		if err := Network.CheckScript(leafScr); err != nil {
+			return nil, fmt.Errorf("leaf script for pc %d cannot "+
+				"be used on the network: %v", pc, err)
+		}
+
 		t := txscript.NewBaseTapLeaf(leafScr)
 		tapLeaves = append(tapLeaves, t)
 	}
@@ -583,21 +762,24 @@ func LeafTapLeaves(aliceKey, bobKey *btcec.PublicKey,
 
 const leafScript = `
 # ====================== LEAF SCRIPT =======================
-# expect pc to be top stack element. Check that it matches.
-OP_DUP 
+# move the step hints above the state out of the way.
+%s
+
+# expect pc to be in the state on the stack. Check that it matches.
+%s
 %s
 OP_EQUALVERIFY
 
-# stack is x|i|pc. Duplicate and run the subscript.
-OP_3DUP
+# stack is the state, e.g. x|i|pc. Duplicate and run the subscript with the
+# hints on top.
+%s
+%s
 %s
 
 # top of stack is now new state. Hash new+oldstate together. This is our commitment
-OP_CAT # pc|i
-OP_CAT # pc|i|x
+%s # pc|i|x
 OP_TOALTSTACK # new state to alt stack
-OP_CAT # pc|i
-OP_CAT # pc|i|x
+%s # pc|i|x
 OP_FROMALTSTACK # new state from alt stack
 OP_SWAP
 OP_CAT # pc|i|x|pc|i|x
@@ -623,37 +805,60 @@ OP_CHECKSIG
 # ====================== LEAF SCRIPT END =======================
 `
 
+// pcToOp returns the script push of the given pc value, using the small
+// integer opcodes where possible.
 func pcToOp(pc uint16) (string, error) {
+	return NumToOp(int(pc)), nil
+}
 
-	switch pc {
-	case 0:
-		return "OP_0", nil
-	case 1:
-		return "OP_1", nil
-	case 2:
-		return "OP_2", nil
+// NumToOp returns the script push of the given number, using the small
+// integer opcodes where possible.
+func NumToOp(n int) string {
+	switch {
+	case n == 0:
+		return "OP_0"
+	case n > 0 && n <= 16:
+		return fmt.Sprintf("OP_%d", n)
 	default:
-		return "", fmt.Errorf("unknown pc %d", pc)
+		return fmt.Sprintf("%x", commitment.ScriptNum(n).Bytes())
 	}
 }
 
-func GenerateLeafStr(aliceKey *btcec.PublicKey, pc uint16,
-	subscript string) (string, error) {
+func GenerateLeafStr(aliceKey *btcec.PublicKey, prog *Program,
+	pc uint16) (string, error) {
+
+	if int(pc) >= len(prog.Steps) {
+		return "", fmt.Errorf("pc %d out of range", pc)
+	}
 
 	pcStr, err := pcToOp(pc)
 	if err != nil {
 		return "", err
 	}
 
-	scr := fmt.Sprintf(leafScript, pcStr, subscript,
+	// Copy the pc to the top of the stack to check it.
+	n := prog.Schema.NumRegisters()
+	pcDepth := n - 1 - prog.Schema.PC
+	pickPC := "OP_DUP"
+	if pcDepth > 0 {
+		pickPC = fmt.Sprintf("%s OP_PICK", NumToOp(pcDepth))
+	}
+
+	// The hints are on top of the start state, and are not part of the
+	// commitment.
+	numHints := prog.NumHints(int(pc))
+	scr := fmt.Sprintf(leafScript,
+		repeatOp("OP_TOALTSTACK", numHints, "\n"), pickPC, pcStr,
+		dupState(n), repeatOp("OP_FROMALTSTACK", numHints, "\n"),
+		prog.StepScript(int(pc)), catState(n), catState(n),
 		schnorr.SerializePubKey(aliceKey))
 	return scr, nil
 }
 
-func GenerateLeaf(aliceKey *btcec.PublicKey, pc uint16,
-	subscript string) ([]byte, error) {
+func GenerateLeaf(aliceKey *btcec.PublicKey, prog *Program,
+	pc uint16) ([]byte, error) {
 
-	scr, err := GenerateLeafStr(aliceKey, pc, subscript)
+	scr, err := GenerateLeafStr(aliceKey, prog, pc)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,253 @@
+package checkpoint
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/mattlab/tracer/store"
+	"github.com/halseth/mattlab/tracer/trace"
+)
+
+// errSegmentFull is returned by a segment sink given more states than the
+// segment holds, stopping the re-execution.
+var errSegmentFull = errors.New("segment full")
+
+// Source is a trace source keeping only every k-th state of a trace, the
+// checkpoints. Other states are computed on demand by re-executing the program
+// from the checkpoint before them, trading CPU for memory: a trace of n states
+// takes about n/k states to keep, and reading a state not in the last
+// re-executed segment takes up to k steps.
+//
+// For programs with a memory, a copy of the memory is kept with every
+// checkpoint. Steps taking prover hints are given the hints of the tracing
+// options by their index in the trace, so the options must give them by index,
+// like trace.RecordedHints, rather than in execution order like
+// trace.HintTape.
+//
+// NOTE: not safe for concurrent use.
+type Source struct {
+	prog     *scripts.Program
+	opts     *trace.Options
+	interval int
+
+	// checkpoints are the states at every interval-th index up to the
+	// halting state, with the memory at each of them for programs with a
+	// memory.
+	checkpoints [][][]byte
+	memories    []*memory.Memory
+
+	// steps is the number of executed steps, the states after the
+	// halting state at index steps being copies of it.
+	steps int
+	last  [][]byte
+
+	numStates int
+
+	// segment is the last re-executed segment, starting at the
+	// checkpoint with index segmentStart.
+	segment      [][][]byte
+	segmentStart int
+
+	// reexecuted is the number of steps re-executed for reading states.
+	reexecuted int
+}
+
+// A compile time check to ensure Source implements the store.Source
+// interface.
+var _ store.Source = (*Source)(nil)
+
+// Trace traces the program from the start state like trace.GetTraceFromState
+// with the given options, keeping a checkpoint every interval states. The
+// options are kept to re-execute segments of the trace, and must not have a
+// sink.
+func Trace(ctx context.Context, prog *scripts.Program, startState [][]byte,
+	interval int, opts *trace.Options) (*Source, error) {
+
+	if interval < 1 {
+		return nil, fmt.Errorf("checkpoint interval must be positive, "+
+			"got %d", interval)
+	}
+
+	if opts == nil {
+		opts = trace.DefaultOptions()
+	}
+	if opts.Sink != nil {
+		return nil, fmt.Errorf("checkpointed trace cannot have a sink")
+	}
+
+	s := &Source{
+		prog:         prog,
+		opts:         opts,
+		interval:     interval,
+		segmentStart: -1,
+	}
+
+	// The memory is modified in place by the trace, so the recorder can
+	// copy it at the checkpoints.
+	traceOpts := *opts
+	traceOpts.Micro = false
+	if prog.Memory != nil {
+		mem := opts.Memory
+		if mem == nil {
+			var err error
+			mem, err = memory.New(prog.Memory.Depth, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		traceOpts.Memory = mem.Copy()
+	}
+	traceOpts.Sink = &recorder{
+		source: s,
+		mem:    traceOpts.Memory,
+	}
+
+	res, err := trace.GetTraceFromState(ctx, prog, startState, &traceOpts)
+	if err != nil {
+		return nil, err
+	}
+	s.steps = res.Steps
+
+	return s, nil
+}
+
+// recorder is the sink keeping the checkpoints of a trace.
+type recorder struct {
+	source *Source
+	mem    *memory.Memory
+	halted bool
+}
+
+// Append adds the next state of the trace, keeping it as a checkpoint if its
+// index is a multiple of the interval.
+//
+// NOTE: part of the trace.Sink interface.
+func (r *recorder) Append(state [][]byte) error {
+	s := r.source
+	if !r.halted && s.numStates%s.interval == 0 {
+		s.checkpoints = append(s.checkpoints, state)
+		if r.mem != nil {
+			s.memories = append(s.memories, r.mem.Copy())
+		}
+	}
+
+	// The states following the halting state are padding copies of it,
+	// they need no checkpoints.
+	pc, err := trace.GetProgramCounter(s.prog.Schema, state)
+	if err == nil && pc == s.prog.HaltPC() {
+		r.halted = true
+	}
+
+	s.last = state
+	s.numStates++
+
+	return nil
+}
+
+// Len returns the number of states in the trace.
+func (s *Source) Len() int {
+	return s.numStates
+}
+
+// State returns the state at the given index, re-executing the segment of the
+// trace holding it if it is not a checkpoint.
+func (s *Source) State(i int) ([][]byte, error) {
+	if i < 0 || i >= s.numStates {
+		return nil, fmt.Errorf("state %d out of range, trace has %d "+
+			"states", i, s.numStates)
+	}
+
+	if i >= s.steps {
+		return s.last, nil
+	}
+
+	if i%s.interval == 0 {
+		return s.checkpoints[i/s.interval], nil
+	}
+
+	start := i - i%s.interval
+	if start != s.segmentStart {
+		if err := s.reexecute(start); err != nil {
+			return nil, fmt.Errorf("re-executing from state %d: %v",
+				start, err)
+		}
+	}
+
+	return s.segment[i-start], nil
+}
+
+// Reexecuted returns the number of steps re-executed so far to read states.
+func (s *Source) Reexecuted() int {
+	return s.reexecuted
+}
+
+// reexecute re-executes the segment of the trace starting at the checkpoint
+// with the given index, up to the next checkpoint or the halting state.
+func (s *Source) reexecute(start int) error {
+	n := min(s.interval, s.steps-start)
+	sink := &segmentSink{
+		size: n + 1,
+	}
+
+	opts := *s.opts
+	opts.Micro = false
+	opts.Progress = nil
+	opts.Depth = 0
+	opts.Sink = sink
+	if s.memories != nil {
+		opts.Memory = s.memories[start/s.interval].Copy()
+	}
+
+	// Hints are given by the index in the full trace.
+	if hints := s.opts.Hints; hints != nil {
+		opts.Hints = func(step, pc int, state [][]byte) ([][]byte,
+			error) {
+
+			return hints(start+step, pc, state)
+		}
+	}
+
+	// Tracing is stopped by the sink once the segment is full, unless
+	// it ends in the halting state.
+	_, err := trace.GetTraceFromState(
+		context.Background(), s.prog, s.checkpoints[start/s.interval],
+		&opts,
+	)
+	if len(sink.states) < sink.size {
+		if err == nil {
+			err = fmt.Errorf("program halted after %d steps, "+
+				"expected %d", len(sink.states)-1, n)
+		}
+
+		return err
+	}
+
+	s.segment = sink.states
+	s.segmentStart = start
+	s.reexecuted += n
+
+	return nil
+}
+
+// segmentSink is the sink collecting the states of a re-executed segment.
+type segmentSink struct {
+	size   int
+	states [][][]byte
+}
+
+// Append adds the next state of the segment, stopping tracing once it is
+// full.
+//
+// NOTE: part of the trace.Sink interface.
+func (s *segmentSink) Append(state [][]byte) error {
+	if len(s.states) == s.size {
+		return errSegmentFull
+	}
+
+	s.states = append(s.states, state)
+	return nil
+}
@@ -0,0 +1,133 @@
+package checkpoint_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/halseth/mattlab/cpu"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/checkpoint"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/stretchr/testify/require"
+)
+
+// sumSrc sums the numbers from 1 to r0 on the CPU, storing the sum in memory.
+const sumSrc = `	LI r1 0
+loop:	JZ r0 done
+	ADD r1 r0
+	SUBI r0 1
+	JMP loop
+done:	LI r2 sum
+	STORE r1 r2
+	HALT
+sum:	DATA 0
+`
+
+// checkStates checks that the checkpointed source gives the states of the
+// full trace, read forwards, backwards and jumping between segments.
+func checkStates(t *testing.T, src *checkpoint.Source, tr [][][]byte) {
+	t.Helper()
+
+	require.Equal(t, len(tr), src.Len())
+
+	var order []int
+	for i := range tr {
+		order = append(order, i)
+	}
+	for i := len(tr) - 1; i >= 0; i-- {
+		order = append(order, i)
+	}
+	for i := 0; i < len(tr); i += 7 {
+		order = append(order, i, len(tr)-1-i)
+	}
+
+	for _, i := range order {
+		state, err := src.State(i)
+		require.NoError(t, err, i)
+		require.Equal(t, tr[i], state, i)
+	}
+
+	_, err := src.State(-1)
+	require.Error(t, err)
+	_, err = src.State(len(tr))
+	require.Error(t, err)
+}
+
+// TestStateMultiply checks the states of a checkpointed trace of the multiply
+// program against the full trace, for different intervals.
+func TestStateMultiply(t *testing.T) {
+	ctx := context.Background()
+	prog := scripts.MultiplyProgram
+
+	full, err := trace.GetTrace(ctx, prog, "02 <> <>", nil)
+	require.NoError(t, err)
+
+	start := full.Trace[0]
+	for _, interval := range []int{1, 2, 3, 4, 5, 16, 17, 100} {
+		src, err := checkpoint.Trace(ctx, prog, start, interval, nil)
+		require.NoError(t, err, interval)
+		checkStates(t, src, full.Trace)
+	}
+}
+
+// TestStateMemory checks the states of a checkpointed trace of the CPU, a
+// program with a memory and prover hints, against the full trace.
+func TestStateMemory(t *testing.T) {
+	ctx := context.Background()
+
+	img, err := cpu.Assemble(sumSrc)
+	require.NoError(t, err)
+	prog, err := img.Program()
+	require.NoError(t, err)
+	start, err := img.StartState(6)
+	require.NoError(t, err)
+
+	mem, err := img.Memory()
+	require.NoError(t, err)
+	opts := trace.DefaultOptions()
+	opts.Strict = trace.StrictAbort
+	opts.Memory = mem
+	opts.Hints = cpu.Hints(mem)
+	full, err := trace.GetTraceFromState(ctx, prog, start, opts)
+	require.NoError(t, err)
+
+	for _, interval := range []int{1, 3, 8, 13} {
+		mem, err := img.Memory()
+		require.NoError(t, err)
+
+		opts := trace.DefaultOptions()
+		opts.Strict = trace.StrictAbort
+		opts.Memory = mem
+		opts.Hints = trace.RecordedHints(prog, full.Hints)
+
+		src, err := checkpoint.Trace(ctx, prog, start, interval, opts)
+		require.NoError(t, err, interval)
+		checkStates(t, src, full.Trace)
+
+		// The memory given is not modified.
+		root := mem.Root()
+		require.Equal(t, start[prog.Memory.Root], root[:])
+	}
+}
+
+// discard is a sink dropping the states.
+type discard struct{}
+
+func (d *discard) Append([][]byte) error {
+	return nil
+}
+
+// TestTraceErrors checks that invalid options are rejected.
+func TestTraceErrors(t *testing.T) {
+	ctx := context.Background()
+	prog := scripts.MultiplyProgram
+	start := [][]byte{{2}, {}, {}}
+
+	_, err := checkpoint.Trace(ctx, prog, start, 0, nil)
+	require.Error(t, err)
+
+	opts := trace.DefaultOptions()
+	opts.Sink = &discard{}
+	_, err = checkpoint.Trace(ctx, prog, start, 4, opts)
+	require.Error(t, err)
+}
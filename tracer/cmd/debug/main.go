@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/halseth/mattlab/loader"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/cmd/tracer/print"
+	"github.com/halseth/mattlab/tracer/debug"
+	"github.com/halseth/mattlab/tracer/trace"
+)
+
+var (
+	maxSteps = flag.Int("maxsteps", trace.DefaultMaxSteps,
+		"maximum number of steps to execute per continue")
+	programPath = flag.String("program", "", "file to load the program "+
+		"from, "+loader.AsmExt+" files are assembled and "+
+		loader.SourceExt+" files compiled; the multiply program if "+
+		"not set")
+	start = flag.String("start", "02 <> <>", "start stack, bottom "+
+		"element first, e.g. for the multiply program: x i pc")
+	startFile = flag.String("startfile", "", "file to read the start "+
+		"stack from, overrides -start")
+	memoryPath = flag.String("memory", "", "file to read the initial "+
+		"memory cells from, for programs with a memory; empty if not "+
+		"set")
+	hintsPath = flag.String("hints", "", "file to read the hint tape "+
+		"from, giving the steps taking prover hints their hints in "+
+		"execution order")
+)
+
+// errQuit is returned by the quit command to end the session.
+var errQuit = errors.New("quit")
+
+// command is a command of the debugger prompt.
+type command struct {
+	usage string
+	run   func(s *debug.Session, args []string) error
+}
+
+var commands = map[string]command{
+	"step": {
+		usage: "step [n]\t\texecute the next n steps, 1 if not given",
+		run:   runStep,
+	},
+	"continue": {
+		usage: "continue\t\texecute steps until a breakpoint is " +
+			"hit or the program halts",
+		run: runContinue,
+	},
+	"break": {
+		usage: "break <pc> | <reg> <op> <value>\n\t\t\tbreak at a " +
+			"pc, or when a register compares to a value by " +
+			"== != < <= > >=",
+		run: runBreak,
+	},
+	"delete": {
+		usage: "delete [n]\t\tdelete breakpoint n, all if not given",
+		run:   runDelete,
+	},
+	"info": {
+		usage: "info\t\t\tlist the breakpoints",
+		run:   runInfo,
+	},
+	"print": {
+		usage: "print\t\t\tprint the registers of the current state",
+		run:   runPrint,
+	},
+	"set": {
+		usage: "set <reg> <value>\tset a register of the current " +
+			"state, values are numbers, 0x hex or <>",
+		run: runSet,
+	},
+	"back": {
+		usage: "back [n]\t\tgo back n states, 1 if not given",
+		run:   runBack,
+	},
+	"rewind": {
+		usage: "rewind <state>\t\tgo back to the state at the given " +
+			"index",
+		run: runRewind,
+	},
+	"ops": {
+		usage: "ops\t\t\tprint the opcodes executed by the next step",
+		run:   runOps,
+	},
+	"quit": {
+		usage: "quit\t\t\tend the session",
+		run: func(*debug.Session, []string) error {
+			return errQuit
+		},
+	},
+}
+
+// The help command lists the commands, so it is added once they are defined.
+func init() {
+	commands["help"] = command{
+		usage: "help\t\t\tprint this help",
+		run:   runHelp,
+	}
+}
+
+// aliases are the short names of commands.
+var aliases = map[string]string{
+	"s": "step",
+	"c": "continue",
+	"b": "break",
+	"d": "delete",
+	"p": "print",
+	"q": "quit",
+}
+
+// debug is an interactive debugger stepping through the execution of a
+// program, reading commands from stdin.
+func main() {
+	flag.Parse()
+	err := run()
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	prog := scripts.MultiplyProgram
+	var err error
+	if *programPath != "" {
+		prog, err = loader.LoadProgram(*programPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	startStackStr := *start
+	if *startFile != "" {
+		startStackStr, err = loader.LoadStartStack(*startFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	startState, err := trace.ParseStartStack(startStackStr)
+	if err != nil {
+		return err
+	}
+
+	opts := &debug.Options{}
+	if *memoryPath != "" {
+		opts.Memory, err = loader.LoadMemory(*memoryPath, prog)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *hintsPath != "" {
+		opts.HintTape, err = loader.LoadHintTape(*hintsPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	s, err := debug.NewSession(prog, startState, opts)
+	if err != nil {
+		return err
+	}
+
+	printState(s)
+	return repl(s, os.Stdin)
+}
+
+// repl reads and runs commands until quit or the end of the input. Failing
+// commands print their error and leave the session as it was.
+func repl(s *debug.Session, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Print("(debug) ")
+		if !scanner.Scan() {
+			fmt.Println()
+			return scanner.Err()
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		name := fields[0]
+		if full, ok := aliases[name]; ok {
+			name = full
+		}
+
+		cmd, ok := commands[name]
+		if !ok {
+			fmt.Printf("unknown command %s, see help\n", fields[0])
+			continue
+		}
+
+		err := cmd.run(s, fields[1:])
+		if err == errQuit {
+			return nil
+		}
+		if err != nil {
+			printError(err)
+		}
+	}
+}
+
+// printError prints the error of a command, and for failing steps the
+// opcodes executed up to the failure.
+func printError(err error) {
+	fmt.Println("error:", err)
+
+	var stepErr *trace.StepError
+	if !errors.As(err, &stepErr) {
+		return
+	}
+
+	for _, op := range stepErr.Ops {
+		fmt.Println("\t" + print.OpString(op))
+	}
+}
+
+// printState prints a single line summary of the current state.
+func printState(s *debug.Session) {
+	els := make([]string, len(s.State()))
+	for i, el := range s.State() {
+		els[i] = print.ElementString(el)
+	}
+
+	status := ""
+	if s.Halted() {
+		status = " (halted)"
+	}
+
+	fmt.Printf("state %d: %s%s\n", s.Step(), strings.Join(els, " "),
+		status)
+}
+
+// parseCount parses the optional count argument of a command, 1 if not given.
+func parseCount(args []string) (int, error) {
+	if len(args) == 0 {
+		return 1, nil
+	}
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid count %q", args[0])
+	}
+
+	return n, nil
+}
+
+func runStep(s *debug.Session, args []string) error {
+	n, err := parseCount(args)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		if err := s.Next(); err != nil {
+			return err
+		}
+	}
+
+	printState(s)
+	return nil
+}
+
+func runContinue(s *debug.Session, _ []string) error {
+	if s.Halted() {
+		return debug.ErrHalted
+	}
+
+	b, err := s.Continue(*maxSteps)
+	if b != nil {
+		fmt.Printf("breakpoint %s hit\n",
+			b.Format(s.Program().Schema))
+	}
+	printState(s)
+
+	return err
+}
+
+func runBreak(s *debug.Session, args []string) error {
+	b, err := debug.ParseBreakpoint(
+		s.Program().Schema, strings.Join(args, " "),
+	)
+	if err != nil {
+		return err
+	}
+
+	s.AddBreakpoint(b)
+	fmt.Printf("breakpoint %d: %s\n", len(s.Breakpoints())-1,
+		b.Format(s.Program().Schema))
+
+	return nil
+}
+
+func runDelete(s *debug.Session, args []string) error {
+	if len(args) == 0 {
+		for len(s.Breakpoints()) > 0 {
+			if err := s.DeleteBreakpoint(0); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	i, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid breakpoint %q", args[0])
+	}
+
+	return s.DeleteBreakpoint(i)
+}
+
+func runInfo(s *debug.Session, _ []string) error {
+	for i, b := range s.Breakpoints() {
+		fmt.Printf("%d\t%s\n", i, b.Format(s.Program().Schema))
+	}
+
+	return nil
+}
+
+func runPrint(s *debug.Session, _ []string) error {
+	sch := s.Program().Schema
+	fmt.Printf("state %d\n", s.Step())
+	for i, el := range s.State() {
+		fmt.Printf("\t%s\t%s\n", sch.Registers[i].Name,
+			print.ElementString(el))
+	}
+
+	return nil
+}
+
+func runSet(s *debug.Session, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: set <reg> <value>")
+	}
+
+	reg, ok := s.Program().Schema.Index(args[0])
+	if !ok {
+		return fmt.Errorf("unknown register %s", args[0])
+	}
+
+	value, err := debug.ParseValue(args[1])
+	if err != nil {
+		return err
+	}
+
+	if err := s.Set(reg, value); err != nil {
+		return err
+	}
+
+	printState(s)
+	return nil
+}
+
+func runBack(s *debug.Session, args []string) error {
+	n, err := parseCount(args)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Rewind(s.Step() - n); err != nil {
+		return err
+	}
+
+	printState(s)
+	return nil
+}
+
+func runRewind(s *debug.Session, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: rewind <state>")
+	}
+
+	step, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fmt.Errorf("invalid state %q", args[0])
+	}
+
+	if err := s.Rewind(step); err != nil {
+		return err
+	}
+
+	printState(s)
+	return nil
+}
+
+func runOps(s *debug.Session, _ []string) error {
+	ops, err := s.Ops()
+	for _, op := range ops {
+		fmt.Println("\t" + print.OpString(op))
+	}
+
+	return err
+}
+
+func runHelp(*debug.Session, []string) error {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Println(commands[name].usage)
+	}
+
+	var short []string
+	for alias, name := range aliases {
+		short = append(short, alias+"="+name)
+	}
+	sort.Strings(short)
+	fmt.Println("aliases:", strings.Join(short, " "))
+
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/cmd/tracer/print"
+	"github.com/halseth/mattlab/tracer/diff"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/mattlab/tracer/trace"
+)
+
+const diffUsage = "diff [flags] <trace a> [trace b]"
+
+// runDiff compares two traces, or a trace against a re-execution of the
+// program from its start state, and reports the first divergent state. Traces
+// diverging is an error.
+func runDiff(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	format := fs.String("format", string(print.FormatText), "format of "+
+		"the trace files: text, hex, json, or store for trace "+
+		"stores written by the tracer")
+	programPath := fs.String("program", "", "file to load the program "+
+		"to re-execute from, the multiply program if not set")
+	memoryPath := fs.String("memory", "", "file to read the initial "+
+		"memory cells of the re-execution from, for programs with a "+
+		"memory; empty if not set")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: trace "+diffUsage)
+		fmt.Fprintln(fs.Output(), "compares trace a against trace b, "+
+			"or against a re-execution of the program if not given")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 && fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("expected one or two traces")
+	}
+
+	hA, a, err := readTrace(fs.Arg(0), *format)
+	if err != nil {
+		return fmt.Errorf("trace a: %v", err)
+	}
+
+	var b [][][]byte
+	nameB := "re-execution"
+	if fs.NArg() == 2 {
+		var hB *print.Header
+		hB, b, err = readTrace(fs.Arg(1), *format)
+		if err != nil {
+			return fmt.Errorf("trace b: %v", err)
+		}
+
+		if !hA.Schema.Equal(hB.Schema) {
+			return fmt.Errorf("trace schemas %q and %q differ",
+				hA.Schema, hB.Schema)
+		}
+		nameB = fs.Arg(1)
+	} else {
+		prog, err := loadProgram(*programPath)
+		if err != nil {
+			return err
+		}
+
+		mem, err := loadMemory(*memoryPath, prog)
+		if err != nil {
+			return err
+		}
+
+		b, err = reExecute(prog, mem, hA, a)
+		if err != nil {
+			return err
+		}
+	}
+
+	d, err := diff.Traces(hA.Schema, a, b)
+	if err != nil {
+		return err
+	}
+
+	if d == nil {
+		fmt.Printf("traces are equal (%d states)\n", len(a))
+		return nil
+	}
+
+	if d.Step == 0 {
+		fmt.Println("traces diverge at start state 0")
+	} else {
+		fmt.Printf("traces diverge at state %d, produced by the step "+
+			"at pc %d from state %d\n", d.Step, d.PC, d.Step-1)
+		fmt.Printf("state %d:\t%s\n", d.Step-1,
+			stateString(a[d.Step-1]))
+	}
+
+	if len(d.Registers) == 0 {
+		fmt.Printf("%s has %d states, %s has %d states\n", fs.Arg(0),
+			len(a), nameB, len(b))
+	} else {
+		fmt.Printf("register\t%s\t%s\n", fs.Arg(0), nameB)
+		for _, r := range d.Registers {
+			fmt.Printf("%s\t%s\t%s\n", r.Register.Name,
+				print.ElementString(r.A),
+				print.ElementString(r.B))
+		}
+	}
+
+	return fmt.Errorf("traces diverge at state %d", d.Step)
+}
+
+// reExecute traces the program from the start state of the given trace,
+// padding it to the same length. The memory is the initial memory of programs
+// with a memory, nil if empty. Steps taking prover hints are given the hints
+// recorded along the trace.
+func reExecute(prog *scripts.Program, mem *memory.Memory, h *print.Header,
+	tr [][][]byte) ([][][]byte, error) {
+
+	if err := checkProgram(h, prog); err != nil {
+		return nil, err
+	}
+
+	if len(tr) == 0 {
+		return nil, fmt.Errorf("empty trace")
+	}
+
+	// Pad to the depth of the given trace, if it is padded.
+	opts := trace.DefaultOptions()
+	opts.Memory = mem
+	opts.Hints = trace.RecordedHints(prog, h.Hints)
+	for d := 1; 1<<d+1 <= len(tr); d++ {
+		if 1<<d+1 == len(tr) {
+			opts.Depth = d
+		}
+	}
+
+	res, err := trace.GetTraceFromState(
+		context.Background(), prog, tr[0], opts,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Trace, nil
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/halseth/mattlab/tracer/cmd/tracer/print"
+	"github.com/halseth/mattlab/tracer/diff"
+	"github.com/halseth/mattlab/tracer/fault"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/halseth/mattlab/tracer/store"
+	"github.com/halseth/mattlab/tracer/verify"
+)
+
+const injectUsage = "inject [flags] <trace>"
+
+// runInject injects a fault into a valid trace, and writes the faulty trace.
+func runInject(args []string) error {
+	fs := flag.NewFlagSet("inject", flag.ExitOnError)
+	format := fs.String("format", string(print.FormatText), "format of "+
+		"the trace files: text, hex or json")
+	programPath := fs.String("program", "", "file to load the program "+
+		"from, the multiply program if not set")
+	memoryPath := fs.String("memory", "", "file to read the initial "+
+		"memory cells from, for programs with a memory; empty if not "+
+		"set")
+	kind := fs.String("fault", fault.Register.String(), "kind of fault: "+
+		"register, skip, pc, padding or truncate")
+	step := fs.Int("step", 1, "index of the state to inject the fault at")
+	register := fs.String("register", "", "register to set for "+
+		"register and padding faults, the bottom register if not set")
+	value := fs.String("value", "", "hex value to set, <> for the empty "+
+		"value; the correct value is perturbed if not set")
+	output := fs.String("o", "", "file to write the faulty trace to, "+
+		"stdout if not set")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: trace "+injectUsage)
+		fmt.Fprintln(fs.Output(), "injects a fault into a valid trace, "+
+			"keeping the other transitions valid")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one trace")
+	}
+
+	traceFormat, err := print.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	h, tr, err := readTrace(fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+
+	prog, err := loadProgram(*programPath)
+	if err != nil {
+		return err
+	}
+
+	if err := checkProgram(h, prog); err != nil {
+		return err
+	}
+
+	mem, err := loadMemory(*memoryPath, prog)
+	if err != nil {
+		return err
+	}
+
+	f := &fault.Fault{}
+	f.Kind, err = fault.ParseKind(*kind)
+	if err != nil {
+		return err
+	}
+	f.Step = *step
+
+	if *register != "" {
+		var ok bool
+		f.Register, ok = prog.Schema.Index(*register)
+		if !ok {
+			return fmt.Errorf("unknown register %s", *register)
+		}
+	}
+
+	switch *value {
+	case "":
+	case "<>":
+		f.Value = []byte{}
+	default:
+		f.Value, err = hex.DecodeString(*value)
+		if err != nil {
+			return fmt.Errorf("invalid value %q: %v", *value, err)
+		}
+	}
+
+	// Only inject into valid traces, so that the fault is the only
+	// invalid transition. Verifying replays the memory, so it is given a
+	// copy.
+	verifyOpts := &verify.Options{
+		Hints: h.Hints,
+	}
+	if mem != nil {
+		verifyOpts.Memory = mem.Copy()
+	}
+
+	res, err := verify.Trace(prog, store.Memory(tr), verifyOpts)
+	if err != nil {
+		return err
+	}
+	if !res.Valid() {
+		return fmt.Errorf("trace is not valid, has %d invalid "+
+			"transitions", len(res.Transitions))
+	}
+
+	faulty, hints, err := fault.Inject(
+		context.Background(), prog, tr, f, mem, h.Hints,
+	)
+	if err != nil {
+		return err
+	}
+
+	header := &print.Header{
+		Schema:  h.Schema,
+		Program: h.Program,
+		Steps:   executedSteps(h.Schema, faulty),
+		Depth:   h.Depth,
+		Env:     h.Env,
+		Hints:   hints,
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		out, err = os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	if err := print.Write(out, traceFormat, header, faulty); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "injected %v\n", f)
+	return nil
+}
+
+// executedSteps returns the number of steps before the trace is padded with
+// copies of its last state.
+func executedSteps(s *schema.Schema, tr [][][]byte) int {
+	steps := len(tr) - 1
+	for steps > 0 && len(diff.States(s, tr[steps-1], tr[steps])) == 0 {
+		steps--
+	}
+
+	return steps
+}
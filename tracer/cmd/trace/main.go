@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/halseth/mattlab/loader"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/cmd/tracer/print"
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/mattlab/tracer/store"
+)
+
+// command is a subcommand of the trace tool.
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"diff": {
+		usage: diffUsage,
+		run:   runDiff,
+	},
+	"inject": {
+		usage: injectUsage,
+		run:   runInject,
+	},
+	"verify": {
+		usage: verifyUsage,
+		run:   runVerify,
+	},
+}
+
+// trace is a tool for inspecting trace files.
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+
+	err := cmd.run(os.Args[2:])
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(os.Stderr, "usage: trace <command> [arguments]")
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "\t%s\n", commands[name].usage)
+	}
+}
+
+// storeFormat is the format of traces read from a trace store, as written by
+// the tracer given -store.
+const storeFormat = "store"
+
+// readTrace reads the trace file at the given path in the given format, - is
+// read from stdin.
+func readTrace(path, format string) (*print.Header, [][][]byte, error) {
+	if format == storeFormat {
+		return readStore(path)
+	}
+
+	f, err := print.ParseFormat(format)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if path == "-" {
+		return print.Read(os.Stdin, f)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	return print.Read(file, f)
+}
+
+// readStore reads the trace in the trace store at the given path, with the
+// header stored along with it.
+func readStore(path string) (*print.Header, [][][]byte, error) {
+	st, err := store.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer st.Close()
+
+	tr, err := store.ReadAll(st)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := &print.Header{
+		Schema: st.Schema(),
+		Steps:  print.UnknownSteps,
+	}
+	if m := st.Meta(); m != nil {
+		h.Program = m.Program
+		h.Steps = m.Steps
+		h.Depth = m.Depth
+		h.Hints = m.Hints
+		if m.Env != "" {
+			h.Env, err = execute.ParseEnv(m.Env)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if h.Steps != print.UnknownSteps && (h.Steps < 0 ||
+		h.Steps >= len(tr)) {
+
+		return nil, nil, fmt.Errorf("store of %d states cannot have %d "+
+			"executed steps", len(tr), h.Steps)
+	}
+
+	return h, tr, nil
+}
+
+// loadProgram loads the program at the given path, or returns the multiply
+// program if the path is empty.
+func loadProgram(path string) (*scripts.Program, error) {
+	if path == "" {
+		return scripts.MultiplyProgram, nil
+	}
+
+	return loader.LoadProgram(path)
+}
+
+// loadMemory loads the initial memory of the program from the given path, or
+// returns nil for the empty memory if the path is empty.
+func loadMemory(path string, prog *scripts.Program) (*memory.Memory, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	return loader.LoadMemory(path, prog)
+}
+
+// checkProgram checks that the trace with the given header can be of the
+// program.
+func checkProgram(h *print.Header, prog *scripts.Program) error {
+	if !h.Schema.Equal(prog.Schema) {
+		return fmt.Errorf("trace schema %q does not match program "+
+			"schema %q", h.Schema, prog.Schema)
+	}
+
+	progHash, err := prog.Hash()
+	if err != nil {
+		return err
+	}
+
+	if h.Program != nil && !bytes.Equal(h.Program, progHash[:]) {
+		return fmt.Errorf("trace is of program %x, expected %x",
+			h.Program, progHash)
+	}
+
+	if h.Env != nil && !h.Env.Equal(prog.ExecEnv()) {
+		return fmt.Errorf("trace was executed in environment %q, "+
+			"program in %q", h.Env, prog.ExecEnv())
+	}
+
+	return nil
+}
+
+// stateString returns the state as tab separated human readable elements.
+func stateString(state [][]byte) string {
+	els := make([]string, len(state))
+	for i, el := range state {
+		els[i] = print.ElementString(el)
+	}
+
+	return strings.Join(els, "\t")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/cmd/tracer/print"
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCheckProgram checks that traces are refused for programs other than the
+// one their header names.
+func TestCheckProgram(t *testing.T) {
+	prog := scripts.MultiplyProgram
+	progHash, err := prog.Hash()
+	require.NoError(t, err)
+
+	otherHash := progHash
+	otherHash[0] ^= 1
+
+	env, err := execute.ParseEnv("flags=standard opcodes=OP_CAT")
+	require.NoError(t, err)
+
+	otherSchema, err := schema.Parse("x i j pc")
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		h    *print.Header
+		err  string
+	}{{
+		name: "matching",
+		h: &print.Header{
+			Schema:  prog.Schema,
+			Program: progHash[:],
+			Env:     prog.ExecEnv(),
+		},
+	}, {
+		name: "unknown program",
+		h: &print.Header{
+			Schema: prog.Schema,
+		},
+	}, {
+		name: "wrong program hash",
+		h: &print.Header{
+			Schema:  prog.Schema,
+			Program: otherHash[:],
+		},
+		err: "trace is of program",
+	}, {
+		name: "wrong schema",
+		h: &print.Header{
+			Schema: otherSchema,
+		},
+		err: "does not match program schema",
+	}, {
+		name: "wrong environment",
+		h: &print.Header{
+			Schema: prog.Schema,
+			Env:    env,
+		},
+		err: "environment",
+	}}
+
+	for _, test := range tests {
+		err := checkProgram(test.h, prog)
+		if test.err == "" {
+			require.NoError(t, err, test.name)
+			continue
+		}
+		require.ErrorContains(t, err, test.err, test.name)
+	}
+}
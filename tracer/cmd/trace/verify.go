@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/halseth/mattlab/tracer/cmd/tracer/print"
+	"github.com/halseth/mattlab/tracer/store"
+	"github.com/halseth/mattlab/tracer/verify"
+)
+
+const verifyUsage = "verify [flags] <trace>"
+
+// runVerify re-executes every transition of a trace, and reports the invalid
+// ones.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	format := fs.String("format", string(print.FormatText), "format of "+
+		"the trace file: text, hex, json, or store for a trace "+
+		"store written by the tracer")
+	programPath := fs.String("program", "", "file to load the program "+
+		"from, the multiply program if not set")
+	memoryPath := fs.String("memory", "", "file to read the initial "+
+		"memory cells from, for programs with a memory; empty if not "+
+		"set")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: trace "+verifyUsage)
+		fmt.Fprintln(fs.Output(), "checks every transition of the trace "+
+			"against the program")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one trace")
+	}
+
+	h, tr, err := readTrace(fs.Arg(0), *format)
+	if err != nil {
+		return err
+	}
+
+	prog, err := loadProgram(*programPath)
+	if err != nil {
+		return err
+	}
+
+	if err := checkProgram(h, prog); err != nil {
+		return err
+	}
+
+	mem, err := loadMemory(*memoryPath, prog)
+	if err != nil {
+		return err
+	}
+
+	res, err := verify.Trace(prog, store.Memory(tr), &verify.Options{
+		Memory: mem,
+		Hints:  h.Hints,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, t := range res.Transitions {
+		fmt.Println(t)
+		fmt.Printf("state %d:\t%s\n", t.Step, stateString(tr[t.Step]))
+		fmt.Printf("state %d:\t%s\n", t.Step+1, stateString(tr[t.Step+1]))
+		if t.Expected != nil {
+			fmt.Printf("expected:\t%s\n", stateString(t.Expected))
+		}
+	}
+
+	if !res.Halted {
+		fmt.Printf("state %d:\t%s is not halted\n", len(tr)-1,
+			stateString(tr[len(tr)-1]))
+	}
+
+	if !res.Valid() {
+		return fmt.Errorf("trace of %d states is invalid: %d invalid "+
+			"transitions", len(tr), len(res.Transitions))
+	}
+
+	fmt.Printf("trace of %d states is valid\n", len(tr))
+	return nil
+}
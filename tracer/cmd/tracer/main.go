@@ -1,28 +1,221 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"os"
+	"os/signal"
+	"time"
 
+	"github.com/halseth/mattlab/loader"
 	"github.com/halseth/mattlab/scripts"
 	"github.com/halseth/mattlab/tracer/cmd/tracer/print"
+	"github.com/halseth/mattlab/tracer/store"
 	"github.com/halseth/mattlab/tracer/trace"
 )
 
+var (
+	maxSteps = flag.Int("maxsteps", trace.DefaultMaxSteps,
+		"maximum number of steps to trace")
+	depth = flag.Int("depth", 0, "commitment tree depth to pad the "+
+		"trace to, 0 picks the smallest that fits")
+	timeout = flag.Duration("timeout", 0, "stop tracing after this "+
+		"duration, 0 means no timeout")
+	progress = flag.Int("progress", 0, "report progress to stderr every "+
+		"n steps, 0 disables")
+	strict = flag.String("strict", trace.StrictOff.String(), "how to "+
+		"handle steps failing in the VM: off, flag or abort")
+	micro = flag.Bool("micro", false, "print the opcodes executed by "+
+		"each step as comments in the trace")
+	format = flag.String("format", string(print.FormatText), "trace "+
+		"output format: text, hex or json")
+	storePath = flag.String("store", "", "stream the trace to a trace "+
+		"store at this path instead of printing it")
+	programPath = flag.String("program", "", "file to load the program "+
+		"from, "+loader.AsmExt+" files are assembled and "+
+		loader.SourceExt+" files compiled; the multiply program if "+
+		"not set")
+	start = flag.String("start", "02 <> <>", "start stack, bottom "+
+		"element first, e.g. for the multiply program: x i pc")
+	startFile = flag.String("startfile", "", "file to read the start "+
+		"stack from, overrides -start")
+	memoryPath = flag.String("memory", "", "file to read the initial "+
+		"memory cells from, for programs with a memory; empty if not "+
+		"set")
+	hintsPath = flag.String("hints", "", "file to read the hint tape "+
+		"from, giving the steps taking prover hints their hints in "+
+		"execution order")
+	output = flag.String("o", "", "file to write the trace to, stdout "+
+		"if not set")
+)
+
 func main() {
+	flag.Parse()
 	err := run()
-	fmt.Println("err:", err)
+	if err != nil {
+		fmt.Println("err:", err)
+		os.Exit(1)
+	}
 }
 
-// x i pc
-var startStackStr = "02 <> <>"
+func run() (err error) {
+	// Stop tracing on interrupt.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	if *timeout != 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	strictMode, err := trace.ParseStrictMode(*strict)
+	if err != nil {
+		return err
+	}
+
+	traceFormat, err := print.ParseFormat(*format)
+	if err != nil {
+		return err
+	}
+
+	opts := &trace.Options{
+		MaxSteps: *maxSteps,
+		Depth:    *depth,
+		Strict:   strictMode,
+		Micro:    *micro,
+	}
+
+	if *progress > 0 {
+		start := time.Now()
+		opts.Progress = func(step int, _ [][]byte) {
+			if step%*progress != 0 {
+				return
+			}
+
+			fmt.Fprintf(os.Stderr, "traced %d steps in %v\n", step,
+				time.Since(start))
+		}
+	}
+
+	prog := scripts.MultiplyProgram
+	if *programPath != "" {
+		prog, err = loader.LoadProgram(*programPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	startStackStr := *start
+	if *startFile != "" {
+		startStackStr, err = loader.LoadStartStack(*startFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *memoryPath != "" {
+		opts.Memory, err = loader.LoadMemory(*memoryPath, prog)
+		if err != nil {
+			return err
+		}
+	}
+
+	if *hintsPath != "" {
+		tape, err := loader.LoadHintTape(*hintsPath)
+		if err != nil {
+			return err
+		}
+
+		opts.Hints = trace.HintTape(prog, tape)
+	}
+
+	var st *store.Store
+	if *storePath != "" {
+		st, err = store.Create(*storePath, prog.Schema)
+		if err != nil {
+			return err
+		}
+
+		// Closing flushes the last states, so its error is returned.
+		defer func() {
+			if cerr := st.Close(); err == nil {
+				err = cerr
+			}
+		}()
+
+		opts.Sink = st
+	}
 
-func run() error {
-	tr, err := trace.GetTrace(scripts.ScriptSteps, startStackStr)
+	res, err := trace.GetTrace(ctx, prog, startStackStr, opts)
 	if err != nil {
 		return err
 	}
 
-	print.PrintTrace(tr)
+	progHash, err := prog.Hash()
+	if err != nil {
+		return err
+	}
+
+	if st != nil {
+		// The store header only holds the schema, the rest of the
+		// trace header is stored along with it.
+		err := st.SetMeta(&store.Meta{
+			Program: progHash[:],
+			Steps:   res.Steps,
+			Depth:   res.Depth,
+			Env:     prog.ExecEnv().String(),
+			Hints:   res.Hints,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		header := &print.Header{
+			Schema:  prog.Schema,
+			Program: progHash[:],
+			Steps:   res.Steps,
+			Depth:   res.Depth,
+			Env:     prog.ExecEnv(),
+			Hints:   res.Hints,
+		}
+		out := os.Stdout
+		if *output != "" {
+			out, err = os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if cerr := out.Close(); err == nil {
+					err = cerr
+				}
+			}()
+		}
+
+		err = print.WriteMicro(
+			out, traceFormat, header, res.Trace, res.Micro,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "executed %d steps, tree depth %d\n",
+		res.Steps, res.Depth)
+
+	for _, stepErr := range res.StepErrors {
+		fmt.Fprintln(os.Stderr, stepErr)
+		for _, op := range stepErr.Ops {
+			if op.Err != nil {
+				fmt.Fprintf(os.Stderr, "failing opcode %d: %s\n",
+					op.Index, op.Opcode)
+			}
+		}
+	}
+
+	if !res.Valid() {
+		return fmt.Errorf("trace has %d failing steps",
+			len(res.StepErrors))
+	}
 
 	return nil
 }
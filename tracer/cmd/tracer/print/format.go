@@ -0,0 +1,311 @@
+package print
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/schema"
+)
+
+// Format is an encoding of a trace file.
+type Format string
+
+const (
+	// FormatText is the tab separated format with one decimal column per
+	// register. It can only hold registers that are minimally encoded
+	// numbers.
+	FormatText Format = "text"
+
+	// FormatHex is the tab separated format with one hex column per
+	// register, and empty elements written as <>.
+	FormatHex Format = "hex"
+
+	// FormatJSON is a JSON object holding the header and the states, with
+	// stack elements in hex.
+	FormatJSON Format = "json"
+)
+
+// Formats are the supported trace formats.
+var Formats = []Format{FormatText, FormatHex, FormatJSON}
+
+// ParseFormat parses the name of a trace format.
+func ParseFormat(s string) (Format, error) {
+	for _, f := range Formats {
+		if string(f) == s {
+			return f, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown trace format %q", s)
+}
+
+// UnknownSteps is the number of executed steps in headers of traces where
+// it is not known which states are padding.
+const UnknownSteps = -1
+
+// Header is the information about a trace stored along with it.
+type Header struct {
+	// Schema is the layout of the states in the trace.
+	Schema *schema.Schema
+
+	// Program is the hash of the program the trace is of, nil if not
+	// known.
+	Program []byte
+
+	// Steps is the number of executed steps, the states after state Steps
+	// are padding. UnknownSteps if not known.
+	Steps int
+
+	// Depth is the depth of the commitment tree of the padded trace, 0 if
+	// not known.
+	Depth int
+
+	// Env is the environment the steps were executed in, nil if not
+	// known.
+	Env *execute.Env
+
+	// Hints are the hints given to each executed step on top of its
+	// state, such that Hints[i] are given to the step from state i. Nil
+	// if the program takes no hints.
+	Hints [][][]byte
+}
+
+// Write writes the trace with its header in the given format.
+func Write(w io.Writer, f Format, h *Header, trace [][][]byte) error {
+	return WriteMicro(w, f, h, trace, nil)
+}
+
+// WriteMicro writes the trace like Write, including the opcodes executed by
+// each step.
+func WriteMicro(w io.Writer, f Format, h *Header, trace [][][]byte,
+	micro [][]*execute.OpStep) error {
+
+	switch f {
+	case FormatText, FormatHex:
+		return writeLines(w, f, h, trace, micro)
+
+	case FormatJSON:
+		return writeJSON(w, h, trace, micro)
+
+	default:
+		return fmt.Errorf("unknown trace format %q", f)
+	}
+}
+
+// Read reads a trace with its header in the given format.
+func Read(r io.Reader, f Format) (*Header, [][][]byte, error) {
+	var (
+		h   *Header
+		tr  [][][]byte
+		err error
+	)
+	switch f {
+	case FormatText, FormatHex:
+		h, tr, err = readLines(r, f)
+
+	case FormatJSON:
+		h, tr, err = readJSON(r)
+
+	default:
+		return nil, nil, fmt.Errorf("unknown trace format %q", f)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := h.check(tr); err != nil {
+		return nil, nil, err
+	}
+
+	return h, tr, nil
+}
+
+// check checks that the padding information in the header is consistent
+// with the trace.
+func (h *Header) check(trace [][][]byte) error {
+	if h.Steps != UnknownSteps && (h.Steps < 0 || h.Steps >= len(trace)) {
+		return fmt.Errorf("trace of %d states cannot have %d executed "+
+			"steps", len(trace), h.Steps)
+	}
+
+	if h.Depth != 0 && len(trace) != 1<<h.Depth+1 {
+		return fmt.Errorf("trace of %d states does not have depth %d",
+			len(trace), h.Depth)
+	}
+
+	if len(h.Hints) >= len(trace) {
+		return fmt.Errorf("trace of %d states cannot have hints for "+
+			"%d steps", len(trace), len(h.Hints))
+	}
+
+	return nil
+}
+
+// jsonRegister is a register in the JSON format.
+type jsonRegister struct {
+	Name  string `json:"name"`
+	Width int    `json:"width"`
+	Alt   bool   `json:"alt,omitempty"`
+}
+
+// jsonSchema is a schema in the JSON format.
+type jsonSchema struct {
+	Registers []jsonRegister `json:"registers"`
+	PC        int            `json:"pc"`
+}
+
+// jsonTrace is a trace in the JSON format. Stack elements are hex encoded.
+type jsonTrace struct {
+	Schema  jsonSchema `json:"schema"`
+	Program string     `json:"program,omitempty"`
+	Steps   *int       `json:"steps,omitempty"`
+	Depth   int        `json:"depth,omitempty"`
+	Env     string     `json:"env,omitempty"`
+	States  [][]string `json:"states"`
+
+	// Hints holds the hints given to each step.
+	Hints [][]string `json:"hints,omitempty"`
+
+	// Micro holds the opcodes executed by each step, one line per opcode.
+	Micro [][]string `json:"micro,omitempty"`
+}
+
+func writeJSON(w io.Writer, h *Header, trace [][][]byte,
+	micro [][]*execute.OpStep) error {
+
+	t := &jsonTrace{
+		Schema: jsonSchema{
+			PC: h.Schema.PC,
+		},
+		Program: hex.EncodeToString(h.Program),
+		Depth:   h.Depth,
+	}
+
+	if h.Env != nil {
+		t.Env = h.Env.String()
+	}
+
+	for _, r := range h.Schema.Registers {
+		t.Schema.Registers = append(t.Schema.Registers, jsonRegister{
+			Name:  r.Name,
+			Width: r.Width,
+			Alt:   r.Alt,
+		})
+	}
+
+	if h.Steps != UnknownSteps {
+		steps := h.Steps
+		t.Steps = &steps
+	}
+
+	for _, state := range trace {
+		els := make([]string, len(state))
+		for i, el := range state {
+			els[i] = hex.EncodeToString(el)
+		}
+		t.States = append(t.States, els)
+	}
+
+	for _, hints := range h.Hints {
+		var els []string
+		for _, el := range hints {
+			els = append(els, hex.EncodeToString(el))
+		}
+		t.Hints = append(t.Hints, els)
+	}
+
+	for _, ops := range micro {
+		lines := make([]string, len(ops))
+		for i, op := range ops {
+			lines[i] = OpString(op)
+		}
+		t.Micro = append(t.Micro, lines)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(t)
+}
+
+func readJSON(r io.Reader) (*Header, [][][]byte, error) {
+	var t jsonTrace
+	if err := json.NewDecoder(r).Decode(&t); err != nil {
+		return nil, nil, err
+	}
+
+	var registers []schema.Register
+	for _, r := range t.Schema.Registers {
+		registers = append(registers, schema.Register{
+			Name:  r.Name,
+			Width: r.Width,
+			Alt:   r.Alt,
+		})
+	}
+
+	s, err := schema.New(registers, t.Schema.PC)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h := &Header{
+		Schema: s,
+		Steps:  UnknownSteps,
+		Depth:  t.Depth,
+	}
+
+	if t.Program != "" {
+		h.Program, err = hex.DecodeString(t.Program)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid program hash: %v",
+				err)
+		}
+	}
+
+	if t.Steps != nil {
+		h.Steps = *t.Steps
+	}
+
+	if t.Env != "" {
+		h.Env, err = execute.ParseEnv(t.Env)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid environment: %v",
+				err)
+		}
+	}
+
+	for i, els := range t.Hints {
+		var hints [][]byte
+		for _, el := range els {
+			b, err := hex.DecodeString(el)
+			if err != nil {
+				return nil, nil, fmt.Errorf("hints of step "+
+					"%d: %v", i, err)
+			}
+			hints = append(hints, b)
+		}
+		h.Hints = append(h.Hints, hints)
+	}
+
+	var tr [][][]byte
+	for i, els := range t.States {
+		state := make([][]byte, len(els))
+		for j, el := range els {
+			state[j], err = hex.DecodeString(el)
+			if err != nil {
+				return nil, nil, fmt.Errorf("state %d: %v", i,
+					err)
+			}
+		}
+
+		if err := s.Validate(state); err != nil {
+			return nil, nil, fmt.Errorf("state %d: %v", i, err)
+		}
+
+		tr = append(tr, state)
+	}
+
+	return h, tr, nil
+}
@@ -2,40 +2,270 @@ package print
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"strconv"
 	"strings"
 
 	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/schema"
 )
 
-func PrintTrace(trace [][][]byte) {
-	fmt.Printf("#:\tx\ti\tpc\n")
+const (
+	// headerPrefix is the prefix of the trace header line, which holds
+	// the state schema.
+	headerPrefix = "#:"
+
+	// programPrefix is the prefix of the header line holding the program
+	// hash.
+	programPrefix = "#program:"
+
+	// stepsPrefix is the prefix of the header line holding the number of
+	// executed steps.
+	stepsPrefix = "#steps:"
+
+	// depthPrefix is the prefix of the header line holding the depth of
+	// the padded trace.
+	depthPrefix = "#depth:"
+
+	// envPrefix is the prefix of the header line holding the environment
+	// the steps were executed in.
+	envPrefix = "#env:"
+
+	// hintsPrefix is the prefix of the line following a state holding
+	// the hints given to the step executed from it, in hex.
+	hintsPrefix = "#hints:"
+
+	// commentPrefix is the prefix of comment lines, which are ignored
+	// when reading a trace.
+	commentPrefix = "#"
+
+	// emptyElement is how empty stack elements are written in the hex
+	// format.
+	emptyElement = "<>"
+
+	// maxTextLen is the maximum length of elements in the text format,
+	// which holds them as int64 numbers.
+	maxTextLen = 8
+)
+
+// PrintTrace prints the trace to stdout, with the state schema as the header
+// line and one decimal column per register.
+func PrintTrace(s *schema.Schema, trace [][][]byte) {
+	PrintMicroTrace(s, trace, nil)
+}
+
+// PrintMicroTrace prints the trace like PrintTrace, with the opcodes executed
+// by each step as comment lines following the state the step was executed
+// from. Stack elements are printed in hex, bottom to top.
+func PrintMicroTrace(s *schema.Schema, trace [][][]byte,
+	micro [][]*execute.OpStep) {
+
+	h := &Header{
+		Schema: s,
+		Steps:  UnknownSteps,
+	}
+
+	err := WriteMicro(os.Stdout, FormatText, h, trace, micro)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unable to print trace: %v\n", err)
+	}
+}
+
+// ReadTrace reads a trace in the format written by PrintTrace from stdin. The
+// state schema is read from the header line.
+func ReadTrace() (*schema.Schema, [][][]byte, error) {
+	h, tr, err := Read(os.Stdin, FormatText)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return h.Schema, tr, nil
+}
+
+// writeLines writes the trace in one of the line based formats: the header
+// lines followed by one line per state, with the hints given to and the
+// opcodes executed by each step following the state the step was executed
+// from.
+func writeLines(w io.Writer, f Format, h *Header, trace [][][]byte,
+	micro [][]*execute.OpStep) error {
+
+	s := h.Schema
+	if _, err := fmt.Fprintf(w, "%s\t%s\n", headerPrefix, s); err != nil {
+		return err
+	}
+
+	var meta []string
+	if h.Program != nil {
+		meta = append(meta, fmt.Sprintf("%s\t%x", programPrefix,
+			h.Program))
+	}
+	if h.Steps != UnknownSteps {
+		meta = append(meta, fmt.Sprintf("%s\t%d", stepsPrefix, h.Steps))
+	}
+	if h.Depth != 0 {
+		meta = append(meta, fmt.Sprintf("%s\t%d", depthPrefix, h.Depth))
+	}
+	if h.Env != nil {
+		meta = append(meta, fmt.Sprintf("%s\t%s", envPrefix, h.Env))
+	}
+	for _, m := range meta {
+		if _, err := fmt.Fprintln(w, m); err != nil {
+			return err
+		}
+	}
+
 	for j, tr := range trace {
-		x := toUint(tr[0])
-		i := toUint(tr[1])
-		ppc := toUint(tr[2])
-		fmt.Printf("%d:\t%d\t%d\t%d\n", j, x, i, ppc)
+		line := fmt.Sprintf("%d:", j)
+		for i, r := range s.Registers {
+			el, err := encodeElement(f, tr[i])
+			if err != nil {
+				return fmt.Errorf("state %d register %s: %v", j,
+					r.Name, err)
+			}
+			line += "\t" + el
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+
+		if j < len(h.Hints) && h.Hints[j] != nil {
+			_, err := fmt.Fprintf(w, "%s\t%s\n", hintsPrefix,
+				strings.Join(hexElements(h.Hints[j]), "\t"))
+			if err != nil {
+				return err
+			}
+		}
+
+		if j >= len(micro) {
+			continue
+		}
+
+		for _, op := range micro[j] {
+			_, err := fmt.Fprintf(w, "%s\t%s\n", commentPrefix,
+				OpString(op))
+			if err != nil {
+				return err
+			}
+		}
 	}
+
+	return nil
 }
 
-func ReadTrace() ([][][]byte, error) {
-	var tr [][][]byte
-	scanner := bufio.NewScanner(os.Stdin)
+// readLines reads a trace in one of the line based formats. Reading stops at
+// the first empty line.
+func readLines(r io.Reader, f Format) (*Header, [][][]byte, error) {
+	var (
+		h = &Header{
+			Steps: UnknownSteps,
+		}
+		tr [][][]byte
+	)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		text := scanner.Text()
 		if text == "" {
 			break // Exit loop if an empty line is entered
 		}
 
-		// Skip first line of trace.
-		if strings.HasPrefix(text, "#:") {
+		// First line of trace is the schema.
+		if hdr, ok := strings.CutPrefix(text, headerPrefix); ok {
+			var err error
+			h.Schema, err = schema.Parse(hdr)
+			if err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		if p, ok := strings.CutPrefix(text, programPrefix); ok {
+			var err error
+			h.Program, err = hex.DecodeString(strings.TrimSpace(p))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid program "+
+					"hash: %v", err)
+			}
+			continue
+		}
+
+		if st, ok := strings.CutPrefix(text, stepsPrefix); ok {
+			var err error
+			h.Steps, err = strconv.Atoi(strings.TrimSpace(st))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid steps: %v",
+					err)
+			}
 			continue
 		}
 
+		if d, ok := strings.CutPrefix(text, depthPrefix); ok {
+			var err error
+			h.Depth, err = strconv.Atoi(strings.TrimSpace(d))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid depth: %v",
+					err)
+			}
+			continue
+		}
+
+		if e, ok := strings.CutPrefix(text, envPrefix); ok {
+			var err error
+			h.Env, err = execute.ParseEnv(e)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid "+
+					"environment: %v", err)
+			}
+			continue
+		}
+
+		if hs, ok := strings.CutPrefix(text, hintsPrefix); ok {
+			if len(tr) == 0 {
+				return nil, nil, fmt.Errorf("hints before " +
+					"first state")
+			}
+
+			step := len(tr) - 1
+			if len(h.Hints) > step {
+				return nil, nil, fmt.Errorf("duplicate hints "+
+					"for step %d", step)
+			}
+
+			var hints [][]byte
+			for _, el := range strings.Fields(hs) {
+				b, err := decodeElement(FormatHex, el)
+				if err != nil {
+					return nil, nil, fmt.Errorf("hints of "+
+						"step %d: %v", step, err)
+				}
+				hints = append(hints, b)
+			}
+
+			for len(h.Hints) < step {
+				h.Hints = append(h.Hints, nil)
+			}
+			h.Hints = append(h.Hints, hints)
+			continue
+		}
+
+		if strings.HasPrefix(text, commentPrefix) {
+			continue
+		}
+
+		if h.Schema == nil {
+			return nil, nil, fmt.Errorf("trace has no header")
+		}
+
 		// Remove line number.
-		l := strings.Split(text, ":")[1]
+		_, l, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, nil, fmt.Errorf("state %d: missing line "+
+				"number", len(tr))
+		}
 
 		stack := strings.Split(l, "\t")
 		var state [][]byte
@@ -44,34 +274,133 @@ func ReadTrace() ([][][]byte, error) {
 				continue
 			}
 
-			u, err := strconv.ParseInt(el, 10, 64)
+			b, err := decodeElement(f, el)
 			if err != nil {
-				return nil, err
+				return nil, nil, fmt.Errorf("state %d: %v",
+					len(tr), err)
 			}
-
-			b := fromUint16(uint16(u))
 			state = append(state, b)
 		}
 
+		if err := h.Schema.Validate(state); err != nil {
+			return nil, nil, fmt.Errorf("state %d: %v", len(tr), err)
+		}
+
 		tr = append(tr, state)
 	}
 
 	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	if h.Schema == nil {
+		return nil, nil, fmt.Errorf("trace has no header")
+	}
+
+	return h, tr, nil
+}
+
+// encodeElement encodes a single stack element in the given line based
+// format. It fails if the element cannot be represented in the format
+// without loss.
+func encodeElement(f Format, b []byte) (string, error) {
+	if f == FormatHex {
+		if len(b) == 0 {
+			return emptyElement, nil
+		}
+		return hex.EncodeToString(b), nil
+	}
+
+	// The text format only holds minimally encoded numbers that fit in
+	// an int64.
+	if len(b) > maxTextLen {
+		return "", fmt.Errorf("%x is not a number, use the hex or "+
+			"json format", b)
+	}
+
+	n := toInt(b, maxTextLen)
+	if !bytes.Equal(fromInt(n), b) {
+		return "", fmt.Errorf("%x is not a minimally encoded "+
+			"number, use the hex or json format", b)
+	}
+
+	return fmt.Sprintf("%d", n), nil
+}
+
+// ElementString returns a human readable form of the stack element: the
+// number it encodes if it is a minimally encoded number, otherwise its hex
+// prefixed by 0x.
+func ElementString(b []byte) string {
+	if s, err := encodeElement(FormatText, b); err == nil {
+		return s
+	}
+
+	return "0x" + hex.EncodeToString(b)
+}
+
+// decodeElement decodes a single stack element in the given line based
+// format.
+func decodeElement(f Format, el string) ([]byte, error) {
+	if f == FormatHex {
+		if el == emptyElement {
+			return nil, nil
+		}
+		return hex.DecodeString(el)
+	}
+
+	u, err := strconv.ParseInt(el, 10, 64)
+	if err != nil {
 		return nil, err
 	}
 
-	return tr, nil
+	return fromInt(u), nil
+}
+
+// OpString returns a single line description of the opcode step.
+func OpString(op *execute.OpStep) string {
+	str := fmt.Sprintf("%d\t%s", op.Index, op.Opcode)
+	if op.Err != nil {
+		return str + fmt.Sprintf("\tfailed: %v", op.Err)
+	}
+
+	str += fmt.Sprintf("\tstack:%s\talt:%s\tcond:%v",
+		stackString(op.Stack), stackString(op.AltStack), op.CondStack)
+	if !op.Executed {
+		str += "\t(skipped)"
+	}
+
+	return str
+}
+
+// stackString returns the stack elements in hex, with empty elements as <>.
+func stackString(stack [][]byte) string {
+	var str string
+	for _, el := range hexElements(stack) {
+		str += " " + el
+	}
+
+	return str
+}
+
+// hexElements returns the stack elements in hex, with empty elements as <>.
+func hexElements(stack [][]byte) []string {
+	els := make([]string, len(stack))
+	for i, el := range stack {
+		els[i], _ = encodeElement(FormatHex, el)
+	}
+
+	return els
 }
 
-func toUint(a []byte) uint16 {
-	n, err := commitment.MakeScriptNum(a, false, 2)
+func toInt(a []byte, width int) int64 {
+	n, err := commitment.MakeScriptNum(a, false, width)
 	if err != nil {
 		panic(err)
 	}
-	return uint16(n)
+	return int64(n)
 }
 
-func fromUint16(u uint16) []byte {
+func fromInt(u int64) []byte {
 	d := commitment.ScriptNum(u)
 	b := d.Bytes()
 	return b
@@ -0,0 +1,228 @@
+package print
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+// requireTrace checks that the two traces hold the same elements. Formats may
+// decode empty elements as nil or empty slices.
+func requireTrace(t *testing.T, want, got [][][]byte, msg string) {
+	t.Helper()
+
+	require.Equal(t, len(want), len(got), msg)
+	for i := range want {
+		require.Equal(t, len(want[i]), len(got[i]), msg)
+		for j := range want[i] {
+			require.True(t, bytes.Equal(want[i][j], got[i][j]),
+				"%s: state %d register %d is %x, expected %x",
+				msg, i, j, got[i][j], want[i][j])
+		}
+	}
+}
+
+// requireHeader checks that the two headers are equal.
+func requireHeader(t *testing.T, want, got *Header, msg string) {
+	t.Helper()
+
+	require.True(t, want.Schema.Equal(got.Schema), msg)
+	require.Equal(t, want.Program, got.Program, msg)
+	require.Equal(t, want.Steps, got.Steps, msg)
+	require.Equal(t, want.Depth, got.Depth, msg)
+
+	if want.Env == nil {
+		require.Nil(t, got.Env, msg)
+	} else {
+		require.NotNil(t, got.Env, msg)
+		require.True(t, want.Env.Equal(got.Env), msg)
+	}
+
+	require.Equal(t, len(want.Hints), len(got.Hints), msg)
+	for i := range want.Hints {
+		requireTrace(t, want.Hints[i:i+1], got.Hints[i:i+1], msg)
+	}
+}
+
+// TestRoundTrip checks that traces written in every format read back the
+// same, with their header.
+func TestRoundTrip(t *testing.T) {
+	s, err := schema.Parse("x:8 i:4 pc* y^:2")
+	require.NoError(t, err)
+
+	env, err := execute.ParseEnv("flags=standard opcodes=OP_CAT")
+	require.NoError(t, err)
+
+	tr := [][][]byte{
+		{fromInt(2), nil, fromInt(0), nil},
+		{fromInt(-4), fromInt(1), fromInt(1), fromInt(300)},
+		{fromInt(1 << 40), fromInt(2), fromInt(2), fromInt(-1)},
+		{fromInt(1 << 40), fromInt(2), fromInt(2), fromInt(-1)},
+		{fromInt(1 << 40), fromInt(2), fromInt(2), fromInt(-1)},
+	}
+
+	headers := []*Header{{
+		Schema: s,
+		Steps:  UnknownSteps,
+	}, {
+		Schema:  s,
+		Program: bytes.Repeat([]byte{0xab}, 32),
+		Steps:   2,
+		Depth:   2,
+		Env:     env,
+	}, {
+		Schema: s,
+		Steps:  0,
+		Hints: [][][]byte{
+			{fromInt(3), nil},
+			nil,
+			{fromInt(-7)},
+		},
+	}}
+
+	for _, f := range Formats {
+		for i, h := range headers {
+			var b bytes.Buffer
+			require.NoError(t, Write(&b, f, h, tr))
+
+			gotH, gotTr, err := Read(&b, f)
+			require.NoError(t, err, "%s header %d", f, i)
+
+			msg := string(f)
+			requireHeader(t, h, gotH, msg)
+			requireTrace(t, tr, gotTr, msg)
+		}
+	}
+}
+
+// TestHexOnly checks that elements that aren't minimally encoded numbers can
+// only be written in the hex and json formats.
+func TestHexOnly(t *testing.T) {
+	s, err := schema.Parse("x:9 pc")
+	require.NoError(t, err)
+
+	h := &Header{
+		Schema: s,
+		Steps:  UnknownSteps,
+	}
+
+	for _, el := range [][]byte{{0x00}, {0x01, 0x00}, make([]byte, 9)} {
+		tr := [][][]byte{{el, nil}}
+
+		var b bytes.Buffer
+		require.ErrorContains(t, Write(&b, FormatText, h, tr),
+			"use the hex or json format")
+
+		for _, f := range []Format{FormatHex, FormatJSON} {
+			var b bytes.Buffer
+			require.NoError(t, Write(&b, f, h, tr))
+
+			_, got, err := Read(&b, f)
+			require.NoError(t, err)
+			requireTrace(t, tr, got, string(f))
+		}
+	}
+}
+
+// TestReadLegacy checks that traces with only the schema header line, as
+// printed by earlier versions, are read.
+func TestReadLegacy(t *testing.T) {
+	const legacy = "#:\tx\ti\tpc\n" +
+		"0:\t2\t0\t0\n" +
+		"1:\t2\t0\t1\n" +
+		"2:\t4\t1\t0\n"
+
+	h, tr, err := Read(strings.NewReader(legacy), FormatText)
+	require.NoError(t, err)
+
+	want, err := schema.Parse("x i pc")
+	require.NoError(t, err)
+	require.True(t, want.Equal(h.Schema))
+	require.Equal(t, 2, h.Schema.PC)
+	require.Nil(t, h.Program)
+	require.Equal(t, UnknownSteps, h.Steps)
+	require.Zero(t, h.Depth)
+	require.Nil(t, h.Env)
+	require.Nil(t, h.Hints)
+
+	requireTrace(t, [][][]byte{
+		{fromInt(2), fromInt(0), fromInt(0)},
+		{fromInt(2), fromInt(0), fromInt(1)},
+		{fromInt(4), fromInt(1), fromInt(0)},
+	}, tr, "legacy")
+}
+
+// TestReadErrors checks that malformed traces and headers inconsistent with
+// the trace are rejected.
+func TestReadErrors(t *testing.T) {
+	const states = "0:\t1\t0\n1:\t1\t1\n2:\t1\t1\n"
+
+	tests := []struct {
+		name  string
+		trace string
+		err   string
+	}{{
+		name:  "no header",
+		trace: states,
+		err:   "no header",
+	}, {
+		name:  "too many steps",
+		trace: "#:\tx\tpc\n#steps:\t3\n" + states,
+		err:   "executed steps",
+	}, {
+		name:  "negative steps",
+		trace: "#:\tx\tpc\n#steps:\t-2\n" + states,
+		err:   "executed steps",
+	}, {
+		name:  "wrong depth",
+		trace: "#:\tx\tpc\n#depth:\t2\n" + states,
+		err:   "depth",
+	}, {
+		name:  "hints for every state",
+		trace: "#:\tx\tpc\n0:\t1\t0\n#hints:\t01\n1:\t1\t1\n#hints:\t01\n",
+		err:   "cannot have hints",
+	}, {
+		name:  "hints before states",
+		trace: "#:\tx\tpc\n#hints:\t01\n" + states,
+		err:   "before first state",
+	}, {
+		name:  "duplicate hints",
+		trace: "#:\tx\tpc\n0:\t1\t0\n#hints:\t01\n#hints:\t02\n1:\t1\t1\n",
+		err:   "duplicate hints",
+	}, {
+		name:  "bad program hash",
+		trace: "#:\tx\tpc\n#program:\txyz\n" + states,
+		err:   "program hash",
+	}, {
+		name:  "bad environment",
+		trace: "#:\tx\tpc\n#env:\tflags=bogus\n" + states,
+		err:   "environment",
+	}, {
+		name:  "not a number",
+		trace: "#:\tx\tpc\n0:\tab\t0\n",
+		err:   "state 0",
+	}, {
+		name:  "wrong register count",
+		trace: "#:\tx\tpc\n0:\t1\t0\t0\n",
+		err:   "state 0",
+	}, {
+		name:  "missing line number",
+		trace: "#:\tx\tpc\n1\t0\n",
+		err:   "missing line number",
+	}}
+
+	for _, test := range tests {
+		_, _, err := Read(strings.NewReader(test.trace), FormatText)
+		require.ErrorContains(t, err, test.err, test.name)
+	}
+
+	_, _, err := Read(strings.NewReader(states), Format("yaml"))
+	require.ErrorContains(t, err, "unknown trace format")
+
+	_, err = ParseFormat("yaml")
+	require.Error(t, err)
+}
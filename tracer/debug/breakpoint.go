@@ -0,0 +1,166 @@
+package debug
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/tracer/schema"
+)
+
+// maxNumWidth is the widest register compared as a number by breakpoints,
+// the size of a script number.
+const maxNumWidth = 8
+
+// cmpOps are the comparisons of breakpoint conditions.
+var cmpOps = []string{"==", "!=", "<", "<=", ">", ">="}
+
+// Breakpoint stops Continue at the first state where a register compares to a
+// value.
+type Breakpoint struct {
+	// Register is the index of the compared register.
+	Register int
+
+	// Op is the comparison, one of ==, !=, <, <=, > and >=. Registers
+	// are ordered as script numbers, and equal if their bytes are equal.
+	Op string
+
+	// Value is the value the register is compared to.
+	Value []byte
+}
+
+// ParseBreakpoint parses a breakpoint condition, e.g. "i >= 5", or the pc of a
+// step to break at, e.g. "3", which is short for "pc == 3". Values are given
+// as by ParseValue.
+func ParseBreakpoint(s *schema.Schema, cond string) (*Breakpoint, error) {
+	fields := strings.Fields(cond)
+	switch len(fields) {
+	case 1:
+		fields = []string{s.Registers[s.PC].Name, "==", fields[0]}
+	case 3:
+	default:
+		return nil, fmt.Errorf("breakpoint must be a pc or <register> " +
+			"<op> <value>")
+	}
+
+	b := &Breakpoint{}
+	var ok bool
+	b.Register, ok = s.Index(fields[0])
+	if !ok {
+		return nil, fmt.Errorf("unknown register %s", fields[0])
+	}
+
+	b.Op = fields[1]
+	if !isCmpOp(b.Op) {
+		return nil, fmt.Errorf("unknown comparison %s, must be one of "+
+			"%s", b.Op, strings.Join(cmpOps, " "))
+	}
+
+	width := s.Registers[b.Register].Width
+	if b.Op != "==" && b.Op != "!=" && width > maxNumWidth {
+		return nil, fmt.Errorf("register %s of width %d is not a "+
+			"number, only == and != apply", fields[0], width)
+	}
+
+	var err error
+	b.Value, err = ParseValue(fields[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// isCmpOp returns true if the op is a breakpoint comparison.
+func isCmpOp(op string) bool {
+	for _, o := range cmpOps {
+		if o == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseValue parses a register value: a decimal number encoded as a minimal
+// script number, hex prefixed by 0x, or <> for the empty value.
+func ParseValue(s string) ([]byte, error) {
+	if s == "<>" {
+		return []byte{}, nil
+	}
+
+	if h, ok := strings.CutPrefix(s, "0x"); ok {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q: %v", s, err)
+		}
+
+		return b, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value %q: %v", s, err)
+	}
+
+	return commitment.ScriptNum(n).Bytes(), nil
+}
+
+// Hit returns true if the state meets the breakpoint condition. Registers not
+// holding a valid script number never meet ordering conditions.
+func (b *Breakpoint) Hit(s *schema.Schema, state [][]byte) bool {
+	v := state[b.Register]
+	switch b.Op {
+	case "==":
+		return bytes.Equal(v, b.Value)
+	case "!=":
+		return !bytes.Equal(v, b.Value)
+	}
+
+	width := s.Registers[b.Register].Width
+	n, err := commitment.MakeScriptNum(v, true, width)
+	if err != nil {
+		return false
+	}
+
+	m, err := commitment.MakeScriptNum(b.Value, false, maxNumWidth)
+	if err != nil {
+		return false
+	}
+
+	switch b.Op {
+	case "<":
+		return n < m
+	case "<=":
+		return n <= m
+	case ">":
+		return n > m
+	case ">=":
+		return n >= m
+	}
+
+	return false
+}
+
+// Format returns the breakpoint condition as parsed by ParseBreakpoint.
+func (b *Breakpoint) Format(s *schema.Schema) string {
+	return fmt.Sprintf("%s %s %s", s.Registers[b.Register].Name, b.Op,
+		valueString(b.Value))
+}
+
+// valueString returns the value as parsed by ParseValue.
+func valueString(v []byte) string {
+	if len(v) == 0 {
+		return "<>"
+	}
+
+	n, err := commitment.MakeScriptNum(v, true, maxNumWidth)
+	if err == nil {
+		return strconv.FormatInt(int64(n), 10)
+	}
+
+	return "0x" + hex.EncodeToString(v)
+}
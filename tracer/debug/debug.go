@@ -0,0 +1,326 @@
+package debug
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/halseth/tapsim/script"
+)
+
+// ErrHalted is returned when stepping a program that has halted.
+var ErrHalted = errors.New("program halted")
+
+// Options are the options of a debugging session.
+type Options struct {
+	// Memory is the initial memory of programs with a memory, the root
+	// register of the start state must hold its root. If nil, the memory
+	// starts out empty.
+	Memory *memory.Memory
+
+	// HintTape is the tape of prover hints, given to the steps taking
+	// prover hints in execution order as by trace.HintTape. Rewinding
+	// also rewinds the tape.
+	HintTape [][]byte
+
+	// Executor is used to execute the steps. If nil, the executor for
+	// the program's environment is used.
+	Executor execute.Executor
+}
+
+// frame is an executed state of the session.
+type frame struct {
+	state [][]byte
+
+	// mem is the memory at the state, nil for programs without memory.
+	mem *memory.Memory
+
+	// tapePos is the number of hints taken from the hint tape before
+	// the state.
+	tapePos int
+}
+
+// Session steps through the execution of a program one step at a time, keeping
+// every state executed so far such that it can be rewound.
+//
+// NOTE: not safe for concurrent use.
+type Session struct {
+	prog      *scripts.Program
+	opts      *Options
+	executor  execute.Executor
+	harness   *execute.Harness
+	pkScripts [][]byte
+
+	frames      []*frame
+	breakpoints []*Breakpoint
+}
+
+// NewSession starts a debugging session of the program from the start state.
+func NewSession(prog *scripts.Program, startState [][]byte,
+	opts *Options) (*Session, error) {
+
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	if err := prog.Validate(); err != nil {
+		return nil, err
+	}
+
+	if err := prog.Schema.Validate(startState); err != nil {
+		return nil, fmt.Errorf("invalid start stack: %v", err)
+	}
+
+	env := prog.ExecEnv()
+	s := &Session{
+		prog:     prog,
+		opts:     opts,
+		executor: opts.Executor,
+		harness:  execute.NewHarnessWithEnv(env),
+	}
+	if s.executor == nil {
+		s.executor = execute.NewExecutor(env)
+	}
+
+	for i := range prog.Steps {
+		pkScript, err := script.Parse(prog.StepScript(i))
+		if err != nil {
+			return nil, fmt.Errorf("parsing step %d: %v", i, err)
+		}
+
+		if err := env.CheckScript(pkScript); err != nil {
+			return nil, fmt.Errorf("step %d: %v", i, err)
+		}
+
+		s.pkScripts = append(s.pkScripts, pkScript)
+	}
+
+	start := &frame{
+		state: startState,
+	}
+	if prog.Memory != nil {
+		start.mem = opts.Memory
+		if start.mem == nil {
+			var err error
+			start.mem, err = memory.New(prog.Memory.Depth, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err := trace.CheckMemoryRoot(prog, start.mem, startState)
+		if err != nil {
+			return nil, fmt.Errorf("start stack: %v", err)
+		}
+	}
+	s.frames = []*frame{start}
+
+	return s, nil
+}
+
+// Program returns the program being debugged.
+func (s *Session) Program() *scripts.Program {
+	return s.prog
+}
+
+// Step returns the index of the current state, the number of steps executed
+// to reach it.
+func (s *Session) Step() int {
+	return len(s.frames) - 1
+}
+
+// State returns the current state.
+func (s *Session) State() [][]byte {
+	return s.current().state
+}
+
+// PC returns the program counter of the current state.
+func (s *Session) PC() (int, error) {
+	return trace.GetProgramCounter(s.prog.Schema, s.State())
+}
+
+// Halted returns true if the current state is at the halting step.
+func (s *Session) Halted() bool {
+	pc, err := s.PC()
+	return err == nil && pc == s.prog.HaltPC()
+}
+
+func (s *Session) current() *frame {
+	return s.frames[len(s.frames)-1]
+}
+
+// stepInput returns the pc of the current state, and the stack the step at it
+// is executed from: the state with the step's hints on top. The memory of the
+// returned frame has the step's memory access applied.
+func (s *Session) stepInput() (int, [][]byte, *frame, error) {
+	cur := s.current()
+	pc, err := s.PC()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	if pc < 0 || pc >= len(s.pkScripts) {
+		return 0, nil, nil, fmt.Errorf("pc %d out of range for "+
+			"program with %d steps", pc, len(s.pkScripts))
+	}
+
+	if pc == s.prog.HaltPC() {
+		return 0, nil, nil, ErrHalted
+	}
+
+	next := &frame{
+		tapePos: cur.tapePos,
+	}
+	if cur.mem != nil {
+		err := trace.CheckMemoryRoot(s.prog, cur.mem, cur.state)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		next.mem = cur.mem.Copy()
+	}
+
+	if s.prog.NumHints(pc) == 0 {
+		return pc, cur.state, next, nil
+	}
+
+	// The tape is read from the position of the current state, so that
+	// stepping again after rewinding gives the same hints.
+	pos := min(cur.tapePos, len(s.opts.HintTape))
+	tape := trace.HintTape(s.prog, s.opts.HintTape[pos:])
+	hints, err := trace.StepHints(
+		s.prog, next.mem, tape, s.Step(), pc, cur.state,
+	)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	next.tapePos += s.prog.NumProverHints(pc)
+
+	stack := append(append([][]byte{}, cur.state...), hints...)
+	return pc, stack, next, nil
+}
+
+// Next executes the step at the current state. If the step fails, the session
+// stays at the current state and a *trace.StepError is returned, holding the
+// opcodes executed up to the failure.
+func (s *Session) Next() error {
+	pc, stack, next, err := s.stepInput()
+	if err != nil {
+		return err
+	}
+
+	end, err := s.executor.ExecuteStep(s.pkScripts[pc], stack)
+	if err == nil || execute.IsBenign(err) {
+		err = s.prog.Schema.Validate(end)
+	}
+	if err == nil && next.mem != nil {
+		err = trace.CheckMemoryRoot(s.prog, next.mem, end)
+	}
+	if err != nil {
+		// Re-execute opcode by opcode to show where it failed.
+		_, ops, _ := s.harness.TraceStep(s.pkScripts[pc], stack)
+		return &trace.StepError{
+			Step: s.Step(),
+			PC:   pc,
+			Err:  err,
+			Ops:  ops,
+		}
+	}
+
+	next.state = end
+	s.frames = append(s.frames, next)
+
+	return nil
+}
+
+// Ops executes the step at the current state opcode by opcode without
+// advancing, and returns the VM state after every executed opcode.
+func (s *Session) Ops() ([]*execute.OpStep, error) {
+	pc, stack, _, err := s.stepInput()
+	if err != nil {
+		return nil, err
+	}
+
+	_, ops, err := s.harness.TraceStep(s.pkScripts[pc], stack)
+	if execute.IsBenign(err) {
+		err = nil
+	}
+
+	return ops, err
+}
+
+// Continue executes steps until a breakpoint is hit, the program halts, a step
+// fails, or maxSteps steps are executed. It returns the breakpoint hit, nil if
+// none was.
+func (s *Session) Continue(maxSteps int) (*Breakpoint, error) {
+	for i := 0; i < maxSteps; i++ {
+		if err := s.Next(); err != nil {
+			return nil, err
+		}
+
+		for _, b := range s.breakpoints {
+			if b.Hit(s.prog.Schema, s.State()) {
+				return b, nil
+			}
+		}
+
+		if s.Halted() {
+			return nil, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no breakpoint hit after %d steps", maxSteps)
+}
+
+// Rewind goes back to the state at the given index, dropping the states after
+// it.
+func (s *Session) Rewind(step int) error {
+	if step < 0 || step > s.Step() {
+		return fmt.Errorf("cannot rewind to state %d, at state %d",
+			step, s.Step())
+	}
+
+	s.frames = s.frames[:step+1]
+	return nil
+}
+
+// Set sets the register of the current state to the value. Steps are executed
+// from the edited state, while the states before it are kept. Setting the
+// memory root register of a program with a memory makes the next step fail,
+// unless it is set back.
+func (s *Session) Set(reg int, value []byte) error {
+	if reg < 0 || reg >= s.prog.Schema.NumRegisters() {
+		return fmt.Errorf("register %d out of range", reg)
+	}
+
+	state := append([][]byte{}, s.State()...)
+	state[reg] = value
+	if err := s.prog.Schema.Validate(state); err != nil {
+		return err
+	}
+
+	s.current().state = state
+	return nil
+}
+
+// AddBreakpoint adds a breakpoint, checked after every step of Continue.
+func (s *Session) AddBreakpoint(b *Breakpoint) {
+	s.breakpoints = append(s.breakpoints, b)
+}
+
+// Breakpoints returns the breakpoints.
+func (s *Session) Breakpoints() []*Breakpoint {
+	return s.breakpoints
+}
+
+// DeleteBreakpoint deletes the breakpoint at the given index.
+func (s *Session) DeleteBreakpoint(i int) error {
+	if i < 0 || i >= len(s.breakpoints) {
+		return fmt.Errorf("no breakpoint %d", i)
+	}
+
+	s.breakpoints = append(s.breakpoints[:i], s.breakpoints[i+1:]...)
+	return nil
+}
@@ -0,0 +1,174 @@
+package debug
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/halseth/mattlab/assembler"
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/stretchr/testify/require"
+)
+
+func num(n int64) []byte {
+	return append([]byte{}, commitment.ScriptNum(n).Bytes()...)
+}
+
+// newSession starts a session of the multiply program from the given start
+// stack, and returns it with the trace of the program from that stack.
+func newSession(t *testing.T, start string) (*Session, [][][]byte) {
+	t.Helper()
+
+	prog := scripts.MultiplyProgram
+	res, err := trace.GetTrace(context.Background(), prog, start, nil)
+	require.NoError(t, err)
+
+	s, err := NewSession(prog, res.Trace[0], nil)
+	require.NoError(t, err)
+
+	return s, res.Trace[:res.Steps+1]
+}
+
+// TestSession checks that a breakpoint on the pc stops at every state at that
+// pc, that rewinding restores the earlier state, and that steps continue from
+// an edited state.
+func TestSession(t *testing.T) {
+	s, tr := newSession(t, "02 <> <>")
+	prog := s.Program()
+
+	b, err := ParseBreakpoint(prog.Schema, "1")
+	require.NoError(t, err)
+	require.Equal(t, "pc == 1", b.Format(prog.Schema))
+	s.AddBreakpoint(b)
+
+	var want []int
+	for i := 1; i < len(tr); i++ {
+		pc, err := trace.GetProgramCounter(prog.Schema, tr[i])
+		require.NoError(t, err)
+		if pc == 1 {
+			want = append(want, i)
+		}
+	}
+	require.NotEmpty(t, want)
+
+	var hits []int
+	for !s.Halted() {
+		hit, err := s.Continue(len(tr))
+		require.NoError(t, err)
+		require.Equal(t, tr[s.Step()], s.State())
+
+		if hit == nil {
+			require.True(t, s.Halted())
+			break
+		}
+		require.Equal(t, b, hit)
+
+		pc, err := s.PC()
+		require.NoError(t, err)
+		require.Equal(t, 1, pc)
+		hits = append(hits, s.Step())
+	}
+	require.Equal(t, want, hits)
+	require.Equal(t, len(tr)-1, s.Step())
+	require.ErrorIs(t, s.Next(), ErrHalted)
+
+	// Rewinding drops the later states.
+	require.NoError(t, s.Rewind(0))
+	require.Equal(t, 0, s.Step())
+	require.Equal(t, tr[0], s.State())
+	require.Error(t, s.Rewind(1))
+	require.Error(t, s.Rewind(-1))
+
+	// Steps from an edited state are executed from it, like a trace
+	// starting in that state.
+	require.NoError(t, s.Set(0, num(3)))
+	_, edited := newSession(t, "03 <> <>")
+	for i := 1; i < len(edited); i++ {
+		require.NoError(t, s.Next())
+		require.Equal(t, i, s.Step())
+		require.Equal(t, edited[i], s.State(), "state %d", i)
+	}
+	require.True(t, s.Halted())
+
+	// Rewinding to an earlier state keeps the edit.
+	require.NoError(t, s.Rewind(0))
+	require.Equal(t, edited[0], s.State())
+}
+
+// TestSessionErrors checks that invalid edits are refused, that a failing step
+// leaves the session at its state, and that Continue gives up after the
+// maximum number of steps.
+func TestSessionErrors(t *testing.T) {
+	s, tr := newSession(t, "02 <> <>")
+
+	require.Error(t, s.Set(-1, nil))
+	require.Error(t, s.Set(3, nil))
+	require.Error(t, s.Set(0, make([]byte, 5)))
+	require.Equal(t, tr[0], s.State())
+
+	// With no breakpoints, Continue stops at the halting state.
+	hit, err := s.Continue(len(tr))
+	require.NoError(t, err)
+	require.Nil(t, hit)
+	require.True(t, s.Halted())
+
+	require.NoError(t, s.Rewind(0))
+	_, err = s.Continue(2)
+	require.ErrorContains(t, err, "after 2 steps")
+	require.Equal(t, 2, s.Step())
+
+	// Step 1 fails, incrementing i past its width.
+	require.NoError(t, s.Rewind(0))
+	require.NoError(t, s.Next())
+	require.NoError(t, s.Set(1, []byte{0xff, 0xff, 0xff, 0x7f}))
+	pc, err := s.PC()
+	require.NoError(t, err)
+	require.Equal(t, 1, pc)
+
+	err = s.Next()
+	var stepErr *trace.StepError
+	require.True(t, errors.As(err, &stepErr))
+	require.Equal(t, 1, stepErr.Step)
+	require.Equal(t, 1, stepErr.PC)
+	require.NotEmpty(t, stepErr.Ops)
+	require.Equal(t, 1, s.Step())
+
+	_, err = s.Continue(len(tr))
+	require.Error(t, err)
+	require.Equal(t, 1, s.Step())
+}
+
+// TestSessionHints checks that rewinding rewinds the hint tape, so steps are
+// given the same hints when executed again.
+func TestSessionHints(t *testing.T) {
+	const src = `#:	n half pc
+div:	HINT half OP_DROP OP_2DUP OP_DUP OP_ADD OP_SUB OP_0 OP_2 OP_WITHIN OP_VERIFY @div
+halt:	OP_NOP
+`
+	a, err := assembler.Assemble(src)
+	require.NoError(t, err)
+	prog, err := a.Program()
+	require.NoError(t, err)
+
+	s, err := NewSession(prog, [][]byte{num(7), nil, nil}, &Options{
+		HintTape: [][]byte{num(3), num(3)},
+	})
+	require.NoError(t, err)
+
+	want := [][]byte{num(7), num(3), nil}
+	require.NoError(t, s.Next())
+	require.Equal(t, want, s.State())
+
+	require.NoError(t, s.Rewind(0))
+	require.NoError(t, s.Next())
+	require.Equal(t, want, s.State())
+
+	require.NoError(t, s.Next())
+	require.Equal(t, want, s.State())
+
+	// The tape is used up.
+	require.Error(t, s.Next())
+	require.Equal(t, 2, s.Step())
+}
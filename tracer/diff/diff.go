@@ -0,0 +1,104 @@
+package diff
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/halseth/mattlab/tracer/trace"
+)
+
+// RegisterDiff is a register holding different values in two states.
+type RegisterDiff struct {
+	// Register is the register that differs.
+	Register schema.Register
+
+	// A and B are the values of the register in the two states.
+	A, B []byte
+}
+
+// Divergence is where two traces first differ.
+type Divergence struct {
+	// Step is the index of the first state that differs.
+	Step int
+
+	// PC is the program counter of the state before Step, the pc of the
+	// step that produced the differing states. It is -1 if the start
+	// states differ, or the pc cannot be decoded.
+	PC int
+
+	// Registers are the registers that differ. It is empty if one of the
+	// traces ends before Step.
+	Registers []RegisterDiff
+}
+
+// Traces compares the two traces of the given schema, and returns the first
+// state where they differ. It returns nil if the traces are equal.
+func Traces(s *schema.Schema, a, b [][][]byte) (*Divergence, error) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+
+	for i := 0; i < n; i++ {
+		if err := s.Validate(a[i]); err != nil {
+			return nil, fmt.Errorf("trace a state %d: %v", i, err)
+		}
+		if err := s.Validate(b[i]); err != nil {
+			return nil, fmt.Errorf("trace b state %d: %v", i, err)
+		}
+
+		regs := States(s, a[i], b[i])
+		if len(regs) == 0 {
+			continue
+		}
+
+		return &Divergence{
+			Step:      i,
+			PC:        prevPC(s, a, i),
+			Registers: regs,
+		}, nil
+	}
+
+	if len(a) == len(b) {
+		return nil, nil
+	}
+
+	return &Divergence{
+		Step: n,
+		PC:   prevPC(s, a, n),
+	}, nil
+}
+
+// States returns the registers that differ between the two states.
+func States(s *schema.Schema, a, b [][]byte) []RegisterDiff {
+	var regs []RegisterDiff
+	for i, r := range s.Registers {
+		if bytes.Equal(a[i], b[i]) {
+			continue
+		}
+
+		regs = append(regs, RegisterDiff{
+			Register: r,
+			A:        a[i],
+			B:        b[i],
+		})
+	}
+
+	return regs
+}
+
+// prevPC returns the program counter of the state before the given step, or
+// -1 if there is none.
+func prevPC(s *schema.Schema, tr [][][]byte, step int) int {
+	if step == 0 {
+		return -1
+	}
+
+	pc, err := trace.GetProgramCounter(s, tr[step-1])
+	if err != nil {
+		return -1
+	}
+
+	return pc
+}
@@ -0,0 +1,117 @@
+package diff
+
+import (
+	"testing"
+
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+// TestTraces checks the first divergence found between traces.
+func TestTraces(t *testing.T) {
+	s, err := schema.Parse("x i pc")
+	require.NoError(t, err)
+	x, i, pc := s.Registers[0], s.Registers[1], s.Registers[2]
+
+	a := [][][]byte{
+		{{2}, {}, {}},
+		{{2}, {}, {1}},
+		{{4}, {1}, {}},
+		{{4}, {1}, {2}},
+	}
+
+	// with returns a copy of a with the register of the state set.
+	with := func(step, reg int, v []byte) [][][]byte {
+		b := make([][][]byte, len(a))
+		for j := range a {
+			b[j] = append([][]byte{}, a[j]...)
+		}
+		b[step][reg] = v
+
+		return b
+	}
+
+	tests := []struct {
+		name string
+		a, b [][][]byte
+		want *Divergence
+	}{{
+		name: "equal",
+		a:    a,
+		b:    with(0, 0, []byte{2}),
+	}, {
+		name: "start states differ",
+		a:    a,
+		b:    with(0, 0, []byte{3}),
+		want: &Divergence{
+			Step: 0,
+			PC:   -1,
+			Registers: []RegisterDiff{
+				{Register: x, A: []byte{2}, B: []byte{3}},
+			},
+		},
+	}, {
+		name: "registers differ",
+		a:    a,
+		b: func() [][][]byte {
+			b := with(2, 1, []byte{2})
+			b[2][2] = []byte{3}
+			return b
+		}(),
+		want: &Divergence{
+			Step: 2,
+			PC:   1,
+			Registers: []RegisterDiff{
+				{Register: i, A: []byte{1}, B: []byte{2}},
+				{Register: pc, A: []byte{}, B: []byte{3}},
+			},
+		},
+	}, {
+		name: "later divergence ignored",
+		a:    with(3, 0, []byte{5}),
+		b:    with(1, 0, []byte{7}),
+		want: &Divergence{
+			Step: 1,
+			PC:   0,
+			Registers: []RegisterDiff{
+				{Register: x, A: []byte{2}, B: []byte{7}},
+			},
+		},
+	}, {
+		name: "b shorter",
+		a:    a,
+		b:    a[:2],
+		want: &Divergence{
+			Step: 2,
+			PC:   1,
+		},
+	}, {
+		name: "a shorter",
+		a:    a[:3],
+		b:    a,
+		want: &Divergence{
+			Step: 3,
+			PC:   0,
+		},
+	}, {
+		name: "a empty",
+		b:    a,
+		want: &Divergence{
+			Step: 0,
+			PC:   -1,
+		},
+	}}
+
+	for _, test := range tests {
+		d, err := Traces(s, test.a, test.b)
+		require.NoError(t, err, test.name)
+		require.Equal(t, test.want, d, test.name)
+	}
+
+	// States not fitting the schema are errors.
+	_, err = Traces(s, with(1, 0, make([]byte, 5)), a)
+	require.ErrorContains(t, err, "trace a state 1")
+
+	_, err = Traces(s, a, [][][]byte{{{2}, {}}})
+	require.ErrorContains(t, err, "trace b state 0")
+}
@@ -0,0 +1,310 @@
+package execute
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// flagNames are the names of the script verification flags, as used by
+// Bitcoin Core where it has an equivalent.
+var flagNames = []struct {
+	name string
+	flag txscript.ScriptFlags
+}{
+	{"P2SH", txscript.ScriptBip16},
+	{"STRICTMULTISIG", txscript.ScriptStrictMultiSig},
+	{"DISCOURAGE_UPGRADABLE_NOPS", txscript.ScriptDiscourageUpgradableNops},
+	{"CHECKLOCKTIMEVERIFY", txscript.ScriptVerifyCheckLockTimeVerify},
+	{"CHECKSEQUENCEVERIFY", txscript.ScriptVerifyCheckSequenceVerify},
+	{"CLEANSTACK", txscript.ScriptVerifyCleanStack},
+	{"DERSIG", txscript.ScriptVerifyDERSignatures},
+	{"LOW_S", txscript.ScriptVerifyLowS},
+	{"MINIMALDATA", txscript.ScriptVerifyMinimalData},
+	{"NULLFAIL", txscript.ScriptVerifyNullFail},
+	{"SIGPUSHONLY", txscript.ScriptVerifySigPushOnly},
+	{"STRICTENC", txscript.ScriptVerifyStrictEncoding},
+	{"WITNESS", txscript.ScriptVerifyWitness},
+	{"DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM",
+		txscript.ScriptVerifyDiscourageUpgradeableWitnessProgram},
+	{"MINIMALIF", txscript.ScriptVerifyMinimalIf},
+	{"WITNESS_PUBKEYTYPE", txscript.ScriptVerifyWitnessPubKeyType},
+	{"TAPROOT", txscript.ScriptVerifyTaproot},
+	{"DISCOURAGE_UPGRADABLE_TAPROOT_VERSION",
+		txscript.ScriptVerifyDiscourageUpgradeableTaprootVersion},
+	{"DISCOURAGE_OP_SUCCESS", txscript.ScriptVerifyDiscourageOpSuccess},
+	{"DISCOURAGE_UPGRADABLE_PUBKEYTYPE",
+		txscript.ScriptVerifyDiscourageUpgradeablePubkeyType},
+}
+
+const (
+	// StandardFlags is the name of the standard flag set, the flags
+	// enforced by default by nodes relaying transactions.
+	StandardFlags = "standard"
+
+	// ConsensusFlags is the name of the flag set enforced by consensus for
+	// taproot spends.
+	ConsensusFlags = "consensus"
+)
+
+// flagSets are the named sets of script verification flags.
+var flagSets = map[string]txscript.ScriptFlags{
+	StandardFlags: txscript.StandardVerifyFlags,
+	ConsensusFlags: txscript.ScriptBip16 |
+		txscript.ScriptVerifyDERSignatures |
+		txscript.ScriptVerifyCheckLockTimeVerify |
+		txscript.ScriptVerifyCheckSequenceVerify |
+		txscript.ScriptVerifyWitness |
+		txscript.ScriptVerifyTaproot,
+}
+
+// requiredFlags are the flags needed to execute steps as tapscript leaves.
+const requiredFlags = txscript.ScriptVerifyWitness |
+	txscript.ScriptVerifyTaproot
+
+// ExtensionOpcodes are the opcodes enabled by the forked script engine on top
+// of tapscript. An environment only allows steps to use those of them it
+// enables.
+var ExtensionOpcodes = map[string]byte{
+	"OP_CAT":                 txscript.OP_CAT,
+	"OP_CHECKCONTRACTVERIFY": txscript.OP_CHECKCONTRACTVERIFY,
+}
+
+// Env is the environment steps are executed in: the verification flags of the
+// script engine, and the extension opcodes steps may use.
+type Env struct {
+	// Flags are the script verification flags of the engine.
+	Flags txscript.ScriptFlags
+
+	// Opcodes are the enabled extension opcodes, by name.
+	Opcodes map[string]bool
+}
+
+// DefaultEnv returns the environment steps are executed in if no other is
+// given: the standard flags, with all extension opcodes enabled.
+func DefaultEnv() *Env {
+	env := &Env{
+		Flags:   txscript.StandardVerifyFlags,
+		Opcodes: make(map[string]bool),
+	}
+	for name := range ExtensionOpcodes {
+		env.Opcodes[name] = true
+	}
+
+	return env
+}
+
+// ParseEnv parses an environment as returned by String, e.g.
+// "flags=standard,-MINIMALIF opcodes=OP_CAT". The flags are a comma separated
+// list of flag names and named flag sets, where names prefixed with - are
+// removed. The opcodes are a comma separated list of extension opcodes, or
+// none. Fields left out have their default value.
+func ParseEnv(s string) (*Env, error) {
+	env := DefaultEnv()
+	for _, field := range strings.Fields(s) {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid environment field %q",
+				field)
+		}
+
+		var err error
+		switch key {
+		case "flags":
+			env.Flags, err = parseFlags(value)
+		case "opcodes":
+			env.Opcodes, err = parseOpcodes(value)
+		default:
+			err = fmt.Errorf("unknown environment field %q", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := env.check(); err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// parseFlags parses a list of script verification flags, or none.
+func parseFlags(s string) (txscript.ScriptFlags, error) {
+	var flags txscript.ScriptFlags
+	if s == "none" {
+		return flags, nil
+	}
+
+	for _, name := range strings.Split(s, ",") {
+		name, remove := strings.CutPrefix(name, "-")
+
+		f, ok := flagSets[name]
+		if !ok {
+			f, ok = flagByName(name)
+		}
+		if !ok {
+			return 0, fmt.Errorf("unknown script flag %q", name)
+		}
+
+		if remove {
+			flags &^= f
+		} else {
+			flags |= f
+		}
+	}
+
+	return flags, nil
+}
+
+// flagByName returns the flag with the given name.
+func flagByName(name string) (txscript.ScriptFlags, bool) {
+	for _, f := range flagNames {
+		if f.name == name {
+			return f.flag, true
+		}
+	}
+
+	return 0, false
+}
+
+// parseOpcodes parses a list of extension opcodes.
+func parseOpcodes(s string) (map[string]bool, error) {
+	opcodes := make(map[string]bool)
+	if s == "none" {
+		return opcodes, nil
+	}
+
+	for _, name := range strings.Split(s, ",") {
+		if _, ok := ExtensionOpcodes[name]; !ok {
+			return nil, fmt.Errorf("unknown extension opcode %q",
+				name)
+		}
+
+		opcodes[name] = true
+	}
+
+	return opcodes, nil
+}
+
+// check checks that steps can be executed in the environment.
+func (e *Env) check() error {
+	if missing := requiredFlags &^ e.Flags; missing != 0 {
+		return fmt.Errorf("steps are executed as tapscript, flags %s "+
+			"are required", flagList("", missing, 0))
+	}
+
+	return nil
+}
+
+// String returns the environment in the format parsed by ParseEnv.
+func (e *Env) String() string {
+	return fmt.Sprintf("flags=%s opcodes=%s", flagsString(e.Flags),
+		opcodesString(e.Opcodes))
+}
+
+// flagsString returns the flags as a comma separated list of names. Flags
+// close to a named flag set are given relative to it, e.g.
+// "standard,-MINIMALIF", whichever list is shortest.
+func flagsString(flags txscript.ScriptFlags) string {
+	best := flagList("", flags, 0)
+	for _, name := range []string{StandardFlags, ConsensusFlags} {
+		set := flagSets[name]
+		s := flagList(name, flags&^set, set&^flags)
+		if len(s) < len(best) {
+			best = s
+		}
+	}
+
+	if best == "" {
+		return "none"
+	}
+
+	return best
+}
+
+// flagList returns the comma separated list starting with the named flag set,
+// if any, followed by the names of the added flags and of the removed flags
+// prefixed with -.
+func flagList(set string, added, removed txscript.ScriptFlags) string {
+	var names []string
+	if set != "" {
+		names = append(names, set)
+	}
+	for _, f := range flagNames {
+		if added&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	for _, f := range flagNames {
+		if removed&f.flag != 0 {
+			names = append(names, "-"+f.name)
+		}
+	}
+
+	return strings.Join(names, ",")
+}
+
+// opcodesString returns the opcodes as a sorted comma separated list.
+func opcodesString(opcodes map[string]bool) string {
+	var names []string
+	for name, enabled := range opcodes {
+		if enabled {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Equal returns true if the two environments are the same.
+func (e *Env) Equal(o *Env) bool {
+	return e.String() == o.String()
+}
+
+// CheckScript returns an error if the script uses an extension opcode not
+// enabled in the environment.
+func (e *Env) CheckScript(pkScript []byte) error {
+	tokenizer := txscript.MakeScriptTokenizer(0, pkScript)
+	for tokenizer.Next() {
+		for name, op := range ExtensionOpcodes {
+			if tokenizer.Opcode() == op && !e.Opcodes[name] {
+				return fmt.Errorf("opcode %s not enabled", name)
+			}
+		}
+	}
+
+	return tokenizer.Err()
+}
+
+// Covers returns an error if the environment doesn't enforce all flags of the
+// other environment.
+func (e *Env) Covers(o *Env) error {
+	if missing := o.Flags &^ e.Flags; missing != 0 {
+		return fmt.Errorf("flags %s not enforced",
+			flagList("", missing, 0))
+	}
+
+	return nil
+}
+
+// NewExecutor returns the executor for steps in the environment. The native
+// interpreter matches the engine with the standard flags and OP_CAT enabled,
+// so it is only used if the environment enforces no other flags and enables
+// OP_CAT.
+func NewExecutor(env *Env) Executor {
+	harness := NewHarnessWithEnv(env)
+	if env.Flags&^txscript.StandardVerifyFlags != 0 ||
+		!env.Opcodes["OP_CAT"] {
+
+		return harness
+	}
+
+	return NewNative(harness)
+}
@@ -1,14 +1,109 @@
 package execute
 
 import (
+	"errors"
+
 	"github.com/btcsuite/btcd/btcec/v2"
+	"github.com/btcsuite/btcd/btcec/v2/schnorr"
 	"github.com/btcsuite/btcd/txscript"
 	"github.com/btcsuite/btcd/wire"
 )
 
+// Executor executes single program steps.
+type Executor interface {
+	// ExecuteStep executes the given pkScript using the passed stack. It
+	// returns the end stack and any error the VM returns from executing
+	// the script.
+	ExecuteStep(pkScript []byte, startStack [][]byte) ([][]byte, error)
+}
+
 // ExecuteStep executes the given pkScript using the passed stack. It returns
 // the end stack and any error the VM returns from executing the script.
+//
+// It sets up a new transaction to execute the script in for every call. Use a
+// Harness or Native executor when executing many steps.
 func ExecuteStep(pkScript []byte, startStack [][]byte) ([][]byte, error) {
+	return NewHarness().ExecuteStep(pkScript, startStack)
+}
+
+// ErrAltStackNotEmpty is returned when a step leaves elements on the alt
+// stack. The VM drops the alt stack at the end of the script, so they would
+// silently be lost from the program state.
+var ErrAltStackNotEmpty = errors.New("alt stack not empty at end of step")
+
+// numsKey is the internal key used for the taproot outputs steps are executed
+// from. Since the key path is never used, we can use the NUMS point rather
+// than generating a new key.
+var numsKey, _ = schnorr.ParsePubKey(txscript.BIP341_NUMS_POINT)
+
+// Harness executes steps using the full script engine. It prepares the
+// transaction context for each distinct script once, and reuses it for
+// subsequent executions of the same script.
+//
+// NOTE: not safe for concurrent use.
+type Harness struct {
+	env      *Env
+	prepared map[string]*preparedScript
+}
+
+// A compile time check to ensure Harness implements the Executor interface.
+var _ Executor = (*Harness)(nil)
+
+// NewHarness creates a new harness with no prepared scripts, executing steps
+// in the default environment.
+func NewHarness() *Harness {
+	return NewHarnessWithEnv(DefaultEnv())
+}
+
+// NewHarnessWithEnv creates a new harness with no prepared scripts, executing
+// steps in the given environment.
+func NewHarnessWithEnv(env *Env) *Harness {
+	return &Harness{
+		env:      env,
+		prepared: make(map[string]*preparedScript),
+	}
+}
+
+// preparedScript is the transaction context needed to execute a script as a
+// taproot leaf.
+type preparedScript struct {
+	tx             *wire.MsgTx
+	prevOut        *wire.TxOut
+	prevOutFetcher txscript.PrevOutputFetcher
+	sigHashes      *txscript.TxSigHashes
+	ctrlBlockBytes []byte
+
+	// lastOp is the last opcode of the script.
+	lastOp byte
+}
+
+// prepare returns the transaction context for the given script, creating it
+// if it is not already prepared.
+func (h *Harness) prepare(pkScript []byte) (*preparedScript, error) {
+	if p, ok := h.prepared[string(pkScript)]; ok {
+		return p, nil
+	}
+
+	// The forked engine enables all extension opcodes, so those not in
+	// the environment are refused up front.
+	if err := h.env.CheckScript(pkScript); err != nil {
+		return nil, err
+	}
+
+	p, err := prepareScript(numsKey, pkScript)
+	if err != nil {
+		return nil, err
+	}
+
+	h.prepared[string(pkScript)] = p
+	return p, nil
+}
+
+// prepareScript creates a transaction spending a taproot output with the
+// given script as its only leaf.
+func prepareScript(inputKey *btcec.PublicKey, pkScript []byte) (
+	*preparedScript, error) {
+
 	scriptIndex := 0
 
 	var tapLeaves []txscript.TapLeaf
@@ -17,12 +112,6 @@ func ExecuteStep(pkScript []byte, startStack [][]byte) ([][]byte, error) {
 
 	tapScriptTree := txscript.AssembleTaprootScriptTree(tapLeaves...)
 
-	privKey, err := btcec.NewPrivateKey()
-	if err != nil {
-		return nil, err
-	}
-
-	inputKey := privKey.PubKey()
 	ctrlBlock := tapScriptTree.LeafMerkleProofs[scriptIndex].ToControlBlock(
 		inputKey,
 	)
@@ -53,38 +142,118 @@ func ExecuteStep(pkScript []byte, startStack [][]byte) ([][]byte, error) {
 		prevOut.PkScript, prevOut.Value,
 	)
 
+	sigHashes := txscript.NewTxSigHashes(tx, prevOutFetcher)
+
+	ctrlBlockBytes, err := ctrlBlock.ToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastOp byte
+	tokenizer := txscript.MakeScriptTokenizer(0, pkScript)
+	for tokenizer.Next() {
+		lastOp = tokenizer.Opcode()
+	}
+
+	return &preparedScript{
+		tx:             tx,
+		prevOut:        prevOut,
+		prevOutFetcher: prevOutFetcher,
+		sigHashes:      sigHashes,
+		ctrlBlockBytes: ctrlBlockBytes,
+		lastOp:         lastOp,
+	}, nil
+}
+
+// ExecuteStep executes the given pkScript using the passed stack in the full
+// script engine.
+func (h *Harness) ExecuteStep(pkScript []byte, startStack [][]byte) (
+	[][]byte, error) {
+
 	var endStack [][]byte
 	stepCallback := func(step *txscript.StepInfo) error {
 		endStack = step.Stack
 		return nil
 	}
 
-	sigHashes := txscript.NewTxSigHashes(tx, prevOutFetcher)
+	err := h.execute(pkScript, startStack, stepCallback)
+	return endStack, err
+}
+
+// execute executes the given pkScript using the passed stack in the full
+// script engine, calling stepCallback with the VM state before the first and
+// after every executed opcode.
+func (h *Harness) execute(pkScript []byte, startStack [][]byte,
+	stepCallback func(*txscript.StepInfo) error) error {
+
+	p, err := h.prepare(pkScript)
+	if err != nil {
+		return err
+	}
+
+	// The VM drops the alt stack before the callback for the last opcode,
+	// so we track its depth before that opcode to find the depth the
+	// step left it at.
+	var prevAltDepth, altDepth int
+	trackAlt := func(step *txscript.StepInfo) error {
+		if step.ScriptIndex == leafScriptIndex {
+			prevAltDepth = altDepth
+			altDepth = len(step.AltStack)
+		}
+
+		return stepCallback(step)
+	}
 
 	var combinedWitness wire.TxWitness
 	for _, el := range startStack {
 		combinedWitness = append(combinedWitness, el)
 	}
 
-	ctrlBlockBytes, err := ctrlBlock.ToBytes()
-	if err != nil {
-		return nil, err
-	}
+	combinedWitness = append(combinedWitness, pkScript, p.ctrlBlockBytes)
 
-	combinedWitness = append(combinedWitness, pkScript, ctrlBlockBytes)
-
-	txCopy := tx.Copy()
+	txCopy := p.tx.Copy()
 	txCopy.TxIn[0].Witness = combinedWitness
 
 	vm, err := txscript.NewDebugEngine(
-		prevOut.PkScript, txCopy, 0, txscript.StandardVerifyFlags,
-		nil, sigHashes, prevOut.Value, prevOutFetcher,
-		stepCallback,
+		p.prevOut.PkScript, txCopy, 0, h.env.Flags,
+		nil, p.sigHashes, p.prevOut.Value, p.prevOutFetcher,
+		trackAlt,
 	)
 
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	err = vm.Execute()
+
+	// If all opcodes were executed, only the last one can have changed
+	// the alt stack depth since the previous callback.
+	if IsBenign(err) {
+		switch p.lastOp {
+		case txscript.OP_TOALTSTACK:
+			prevAltDepth++
+		case txscript.OP_FROMALTSTACK:
+			prevAltDepth--
+		}
+
+		if prevAltDepth != 0 {
+			return ErrAltStackNotEmpty
+		}
+	}
+
+	return err
+}
+
+// IsBenign returns true if the error from executing a step is only caused by
+// the end stack not being a valid final stack for a standalone script. Steps
+// leave the program state on the stack, so such errors are expected. Any
+// other error means the step script itself failed.
+func IsBenign(err error) bool {
+	if err == nil {
+		return true
 	}
 
-	return endStack, vm.Execute()
+	return txscript.IsErrorCode(err, txscript.ErrCleanStack) ||
+		txscript.IsErrorCode(err, txscript.ErrEvalFalse) ||
+		txscript.IsErrorCode(err, txscript.ErrEmptyStack)
 }
@@ -0,0 +1,72 @@
+package execute_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/halseth/tapsim/script"
+	"github.com/stretchr/testify/require"
+)
+
+// step is a step script with the stack it is executed from.
+type step struct {
+	pkScript []byte
+	stack    [][]byte
+}
+
+// multiplySteps returns the executed steps of the multiply program trace from
+// x i pc = 02 <> <>.
+func multiplySteps(b *testing.B) []step {
+	prog := scripts.MultiplyProgram
+	res, err := trace.GetTrace(
+		context.Background(), prog, "02 <> <>", nil,
+	)
+	require.NoError(b, err)
+
+	var steps []step
+	for i := 0; i < res.Steps; i++ {
+		state := res.Trace[i]
+		pc, err := trace.GetProgramCounter(prog.Schema, state)
+		require.NoError(b, err)
+
+		pkScript, err := script.Parse(prog.Steps[pc])
+		require.NoError(b, err)
+
+		steps = append(steps, step{
+			pkScript: pkScript,
+			stack:    state,
+		})
+	}
+
+	return steps
+}
+
+// benchmarkExecuteStep measures the per-step cost of the executor, by
+// executing every transition of the multiply program trace in turn.
+func benchmarkExecuteStep(b *testing.B, exec func([]byte, [][]byte) (
+	[][]byte, error)) {
+
+	steps := multiplySteps(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s := steps[i%len(steps)]
+		_, _ = exec(s.pkScript, s.stack)
+	}
+}
+
+func BenchmarkExecuteStepEngine(b *testing.B) {
+	benchmarkExecuteStep(b, execute.ExecuteStep)
+}
+
+func BenchmarkExecuteStepHarness(b *testing.B) {
+	benchmarkExecuteStep(b, execute.NewHarness().ExecuteStep)
+}
+
+func BenchmarkExecuteStepNative(b *testing.B) {
+	native := execute.NewNative(execute.NewHarness())
+	benchmarkExecuteStep(b, native.ExecuteStep)
+}
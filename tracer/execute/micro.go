@@ -0,0 +1,190 @@
+package execute
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// leafScriptIndex is the engine's script index of the step script. The
+// engine executes the empty signature script, the taproot output script and
+// then the leaf script.
+const leafScriptIndex = 2
+
+// OpStep is the VM state after executing a single opcode of a step script.
+type OpStep struct {
+	// Index is the index of the opcode within the step script.
+	Index int
+
+	// Opcode is the disassembled opcode, with push data in hex.
+	Opcode string
+
+	// Executed is false if the opcode was skipped because it is in a
+	// conditional branch not being executed.
+	Executed bool
+
+	// StackBefore is the stack before executing the opcode.
+	StackBefore [][]byte
+
+	// Stack is the stack after executing the opcode. Nil if the opcode
+	// failed.
+	Stack [][]byte
+
+	// AltStack is the alt stack after executing the opcode. The alt stack
+	// is cleared by the VM at the end of the script, so it is always empty
+	// after the last opcode.
+	AltStack [][]byte
+
+	// CondStack is the condition stack after executing the opcode, with
+	// values txscript.OpCondFalse, OpCondTrue or OpCondSkip.
+	CondStack []int
+
+	// Err is the error returned by the VM if the opcode failed.
+	Err error
+}
+
+// TraceStep executes the given pkScript using the passed stack in the full
+// script engine, like ExecuteStep. In addition it returns the VM state after
+// every opcode executed. If an opcode fails, it is the last one returned,
+// with its error set.
+func (h *Harness) TraceStep(pkScript []byte, startStack [][]byte) (
+	[][]byte, []*OpStep, error) {
+
+	var (
+		endStack  [][]byte
+		prev      *txscript.StepInfo
+		condStack []int
+		ops       []*OpStep
+	)
+
+	// We tokenize the script alongside the engine to know which opcode
+	// was executed, and track the condition stack as the engine does.
+	tokenizer := txscript.MakeScriptTokenizer(0, pkScript)
+	nextOp := func(stackBefore [][]byte) *OpStep {
+		start := tokenizer.ByteIndex()
+		if !tokenizer.Next() {
+			return nil
+		}
+
+		opcode, _ := txscript.DisasmString(
+			pkScript[start:tokenizer.ByteIndex()],
+		)
+
+		executing := isExecuting(condStack)
+		condStack = nextCondStack(
+			condStack, tokenizer.Opcode(), stackBefore,
+		)
+
+		return &OpStep{
+			Index:       len(ops),
+			Opcode:      opcode,
+			Executed:    executing || isConditional(tokenizer.Opcode()),
+			StackBefore: stackBefore,
+			CondStack:   append([]int(nil), condStack...),
+		}
+	}
+
+	stepCallback := func(step *txscript.StepInfo) error {
+		endStack = step.Stack
+		if step.ScriptIndex != leafScriptIndex {
+			return nil
+		}
+
+		// The first callback for the leaf script is the start state.
+		if prev != nil {
+			op := nextOp(prev.Stack)
+			if op != nil {
+				op.Stack = step.Stack
+				op.AltStack = step.AltStack
+				ops = append(ops, op)
+			}
+		}
+
+		prev = step
+		return nil
+	}
+
+	err := h.execute(pkScript, startStack, stepCallback)
+
+	// If an opcode failed there was no callback for it, so we add it
+	// here. Errors from checking the final stack are not caused by an
+	// opcode, and the script will be fully tokenized in that case.
+	if err != nil && prev != nil {
+		if op := nextOp(prev.Stack); op != nil {
+			op.Err = err
+			ops = append(ops, op)
+		}
+	}
+
+	return endStack, ops, err
+}
+
+// isExecuting returns true if opcodes are executed with the given condition
+// stack.
+func isExecuting(condStack []int) bool {
+	return len(condStack) == 0 ||
+		condStack[len(condStack)-1] == txscript.OpCondTrue
+}
+
+// isConditional returns true if the opcode is one that is always executed, as
+// it changes the condition stack.
+func isConditional(op byte) bool {
+	switch op {
+	case txscript.OP_IF, txscript.OP_NOTIF, txscript.OP_ELSE,
+		txscript.OP_ENDIF:
+
+		return true
+	}
+
+	return false
+}
+
+// nextCondStack returns the condition stack after executing the opcode with
+// the given stack. Invalid conditionals leave the condition stack unchanged,
+// as the engine fails on them.
+func nextCondStack(condStack []int, op byte, stack [][]byte) []int {
+	switch op {
+	case txscript.OP_IF, txscript.OP_NOTIF:
+		if !isExecuting(condStack) {
+			return append(condStack, txscript.OpCondSkip)
+		}
+
+		if len(stack) == 0 {
+			return condStack
+		}
+
+		// Tapscript requires the condition to be minimally encoded, so
+		// it is true only if it is exactly 0x01.
+		top := stack[len(stack)-1]
+		cond := len(top) == 1 && top[0] == 1
+		if op == txscript.OP_NOTIF {
+			cond = !cond
+		}
+
+		if cond {
+			return append(condStack, txscript.OpCondTrue)
+		}
+		return append(condStack, txscript.OpCondFalse)
+
+	case txscript.OP_ELSE:
+		if len(condStack) == 0 {
+			return condStack
+		}
+
+		c := append([]int(nil), condStack...)
+		switch c[len(c)-1] {
+		case txscript.OpCondTrue:
+			c[len(c)-1] = txscript.OpCondFalse
+		case txscript.OpCondFalse:
+			c[len(c)-1] = txscript.OpCondTrue
+		}
+		return c
+
+	case txscript.OP_ENDIF:
+		if len(condStack) == 0 {
+			return condStack
+		}
+
+		return condStack[:len(condStack)-1]
+	}
+
+	return condStack
+}
@@ -0,0 +1,692 @@
+package execute
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/halseth/mattlab/commitment"
+)
+
+const (
+	// maxScriptNumLen is the maximum number of bytes a stack element
+	// interpreted as a number may be.
+	maxScriptNumLen = 4
+
+	// maxElementSize is the maximum size of a data push or witness
+	// element.
+	maxElementSize = 520
+)
+
+// errFallback is returned by the native interpreter when it cannot tell the
+// outcome of a script with certainty, and the script must be executed by the
+// full engine.
+var errFallback = errors.New("fall back to script engine")
+
+// Native executes steps using a native Go interpreter for the stack-only
+// opcodes used by program steps. It falls back to another executor for
+// scripts using other opcodes, and for any execution that fails, such that
+// errors are always reported by the script engine.
+//
+// NOTE: not safe for concurrent use.
+type Native struct {
+	fallback Executor
+
+	// scripts caches parsed scripts. A nil entry means the script is not
+	// supported by the native interpreter.
+	scripts map[string][]nativeOp
+}
+
+// A compile time check to ensure Native implements the Executor interface.
+var _ Executor = (*Native)(nil)
+
+// NewNative creates a new native executor that uses the given executor for
+// scripts it cannot execute itself.
+func NewNative(fallback Executor) *Native {
+	return &Native{
+		fallback: fallback,
+		scripts:  make(map[string][]nativeOp),
+	}
+}
+
+// nativeOp is a parsed opcode with its push data.
+type nativeOp struct {
+	op   byte
+	data []byte
+}
+
+// ExecuteStep executes the given pkScript using the passed stack. The end
+// stack and error are the same as what the script engine would return.
+func (n *Native) ExecuteStep(pkScript []byte, startStack [][]byte) (
+	[][]byte, error) {
+
+	ops, ok := n.scripts[string(pkScript)]
+	if !ok {
+		ops = parseNative(pkScript)
+		n.scripts[string(pkScript)] = ops
+	}
+
+	if ops != nil {
+		endStack, err := executeNative(ops, startStack)
+		if err != errFallback {
+			return endStack, err
+		}
+	}
+
+	return n.fallback.ExecuteStep(pkScript, startStack)
+}
+
+// parseNative parses the script into native ops. It returns nil if the script
+// contains opcodes that are not supported, or pushes that are not minimal.
+func parseNative(pkScript []byte) []nativeOp {
+	var ops []nativeOp
+	tokenizer := txscript.MakeScriptTokenizer(0, pkScript)
+	for tokenizer.Next() {
+		op := tokenizer.Opcode()
+		data := tokenizer.Data()
+
+		if op <= txscript.OP_PUSHDATA4 && !isMinimalPush(op, data) {
+			return nil
+		}
+
+		if !nativeOpcodes[op] {
+			return nil
+		}
+
+		ops = append(ops, nativeOp{
+			op:   op,
+			data: data,
+		})
+	}
+
+	if tokenizer.Err() != nil || len(ops) == 0 {
+		return nil
+	}
+
+	return ops
+}
+
+// isMinimalPush returns whether the push is using the smallest possible
+// opcode for the data.
+func isMinimalPush(op byte, data []byte) bool {
+	dataLen := len(data)
+	switch {
+	case dataLen > maxElementSize:
+		return false
+	case dataLen == 0:
+		return op == txscript.OP_0
+	case dataLen == 1 && data[0] >= 1 && data[0] <= 16:
+		return false
+	case dataLen == 1 && data[0] == 0x81:
+		return false
+	case dataLen <= 75:
+		return int(op) == dataLen
+	case dataLen <= 255:
+		return op == txscript.OP_PUSHDATA1
+	default:
+		return op == txscript.OP_PUSHDATA2
+	}
+}
+
+// nativeOpcodes are the opcodes the native interpreter supports, in addition
+// to data pushes.
+var nativeOpcodes = func() map[byte]bool {
+	m := make(map[byte]bool)
+	for op := 0; op <= txscript.OP_PUSHDATA4; op++ {
+		m[byte(op)] = true
+	}
+	for op := txscript.OP_1; op <= txscript.OP_16; op++ {
+		m[byte(op)] = true
+	}
+	for _, op := range []byte{
+		txscript.OP_1NEGATE,
+		txscript.OP_NOP,
+		txscript.OP_IF, txscript.OP_NOTIF, txscript.OP_ELSE,
+		txscript.OP_ENDIF, txscript.OP_VERIFY,
+		txscript.OP_TOALTSTACK, txscript.OP_FROMALTSTACK,
+		txscript.OP_2DROP, txscript.OP_2DUP, txscript.OP_3DUP,
+		txscript.OP_2OVER, txscript.OP_2ROT, txscript.OP_2SWAP,
+		txscript.OP_IFDUP, txscript.OP_DEPTH, txscript.OP_DROP,
+		txscript.OP_DUP, txscript.OP_NIP, txscript.OP_OVER,
+		txscript.OP_PICK, txscript.OP_ROLL, txscript.OP_ROT,
+		txscript.OP_SWAP, txscript.OP_TUCK,
+		txscript.OP_CAT, txscript.OP_SIZE,
+		txscript.OP_EQUAL, txscript.OP_EQUALVERIFY,
+		txscript.OP_1ADD, txscript.OP_1SUB, txscript.OP_NEGATE,
+		txscript.OP_ABS, txscript.OP_NOT, txscript.OP_0NOTEQUAL,
+		txscript.OP_ADD, txscript.OP_SUB, txscript.OP_BOOLAND,
+		txscript.OP_BOOLOR, txscript.OP_NUMEQUAL,
+		txscript.OP_NUMEQUALVERIFY, txscript.OP_NUMNOTEQUAL,
+		txscript.OP_LESSTHAN, txscript.OP_GREATERTHAN,
+		txscript.OP_LESSTHANOREQUAL, txscript.OP_GREATERTHANOREQUAL,
+		txscript.OP_MIN, txscript.OP_MAX, txscript.OP_WITHIN,
+		txscript.OP_SHA256,
+	} {
+		m[op] = true
+	}
+	return m
+}()
+
+// nativeVM is the state of a native script execution.
+type nativeVM struct {
+	stk [][]byte
+	alt [][]byte
+
+	// cond is the condition stack, with values as in txscript.
+	cond []int
+}
+
+func (vm *nativeVM) executing() bool {
+	return len(vm.cond) == 0 || vm.cond[len(vm.cond)-1] == txscript.OpCondTrue
+}
+
+func (vm *nativeVM) push(b []byte) {
+	vm.stk = append(vm.stk, b)
+}
+
+func (vm *nativeVM) pushInt(n commitment.ScriptNum) {
+	vm.push(n.Bytes())
+}
+
+func (vm *nativeVM) pushBool(b bool) {
+	if b {
+		vm.push([]byte{1})
+		return
+	}
+	vm.push(nil)
+}
+
+func (vm *nativeVM) pop() ([]byte, error) {
+	if len(vm.stk) == 0 {
+		return nil, errFallback
+	}
+
+	b := vm.stk[len(vm.stk)-1]
+	vm.stk = vm.stk[:len(vm.stk)-1]
+	return b, nil
+}
+
+func (vm *nativeVM) popInt() (commitment.ScriptNum, error) {
+	b, err := vm.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := commitment.MakeScriptNum(b, true, maxScriptNumLen)
+	if err != nil {
+		return 0, errFallback
+	}
+
+	return n, nil
+}
+
+func (vm *nativeVM) popBool() (bool, error) {
+	b, err := vm.pop()
+	if err != nil {
+		return false, err
+	}
+
+	return asBool(b), nil
+}
+
+// peek returns the element idx from the top of the stack.
+func (vm *nativeVM) peek(idx int) ([]byte, error) {
+	if idx < 0 || idx >= len(vm.stk) {
+		return nil, errFallback
+	}
+
+	return vm.stk[len(vm.stk)-idx-1], nil
+}
+
+// need checks that the stack has at least n elements.
+func (vm *nativeVM) need(n int) error {
+	if len(vm.stk) < n {
+		return errFallback
+	}
+
+	return nil
+}
+
+// asBool interprets the stack element as a boolean.
+func asBool(t []byte) bool {
+	for i := range t {
+		if t[i] != 0 {
+			// Negative 0 is also considered false.
+			if i == len(t)-1 && t[i] == 0x80 {
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// executeNative executes the ops on the given start stack. It returns
+// errFallback if the execution does not succeed, otherwise it returns the end
+// stack and the error the script engine returns when checking the end stack,
+// or ErrAltStackNotEmpty if the alt stack is not empty.
+func executeNative(ops []nativeOp, startStack [][]byte) ([][]byte, error) {
+	if len(startStack) > txscript.MaxStackSize {
+		return nil, errFallback
+	}
+
+	for _, el := range startStack {
+		if len(el) > maxElementSize {
+			return nil, errFallback
+		}
+	}
+
+	vm := &nativeVM{
+		stk: make([][]byte, len(startStack), len(startStack)+8),
+	}
+	copy(vm.stk, startStack)
+
+	for _, op := range ops {
+		if err := vm.step(op); err != nil {
+			return nil, err
+		}
+
+		if len(vm.stk)+len(vm.alt) > txscript.MaxStackSize {
+			return nil, errFallback
+		}
+	}
+
+	if len(vm.cond) != 0 {
+		return nil, errFallback
+	}
+
+	endStack := vm.stk
+
+	if len(vm.alt) != 0 {
+		return endStack, ErrAltStackNotEmpty
+	}
+
+	// Check the end stack the same way the engine does for tapscript
+	// execution.
+	if len(endStack) != 1 {
+		str := fmt.Sprintf("stack must contain exactly one item "+
+			"(contains %d)", len(endStack))
+		return endStack, txscript.Error{
+			ErrorCode:   txscript.ErrCleanStack,
+			Description: str,
+		}
+	}
+
+	if !asBool(endStack[0]) {
+		return endStack, txscript.Error{
+			ErrorCode: txscript.ErrEvalFalse,
+			Description: "false stack entry at end of script " +
+				"execution",
+		}
+	}
+
+	return endStack, nil
+}
+
+// step executes a single op.
+func (vm *nativeVM) step(op nativeOp) error {
+	// Conditionals are executed also in non-executing branches.
+	switch op.op {
+	case txscript.OP_IF, txscript.OP_NOTIF:
+		cond := txscript.OpCondSkip
+		if vm.executing() {
+			b, err := vm.pop()
+			if err != nil {
+				return err
+			}
+
+			// Minimal if is always enforced for tapscript.
+			if len(b) > 1 || (len(b) == 1 && b[0] != 1) {
+				return errFallback
+			}
+
+			v := asBool(b)
+			if op.op == txscript.OP_NOTIF {
+				v = !v
+			}
+
+			cond = txscript.OpCondFalse
+			if v {
+				cond = txscript.OpCondTrue
+			}
+		}
+		vm.cond = append(vm.cond, cond)
+		return nil
+
+	case txscript.OP_ELSE:
+		if len(vm.cond) == 0 {
+			return errFallback
+		}
+
+		i := len(vm.cond) - 1
+		switch vm.cond[i] {
+		case txscript.OpCondTrue:
+			vm.cond[i] = txscript.OpCondFalse
+		case txscript.OpCondFalse:
+			vm.cond[i] = txscript.OpCondTrue
+		}
+		return nil
+
+	case txscript.OP_ENDIF:
+		if len(vm.cond) == 0 {
+			return errFallback
+		}
+
+		vm.cond = vm.cond[:len(vm.cond)-1]
+		return nil
+	}
+
+	if !vm.executing() {
+		return nil
+	}
+
+	switch {
+	case op.op <= txscript.OP_PUSHDATA4:
+		vm.push(op.data)
+		return nil
+
+	case op.op == txscript.OP_1NEGATE:
+		vm.pushInt(-1)
+		return nil
+
+	case op.op >= txscript.OP_1 && op.op <= txscript.OP_16:
+		vm.pushInt(commitment.ScriptNum(op.op - txscript.OP_1 + 1))
+		return nil
+	}
+
+	switch op.op {
+	case txscript.OP_NOP:
+		return nil
+
+	case txscript.OP_VERIFY:
+		v, err := vm.popBool()
+		if err != nil {
+			return err
+		}
+		if !v {
+			return errFallback
+		}
+
+	case txscript.OP_TOALTSTACK:
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		vm.alt = append(vm.alt, b)
+
+	case txscript.OP_FROMALTSTACK:
+		if len(vm.alt) == 0 {
+			return errFallback
+		}
+		vm.push(vm.alt[len(vm.alt)-1])
+		vm.alt = vm.alt[:len(vm.alt)-1]
+
+	case txscript.OP_2DROP:
+		if err := vm.need(2); err != nil {
+			return err
+		}
+		vm.stk = vm.stk[:len(vm.stk)-2]
+
+	case txscript.OP_2DUP, txscript.OP_3DUP:
+		n := 2
+		if op.op == txscript.OP_3DUP {
+			n = 3
+		}
+		if err := vm.need(n); err != nil {
+			return err
+		}
+		vm.stk = append(vm.stk, vm.stk[len(vm.stk)-n:]...)
+
+	case txscript.OP_2OVER:
+		if err := vm.need(4); err != nil {
+			return err
+		}
+		l := len(vm.stk)
+		vm.stk = append(vm.stk, vm.stk[l-4], vm.stk[l-3])
+
+	case txscript.OP_2ROT:
+		if err := vm.need(6); err != nil {
+			return err
+		}
+		l := len(vm.stk)
+		x1, x2 := vm.stk[l-6], vm.stk[l-5]
+		copy(vm.stk[l-6:], vm.stk[l-4:])
+		vm.stk[l-2], vm.stk[l-1] = x1, x2
+
+	case txscript.OP_2SWAP:
+		if err := vm.need(4); err != nil {
+			return err
+		}
+		l := len(vm.stk)
+		vm.stk[l-4], vm.stk[l-2] = vm.stk[l-2], vm.stk[l-4]
+		vm.stk[l-3], vm.stk[l-1] = vm.stk[l-1], vm.stk[l-3]
+
+	case txscript.OP_IFDUP:
+		b, err := vm.peek(0)
+		if err != nil {
+			return err
+		}
+		if asBool(b) {
+			vm.push(b)
+		}
+
+	case txscript.OP_DEPTH:
+		vm.pushInt(commitment.ScriptNum(len(vm.stk)))
+
+	case txscript.OP_DROP:
+		if _, err := vm.pop(); err != nil {
+			return err
+		}
+
+	case txscript.OP_DUP:
+		b, err := vm.peek(0)
+		if err != nil {
+			return err
+		}
+		vm.push(b)
+
+	case txscript.OP_NIP:
+		if err := vm.need(2); err != nil {
+			return err
+		}
+		l := len(vm.stk)
+		vm.stk[l-2] = vm.stk[l-1]
+		vm.stk = vm.stk[:l-1]
+
+	case txscript.OP_OVER:
+		b, err := vm.peek(1)
+		if err != nil {
+			return err
+		}
+		vm.push(b)
+
+	case txscript.OP_PICK, txscript.OP_ROLL:
+		n, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		idx := int(n.Int32())
+		b, err := vm.peek(idx)
+		if err != nil {
+			return err
+		}
+		if op.op == txscript.OP_ROLL {
+			i := len(vm.stk) - idx - 1
+			vm.stk = append(vm.stk[:i], vm.stk[i+1:]...)
+		}
+		vm.push(b)
+
+	case txscript.OP_ROT:
+		if err := vm.need(3); err != nil {
+			return err
+		}
+		l := len(vm.stk)
+		x1 := vm.stk[l-3]
+		vm.stk[l-3], vm.stk[l-2] = vm.stk[l-2], vm.stk[l-1]
+		vm.stk[l-1] = x1
+
+	case txscript.OP_SWAP:
+		if err := vm.need(2); err != nil {
+			return err
+		}
+		l := len(vm.stk)
+		vm.stk[l-2], vm.stk[l-1] = vm.stk[l-1], vm.stk[l-2]
+
+	case txscript.OP_TUCK:
+		if err := vm.need(2); err != nil {
+			return err
+		}
+		l := len(vm.stk)
+		x1, x2 := vm.stk[l-2], vm.stk[l-1]
+		vm.stk[l-2], vm.stk[l-1] = x2, x1
+		vm.push(x2)
+
+	case txscript.OP_CAT:
+		// The top element comes first in the concatenation.
+		b1, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b2, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		buf := make([]byte, 0, len(b1)+len(b2))
+		buf = append(buf, b1...)
+		buf = append(buf, b2...)
+		vm.push(buf)
+
+	case txscript.OP_SIZE:
+		b, err := vm.peek(0)
+		if err != nil {
+			return err
+		}
+		vm.pushInt(commitment.ScriptNum(len(b)))
+
+	case txscript.OP_EQUAL, txscript.OP_EQUALVERIFY:
+		b1, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		b2, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		eq := bytes.Equal(b1, b2)
+		if op.op == txscript.OP_EQUALVERIFY {
+			if !eq {
+				return errFallback
+			}
+			return nil
+		}
+		vm.pushBool(eq)
+
+	case txscript.OP_1ADD, txscript.OP_1SUB, txscript.OP_NEGATE,
+		txscript.OP_ABS, txscript.OP_NOT, txscript.OP_0NOTEQUAL:
+
+		n, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		switch op.op {
+		case txscript.OP_1ADD:
+			n++
+		case txscript.OP_1SUB:
+			n--
+		case txscript.OP_NEGATE:
+			n = -n
+		case txscript.OP_ABS:
+			if n < 0 {
+				n = -n
+			}
+		case txscript.OP_NOT:
+			if n == 0 {
+				n = 1
+			} else {
+				n = 0
+			}
+		case txscript.OP_0NOTEQUAL:
+			if n != 0 {
+				n = 1
+			}
+		}
+		vm.pushInt(n)
+
+	case txscript.OP_ADD, txscript.OP_SUB, txscript.OP_BOOLAND,
+		txscript.OP_BOOLOR, txscript.OP_NUMEQUAL,
+		txscript.OP_NUMEQUALVERIFY, txscript.OP_NUMNOTEQUAL,
+		txscript.OP_LESSTHAN, txscript.OP_GREATERTHAN,
+		txscript.OP_LESSTHANOREQUAL, txscript.OP_GREATERTHANOREQUAL,
+		txscript.OP_MIN, txscript.OP_MAX:
+
+		// b is the top element, a the one below.
+		b, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		a, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		switch op.op {
+		case txscript.OP_ADD:
+			vm.pushInt(a + b)
+		case txscript.OP_SUB:
+			vm.pushInt(a - b)
+		case txscript.OP_BOOLAND:
+			vm.pushBool(a != 0 && b != 0)
+		case txscript.OP_BOOLOR:
+			vm.pushBool(a != 0 || b != 0)
+		case txscript.OP_NUMEQUAL:
+			vm.pushBool(a == b)
+		case txscript.OP_NUMEQUALVERIFY:
+			if a != b {
+				return errFallback
+			}
+		case txscript.OP_NUMNOTEQUAL:
+			vm.pushBool(a != b)
+		case txscript.OP_LESSTHAN:
+			vm.pushBool(a < b)
+		case txscript.OP_GREATERTHAN:
+			vm.pushBool(a > b)
+		case txscript.OP_LESSTHANOREQUAL:
+			vm.pushBool(a <= b)
+		case txscript.OP_GREATERTHANOREQUAL:
+			vm.pushBool(a >= b)
+		case txscript.OP_MIN:
+			vm.pushInt(min(a, b))
+		case txscript.OP_MAX:
+			vm.pushInt(max(a, b))
+		}
+
+	case txscript.OP_WITHIN:
+		maxVal, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		minVal, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		x, err := vm.popInt()
+		if err != nil {
+			return err
+		}
+		vm.pushBool(x >= minVal && x < maxVal)
+
+	case txscript.OP_SHA256:
+		b, err := vm.pop()
+		if err != nil {
+			return err
+		}
+		h := sha256.Sum256(b)
+		vm.push(h[:])
+
+	default:
+		return errFallback
+	}
+
+	return nil
+}
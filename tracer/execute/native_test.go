@@ -0,0 +1,223 @@
+package execute
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingExecutor is a fallback executor recording whether the native
+// interpreter fell back to it.
+type recordingExecutor struct {
+	Executor
+	called bool
+}
+
+func (r *recordingExecutor) ExecuteStep(pkScript []byte,
+	startStack [][]byte) ([][]byte, error) {
+
+	r.called = true
+	return r.Executor.ExecuteStep(pkScript, startStack)
+}
+
+// testElements are stack elements around the edge cases of number and boolean
+// encoding.
+var testElements = [][]byte{
+	{}, {0x00}, {0x80}, {0x01}, {0x02}, {0x81}, {0x7f}, {0xff},
+	{0x00, 0x80}, {0x00, 0x00}, {0xff, 0x7f}, {0xff, 0xff, 0xff, 0x7f},
+	{0xff, 0xff, 0xff, 0xff}, {0x01, 0x02, 0x03, 0x04, 0x05},
+}
+
+// randElement returns an element of testElements, or random bytes.
+func randElement(r *rand.Rand) []byte {
+	if r.Intn(4) > 0 {
+		return testElements[r.Intn(len(testElements))]
+	}
+
+	b := make([]byte, r.Intn(6))
+	r.Read(b)
+	return b
+}
+
+// randScript returns a script of random native opcodes and minimal pushes.
+// Conditionals are not balanced, so some scripts are invalid.
+func randScript(t *testing.T, r *rand.Rand) []byte {
+	var ops []byte
+	for op := txscript.OP_PUSHDATA4 + 1; op <= 0xff; op++ {
+		if nativeOpcodes[byte(op)] {
+			ops = append(ops, byte(op))
+		}
+	}
+
+	b := txscript.NewScriptBuilder()
+	for i, n := 0, 1+r.Intn(12); i < n; i++ {
+		if r.Intn(4) == 0 {
+			b.AddData(randElement(r))
+			continue
+		}
+		b.AddOp(ops[r.Intn(len(ops))])
+	}
+
+	pkScript, err := b.Script()
+	require.NoError(t, err)
+	return pkScript
+}
+
+// requireSameResult checks that the native result is the one of the engine.
+func requireSameResult(t *testing.T, wantStack, gotStack [][]byte, wantErr,
+	gotErr error, msg string) {
+
+	t.Helper()
+
+	if wantErr == nil {
+		require.NoError(t, gotErr, msg)
+	} else {
+		require.Error(t, gotErr, msg)
+		require.Equal(t, wantErr.Error(), gotErr.Error(), msg)
+	}
+
+	// Failing executions don't leave a meaningful end stack.
+	if IsBenign(wantErr) || wantErr == ErrAltStackNotEmpty {
+		// The engine and the interpreter may represent empty
+		// elements differently.
+		require.Equal(t, len(wantStack), len(gotStack), msg)
+		for i := range wantStack {
+			require.True(t, bytes.Equal(wantStack[i], gotStack[i]),
+				"%s: element %d is %x, expected %x", msg, i,
+				gotStack[i], wantStack[i])
+		}
+	}
+}
+
+// TestNativeMatchesEngine executes random scripts from random stacks with the
+// native interpreter and the script engine, and checks that the scripts the
+// interpreter executes itself give the same end stack and error.
+func TestNativeMatchesEngine(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	harness := NewHarness()
+	fallback := &recordingExecutor{Executor: harness}
+	native := NewNative(fallback)
+
+	const numScripts = 5000
+	numNative := 0
+	for i := 0; i < numScripts; i++ {
+		pkScript := randScript(t, r)
+
+		stack := make([][]byte, r.Intn(6))
+		for j := range stack {
+			stack[j] = randElement(r)
+		}
+
+		disasm, _ := txscript.DisasmString(pkScript)
+		msg := fmt.Sprintf("%s from %x", disasm, stack)
+
+		wantStack, wantErr := harness.ExecuteStep(pkScript, stack)
+
+		fallback.called = false
+		gotStack, gotErr := native.ExecuteStep(pkScript, stack)
+		if !fallback.called {
+			numNative++
+		}
+
+		requireSameResult(t, wantStack, gotStack, wantErr, gotErr, msg)
+	}
+
+	// Most scripts fail, but enough must be executed natively for the
+	// test to be meaningful.
+	t.Logf("%d of %d executed natively", numNative, numScripts)
+	require.Greater(t, numNative, numScripts/10)
+}
+
+// TestNativeFallback checks that scripts the native interpreter doesn't
+// support, and executions it can't tell the outcome of, are executed by the
+// fallback executor.
+func TestNativeFallback(t *testing.T) {
+	tests := []struct {
+		name   string
+		script func(*txscript.ScriptBuilder)
+		stack  [][]byte
+	}{{
+		name: "unsupported opcode",
+		script: func(b *txscript.ScriptBuilder) {
+			b.AddOp(txscript.OP_HASH160).AddOp(txscript.OP_DROP)
+		},
+		stack: [][]byte{{0x01}, {0x02}},
+	}, {
+		name: "non-minimal push",
+		script: func(b *txscript.ScriptBuilder) {
+			b.AddOp(txscript.OP_DATA_1).AddOp(0x05)
+		},
+		stack: [][]byte{{0x01}},
+	}, {
+		name: "failing verify",
+		script: func(b *txscript.ScriptBuilder) {
+			b.AddOp(txscript.OP_0).AddOp(txscript.OP_VERIFY)
+		},
+		stack: [][]byte{{0x01}},
+	}, {
+		name: "underflow",
+		script: func(b *txscript.ScriptBuilder) {
+			b.AddOp(txscript.OP_ADD)
+		},
+		stack: [][]byte{{0x01}},
+	}, {
+		name: "unbalanced conditional",
+		script: func(b *txscript.ScriptBuilder) {
+			b.AddOp(txscript.OP_IF)
+		},
+		stack: [][]byte{{0x01}, {0x01}},
+	}, {
+		name: "non-minimal if",
+		script: func(b *txscript.ScriptBuilder) {
+			b.AddOp(txscript.OP_IF).AddOp(txscript.OP_ENDIF)
+		},
+		stack: [][]byte{{0x01}, {0x02}},
+	}, {
+		name: "number too long",
+		script: func(b *txscript.ScriptBuilder) {
+			b.AddOp(txscript.OP_1ADD)
+		},
+		stack: [][]byte{{0x01, 0x02, 0x03, 0x04, 0x05}},
+	}}
+
+	harness := NewHarness()
+	for _, test := range tests {
+		b := txscript.NewScriptBuilder()
+		test.script(b)
+		pkScript, err := b.Script()
+		require.NoError(t, err, test.name)
+
+		fallback := &recordingExecutor{Executor: harness}
+		native := NewNative(fallback)
+
+		wantStack, wantErr := harness.ExecuteStep(pkScript, test.stack)
+		gotStack, gotErr := native.ExecuteStep(pkScript, test.stack)
+		require.True(t, fallback.called, test.name)
+		requireSameResult(
+			t, wantStack, gotStack, wantErr, gotErr, test.name,
+		)
+	}
+}
+
+// TestNewExecutorOpcodes checks that the executor of an environment not
+// enabling an extension opcode refuses scripts using it, like the engine.
+func TestNewExecutorOpcodes(t *testing.T) {
+	env, err := ParseEnv("flags=standard opcodes=OP_CHECKCONTRACTVERIFY")
+	require.NoError(t, err)
+
+	pkScript, err := txscript.NewScriptBuilder().
+		AddOp(txscript.OP_CAT).Script()
+	require.NoError(t, err)
+
+	stack := [][]byte{{0x01}, {0x02}}
+	_, wantErr := NewHarnessWithEnv(env).ExecuteStep(pkScript, stack)
+	require.Error(t, wantErr)
+
+	_, err = NewExecutor(env).ExecuteStep(pkScript, stack)
+	require.Equal(t, wantErr, err)
+}
@@ -0,0 +1,336 @@
+package fault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/halseth/mattlab/tracer/trace"
+)
+
+// Kind is a kind of fault injected into a trace.
+type Kind uint8
+
+const (
+	// Register sets a register of an executed state to a wrong value. The
+	// states after it are re-executed from the faulty state.
+	Register Kind = iota
+
+	// Skip drops the state produced by an executed step, such that the
+	// state before it is followed by the state after it. The trace is
+	// padded at the end to keep its length.
+	Skip
+
+	// PC sets the program counter of an executed state to a wrong value.
+	// The states after it are re-executed from the faulty state, or
+	// repeat it if its pc is out of range.
+	PC
+
+	// Padding sets a register of a padding state after the halting state
+	// to a wrong value. The padding states after it repeat the faulty
+	// state.
+	Padding
+
+	// Truncate ends the trace before the program halts, by replacing the
+	// states after a state before the halting state with copies of it.
+	// The end state is then not halting, and every transition from the
+	// copies is invalid.
+	Truncate
+)
+
+// kinds are all fault kinds.
+var kinds = []Kind{Register, Skip, PC, Padding, Truncate}
+
+// String returns the name of the kind.
+func (k Kind) String() string {
+	switch k {
+	case Register:
+		return "register"
+	case Skip:
+		return "skip"
+	case PC:
+		return "pc"
+	case Padding:
+		return "padding"
+	case Truncate:
+		return "truncate"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(k))
+	}
+}
+
+// ParseKind parses a kind name as returned by String.
+func ParseKind(s string) (Kind, error) {
+	for _, k := range kinds {
+		if k.String() == s {
+			return k, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown fault kind %q", s)
+}
+
+// Fault is a fault to inject into a trace.
+type Fault struct {
+	// Kind is the kind of fault.
+	Kind Kind
+
+	// Step is the index of the state the fault is injected at. For Skip
+	// faults it is the dropped state, for Truncate faults the last state
+	// kept.
+	Step int
+
+	// Register is the index of the register set by Register and Padding
+	// faults.
+	Register int
+
+	// Value is the value set by Register, PC and Padding faults. If nil,
+	// the correct value is perturbed: numbers are incremented, the pc is
+	// moved to the next step, and other values have their lowest bit
+	// flipped.
+	Value []byte
+}
+
+// String returns a human readable description of the fault.
+func (f *Fault) String() string {
+	return fmt.Sprintf("%v fault at state %d", f.Kind, f.Step)
+}
+
+// Inject returns a copy of the valid trace of the given program with the fault
+// injected. The trace must be padded after the halting state, and its length is
+// kept. Apart from the fault itself, every transition of the faulty trace is
+// valid, so that the fault is the only place a dispute can be won.
+//
+// The memory is the initial memory of programs with a memory, nil if it starts
+// out empty. It is replayed up to the faulty state when re-executing from it.
+// The hints are those recorded along the trace, as in trace.Result. Steps
+// re-executed from the faulty state are given the prover hints recorded for
+// the step at the same index, and the hints of the faulty trace are returned
+// along with it.
+func Inject(ctx context.Context, prog *scripts.Program, tr [][][]byte,
+	f *Fault, mem *memory.Memory, hints [][][]byte) ([][][]byte,
+	[][][]byte, error) {
+
+	halt, err := haltIndex(prog, tr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The start state is Bob's question, and can't be wrong.
+	first, last := 1, halt
+	switch f.Kind {
+	case Skip, Truncate:
+		last = halt - 1
+	case Padding:
+		first, last = halt+1, len(tr)-1
+	}
+	if f.Step < first || f.Step > last {
+		return nil, nil, fmt.Errorf("%v fault must be at a state in "+
+			"[%d, %d]", f.Kind, first, last)
+	}
+
+	faulty := make([][][]byte, f.Step, len(tr))
+	copy(faulty, tr[:f.Step])
+	prefixHints := append(
+		[][][]byte{}, hints[:min(f.Step, len(hints))]...,
+	)
+
+	switch f.Kind {
+	case Register, Padding:
+		if f.Register < 0 || f.Register >= prog.Schema.NumRegisters() {
+			return nil, nil, fmt.Errorf("register %d out of range",
+				f.Register)
+		}
+		if f.Register == prog.Schema.PC {
+			return nil, nil, fmt.Errorf("use a %v fault to set "+
+				"the pc", PC)
+		}
+
+		state, err := setRegister(
+			prog.Schema, tr[f.Step], f.Register, f.Value,
+			perturb(tr[f.Step][f.Register]),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if f.Kind == Padding {
+			return pad(faulty, state, len(tr)), hints, nil
+		}
+
+		return rerun(ctx, prog, tr, faulty, state, mem, hints)
+
+	case PC:
+		pc, err := trace.GetProgramCounter(prog.Schema, tr[f.Step])
+		if err != nil {
+			return nil, nil, err
+		}
+		next := commitment.ScriptNum((pc + 1) % len(prog.Steps))
+
+		state, err := setRegister(
+			prog.Schema, tr[f.Step], prog.Schema.PC, f.Value,
+			next.Bytes(),
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return rerun(ctx, prog, tr, faulty, state, mem, hints)
+
+	case Skip:
+		faulty = append(faulty, tr[f.Step+1:]...)
+		if f.Step+1 < len(hints) {
+			prefixHints = append(prefixHints, hints[f.Step+1:]...)
+		}
+		return pad(faulty, tr[len(tr)-1], len(tr)), prefixHints, nil
+
+	case Truncate:
+		return pad(faulty, tr[f.Step], len(tr)), prefixHints, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown fault kind %v", f.Kind)
+}
+
+// haltIndex returns the index of the first halting state of the trace.
+func haltIndex(prog *scripts.Program, tr [][][]byte) (int, error) {
+	for i, state := range tr {
+		pc, err := trace.GetProgramCounter(prog.Schema, state)
+		if err != nil {
+			return 0, fmt.Errorf("state %d: %v", i, err)
+		}
+
+		if pc == prog.HaltPC() {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("trace of %d states never halts", len(tr))
+}
+
+// setRegister returns a copy of the state with the register set to the value,
+// or to the default value if nil.
+func setRegister(s *schema.Schema, state [][]byte, reg int, value,
+	def []byte) ([][]byte, error) {
+
+	if value == nil {
+		value = def
+	}
+	if bytes.Equal(value, state[reg]) {
+		return nil, fmt.Errorf("register %s already holds %x",
+			s.Registers[reg].Name, value)
+	}
+
+	faulty := make([][]byte, len(state))
+	copy(faulty, state)
+	faulty[reg] = value
+
+	if err := s.Validate(faulty); err != nil {
+		return nil, fmt.Errorf("faulty state: %v", err)
+	}
+
+	return faulty, nil
+}
+
+// perturb returns a value differing from the given one: numbers are
+// incremented, and other values have their lowest bit flipped.
+func perturb(v []byte) []byte {
+	n, err := commitment.MakeScriptNum(v, true, schema.DefaultWidth)
+	if err == nil {
+		return (n + 1).Bytes()
+	}
+
+	p := append([]byte{}, v...)
+	p[0] ^= 1
+	return p
+}
+
+// rerun appends the faulty state and the states following from executing the
+// program from it to the trace prefix, and pads the result to the given
+// length. The memory is replayed along the states of the prefix. It returns
+// the faulty trace and its hints.
+func rerun(ctx context.Context, prog *scripts.Program, tr, prefix [][][]byte,
+	state [][]byte, mem *memory.Memory, hints [][][]byte) ([][][]byte,
+	[][][]byte, error) {
+
+	start := len(prefix)
+	prefixHints := append(
+		[][][]byte{}, hints[:min(start, len(hints))]...,
+	)
+
+	// Nothing can be executed from a pc out of range.
+	pc, err := trace.GetProgramCounter(prog.Schema, state)
+	if err != nil || pc < 0 || pc >= len(prog.Steps) {
+		return pad(prefix, state, len(tr)), prefixHints, nil
+	}
+
+	recorded := trace.RecordedHints(prog, hints)
+	opts := &trace.Options{
+		MaxSteps: len(tr),
+		Hints: func(step, pc int, state [][]byte) ([][]byte, error) {
+			return recorded(start+step, pc, state)
+		},
+	}
+	if prog.Memory != nil {
+		if mem == nil {
+			mem, err = memory.New(prog.Memory.Depth, nil)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		mem = mem.Copy()
+		for i, s := range prefix {
+			pc, err := trace.GetProgramCounter(prog.Schema, s)
+			if err != nil {
+				return nil, nil, fmt.Errorf("state %d: %v", i,
+					err)
+			}
+
+			_, err = trace.StepHints(
+				prog, mem, recorded, i, pc, s,
+			)
+			if err != nil {
+				return nil, nil, fmt.Errorf("state %d: %v", i,
+					err)
+			}
+		}
+		opts.Memory = mem
+	}
+
+	res, err := trace.GetTraceFromState(ctx, prog, state, opts)
+	if err != nil {
+		return nil, nil, fmt.Errorf("re-executing from faulty "+
+			"state: %v", err)
+	}
+
+	executed := res.Trace[:res.Steps+1]
+	if len(prefix)+len(executed) > len(tr) {
+		return nil, nil, fmt.Errorf("execution from faulty state "+
+			"takes %d steps, more than fit in trace of %d states",
+			res.Steps, len(tr))
+	}
+
+	prefix = append(prefix, executed...)
+
+	// Hints were only recorded up to the last step taking any.
+	for len(prefixHints) < start {
+		prefixHints = append(prefixHints, nil)
+	}
+	prefixHints = append(prefixHints, res.Hints...)
+
+	return pad(prefix, executed[len(executed)-1], len(tr)), prefixHints,
+		nil
+}
+
+// pad appends the state to the trace until it has the given length.
+func pad(tr [][][]byte, state [][]byte, length int) [][][]byte {
+	for len(tr) < length {
+		tr = append(tr, state)
+	}
+
+	return tr
+}
@@ -0,0 +1,104 @@
+package fault_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/fault"
+	"github.com/halseth/mattlab/tracer/store"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/halseth/mattlab/tracer/verify"
+	"github.com/stretchr/testify/require"
+)
+
+// TestInject checks that a fault of every kind injected at every state it can
+// be injected at makes the multiply program trace invalid, with the first
+// invalid transition where the fault is.
+func TestInject(t *testing.T) {
+	ctx := context.Background()
+	prog := scripts.MultiplyProgram
+
+	res, err := trace.GetTrace(ctx, prog, "02 <> <>", nil)
+	require.NoError(t, err)
+
+	tr := res.Trace
+	halt := res.Steps
+
+	valid, err := verify.Trace(prog, store.Memory(tr), nil)
+	require.NoError(t, err)
+	require.True(t, valid.Valid())
+
+	tests := []struct {
+		kind  fault.Kind
+		first int
+		last  int
+
+		// invalid returns the index of the state the first invalid
+		// transition starts from, for a fault at the given state.
+		invalid func(step int) int
+	}{
+		{
+			kind:    fault.Register,
+			first:   1,
+			last:    halt,
+			invalid: func(step int) int { return step - 1 },
+		},
+		{
+			kind:    fault.Skip,
+			first:   1,
+			last:    halt - 1,
+			invalid: func(step int) int { return step - 1 },
+		},
+		{
+			kind:    fault.PC,
+			first:   1,
+			last:    halt,
+			invalid: func(step int) int { return step - 1 },
+		},
+		{
+			kind:    fault.Padding,
+			first:   halt + 1,
+			last:    len(tr) - 1,
+			invalid: func(step int) int { return step - 1 },
+		},
+		{
+			kind:    fault.Truncate,
+			first:   1,
+			last:    halt - 1,
+			invalid: func(step int) int { return step },
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.kind.String(), func(t *testing.T) {
+			for step := test.first; step <= test.last; step++ {
+				f := &fault.Fault{Kind: test.kind, Step: step}
+				faulty, _, err := fault.Inject(
+					ctx, prog, tr, f, nil, nil,
+				)
+				require.NoError(t, err, f)
+				require.Len(t, faulty, len(tr), f)
+
+				res, err := verify.Trace(
+					prog, store.Memory(faulty), nil,
+				)
+				require.NoError(t, err, f)
+				require.False(t, res.Valid(), f)
+				require.NotEmpty(t, res.Transitions, f)
+				require.Equal(t, test.invalid(step),
+					res.Transitions[0].Step, f)
+			}
+
+			// Faults outside the range are rejected.
+			for _, step := range []int{test.first - 1, test.last + 1} {
+				f := &fault.Fault{Kind: test.kind, Step: step}
+				_, _, err := fault.Inject(
+					ctx, prog, tr, f, nil, nil,
+				)
+				require.Error(t, err, f)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package memory
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// MaxDepth is the maximum depth of a memory tree. Addresses are accumulated
+// as script numbers when verifying proofs, which must stay below 2^31.
+const MaxDepth = 20
+
+// Memory is a merkleized memory of 2^depth cells. Each cell holds an arbitrary
+// byte string, and the leaves of the tree are the sha256 of the cells. Inner
+// nodes are the sha256 of the left child concatenated with the right child.
+type Memory struct {
+	depth int
+	cells [][]byte
+
+	// nodes holds the tree levels, nodes[0] being the leaf hashes and
+	// nodes[depth] holding only the root.
+	nodes [][][32]byte
+}
+
+// New creates a memory of 2^depth cells, with the first cells set to the
+// given values. The remaining cells are empty.
+func New(depth int, cells [][]byte) (*Memory, error) {
+	if depth < 1 || depth > MaxDepth {
+		return nil, fmt.Errorf("memory depth %d not in range [1, %d]",
+			depth, MaxDepth)
+	}
+
+	size := 1 << depth
+	if len(cells) > size {
+		return nil, fmt.Errorf("%d cells don't fit in memory of %d "+
+			"cells", len(cells), size)
+	}
+
+	m := &Memory{
+		depth: depth,
+		cells: make([][]byte, size),
+		nodes: make([][][32]byte, depth+1),
+	}
+	for i := range m.cells {
+		if i < len(cells) {
+			m.cells[i] = cells[i]
+		} else {
+			m.cells[i] = []byte{}
+		}
+	}
+
+	m.nodes[0] = make([][32]byte, size)
+	for i, c := range m.cells {
+		m.nodes[0][i] = sha256.Sum256(c)
+	}
+	for l := 1; l <= depth; l++ {
+		below := m.nodes[l-1]
+		m.nodes[l] = make([][32]byte, len(below)/2)
+		for i := range m.nodes[l] {
+			m.nodes[l][i] = hashNodes(below[2*i], below[2*i+1])
+		}
+	}
+
+	return m, nil
+}
+
+// EmptyRoot returns the root of a memory of 2^depth empty cells.
+func EmptyRoot(depth int) [32]byte {
+	root := sha256.Sum256(nil)
+	for l := 0; l < depth; l++ {
+		root = hashNodes(root, root)
+	}
+
+	return root
+}
+
+// hashNodes returns the parent of the two nodes.
+func hashNodes(left, right [32]byte) [32]byte {
+	var b [64]byte
+	copy(b[:32], left[:])
+	copy(b[32:], right[:])
+	return sha256.Sum256(b[:])
+}
+
+// Depth returns the depth of the memory tree.
+func (m *Memory) Depth() int {
+	return m.depth
+}
+
+// Size returns the number of cells of the memory.
+func (m *Memory) Size() int {
+	return len(m.cells)
+}
+
+// Root returns the root of the memory tree.
+func (m *Memory) Root() [32]byte {
+	return m.nodes[m.depth][0]
+}
+
+// checkAddr returns an error if the address is out of range.
+func (m *Memory) checkAddr(addr int) error {
+	if addr < 0 || addr >= len(m.cells) {
+		return fmt.Errorf("address %d out of range for memory of %d "+
+			"cells", addr, len(m.cells))
+	}
+
+	return nil
+}
+
+// Read returns the value of the cell at the given address.
+func (m *Memory) Read(addr int) ([]byte, error) {
+	if err := m.checkAddr(addr); err != nil {
+		return nil, err
+	}
+
+	return m.cells[addr], nil
+}
+
+// Write sets the value of the cell at the given address, updating the tree.
+func (m *Memory) Write(addr int, value []byte) error {
+	if err := m.checkAddr(addr); err != nil {
+		return err
+	}
+
+	m.cells[addr] = append([]byte{}, value...)
+	m.nodes[0][addr] = sha256.Sum256(value)
+
+	i := addr
+	for l := 1; l <= m.depth; l++ {
+		i /= 2
+		m.nodes[l][i] = hashNodes(
+			m.nodes[l-1][2*i], m.nodes[l-1][2*i+1],
+		)
+	}
+
+	return nil
+}
+
+// Proof returns the inclusion proof of the cell at the given address, in the
+// order it is pushed on the stack as step hints. From the bottom up, it holds
+// a sibling and direction for each level from the root down, followed by the
+// cell value on top:
+//
+//	<sibling d-1> <dir d-1> ... <sibling 0> <dir 0> <value>
+//
+// The sibling at level l is the sibling of the ancestor of the cell l levels
+// above it. The direction is 1 if that ancestor is a right child and empty if
+// it is a left child, such that the directions are the bits of the address.
+func (m *Memory) Proof(addr int) ([][]byte, error) {
+	if err := m.checkAddr(addr); err != nil {
+		return nil, err
+	}
+
+	proof := make([][]byte, 0, 2*m.depth+1)
+	for l := m.depth - 1; l >= 0; l-- {
+		i := addr >> l
+		sibling := m.nodes[l][i^1]
+
+		dir := []byte{}
+		if i&1 == 1 {
+			dir = []byte{1}
+		}
+
+		proof = append(proof, sibling[:], dir)
+	}
+
+	return append(proof, m.cells[addr]), nil
+}
+
+// Copy returns a copy of the memory that can be modified independently.
+func (m *Memory) Copy() *Memory {
+	c := &Memory{
+		depth: m.depth,
+		cells: make([][]byte, len(m.cells)),
+		nodes: make([][][32]byte, len(m.nodes)),
+	}
+	copy(c.cells, m.cells)
+	for l := range m.nodes {
+		c.nodes[l] = append([][32]byte{}, m.nodes[l]...)
+	}
+
+	return c
+}
@@ -0,0 +1,131 @@
+package memory
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// proofRoot returns the root the inclusion proof leads to, and the address
+// given by its directions.
+func proofRoot(t *testing.T, proof [][]byte) ([32]byte, int) {
+	t.Helper()
+
+	require.Equal(t, 1, len(proof)%2)
+	depth := len(proof) / 2
+
+	node := sha256.Sum256(proof[len(proof)-1])
+	addr := 0
+	for l := 0; l < depth; l++ {
+		sibling := proof[len(proof)-3-2*l]
+		dir := proof[len(proof)-2-2*l]
+
+		var s [32]byte
+		copy(s[:], sibling)
+		switch {
+		case len(dir) == 0:
+			node = hashNodes(node, s)
+		case bytes.Equal(dir, []byte{1}):
+			node = hashNodes(s, node)
+			addr |= 1 << l
+		default:
+			t.Fatalf("invalid direction %x", dir)
+		}
+	}
+
+	return node, addr
+}
+
+// TestProofs checks that the proofs of every cell lead to the memory root, at
+// the cell's address, also after writes.
+func TestProofs(t *testing.T) {
+	cells := [][]byte{{1}, {2}, {}, {3, 4}, {5}}
+	m, err := New(3, cells)
+	require.NoError(t, err)
+	require.Equal(t, 3, m.Depth())
+	require.Equal(t, 8, m.Size())
+
+	check := func() {
+		for addr := 0; addr < m.Size(); addr++ {
+			proof, err := m.Proof(addr)
+			require.NoError(t, err)
+			require.Len(t, proof, 2*m.Depth()+1)
+
+			value, err := m.Read(addr)
+			require.NoError(t, err)
+			require.Equal(t, value, proof[len(proof)-1])
+
+			root, a := proofRoot(t, proof)
+			require.Equal(t, m.Root(), root, addr)
+			require.Equal(t, addr, a)
+		}
+	}
+	check()
+
+	require.NoError(t, m.Write(2, []byte{9}))
+	require.NoError(t, m.Write(7, []byte{7, 7}))
+	require.NoError(t, m.Write(0, []byte{}))
+	check()
+
+	// Writing gives the same root as creating the memory with the
+	// written cells.
+	want, err := New(3, [][]byte{
+		{}, {2}, {9}, {3, 4}, {5}, {}, {}, {7, 7},
+	})
+	require.NoError(t, err)
+	require.Equal(t, want.Root(), m.Root())
+}
+
+// TestEmptyRoot checks that the empty root is the root of an empty memory.
+func TestEmptyRoot(t *testing.T) {
+	for depth := 1; depth <= 10; depth++ {
+		m, err := New(depth, nil)
+		require.NoError(t, err)
+		require.Equal(t, EmptyRoot(depth), m.Root(), depth)
+	}
+
+	require.NotEqual(t, EmptyRoot(1), EmptyRoot(2))
+}
+
+// TestCopy checks that copies are modified independently.
+func TestCopy(t *testing.T) {
+	m, err := New(2, [][]byte{{1}})
+	require.NoError(t, err)
+	root := m.Root()
+
+	c := m.Copy()
+	require.NoError(t, c.Write(0, []byte{2}))
+	require.Equal(t, root, m.Root())
+	require.NotEqual(t, root, c.Root())
+
+	v, err := m.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, v)
+}
+
+// TestErrors checks that invalid depths and addresses are rejected.
+func TestErrors(t *testing.T) {
+	_, err := New(0, nil)
+	require.Error(t, err)
+
+	_, err = New(MaxDepth+1, nil)
+	require.Error(t, err)
+
+	_, err = New(1, [][]byte{{1}, {2}, {3}})
+	require.Error(t, err)
+
+	m, err := New(2, nil)
+	require.NoError(t, err)
+
+	for _, addr := range []int{-1, 4} {
+		_, err = m.Read(addr)
+		require.Error(t, err)
+
+		_, err = m.Proof(addr)
+		require.Error(t, err)
+
+		require.Error(t, m.Write(addr, []byte{1}))
+	}
+}
@@ -0,0 +1,247 @@
+package schema
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DefaultWidth is the width used for registers that don't specify one. It is
+// the maximum number of bytes most numeric opcodes accept as input.
+const DefaultWidth = 4
+
+// Register is a single named element of the program state.
+type Register struct {
+	// Name is the human readable name of the register.
+	Name string
+
+	// Width is the maximum number of bytes the register value can take
+	// up on the stack.
+	Width int
+
+	// Alt is true if the register is carried on the alt stack while
+	// executing a step.
+	Alt bool
+}
+
+// Schema describes the layout of the program state on the stack.
+//
+// Registers carried on the alt stack are placed after the main stack
+// registers, in the order they are returned to the main stack by
+// OP_FROMALTSTACK. The state is in this way the main stack after moving the
+// alt stack onto it, and it is committed to like any other state.
+type Schema struct {
+	// Registers are the state registers in stack order, the first
+	// register being the bottom stack element.
+	Registers []Register
+
+	// PC is the index into Registers of the program counter.
+	PC int
+}
+
+// New creates a new schema from the given registers, with the register at
+// index pc being the program counter.
+func New(registers []Register, pc int) (*Schema, error) {
+	s := &Schema{
+		Registers: registers,
+		PC:        pc,
+	}
+
+	if err := s.check(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// check performs sanity checks on the schema.
+func (s *Schema) check() error {
+	if len(s.Registers) == 0 {
+		return fmt.Errorf("schema has no registers")
+	}
+
+	if s.PC < 0 || s.PC >= len(s.Registers) {
+		return fmt.Errorf("pc index %d out of range", s.PC)
+	}
+
+	if s.Registers[s.PC].Alt {
+		return fmt.Errorf("pc cannot be an alt stack register")
+	}
+
+	seen := make(map[string]struct{})
+	for i, r := range s.Registers {
+		if r.Name == "" {
+			return fmt.Errorf("register with empty name")
+		}
+
+		if strings.ContainsAny(r.Name, ":*^\t ") {
+			return fmt.Errorf("invalid register name %q", r.Name)
+		}
+
+		if i > 0 && s.Registers[i-1].Alt && !r.Alt {
+			return fmt.Errorf("main stack register %s after alt "+
+				"stack registers", r.Name)
+		}
+
+		if _, ok := seen[r.Name]; ok {
+			return fmt.Errorf("duplicate register %s", r.Name)
+		}
+		seen[r.Name] = struct{}{}
+
+		if r.Width < 0 {
+			return fmt.Errorf("register %s has negative width",
+				r.Name)
+		}
+	}
+
+	return nil
+}
+
+// NumRegisters returns the number of stack elements in a state.
+func (s *Schema) NumRegisters() int {
+	return len(s.Registers)
+}
+
+// NumAlt returns the number of registers carried on the alt stack.
+func (s *Schema) NumAlt() int {
+	n := 0
+	for _, r := range s.Registers {
+		if r.Alt {
+			n++
+		}
+	}
+
+	return n
+}
+
+// Index returns the index of the register with the given name.
+func (s *Schema) Index(name string) (int, bool) {
+	for i, r := range s.Registers {
+		if r.Name == name {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// Names returns the register names in stack order.
+func (s *Schema) Names() []string {
+	names := make([]string, len(s.Registers))
+	for i, r := range s.Registers {
+		names[i] = r.Name
+	}
+
+	return names
+}
+
+// Validate checks that the given state matches the schema.
+func (s *Schema) Validate(state [][]byte) error {
+	if len(state) != len(s.Registers) {
+		return fmt.Errorf("state has %d elements, schema has %d "+
+			"registers", len(state), len(s.Registers))
+	}
+
+	for i, r := range s.Registers {
+		if len(state[i]) > r.Width {
+			return fmt.Errorf("register %s is %d bytes, max "+
+				"width is %d", r.Name, len(state[i]), r.Width)
+		}
+	}
+
+	return nil
+}
+
+// Equal returns true if the two schemas describe the same state layout.
+func (s *Schema) Equal(o *Schema) bool {
+	if s.PC != o.PC || len(s.Registers) != len(o.Registers) {
+		return false
+	}
+
+	for i := range s.Registers {
+		if s.Registers[i] != o.Registers[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// String encodes the schema as tab separated registers on the form
+// name[*|^]:width, where * marks the program counter and ^ marks alt stack
+// registers. This is the format used in trace headers.
+func (s *Schema) String() string {
+	var cols []string
+	for i, r := range s.Registers {
+		name := r.Name
+		if i == s.PC {
+			name += "*"
+		}
+		if r.Alt {
+			name += "^"
+		}
+		cols = append(cols, fmt.Sprintf("%s:%d", name, r.Width))
+	}
+
+	return strings.Join(cols, "\t")
+}
+
+// Parse parses a schema encoded by String. The width can be omitted, in which
+// case DefaultWidth is used. If no register is marked as the program counter,
+// the register named pc is used, falling back to the top main stack element.
+func Parse(str string) (*Schema, error) {
+	var (
+		registers []Register
+		pc        = -1
+	)
+	for _, col := range strings.Fields(str) {
+		name, widthStr, hasWidth := strings.Cut(col, ":")
+
+		width := DefaultWidth
+		if hasWidth {
+			w, err := strconv.Atoi(widthStr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid width for "+
+					"register %s: %v", name, err)
+			}
+			width = w
+		}
+
+		alt := false
+		if n, ok := strings.CutSuffix(name, "^"); ok {
+			name = n
+			alt = true
+		}
+
+		if n, ok := strings.CutSuffix(name, "*"); ok {
+			if pc != -1 {
+				return nil, fmt.Errorf("multiple program " +
+					"counters in schema")
+			}
+			name = n
+			pc = len(registers)
+		}
+
+		registers = append(registers, Register{
+			Name:  name,
+			Width: width,
+			Alt:   alt,
+		})
+	}
+
+	if pc == -1 {
+		for i := len(registers) - 1; i >= 0; i-- {
+			if !registers[i].Alt {
+				pc = i
+				break
+			}
+		}
+		for i, r := range registers {
+			if r.Name == "pc" {
+				pc = i
+			}
+		}
+	}
+
+	return New(registers, pc)
+}
@@ -0,0 +1,148 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// TestParse checks that schemas are parsed with the right registers and pc,
+// and that they encode back to a string parsing to the same schema.
+func TestParse(t *testing.T) {
+	tests := []struct {
+		str  string
+		want *Schema
+		enc  string
+	}{{
+		str: "x i pc",
+		want: &Schema{
+			Registers: []Register{
+				{Name: "x", Width: DefaultWidth},
+				{Name: "i", Width: DefaultWidth},
+				{Name: "pc", Width: DefaultWidth},
+			},
+			PC: 2,
+		},
+		enc: "x:4\ti:4\tpc*:4",
+	}, {
+		// The register named pc is the program counter even if it
+		// isn't on top.
+		str: "pc:2\tx:8\ty:0",
+		want: &Schema{
+			Registers: []Register{
+				{Name: "pc", Width: 2},
+				{Name: "x", Width: 8},
+				{Name: "y", Width: 0},
+			},
+			PC: 0,
+		},
+		enc: "pc*:2\tx:8\ty:0",
+	}, {
+		// Without a pc register, the top main stack register is the
+		// program counter.
+		str: "a b c^:3",
+		want: &Schema{
+			Registers: []Register{
+				{Name: "a", Width: DefaultWidth},
+				{Name: "b", Width: DefaultWidth},
+				{Name: "c", Width: 3, Alt: true},
+			},
+			PC: 1,
+		},
+		enc: "a:4\tb*:4\tc^:3",
+	}, {
+		// The marked program counter takes precedence over the
+		// register named pc.
+		str: "step*:1 pc x^ y^:32",
+		want: &Schema{
+			Registers: []Register{
+				{Name: "step", Width: 1},
+				{Name: "pc", Width: DefaultWidth},
+				{Name: "x", Width: DefaultWidth, Alt: true},
+				{Name: "y", Width: 32, Alt: true},
+			},
+			PC: 0,
+		},
+		enc: "step*:1\tpc:4\tx^:4\ty^:32",
+	}}
+
+	for _, test := range tests {
+		s, err := Parse(test.str)
+		require.NoError(t, err, test.str)
+		require.Equal(t, test.want, s, test.str)
+		require.Equal(t, test.enc, s.String(), test.str)
+		require.Equal(t, len(test.want.Registers), s.NumRegisters())
+
+		again, err := Parse(s.String())
+		require.NoError(t, err, test.str)
+		require.True(t, s.Equal(again), test.str)
+		require.Equal(t, s, again, test.str)
+	}
+}
+
+// TestParseErrors checks that invalid schemas are rejected.
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		str string
+		err string
+	}{
+		{"", "no registers"},
+		{"x:a pc", "invalid width"},
+		{"x:-1 pc", "negative width"},
+		{"x* pc*", "multiple program counters"},
+		{"x pc^", "pc cannot be an alt stack register"},
+		{"x pc*^", "pc cannot be an alt stack register"},
+		{"x^ pc", "after alt stack registers"},
+		{"x pc x", "duplicate register"},
+		{":4 pc", "empty name"},
+		{"x:4:4 pc", "invalid width"},
+		{"x^* pc", "invalid register name"},
+	}
+
+	for _, test := range tests {
+		_, err := Parse(test.str)
+		require.ErrorContains(t, err, test.err, test.str)
+	}
+}
+
+// TestValidate checks that states are validated against the register count and
+// widths.
+func TestValidate(t *testing.T) {
+	s, err := Parse("x:2 y:0 pc")
+	require.NoError(t, err)
+
+	require.NoError(t, s.Validate([][]byte{{1, 2}, {}, {1}}))
+	require.NoError(t, s.Validate([][]byte{nil, nil, nil}))
+
+	require.ErrorContains(t, s.Validate([][]byte{{1}, {}}), "2 elements")
+	require.ErrorContains(t,
+		s.Validate([][]byte{{1}, {}, {1}, {1}}), "4 elements")
+	require.ErrorContains(t,
+		s.Validate([][]byte{{1, 2, 3}, {}, {1}}), "register x is 3 bytes")
+	require.ErrorContains(t,
+		s.Validate([][]byte{{1}, {0}, {1}}), "register y is 1 bytes")
+}
+
+// TestLookup checks the register lookups and the schema comparison.
+func TestLookup(t *testing.T) {
+	s, err := Parse("x i pc a^ b^")
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"x", "i", "pc", "a", "b"}, s.Names())
+	require.Equal(t, 2, s.NumAlt())
+
+	i, ok := s.Index("a")
+	require.True(t, ok)
+	require.Equal(t, 3, i)
+
+	_, ok = s.Index("y")
+	require.False(t, ok)
+
+	for _, str := range []string{"x i pc a^", "x i pc a^ b^:3", "x i* pc a^ b^",
+		"x i pc a^ c^"} {
+
+		o, err := Parse(str)
+		require.NoError(t, err)
+		require.False(t, s.Equal(o), str)
+	}
+}
@@ -0,0 +1,168 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Meta is the information about a stored trace besides its schema, as in the
+// header of trace files.
+type Meta struct {
+	// Program is the hash of the program the trace is of, nil if not
+	// known.
+	Program []byte
+
+	// Steps is the number of executed steps, the states after state Steps
+	// are padding. Negative if not known.
+	Steps int
+
+	// Depth is the depth of the commitment tree of the padded trace, 0 if
+	// not known.
+	Depth int
+
+	// Env is the environment the steps were executed in, as parsed by
+	// execute.ParseEnv, empty if not known.
+	Env string
+
+	// Hints are the hints given to each executed step on top of its
+	// state, such that Hints[i] are given to the step from state i. Nil
+	// if the program takes no hints.
+	Hints [][][]byte
+}
+
+// Meta returns the metadata of the stored trace, nil if none was set.
+func (s *Store) Meta() *Meta {
+	return s.meta
+}
+
+// SetMeta writes the metadata of the stored trace, replacing any previous
+// metadata. It is written directly to disk, unlike the states.
+func (s *Store) SetMeta(m *Meta) error {
+	f, err := os.Create(s.path + metaSuffix)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(encodeMeta(m))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	s.meta = m
+	return nil
+}
+
+// encodeMeta encodes the metadata as a sequence of varints and varint length
+// prefixed byte strings: the program hash, steps, depth and environment, then
+// the number of hinted steps followed by the hints of each step, prefixed by
+// their number.
+func encodeMeta(m *Meta) []byte {
+	appendBytes := func(b, el []byte) []byte {
+		b = binary.AppendUvarint(b, uint64(len(el)))
+		return append(b, el...)
+	}
+
+	var b []byte
+	b = appendBytes(b, m.Program)
+	b = binary.AppendVarint(b, int64(m.Steps))
+	b = binary.AppendUvarint(b, uint64(m.Depth))
+	b = appendBytes(b, []byte(m.Env))
+
+	b = binary.AppendUvarint(b, uint64(len(m.Hints)))
+	for _, hints := range m.Hints {
+		b = binary.AppendUvarint(b, uint64(len(hints)))
+		for _, h := range hints {
+			b = appendBytes(b, h)
+		}
+	}
+
+	return b
+}
+
+// metaReader reads the fields of encoded metadata.
+type metaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *metaReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = fmt.Errorf("corrupt varint")
+		return 0
+	}
+	r.b = r.b[n:]
+
+	return v
+}
+
+func (r *metaReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = fmt.Errorf("corrupt varint")
+		return 0
+	}
+	r.b = r.b[n:]
+
+	return v
+}
+
+func (r *metaReader) bytes() []byte {
+	l := r.uvarint()
+	if r.err != nil {
+		return nil
+	}
+
+	if l > uint64(len(r.b)) {
+		r.err = fmt.Errorf("element of %d bytes, %d left", l, len(r.b))
+		return nil
+	}
+
+	el := r.b[:l]
+	r.b = r.b[l:]
+
+	return el
+}
+
+// decodeMeta decodes metadata encoded by encodeMeta.
+func decodeMeta(b []byte) (*Meta, error) {
+	r := &metaReader{b: b}
+	m := &Meta{}
+
+	if p := r.bytes(); len(p) > 0 {
+		m.Program = p
+	}
+	m.Steps = int(r.varint())
+	m.Depth = int(r.uvarint())
+	m.Env = string(r.bytes())
+
+	numHinted := r.uvarint()
+	for i := uint64(0); i < numHinted && r.err == nil; i++ {
+		var hints [][]byte
+		for j, n := uint64(0), r.uvarint(); j < n && r.err == nil; j++ {
+			hints = append(hints, r.bytes())
+		}
+		m.Hints = append(m.Hints, hints)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.b) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes", len(r.b))
+	}
+
+	return m, nil
+}
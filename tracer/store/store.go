@@ -0,0 +1,360 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/halseth/mattlab/tracer/schema"
+)
+
+// Source gives random access to the states of a trace.
+type Source interface {
+	// Len returns the number of states in the trace.
+	Len() int
+
+	// State returns the state at the given index.
+	State(i int) ([][]byte, error)
+}
+
+// Memory is a Source backed by a trace held in memory.
+type Memory [][][]byte
+
+// A compile time check to ensure Memory implements the Source interface.
+var _ Source = Memory(nil)
+
+// Len returns the number of states in the trace.
+func (m Memory) Len() int {
+	return len(m)
+}
+
+// State returns the state at the given index.
+func (m Memory) State(i int) ([][]byte, error) {
+	if i < 0 || i >= len(m) {
+		return nil, fmt.Errorf("state %d out of range, trace has %d "+
+			"states", i, len(m))
+	}
+
+	return m[i], nil
+}
+
+// ReadAll reads all states of the source into memory.
+func ReadAll(src Source) ([][][]byte, error) {
+	tr := make([][][]byte, src.Len())
+	for i := range tr {
+		var err error
+		tr[i], err = src.State(i)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return tr, nil
+}
+
+const (
+	// magic is the start of every trace store file.
+	magic = "mattlab-trace\x00"
+
+	// indexSuffix is appended to the store path to get the path of its
+	// index file.
+	indexSuffix = ".idx"
+
+	// metaSuffix is appended to the store path to get the path of its
+	// metadata file.
+	metaSuffix = ".meta"
+
+	// offsetSize is the size of each index entry.
+	offsetSize = 8
+)
+
+// Store is an append-only trace store on disk. States are streamed to a data
+// file, and the offset of each state is written to an index file, giving
+// random access to states by step without holding the trace in memory.
+//
+// The data file starts with a header holding the schema, followed by the
+// states. Each state is its registers in stack order, each prefixed by its
+// length as a varint. The index file holds the 8 byte big endian offset of
+// each state in the data file. The rest of the trace header, only known once
+// the trace is complete, is written to a metadata file by SetMeta.
+//
+// NOTE: not safe for concurrent use.
+type Store struct {
+	path   string
+	schema *schema.Schema
+	meta   *Meta
+
+	data  *os.File
+	index *os.File
+
+	dataW  *bufio.Writer
+	indexW *bufio.Writer
+
+	// dirty is true if there are appended states not yet flushed to
+	// disk.
+	dirty bool
+
+	// size is the size of the data file, including buffered writes.
+	size int64
+
+	numStates int
+}
+
+// A compile time check to ensure Store implements the Source interface.
+var _ Source = (*Store)(nil)
+
+// Create creates a new empty store at the given path for traces of the given
+// schema. Existing files are truncated.
+func Create(path string, s *schema.Schema) (*Store, error) {
+	data, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := os.Create(path + indexSuffix)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	// The metadata of a previous trace doesn't apply to the new one.
+	err = os.Remove(path + metaSuffix)
+	if err != nil && !os.IsNotExist(err) {
+		data.Close()
+		index.Close()
+		return nil, err
+	}
+
+	st := &Store{
+		path:   path,
+		schema: s,
+		data:   data,
+		index:  index,
+		dataW:  bufio.NewWriter(data),
+		indexW: bufio.NewWriter(index),
+	}
+
+	hdr := []byte(magic)
+	hdr = binary.AppendUvarint(hdr, uint64(len(s.String())))
+	hdr = append(hdr, s.String()...)
+	if _, err := st.dataW.Write(hdr); err != nil {
+		st.Close()
+		return nil, err
+	}
+	st.size = int64(len(hdr))
+	st.dirty = true
+
+	return st, nil
+}
+
+// Open opens an existing store at the given path. States can be appended to
+// it.
+func Open(path string) (*Store, error) {
+	data, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := os.OpenFile(path+indexSuffix, os.O_RDWR, 0)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	st := &Store{
+		path:   path,
+		data:   data,
+		index:  index,
+		dataW:  bufio.NewWriter(data),
+		indexW: bufio.NewWriter(index),
+	}
+
+	if err := st.load(); err != nil {
+		st.Close()
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+
+	return st, nil
+}
+
+// load reads the header and sizes of an opened store, and positions the
+// files for appending.
+func (s *Store) load() error {
+	r := bufio.NewReader(io.NewSectionReader(s.data, 0, 1<<62))
+
+	m := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, m); err != nil || string(m) != magic {
+		return fmt.Errorf("not a trace store")
+	}
+
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+
+	schemaStr := make([]byte, l)
+	if _, err := io.ReadFull(r, schemaStr); err != nil {
+		return err
+	}
+
+	s.schema, err = schema.Parse(string(schemaStr))
+	if err != nil {
+		return err
+	}
+
+	s.size, err = s.data.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	indexSize, err := s.index.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	if indexSize%offsetSize != 0 {
+		return fmt.Errorf("index of size %d is corrupt", indexSize)
+	}
+	s.numStates = int(indexSize / offsetSize)
+
+	meta, err := os.ReadFile(s.path + metaSuffix)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	s.meta, err = decodeMeta(meta)
+	if err != nil {
+		return fmt.Errorf("metadata: %v", err)
+	}
+
+	return nil
+}
+
+// Schema returns the schema of the stored trace.
+func (s *Store) Schema() *schema.Schema {
+	return s.schema
+}
+
+// Len returns the number of states in the store.
+func (s *Store) Len() int {
+	return s.numStates
+}
+
+// Append appends a state to the store.
+func (s *Store) Append(state [][]byte) error {
+	if err := s.schema.Validate(state); err != nil {
+		return fmt.Errorf("state %d: %v", s.numStates, err)
+	}
+
+	var offset [offsetSize]byte
+	binary.BigEndian.PutUint64(offset[:], uint64(s.size))
+	if _, err := s.indexW.Write(offset[:]); err != nil {
+		return err
+	}
+
+	var buf []byte
+	for _, el := range state {
+		buf = binary.AppendUvarint(buf, uint64(len(el)))
+		buf = append(buf, el...)
+	}
+
+	if _, err := s.dataW.Write(buf); err != nil {
+		return err
+	}
+
+	s.size += int64(len(buf))
+	s.numStates++
+	s.dirty = true
+
+	return nil
+}
+
+// State returns the state at the given index.
+func (s *Store) State(i int) ([][]byte, error) {
+	if i < 0 || i >= s.numStates {
+		return nil, fmt.Errorf("state %d out of range, store has %d "+
+			"states", i, s.numStates)
+	}
+
+	if err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	// The state ends where the next one starts, or at the end of the
+	// data file for the last state.
+	var offsets [2 * offsetSize]byte
+	n := len(offsets)
+	if i == s.numStates-1 {
+		n = offsetSize
+	}
+	_, err := s.index.ReadAt(offsets[:n], int64(i)*offsetSize)
+	if err != nil {
+		return nil, err
+	}
+
+	start := int64(binary.BigEndian.Uint64(offsets[:offsetSize]))
+	end := s.size
+	if n > offsetSize {
+		end = int64(binary.BigEndian.Uint64(offsets[offsetSize:]))
+	}
+	if end < start || end > s.size {
+		return nil, fmt.Errorf("state %d: corrupt index", i)
+	}
+
+	rec := make([]byte, end-start)
+	if _, err := s.data.ReadAt(rec, start); err != nil {
+		return nil, fmt.Errorf("state %d: %v", i, err)
+	}
+
+	state := make([][]byte, s.schema.NumRegisters())
+	for j := range state {
+		l, k := binary.Uvarint(rec)
+		if k <= 0 || l > uint64(len(rec)-k) {
+			return nil, fmt.Errorf("state %d: corrupt register %d",
+				i, j)
+		}
+
+		state[j] = rec[k : k+int(l)]
+		rec = rec[k+int(l):]
+	}
+
+	return state, nil
+}
+
+// Flush writes appended states to disk.
+func (s *Store) Flush() error {
+	if !s.dirty {
+		return nil
+	}
+
+	if err := s.dataW.Flush(); err != nil {
+		return err
+	}
+
+	if err := s.indexW.Flush(); err != nil {
+		return err
+	}
+
+	s.dirty = false
+	return nil
+}
+
+// Close flushes and closes the store.
+func (s *Store) Close() error {
+	err := s.Flush()
+
+	if cerr := s.data.Close(); err == nil {
+		err = cerr
+	}
+
+	if cerr := s.index.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
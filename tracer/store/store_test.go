@@ -0,0 +1,186 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/halseth/mattlab/tracer/schema"
+	"github.com/stretchr/testify/require"
+)
+
+// testSchema returns the schema of the test states.
+func testSchema(t *testing.T) *schema.Schema {
+	s, err := schema.Parse("x i:8 pc")
+	require.NoError(t, err)
+
+	return s
+}
+
+// testStates returns states of the test schema, with empty and wide
+// registers.
+func testStates(n int) [][][]byte {
+	states := make([][][]byte, n)
+	for i := range states {
+		states[i] = [][]byte{
+			{byte(i)},
+			make([]byte, i%9),
+			{},
+		}
+	}
+
+	return states
+}
+
+// requireStates checks that the source holds the given states.
+func requireStates(t *testing.T, want [][][]byte, src Source) {
+	t.Helper()
+
+	require.Equal(t, len(want), src.Len())
+	for i := range want {
+		state, err := src.State(i)
+		require.NoError(t, err)
+		require.Equal(t, want[i], state, "state %d", i)
+	}
+}
+
+// TestStoreRoundTrip checks that appended states read back the same, before
+// flushing, after closing and reopening, and after appending to a reopened
+// store.
+func TestStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.st")
+	s := testSchema(t)
+	states := testStates(20)
+
+	st, err := Create(path, s)
+	require.NoError(t, err)
+	require.Zero(t, st.Len())
+	require.Nil(t, st.Meta())
+
+	for _, state := range states[:10] {
+		require.NoError(t, st.Append(state))
+	}
+
+	// States are readable before being flushed.
+	requireStates(t, states[:10], st)
+	require.NoError(t, st.Close())
+
+	st, err = Open(path)
+	require.NoError(t, err)
+	require.True(t, st.Schema().Equal(s))
+	require.Nil(t, st.Meta())
+	requireStates(t, states[:10], st)
+
+	for _, state := range states[10:] {
+		require.NoError(t, st.Append(state))
+	}
+	requireStates(t, states, st)
+	require.NoError(t, st.Close())
+
+	st, err = Open(path)
+	require.NoError(t, err)
+	defer st.Close()
+	requireStates(t, states, st)
+
+	all, err := ReadAll(st)
+	require.NoError(t, err)
+	require.Equal(t, states, all)
+}
+
+// TestStoreMeta checks that the metadata is stored along with the trace, and
+// that creating a store over an existing one drops its metadata.
+func TestStoreMeta(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.st")
+	s := testSchema(t)
+
+	tests := []*Meta{{
+		Steps: -1,
+	}, {
+		Program: make([]byte, 32),
+		Steps:   3,
+		Depth:   2,
+		Env:     "flags=standard opcodes=OP_CAT",
+	}, {
+		Program: []byte{1, 2, 3},
+		Steps:   4,
+		Depth:   3,
+		Hints: [][][]byte{
+			{{1}, {}},
+			nil,
+			{{2, 3}},
+		},
+	}}
+
+	for _, meta := range tests {
+		st, err := Create(path, s)
+		require.NoError(t, err)
+		for _, state := range testStates(5) {
+			require.NoError(t, st.Append(state))
+		}
+		require.NoError(t, st.SetMeta(meta))
+		require.Equal(t, meta, st.Meta())
+		require.NoError(t, st.Close())
+
+		st, err = Open(path)
+		require.NoError(t, err)
+		require.Equal(t, meta, st.Meta())
+		require.NoError(t, st.Close())
+	}
+
+	st, err := Create(path, s)
+	require.NoError(t, err)
+	require.NoError(t, st.Close())
+
+	st, err = Open(path)
+	require.NoError(t, err)
+	require.Nil(t, st.Meta())
+	require.NoError(t, st.Close())
+}
+
+// TestStoreErrors checks that out of range reads, states not fitting the
+// schema and files that aren't stores are rejected.
+func TestStoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "trace.st")
+
+	st, err := Create(path, testSchema(t))
+	require.NoError(t, err)
+	defer st.Close()
+
+	for _, state := range testStates(3) {
+		require.NoError(t, st.Append(state))
+	}
+
+	for _, i := range []int{-1, 3, 100} {
+		_, err := st.State(i)
+		require.ErrorContains(t, err, "out of range")
+	}
+
+	// Too few registers, and a register wider than its width.
+	require.Error(t, st.Append([][]byte{{1}, {}}))
+	require.Error(t, st.Append([][]byte{{1}, make([]byte, 9), {}}))
+	require.Equal(t, 3, st.Len())
+
+	_, err = Open(filepath.Join(dir, "missing.st"))
+	require.Error(t, err)
+
+	bad := filepath.Join(dir, "bad.st")
+	require.NoError(t, os.WriteFile(bad, []byte("not a store"), 0o644))
+	require.NoError(t, os.WriteFile(bad+indexSuffix, nil, 0o644))
+	_, err = Open(bad)
+	require.ErrorContains(t, err, "not a trace store")
+
+	require.NoError(t, st.Flush())
+	require.NoError(t, os.WriteFile(path+metaSuffix, []byte{0x05}, 0o644))
+	_, err = Open(path)
+	require.ErrorContains(t, err, "metadata")
+}
+
+// TestMemory checks the in-memory source.
+func TestMemory(t *testing.T) {
+	states := testStates(4)
+	requireStates(t, states, Memory(states))
+
+	_, err := Memory(states).State(4)
+	require.ErrorContains(t, err, "out of range")
+}
@@ -0,0 +1,143 @@
+package trace_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/halseth/mattlab/assembler"
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/store"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/halseth/mattlab/tracer/verify"
+	"github.com/stretchr/testify/require"
+)
+
+// halveSrc halves n, taking n/2 as a hint stored in half and checking that
+// n - 2*half is 0 or 1.
+const halveSrc = `#:	n half pc
+div:	HINT half OP_DROP OP_2DUP OP_DUP OP_ADD OP_SUB OP_0 OP_2 OP_WITHIN OP_VERIFY @halt
+halt:	OP_NOP
+`
+
+// addSrc sets x to the sum of two hints left on top of the state.
+const addSrc = `#:	x pc
+add:	HINT 2 OP_ADD OP_ROT OP_DROP OP_SWAP OP_DROP @halt
+halt:	OP_NOP
+`
+
+func assemble(t *testing.T, src string) *scripts.Program {
+	t.Helper()
+
+	a, err := assembler.Assemble(src)
+	require.NoError(t, err)
+	prog, err := a.Program()
+	require.NoError(t, err)
+
+	return prog
+}
+
+func num(n int64) []byte {
+	return append([]byte{}, commitment.ScriptNum(n).Bytes()...)
+}
+
+// TestHints checks that steps are given the hints of the tape, that the hints
+// are recorded, and that replaying the recorded hints gives the same trace.
+func TestHints(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name  string
+		src   string
+		start string
+		tape  [][]byte
+		end   [][]byte
+	}{
+		{
+			name:  "stored",
+			src:   halveSrc,
+			start: "07 <> <>",
+			tape:  [][]byte{num(3)},
+			end:   [][]byte{num(7), num(3), num(1)},
+		},
+		{
+			name:  "left for the script",
+			src:   addSrc,
+			start: "<> <>",
+			tape:  [][]byte{num(2), num(5)},
+			end:   [][]byte{num(7), num(1)},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			prog := assemble(t, test.src)
+
+			opts := trace.DefaultOptions()
+			opts.Strict = trace.StrictAbort
+			opts.Hints = trace.HintTape(prog, test.tape)
+			res, err := trace.GetTrace(ctx, prog, test.start, opts)
+			require.NoError(t, err)
+			require.Equal(t, test.end, res.Trace[len(res.Trace)-1])
+			require.Equal(t, [][][]byte{test.tape}, res.Hints)
+
+			opts.Hints = trace.RecordedHints(prog, res.Hints)
+			replay, err := trace.GetTrace(ctx, prog, test.start, opts)
+			require.NoError(t, err)
+			require.Equal(t, res.Trace, replay.Trace)
+
+			v, err := verify.Trace(prog, store.Memory(res.Trace),
+				&verify.Options{Hints: res.Hints})
+			require.NoError(t, err)
+			require.True(t, v.Valid())
+
+			// Without the hints, the transition can't be
+			// checked.
+			v, err = verify.Trace(prog, store.Memory(res.Trace),
+				nil)
+			require.NoError(t, err)
+			require.False(t, v.Valid())
+		})
+	}
+}
+
+// TestBadHints checks that hints failing the step's checks, and missing hints,
+// are errors.
+func TestBadHints(t *testing.T) {
+	ctx := context.Background()
+	prog := assemble(t, halveSrc)
+
+	for _, half := range []int64{2, 4, -3} {
+		opts := trace.DefaultOptions()
+		opts.Strict = trace.StrictAbort
+		opts.Hints = trace.HintTape(prog, [][]byte{num(half)})
+
+		_, err := trace.GetTrace(ctx, prog, "07 <> <>", opts)
+		var stepErr *trace.StepError
+		require.ErrorAs(t, err, &stepErr, half)
+		require.Equal(t, 0, stepErr.Step)
+	}
+
+	// The tape runs out.
+	opts := trace.DefaultOptions()
+	opts.Hints = trace.HintTape(prog, nil)
+	_, err := trace.GetTrace(ctx, prog, "07 <> <>", opts)
+	require.Error(t, err)
+
+	// No hint provider.
+	_, err = trace.GetTrace(ctx, prog, "07 <> <>", nil)
+	require.Error(t, err)
+
+	// Recorded hints of the wrong trace are rejected when verifying.
+	opts = trace.DefaultOptions()
+	opts.Hints = trace.HintTape(prog, [][]byte{num(3)})
+	res, err := trace.GetTrace(ctx, prog, "07 <> <>", opts)
+	require.NoError(t, err)
+
+	v, err := verify.Trace(prog, store.Memory(res.Trace), &verify.Options{
+		Hints: [][][]byte{{num(4)}},
+	})
+	require.NoError(t, err)
+	require.False(t, v.Valid())
+}
@@ -1,23 +1,258 @@
 package trace
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/scripts"
 	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/mattlab/tracer/schema"
 	"github.com/halseth/tapsim/script"
 )
 
-const maxSteps = 80
+// DefaultMaxSteps is the maximum number of program steps executed if no
+// other bound is given.
+const DefaultMaxSteps = 1 << 20
 
-// GetTrace creates a trace from executing the passed script steps and start
-// stack. It assumes that the program counter is the top stack element and that
-// it can be used to index into the scriptSteps slice.
-func GetTrace(scriptSteps []string, startStackStr string) ([][][]byte, error) {
-	numSteps := len(scriptSteps)
-	if scriptSteps[numSteps-1] != "OP_NOP" {
-		return nil, fmt.Errorf("last script step must be OP_NOP")
+// StrictMode determines how VM errors from executing program steps are
+// handled.
+type StrictMode uint8
+
+const (
+	// StrictOff ignores VM errors, only the end stack of each step is
+	// used.
+	StrictOff StrictMode = iota
+
+	// StrictFlag records steps failing in the VM in the result, but
+	// completes the trace.
+	StrictFlag
+
+	// StrictAbort stops tracing with an error at the first step failing
+	// in the VM.
+	StrictAbort
+)
+
+// String returns the name of the mode.
+func (m StrictMode) String() string {
+	switch m {
+	case StrictOff:
+		return "off"
+	case StrictFlag:
+		return "flag"
+	case StrictAbort:
+		return "abort"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(m))
+	}
+}
+
+// ParseStrictMode parses a mode name as returned by String.
+func ParseStrictMode(s string) (StrictMode, error) {
+	for _, m := range []StrictMode{StrictOff, StrictFlag, StrictAbort} {
+		if m.String() == s {
+			return m, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown strict mode %q", s)
+}
+
+// StepError is a VM error from executing a program step.
+type StepError struct {
+	// Step is the index of the state the step was executed from.
+	Step int
+
+	// PC is the program counter of the executed step.
+	PC int
+
+	// Err is the error returned by the VM.
+	Err error
+
+	// Ops are the opcodes executed by the step, if micro tracing.
+	Ops []*execute.OpStep
+}
+
+// Error returns a human readable description of the step error.
+func (e *StepError) Error() string {
+	return fmt.Sprintf("step %d at pc %d failed: %v", e.Step, e.PC, e.Err)
+}
+
+// Options are the options used when tracing a program.
+type Options struct {
+	// MaxSteps is the maximum number of program steps to execute before
+	// giving up, padding not counted: a program halting after exactly
+	// MaxSteps steps is traced. If zero, DefaultMaxSteps is used.
+	MaxSteps int
+
+	// Depth is the depth of the commitment tree the trace should be
+	// padded to, such that it has 2^Depth state transitions. If zero, the
+	// smallest depth that fits the trace is chosen.
+	Depth int
+
+	// Progress, if set, is called for every state added to the trace,
+	// including padding states.
+	Progress func(step int, state [][]byte)
+
+	// Executor is used to execute the program steps. If nil, the executor
+	// for the program's environment is used.
+	Executor execute.Executor
+
+	// Strict determines how steps failing in the VM are handled. Errors
+	// only caused by the end stack not being a valid final stack are
+	// never considered failures.
+	Strict StrictMode
+
+	// Micro enables recording every opcode executed within each step.
+	// Steps are then always executed by the script engine, and Executor
+	// is not used.
+	Micro bool
+
+	// Sink, if set, receives every state of the trace, including padding
+	// states, instead of the trace being kept in memory. Result.Trace is
+	// then nil.
+	Sink Sink
+
+	// Memory is the initial memory of programs with a memory, the root
+	// register of the start state must hold its root. If nil, the memory
+	// starts out empty. It is modified by the steps storing to memory.
+	Memory *memory.Memory
+
+	// Hints provides the prover hints for steps taking them. It must be
+	// set for programs with such steps.
+	Hints HintProvider
+}
+
+// HintProvider returns the prover hints for executing the step at the given pc
+// from the state at the given index of the trace. It is only called for steps
+// taking prover hints, and must return as many hints as the step takes, the
+// last one being on top of the stack.
+type HintProvider func(step, pc int, state [][]byte) ([][]byte, error)
+
+// HintTape returns a hint provider giving the steps of the program taking
+// prover hints the next hints from the tape, in execution order.
+func HintTape(prog *scripts.Program, tape [][]byte) HintProvider {
+	return func(step, pc int, _ [][]byte) ([][]byte, error) {
+		n := prog.NumProverHints(pc)
+		if n > len(tape) {
+			return nil, fmt.Errorf("hint tape exhausted, %d hints "+
+				"left for step taking %d", len(tape), n)
+		}
+
+		hints := tape[:n]
+		tape = tape[n:]
+		return hints, nil
 	}
+}
+
+// RecordedHints returns a hint provider giving the steps of the program the
+// prover hints recorded along a trace of it, as in Result.Hints.
+func RecordedHints(prog *scripts.Program, hints [][][]byte) HintProvider {
+	return func(step, pc int, _ [][]byte) ([][]byte, error) {
+		n := prog.NumProverHints(pc)
+		if step >= len(hints) || len(hints[step]) < n {
+			return nil, fmt.Errorf("no hints recorded for step %d",
+				step)
+		}
 
+		// The prover hints are on top of the memory proof.
+		return hints[step][len(hints[step])-n:], nil
+	}
+}
+
+// Sink receives the states of a trace as they are produced, such as a trace
+// store.
+type Sink interface {
+	// Append adds the next state of the trace.
+	Append(state [][]byte) error
+}
+
+// DefaultOptions returns the default tracing options.
+func DefaultOptions() *Options {
+	return &Options{
+		MaxSteps: DefaultMaxSteps,
+	}
+}
+
+func (o *Options) maxSteps() int {
+	if o.MaxSteps == 0 {
+		return DefaultMaxSteps
+	}
+
+	return o.MaxSteps
+}
+
+func (o *Options) executor(env *execute.Env) execute.Executor {
+	if o.Executor == nil {
+		return execute.NewExecutor(env)
+	}
+
+	return o.Executor
+}
+
+func (o *Options) progress(step int, state [][]byte) {
+	if o.Progress != nil {
+		o.Progress(step, state)
+	}
+}
+
+// Result is the outcome of tracing a program.
+type Result struct {
+	// Trace is the padded trace. It is nil if the states were sent to a
+	// sink.
+	Trace [][][]byte
+
+	// Steps is the number of program steps executed before the program
+	// halted, not counting padding.
+	Steps int
+
+	// Depth is the depth of the commitment tree for the padded trace,
+	// which has 2^Depth state transitions.
+	Depth int
+
+	// StepErrors are the steps that failed in the VM. Only recorded in
+	// strict mode.
+	StepErrors []*StepError
+
+	// Micro holds the opcodes executed by each step, such that Micro[i]
+	// takes Trace[i] to Trace[i+1]. Only recorded if micro tracing.
+	Micro [][]*execute.OpStep
+
+	// Hints holds the hints given to each step on top of its start state,
+	// such that Hints[i] are given to the step from Trace[i]: the proof
+	// of its memory access, followed by its prover hints. Only recorded
+	// for programs taking hints, for the executed steps. Steps taking no
+	// hints have nil hints.
+	Hints [][][]byte
+}
+
+// Valid returns true if no steps were recorded as failing in the VM.
+func (r *Result) Valid() bool {
+	return len(r.StepErrors) == 0
+}
+
+// GetTrace creates a trace from executing the passed program with the given
+// start stack. It uses the program's schema to find the program counter, and
+// the program counter is used to index into the program's script steps.
+//
+// Tracing stops with an error if the context is cancelled or its deadline
+// is exceeded.
+func GetTrace(ctx context.Context, prog *scripts.Program, startStackStr string,
+	opts *Options) (*Result, error) {
+
+	startStack, err := ParseStartStack(startStackStr)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetTraceFromState(ctx, prog, startStack, opts)
+}
+
+// ParseStartStack parses a start stack in the tapsim witness syntax, bottom
+// element first.
+func ParseStartStack(startStackStr string) ([][]byte, error) {
 	// Empty sign func, we don't support signatures.
 	signFunc := func(keyID string) ([]byte, error) {
 		return nil, fmt.Errorf("signatures not supported")
@@ -38,56 +273,433 @@ func GetTrace(scriptSteps []string, startStackStr string) ([][][]byte, error) {
 		startStack = append(startStack, w)
 	}
 
-	var trace [][][]byte
-	trace = append(trace, startStack)
+	return startStack, nil
+}
+
+// GetTraceFromState creates a trace like GetTrace, from the given start
+// state.
+func GetTraceFromState(ctx context.Context, prog *scripts.Program,
+	startStack [][]byte, opts *Options) (*Result, error) {
+
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	scriptSteps := prog.Steps
+	numSteps := len(scriptSteps)
+	if err := prog.Validate(); err != nil {
+		return nil, err
+	}
+
+	err := prog.Schema.Validate(startStack)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start stack: %v", err)
+	}
+
+	var (
+		mem   *memory.Memory
+		hints [][][]byte
+	)
+	if prog.Memory != nil {
+		mem = opts.Memory
+		if mem == nil && prog.Memory.Init != nil {
+			return nil, fmt.Errorf("program starts with memory "+
+				"root %x, but no initial memory given",
+				prog.Memory.Init[:])
+		}
+		if mem == nil {
+			mem, err = memory.New(prog.Memory.Depth, nil)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if err := CheckMemoryRoot(prog, mem, startStack); err != nil {
+			return nil, fmt.Errorf("start stack: %v", err)
+		}
+	}
+
+	var (
+		trace     [][][]byte
+		numStates int
+	)
+	appendState := func(state [][]byte) error {
+		if opts.Sink != nil {
+			if err := opts.Sink.Append(state); err != nil {
+				return fmt.Errorf("state %d: %v", numStates, err)
+			}
+		} else {
+			trace = append(trace, state)
+		}
+
+		opts.progress(numStates, state)
+		numStates++
+
+		return nil
+	}
+
+	if err := appendState(startStack); err != nil {
+		return nil, err
+	}
 
 	currentStack := startStack
 
-	bound := 0
-	pc := GetProgramCounter(currentStack)
-	for pc < uint8(numSteps)-1 {
-		// Execute script step at current program counter.
-		pkScript, err := script.Parse(scriptSteps[pc])
+	maxSteps := opts.maxSteps()
+	env := prog.ExecEnv()
+	executor := opts.executor(env)
+
+	var (
+		microTracer *execute.Harness
+		microTrace  [][]*execute.OpStep
+	)
+	if opts.Micro {
+		microTracer = execute.NewHarnessWithEnv(env)
+	}
+
+	// Parse each step once, as they are executed many times.
+	pkScripts := make([][]byte, numSteps)
+	for i := range scriptSteps {
+		pkScripts[i], err = script.Parse(prog.StepScript(i))
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("parsing step %d: %v", i, err)
 		}
 
-		// We ignore the error, as we don't need this to be valid as a
-		// standalone Bitcoin script
-		currentStack, _ = execute.ExecuteStep(pkScript, currentStack)
-		//fmt.Println("stack", spew.Sdump(currentStack))
+		if err := env.CheckScript(pkScripts[i]); err != nil {
+			return nil, fmt.Errorf("step %d: %v", i, err)
+		}
+	}
 
-		trace = append(trace, currentStack)
-		pc = GetProgramCounter(currentStack)
+	takesHints := prog.TakesHints()
 
-		bound++
+	var stepErrors []*StepError
+	bound := 0
+	pc, err := getProgramCounter(prog.Schema, currentStack, numSteps)
+	if err != nil {
+		return nil, fmt.Errorf("start stack: %v", err)
+	}
+	for pc < numSteps-1 {
+		if err := ctx.Err(); err != nil {
+			return nil, fmt.Errorf("tracing stopped after %d "+
+				"steps: %v", bound, err)
+		}
+
+		// The program hasn't halted, so it needs another step.
 		if bound >= maxSteps {
 			return nil, fmt.Errorf("reached bound of %d steps",
 				maxSteps)
 		}
+
+		// Execute script step at current program counter.
+		pkScript := pkScripts[pc]
+
+		// Steps accessing memory are given the proof of the accessed
+		// cell on top of the state, and steps taking prover hints
+		// the hints on top of it.
+		stepStack := currentStack
+		if takesHints {
+			stepHints, err := StepHints(
+				prog, mem, opts.Hints, numStates-1, pc,
+				currentStack,
+			)
+			if err != nil {
+				return nil, fmt.Errorf("step %d at pc %d: %v",
+					numStates-1, pc, err)
+			}
+			hints = append(hints, stepHints)
+
+			stepStack = append(
+				append([][]byte{}, currentStack...),
+				stepHints...,
+			)
+		}
+
+		// We ignore benign errors, as we don't need this to be valid as
+		// a standalone Bitcoin script.
+		var ops []*execute.OpStep
+		if microTracer != nil {
+			currentStack, ops, err = microTracer.TraceStep(
+				pkScript, stepStack,
+			)
+			microTrace = append(microTrace, ops)
+		} else {
+			currentStack, err = executor.ExecuteStep(
+				pkScript, stepStack,
+			)
+		}
+		//fmt.Println("stack", spew.Sdump(currentStack))
+
+		// Elements left on the alt stack are dropped by the VM, and
+		// would silently be lost from the state.
+		if err == execute.ErrAltStackNotEmpty {
+			return nil, &StepError{
+				Step: numStates - 1,
+				PC:   pc,
+				Err:  err,
+				Ops:  ops,
+			}
+		}
+
+		var stepErr *StepError
+		if opts.Strict != StrictOff && !execute.IsBenign(err) {
+			stepErr = &StepError{
+				Step: numStates - 1,
+				PC:   pc,
+				Err:  err,
+				Ops:  ops,
+			}
+			if opts.Strict == StrictAbort {
+				return nil, stepErr
+			}
+
+			stepErrors = append(stepErrors, stepErr)
+		}
+
+		if err := prog.Schema.Validate(currentStack); err != nil {
+			// If the step failed, the VM error is more useful
+			// than the malformed state it left behind.
+			if stepErr != nil {
+				return nil, stepErr
+			}
+
+			return nil, fmt.Errorf("step %d at pc %d: %v",
+				numStates, pc, err)
+		}
+
+		// The memory kept by the tracer must match the root left
+		// by the step.
+		if mem != nil {
+			err := CheckMemoryRoot(prog, mem, currentStack)
+			if err != nil {
+				if stepErr != nil {
+					return nil, stepErr
+				}
+
+				return nil, fmt.Errorf("step %d at pc %d: %v",
+					numStates, pc, err)
+			}
+		}
+
+		if err := appendState(currentStack); err != nil {
+			return nil, err
+		}
+
+		pc, err = getProgramCounter(prog.Schema, currentStack, numSteps)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: %v", numStates-1, err)
+		}
+
+		bound++
+	}
+
+	depth, err := pad(ctx, numStates, currentStack, appendState, opts)
+	if err != nil {
+		return nil, err
 	}
 
+	return &Result{
+		Trace:      trace,
+		Steps:      bound,
+		Depth:      depth,
+		StepErrors: stepErrors,
+		Micro:      microTrace,
+		Hints:      hints,
+	}, nil
+}
+
+// StepHints returns the hints for executing the step at the given pc from the
+// state at the given index: the proof of its memory access, if any, followed by
+// its prover hints. The memory access is applied to the memory, after the
+// prover hints stored in registers.
+func StepHints(prog *scripts.Program, mem *memory.Memory, provider HintProvider,
+	step, pc int, state [][]byte) ([][]byte, error) {
+
+	var prover [][]byte
+	if n := prog.NumProverHints(pc); n > 0 {
+		if provider == nil {
+			return nil, fmt.Errorf("step takes %d prover hints, "+
+				"but no hint provider given", n)
+		}
+
+		var err error
+		prover, err = provider(step, pc, state)
+		if err != nil {
+			return nil, fmt.Errorf("hints: %v", err)
+		}
+		if len(prover) != n {
+			return nil, fmt.Errorf("step takes %d prover hints, "+
+				"got %d", n, len(prover))
+		}
+
+		if regs := prog.HintOp(pc).Regs; regs != nil {
+			state = append([][]byte{}, state...)
+			for i, r := range regs {
+				state[r] = prover[i]
+			}
+		}
+	}
+
+	var hints [][]byte
+	if mem != nil {
+		proof, err := MemoryStep(prog, mem, pc, state)
+		if err != nil {
+			return nil, err
+		}
+		hints = append(hints, proof...)
+	}
+
+	return append(hints, prover...), nil
+}
+
+// MemoryStep returns the hints for executing the step at the given pc from the
+// given state, and applies its memory access to the memory. Steps accessing
+// memory are given the inclusion proof of the accessed cell, other steps no
+// hints.
+func MemoryStep(prog *scripts.Program, mem *memory.Memory, pc int,
+	state [][]byte) ([][]byte, error) {
+
+	op := prog.Memory.Op(pc)
+	if op == nil {
+		return nil, nil
+	}
+
+	addr, err := commitment.MakeScriptNum(
+		state[op.Addr], true, schema.DefaultWidth,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %x: %v",
+			state[op.Addr], err)
+	}
+
+	proof, err := mem.Proof(int(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	if op.Kind == scripts.MemStore {
+		if err := mem.Write(int(addr), state[op.Reg]); err != nil {
+			return nil, err
+		}
+	}
+
+	return proof, nil
+}
+
+// CheckMemoryRoot checks that the memory root register of the state holds the
+// root of the memory.
+func CheckMemoryRoot(prog *scripts.Program, mem *memory.Memory,
+	state [][]byte) error {
+
+	root := mem.Root()
+	if !bytes.Equal(state[prog.Memory.Root], root[:]) {
+		return fmt.Errorf("memory root %x does not match memory "+
+			"with root %x", state[prog.Memory.Root], root[:])
+	}
+
+	return nil
+}
+
+// Pad pads the trace by repeating its last state, such that it has a power of
+// two state transitions. It returns the padded trace and the depth of its
+// commitment tree.
+func Pad(ctx context.Context, trace [][][]byte, opts *Options) ([][][]byte,
+	int, error) {
+
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+
+	if len(trace) == 0 {
+		return nil, 0, fmt.Errorf("cannot pad empty trace")
+	}
+
+	appendState := func(state [][]byte) error {
+		trace = append(trace, state)
+		opts.progress(len(trace)-1, state)
+		return nil
+	}
+
+	depth, err := pad(
+		ctx, len(trace), trace[len(trace)-1], appendState, opts,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return trace, depth, nil
+}
+
+// pad pads a trace of numStates states ending in the last state, by passing
+// copies of the last state to appendState until it has a power of two state
+// transitions. It returns the depth of the commitment tree of the padded
+// trace.
+func pad(ctx context.Context, numStates int, last [][]byte,
+	appendState func([][]byte) error, opts *Options) (int, error) {
+
 	// We need the trace to be of length a power of two+1.
+	depth := 1
 	pow2 := 2
-	for pow2+1 < len(trace) {
+	for pow2+1 < numStates {
 		pow2 = pow2 * 2
+		depth++
+	}
+
+	if opts.Depth != 0 {
+		if depth > opts.Depth {
+			return 0, fmt.Errorf("trace of %d steps does not fit "+
+				"in tree of depth %d", numStates-1, opts.Depth)
+		}
+
+		depth = opts.Depth
+		pow2 = 1 << depth
+	}
+
+	for ; numStates < pow2+1; numStates++ {
+		if err := ctx.Err(); err != nil {
+			return 0, fmt.Errorf("padding stopped: %v", err)
+		}
+
+		if err := appendState(last); err != nil {
+			return 0, err
+		}
 	}
 
-	for len(trace) < pow2+1 {
-		trace = append(trace, currentStack)
+	return depth, nil
+}
+
+// GetProgramCounter returns the program counter from the stack, using the
+// schema to locate it. The program counter is decoded as a minimally encoded
+// script number of at most the pc register's width.
+func GetProgramCounter(s *schema.Schema, stack [][]byte) (int, error) {
+	if s.PC >= len(stack) {
+		return 0, fmt.Errorf("stack of %d elements has no pc at "+
+			"index %d", len(stack), s.PC)
 	}
 
-	return trace, nil
+	pcBytes := stack[s.PC]
+	width := s.Registers[s.PC].Width
+
+	pc, err := commitment.MakeScriptNum(pcBytes, true, width)
+	if err != nil {
+		return 0, fmt.Errorf("invalid pc %x: %v", pcBytes, err)
+	}
+
+	return int(pc), nil
 }
 
-// GetProgramCounter assumes program counter is top stack element.
-func GetProgramCounter(stack [][]byte) uint8 {
-	pcBytes := stack[len(stack)-1]
+// getProgramCounter returns the program counter from the stack, checking
+// that it is within the range of a program with numSteps steps.
+func getProgramCounter(s *schema.Schema, stack [][]byte, numSteps int) (int,
+	error) {
+
+	pc, err := GetProgramCounter(s, stack)
+	if err != nil {
+		return 0, err
+	}
 
-	var pc uint8
-	if len(pcBytes) > 0 {
-		pc = pcBytes[0]
+	if pc < 0 || pc >= numSteps {
+		return 0, fmt.Errorf("pc %d out of range for program with %d "+
+			"steps", pc, numSteps)
 	}
 
-	return pc
+	return pc, nil
 }
@@ -0,0 +1,92 @@
+package trace_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/stretchr/testify/require"
+)
+
+// multiplySteps is the number of steps the multiply program executes before
+// halting.
+const multiplySteps = 17
+
+// TestMaxSteps checks that programs halting after at most MaxSteps steps are
+// traced, padding not counted.
+func TestMaxSteps(t *testing.T) {
+	ctx := context.Background()
+	prog := scripts.MultiplyProgram
+
+	for _, maxSteps := range []int{multiplySteps, multiplySteps + 1, 32} {
+		res, err := trace.GetTrace(ctx, prog, "02 <> <>", &trace.Options{
+			MaxSteps: maxSteps,
+		})
+		require.NoError(t, err, maxSteps)
+		require.Equal(t, multiplySteps, res.Steps)
+		require.Len(t, res.Trace, 33)
+	}
+
+	for _, maxSteps := range []int{1, multiplySteps - 1} {
+		_, err := trace.GetTrace(ctx, prog, "02 <> <>", &trace.Options{
+			MaxSteps: maxSteps,
+		})
+		require.Error(t, err, maxSteps)
+	}
+}
+
+// TestDepth checks that traces are padded to the given depth.
+func TestDepth(t *testing.T) {
+	ctx := context.Background()
+	prog := scripts.MultiplyProgram
+
+	res, err := trace.GetTrace(ctx, prog, "02 <> <>", nil)
+	require.NoError(t, err)
+	require.Equal(t, 5, res.Depth)
+	require.Len(t, res.Trace, 1<<5+1)
+
+	last := res.Trace[multiplySteps]
+	for _, state := range res.Trace[multiplySteps:] {
+		require.Equal(t, last, state)
+	}
+
+	res, err = trace.GetTrace(ctx, prog, "02 <> <>", &trace.Options{
+		Depth: 7,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 7, res.Depth)
+	require.Len(t, res.Trace, 1<<7+1)
+
+	_, err = trace.GetTrace(ctx, prog, "02 <> <>", &trace.Options{
+		Depth: 4,
+	})
+	require.Error(t, err)
+}
+
+// TestProgress checks that progress is reported for every state.
+func TestProgress(t *testing.T) {
+	var steps []int
+	res, err := trace.GetTrace(
+		context.Background(), scripts.MultiplyProgram, "02 <> <>",
+		&trace.Options{
+			Progress: func(step int, state [][]byte) {
+				steps = append(steps, step)
+			},
+		},
+	)
+	require.NoError(t, err)
+	require.Len(t, steps, len(res.Trace))
+	for i, step := range steps {
+		require.Equal(t, i, step)
+	}
+}
+
+// TestCancel checks that tracing stops when the context is canceled.
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := trace.GetTrace(ctx, scripts.MultiplyProgram, "02 <> <>", nil)
+	require.ErrorContains(t, err, context.Canceled.Error())
+}
@@ -0,0 +1,240 @@
+package verify
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/execute"
+	"github.com/halseth/mattlab/tracer/memory"
+	"github.com/halseth/mattlab/tracer/store"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/halseth/tapsim/script"
+)
+
+// Transition is an invalid state transition of a trace.
+type Transition struct {
+	// Step is the index of the state the transition starts from, the
+	// transition takes the trace to state Step+1.
+	Step int
+
+	// PC is the program counter of the start state, -1 if it cannot be
+	// decoded.
+	PC int
+
+	// Err describes why the transition is invalid.
+	Err error
+
+	// Expected is the state the step at PC produces from the start
+	// state. It is nil if the step could not be executed.
+	Expected [][]byte
+}
+
+// Error returns a human readable description of the invalid transition.
+func (t *Transition) Error() string {
+	return fmt.Sprintf("transition %d -> %d at pc %d: %v", t.Step,
+		t.Step+1, t.PC, t.Err)
+}
+
+// Result is the outcome of verifying a trace.
+type Result struct {
+	// Transitions are the invalid transitions of the trace.
+	Transitions []*Transition
+
+	// Halted is true if the last state of the trace is in the halting
+	// state of the program.
+	Halted bool
+}
+
+// Valid returns true if all transitions of the trace are valid, and it ends
+// in the halting state.
+func (r *Result) Valid() bool {
+	return len(r.Transitions) == 0 && r.Halted
+}
+
+// Options are the options used when verifying a trace.
+type Options struct {
+	// Executor is used to execute the program steps. If nil, the executor
+	// for the program's environment is used.
+	Executor execute.Executor
+
+	// Memory is the initial memory of programs with a memory. If nil, the
+	// memory starts out empty. It is modified by the steps storing to
+	// memory.
+	Memory *memory.Memory
+
+	// Hints are the hints recorded along the trace, as in trace.Result.
+	// Steps taking prover hints are given the recorded ones, which can't
+	// be recomputed.
+	Hints [][][]byte
+}
+
+// Trace re-executes every transition of the trace with the given program, and
+// returns the transitions that are invalid. A transition is valid if the pc of
+// its start state selects a step of the program, and executing that step from
+// the start state succeeds and gives the end state. Padding transitions from
+// the halting state must leave the state unchanged.
+//
+// For programs with a memory, the memory is replayed alongside the trace to
+// give steps accessing it their proof hints, and the memory root of every
+// start state must match it. A step taking prover hints is invalid if none are
+// recorded for it.
+func Trace(prog *scripts.Program, tr store.Source, opts *Options) (*Result,
+	error) {
+
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	env := prog.ExecEnv()
+	executor := opts.Executor
+	if executor == nil {
+		executor = execute.NewExecutor(env)
+	}
+
+	mem := opts.Memory
+	if prog.Memory != nil && mem == nil {
+		var err error
+		mem, err = memory.New(prog.Memory.Depth, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if tr.Len() == 0 {
+		return nil, fmt.Errorf("empty trace")
+	}
+
+	pkScripts := make([][]byte, len(prog.Steps))
+	for i := range prog.Steps {
+		var err error
+		pkScripts[i], err = script.Parse(prog.StepScript(i))
+		if err != nil {
+			return nil, fmt.Errorf("parsing step %d: %v", i, err)
+		}
+
+		if err := env.CheckScript(pkScripts[i]); err != nil {
+			return nil, fmt.Errorf("step %d: %v", i, err)
+		}
+	}
+
+	hints := trace.RecordedHints(prog, opts.Hints)
+
+	res := &Result{}
+	state, err := tr.State(0)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < tr.Len()-1; i++ {
+		next, err := tr.State(i + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		t := transition(
+			prog, pkScripts, executor, mem, hints, i, state, next,
+		)
+		if t != nil {
+			res.Transitions = append(res.Transitions, t)
+		}
+
+		state = next
+	}
+
+	pc, err := trace.GetProgramCounter(prog.Schema, state)
+	res.Halted = err == nil && pc == prog.HaltPC()
+
+	return res, nil
+}
+
+// transition checks the transition from state to next, returning nil if it is
+// valid. The memory, if any, is advanced by the step.
+func transition(prog *scripts.Program, pkScripts [][]byte,
+	executor execute.Executor, mem *memory.Memory,
+	hints trace.HintProvider, step int, state, next [][]byte) *Transition {
+
+	t := &Transition{
+		Step: step,
+		PC:   -1,
+	}
+
+	if err := prog.Schema.Validate(state); err != nil {
+		t.Err = fmt.Errorf("invalid start state: %v", err)
+		return t
+	}
+
+	pc, err := trace.GetProgramCounter(prog.Schema, state)
+	if err != nil {
+		t.Err = err
+		return t
+	}
+	t.PC = pc
+
+	if pc < 0 || pc >= len(pkScripts) {
+		t.Err = fmt.Errorf("pc %d out of range for program with %d "+
+			"steps", pc, len(pkScripts))
+		return t
+	}
+
+	// Once halted, the trace is padded with copies of the halting
+	// state.
+	if pc == prog.HaltPC() {
+		t.Expected = state
+		if !statesEqual(state, next) {
+			t.Err = fmt.Errorf("padding step changes the halting " +
+				"state")
+			return t
+		}
+
+		return nil
+	}
+
+	if mem != nil {
+		if err := trace.CheckMemoryRoot(prog, mem, state); err != nil {
+			t.Err = err
+			return t
+		}
+	}
+
+	stack := state
+	if prog.NumHints(pc) > 0 {
+		stepHints, err := trace.StepHints(
+			prog, mem, hints, step, pc, state,
+		)
+		if err != nil {
+			t.Err = err
+			return t
+		}
+		stack = append(append([][]byte{}, state...), stepHints...)
+	}
+
+	end, err := executor.ExecuteStep(pkScripts[pc], stack)
+	if !execute.IsBenign(err) {
+		t.Err = fmt.Errorf("step failed: %v", err)
+		return t
+	}
+	t.Expected = end
+
+	if !statesEqual(end, next) {
+		t.Err = fmt.Errorf("end state does not match executed step")
+		return t
+	}
+
+	return nil
+}
+
+// statesEqual returns true if the two states are equal.
+func statesEqual(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,202 @@
+package verify
+
+import (
+	"context"
+	"testing"
+
+	"github.com/halseth/mattlab/assembler"
+	"github.com/halseth/mattlab/commitment"
+	"github.com/halseth/mattlab/scripts"
+	"github.com/halseth/mattlab/tracer/store"
+	"github.com/halseth/mattlab/tracer/trace"
+	"github.com/stretchr/testify/require"
+)
+
+// halveSrc halves n, taking n/2 as a prover hint.
+const halveSrc = `#:	n half pc
+div:	HINT half OP_DROP OP_2DUP OP_DUP OP_ADD OP_SUB OP_0 OP_2 OP_WITHIN OP_VERIFY @halt
+halt:	OP_NOP
+`
+
+func num(n int64) []byte {
+	return append([]byte{}, commitment.ScriptNum(n).Bytes()...)
+}
+
+// multiplyTrace returns the trace of the multiply program, and the number of
+// executed steps.
+func multiplyTrace(t *testing.T) ([][][]byte, int) {
+	t.Helper()
+
+	res, err := trace.GetTrace(
+		context.Background(), scripts.MultiplyProgram, "02 <> <>", nil,
+	)
+	require.NoError(t, err)
+	require.Greater(t, len(res.Trace), res.Steps+1)
+
+	return res.Trace, res.Steps
+}
+
+// copyTrace returns a copy of the trace that can be modified.
+func copyTrace(tr [][][]byte) [][][]byte {
+	cp := make([][][]byte, len(tr))
+	for i := range tr {
+		cp[i] = append([][]byte{}, tr[i]...)
+	}
+
+	return cp
+}
+
+// TestValid checks that a valid trace passes.
+func TestValid(t *testing.T) {
+	tr, _ := multiplyTrace(t)
+
+	res, err := Trace(scripts.MultiplyProgram, store.Memory(tr), nil)
+	require.NoError(t, err)
+	require.Empty(t, res.Transitions)
+	require.True(t, res.Halted)
+	require.True(t, res.Valid())
+
+	_, err = Trace(scripts.MultiplyProgram, store.Memory(nil), nil)
+	require.ErrorContains(t, err, "empty trace")
+}
+
+// TestBadTransition checks that a modified register or pc is reported as an
+// invalid transition into the modified state, with the expected end state.
+func TestBadTransition(t *testing.T) {
+	prog := scripts.MultiplyProgram
+	tr, halt := multiplyTrace(t)
+
+	for step := 1; step <= halt; step++ {
+		for _, reg := range []int{0, prog.Schema.PC} {
+			bad := copyTrace(tr)
+			bad[step][reg] = num(7)
+
+			res, err := Trace(prog, store.Memory(bad), nil)
+			require.NoError(t, err)
+			require.False(t, res.Valid())
+			require.NotEmpty(t, res.Transitions)
+
+			first := res.Transitions[0]
+			require.Equal(t, step-1, first.Step, "state %d", step)
+
+			pc, err := trace.GetProgramCounter(prog.Schema, tr[step-1])
+			require.NoError(t, err)
+			require.Equal(t, pc, first.PC)
+			require.Equal(t, tr[step], first.Expected)
+			require.ErrorContains(t, first.Err, "does not match")
+		}
+	}
+}
+
+// TestPadding checks that padding changing the halting state is invalid, and
+// that a trace not ending in the halting state isn't valid.
+func TestPadding(t *testing.T) {
+	prog := scripts.MultiplyProgram
+	tr, halt := multiplyTrace(t)
+
+	bad := copyTrace(tr)
+	bad[len(bad)-1][0] = num(7)
+
+	res, err := Trace(prog, store.Memory(bad), nil)
+	require.NoError(t, err)
+	require.Len(t, res.Transitions, 1)
+	require.Equal(t, len(bad)-2, res.Transitions[0].Step)
+	require.Equal(t, prog.HaltPC(), res.Transitions[0].PC)
+	require.ErrorContains(t, res.Transitions[0].Err, "padding")
+
+	// The transitions of a trace cut short are valid, but it doesn't
+	// halt.
+	res, err = Trace(prog, store.Memory(tr[:halt]), nil)
+	require.NoError(t, err)
+	require.Empty(t, res.Transitions)
+	require.False(t, res.Halted)
+	require.False(t, res.Valid())
+}
+
+// TestWrongProgram checks that a trace verified against another program with
+// the same schema is invalid at the first step that differs.
+func TestWrongProgram(t *testing.T) {
+	tr, _ := multiplyTrace(t)
+
+	// Add instead of doubling x.
+	steps := append([]string{}, scripts.ScriptSteps...)
+	steps[1] = "OP_DROP OP_1ADD OP_SWAP OP_1ADD OP_SWAP OP_0"
+	prog := &scripts.Program{
+		Schema: scripts.StateSchema,
+		Steps:  steps,
+	}
+
+	first := -1
+	for i := range tr {
+		pc, err := trace.GetProgramCounter(prog.Schema, tr[i])
+		require.NoError(t, err)
+		if pc == 1 {
+			first = i
+			break
+		}
+	}
+	require.NotEqual(t, -1, first)
+
+	res, err := Trace(prog, store.Memory(tr), nil)
+	require.NoError(t, err)
+	require.False(t, res.Valid())
+	require.Equal(t, first, res.Transitions[0].Step)
+	require.Equal(t, 1, res.Transitions[0].PC)
+
+	// Steps that can't be executed are an error.
+	prog.Steps = append([]string{"OP_BOGUS"}, steps[1:]...)
+	_, err = Trace(prog, store.Memory(tr), nil)
+	require.ErrorContains(t, err, "step 0")
+}
+
+// TestHints checks that steps taking prover hints are checked with the
+// recorded hints, and are invalid with the hints of another trace or without
+// hints.
+func TestHints(t *testing.T) {
+	a, err := assembler.Assemble(halveSrc)
+	require.NoError(t, err)
+	prog, err := a.Program()
+	require.NoError(t, err)
+
+	opts := trace.DefaultOptions()
+	opts.Hints = trace.HintTape(prog, [][]byte{num(3)})
+	tr, err := trace.GetTrace(context.Background(), prog, "07 <> <>", opts)
+	require.NoError(t, err)
+
+	res, err := Trace(prog, store.Memory(tr.Trace), &Options{
+		Hints: tr.Hints,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Valid())
+
+	tests := []struct {
+		name  string
+		hints [][][]byte
+		err   string
+	}{{
+		name:  "other hint",
+		hints: [][][]byte{{num(4)}},
+		err:   "step failed",
+	}, {
+		name:  "hint too small",
+		hints: [][][]byte{{num(2)}},
+		err:   "step failed",
+	}, {
+		name: "no hints",
+	}}
+
+	for _, test := range tests {
+		res, err := Trace(prog, store.Memory(tr.Trace), &Options{
+			Hints: test.hints,
+		})
+		require.NoError(t, err, test.name)
+		require.False(t, res.Valid(), test.name)
+		require.Len(t, res.Transitions, 1, test.name)
+		require.Equal(t, 0, res.Transitions[0].Step, test.name)
+		if test.err != "" {
+			require.ErrorContains(
+				t, res.Transitions[0].Err, test.err, test.name,
+			)
+		}
+	}
+}